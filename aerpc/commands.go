@@ -19,9 +19,12 @@ package aerpc
 import (
 	"errors"
 	"fmt"
+	"github.com/cheggaaa/Anteater/backup"
 	"github.com/cheggaaa/Anteater/stats"
+	"github.com/cheggaaa/Anteater/storage"
 	"github.com/cheggaaa/Anteater/utils"
 	"net/rpc"
+	"strconv"
 	"strings"
 )
 
@@ -46,7 +49,13 @@ func RegisterCommands() {
 	cmds = append(cmds, new(RpcCommandStatus))
 	cmds = append(cmds, new(RpcCommandCheck))
 	cmds = append(cmds, new(RpcCommandBackup))
+	cmds = append(cmds, new(RpcCommandBackupStatus))
 	cmds = append(cmds, new(RpcCommandFileList))
+	cmds = append(cmds, new(RpcCommandDump))
+	cmds = append(cmds, new(RpcCommandCompact))
+	cmds = append(cmds, new(RpcCommandRebuild))
+	cmds = append(cmds, new(RpcCommandScrub))
+	cmds = append(cmds, new(RpcCommandScrubStatus))
 
 	for _, cmd := range cmds {
 		Commands[cmd.ShortName()] = cmd
@@ -94,16 +103,62 @@ func (c *RpcCommandStatus) Print() {
 	fmt.Println("Enviroment")
 	fmt.Printf("  Go version: %s\n  Server time:  %v\n  Num goroutines: %d\n  Memory allocated: %s\n\n", c.Env.GoVersion, c.Env.Time, c.Env.NumGoroutine, utils.HumanBytes(int64(c.Env.MemAlloc)))
 	fmt.Println("Storage")
-	fmt.Printf("  Containers count: %d\n  Files count: %d\n  Files size: %s\n  Allocated size: %s (profit: %.2f%%)\n  Holes: %s (%d)\n  Index version: %d\n\n",
+	fmt.Printf("  Containers count: %d\n  Files count: %d\n  Files size: %s\n  Allocated size: %s (profit: %.2f%%)\n  Holes: %s (%d)\n  Deduplicated: %d (%s)\n  Index version: %d\n\n",
 		c.Storage.ContainersCount, c.Storage.FilesCount, utils.HumanBytes(c.Storage.FilesSize), utils.HumanBytes(c.Storage.FilesRealSize),
-		(float64(c.Storage.FilesSize)/float64(c.Storage.FilesRealSize))*100, utils.HumanBytes(c.Storage.HoleSize), c.Storage.HoleCount, c.Storage.IndexVersion)
+		(float64(c.Storage.FilesSize)/float64(c.Storage.FilesRealSize))*100, utils.HumanBytes(c.Storage.HoleSize), c.Storage.HoleCount,
+		c.Storage.DedupFiles, utils.HumanBytes(c.Storage.DedupSize), c.Storage.IndexVersion)
+	if len(c.Storage.Disks) > 1 {
+		fmt.Println("Disks")
+		for _, d := range c.Storage.Disks {
+			fmt.Printf("  %s: %d containers, %s allocated, %s files, %s free\n", d.Path, d.ContainersCount,
+				utils.HumanBytes(d.TotalSize), utils.HumanBytes(d.FilesSize), utils.HumanBytes(d.FreeSpace))
+			if d.Degraded {
+				fmt.Printf("    degraded: %s\n", d.Error)
+			}
+		}
+		fmt.Println()
+	}
+	if c.Storage.PhysicalSize < c.Storage.TotalSize {
+		fmt.Println("Sparse containers")
+		fmt.Printf("  Logical size: %s\n  Physical size: %s\n\n", utils.HumanBytes(c.Storage.TotalSize), utils.HumanBytes(c.Storage.PhysicalSize))
+	}
+	if c.Storage.Redundancy != "" {
+		fmt.Println("Redundancy")
+		fmt.Printf("  Mode: %s\n  Degraded containers: %d\n  Reconstructed reads: %d\n\n",
+			c.Storage.Redundancy, c.Storage.DegradedContainers, c.Storage.Reconstructed)
+	}
 	fmt.Println("Counters")
-	fmt.Printf("  Get: %d\n  Add: %d\n  Delete: %d\n  Not found: %d\n  Not modified: %d\n\n",
-		c.Counters["get"], c.Counters["add"], c.Counters["delete"], c.Counters["notFound"], c.Counters["notModified"])
+	fmt.Printf("  Get: %d\n  Add: %d\n  Delete: %d\n  Not found: %d\n  Not modified: %d\n  Expired: %d\n\n",
+		c.Counters["get"], c.Counters["add"], c.Counters["delete"], c.Counters["notFound"], c.Counters["notModified"], c.Counters["expired"])
 	fmt.Println("Traffic")
 	fmt.Printf("  In: %s\n  Out: %s\n\n", utils.HumanBytes(int64(c.Traffic["in"])), utils.HumanBytes(int64(c.Traffic["out"])))
 	fmt.Println("Allocates")
 	fmt.Printf("  Append: %d\n  Replace: %d\n  In hole: %d\n\n", c.Allocate["append"], c.Allocate["replace"], c.Allocate["in"])
+	fmt.Println("Compaction")
+	fmt.Printf("  Runs: %d\n  Moved files: %d (%s)\n  Truncated: %s\n  Punched: %s\n  Removed empty containers: %d\n\n", c.Compact["runs"], c.Compact["files"],
+		utils.HumanBytes(int64(c.Compact["bytes"])), utils.HumanBytes(int64(c.Compact["truncated"])), utils.HumanBytes(int64(c.Compact["punched"])),
+		c.Compact["retired"])
+	if r := c.Scrub; r != nil && r.Pass > 0 {
+		state := "done"
+		if r.Running {
+			state = "running"
+		}
+		fmt.Println("Scrub")
+		fmt.Printf("  Pass: %d (%s)\n  Started: %v\n  Checked: %d files (%s)\n  Corrupted: %d\n\n",
+			r.Pass, state, r.Started, r.Files, utils.HumanBytes(r.Bytes), r.Corrupt)
+	}
+	if r := c.Replication; r != nil && r.Role != "" {
+		fmt.Println("Replication")
+		fmt.Printf("  Role: %s\n  Epoch: %d\n", r.Role, r.Epoch)
+		if r.Primary != "" {
+			fmt.Printf("  Version: %d\n  Primary: %s (version: %d)\n  Lag: %d changes (%v)\n  Last sync: %v\n  Applied: %d\n  Full resyncs: %d\n  Errors: %d\n",
+				r.Version, r.Primary, r.PrimaryVersion, r.Lag, r.LagTime, r.LastSync, r.Applied, r.CatchUps, r.Errors)
+			if r.LastError != "" {
+				fmt.Printf("  Last error: %s\n", r.LastError)
+			}
+		}
+		fmt.Println()
+	}
 }
 func (c *RpcCommandStatus) Data() interface{} { return c }
 func (c *RpcCommandStatus) Execute(client *rpc.Client) (err error) {
@@ -138,12 +193,14 @@ func (c *RpcCommandCheck) Execute(client *rpc.Client) (err error) {
 // BACKUP
 type RpcCommandBackup struct {
 	path   string
-	result bool
+	result backup.Result
 }
 
 func (c *RpcCommandBackup) ShortName() string { return "BACKUP" }
 func (c *RpcCommandBackup) RpcName() string   { return "Storage.Backup" }
-func (c *RpcCommandBackup) Help() string      { return "Return true or false" }
+func (c *RpcCommandBackup) Help() string {
+	return "Sync all files to backup storage in the given path and return counts of synced files"
+}
 func (c *RpcCommandBackup) SetArgs(args []string) (err error) {
 	if len(args) < 1 {
 		err = errors.New("Missing path argument")
@@ -153,9 +210,9 @@ func (c *RpcCommandBackup) SetArgs(args []string) (err error) {
 	return
 }
 func (c *RpcCommandBackup) Print() {
-	fmt.Printf("Result: %v\n", c.result)
+	printBackupResult(&c.result)
 }
-func (c *RpcCommandBackup) Data() interface{} { return c }
+func (c *RpcCommandBackup) Data() interface{} { return &c.result }
 func (c *RpcCommandBackup) Execute(client *rpc.Client) (err error) {
 	if c.path == "" {
 		return errors.New("Missing path argument")
@@ -164,6 +221,38 @@ func (c *RpcCommandBackup) Execute(client *rpc.Client) (err error) {
 	return
 }
 
+// BACKUPSTATUS
+type RpcCommandBackupStatus backup.Result
+
+func (c *RpcCommandBackupStatus) ShortName() string { return "BACKUPSTATUS" }
+func (c *RpcCommandBackupStatus) RpcName() string   { return "Storage.BackupStatus" }
+func (c *RpcCommandBackupStatus) Help() string {
+	return "Return progress of running (or result of last) backup"
+}
+func (c *RpcCommandBackupStatus) SetArgs(args []string) (err error) { return }
+func (c *RpcCommandBackupStatus) Print() {
+	printBackupResult((*backup.Result)(c))
+}
+func (c *RpcCommandBackupStatus) Data() interface{} { return c }
+func (c *RpcCommandBackupStatus) Execute(client *rpc.Client) (err error) {
+	err = client.Call(c.RpcName(), true, (*backup.Result)(c))
+	return
+}
+
+func printBackupResult(r *backup.Result) {
+	if r.Started.IsZero() {
+		fmt.Println("Backup not started")
+		return
+	}
+	state := "done"
+	if r.Running {
+		state = "running"
+	}
+	fmt.Printf("Backup to %s (%s)\n  Started: %v (duration: %v)\n", r.Path, state, r.Started, r.Duration)
+	fmt.Printf("  Checked: %d of %d\n  Added: %d\n  Updated: %d\n  Deleted: %d\n  Skipped: %d\n  Errors: %d\n",
+		r.Checked, r.Total, r.Added, r.Updated, r.Deleted, r.Skipped, r.Errors)
+}
+
 // FILELIST
 type RpcCommandFileList struct {
 	result []string
@@ -188,3 +277,155 @@ func (c *RpcCommandFileList) Data() interface{} { return c.result }
 func (c *RpcCommandFileList) Execute(client *rpc.Client) (err error) {
 	return client.Call(c.RpcName(), c.path, &c.result)
 }
+
+// DUMP
+type RpcCommandDump struct {
+	path   string
+	result storage.SnapshotResult
+}
+
+func (c *RpcCommandDump) ShortName() string { return "DUMP" }
+func (c *RpcCommandDump) RpcName() string   { return "Storage.Snapshot" }
+func (c *RpcCommandDump) Help() string {
+	return "Make consistent snapshot of all containers to the given dir. Snapshot can be used as data path"
+}
+func (c *RpcCommandDump) SetArgs(args []string) (err error) {
+	if len(args) < 1 {
+		err = errors.New("Missing path argument")
+		return
+	}
+	c.path = strings.Trim(args[0], " ")
+	return
+}
+func (c *RpcCommandDump) Print() {
+	r := c.result
+	fmt.Printf("Snapshot saved to %s\n  Index version: %d\n  Containers: %d\n  Files: %d\n  Size: %s\n  Freeze time: %v\n  Duration: %v\n",
+		r.Path, r.IndexVersion, r.Containers, r.FilesCount, utils.HumanBytes(r.Size), r.FreezeTime, r.Duration)
+}
+func (c *RpcCommandDump) Data() interface{} { return &c.result }
+func (c *RpcCommandDump) Execute(client *rpc.Client) (err error) {
+	if c.path == "" {
+		return errors.New("Missing path argument")
+	}
+	return client.Call(c.RpcName(), c.path, &c.result)
+}
+
+// COMPACT
+type RpcCommandCompact struct {
+	id     int64
+	result bool
+}
+
+func (c *RpcCommandCompact) ShortName() string { return "COMPACT" }
+func (c *RpcCommandCompact) RpcName() string   { return "Storage.Compact" }
+func (c *RpcCommandCompact) Help() string {
+	return "Start background compaction for a container with given id or for all containers if id not specified"
+}
+func (c *RpcCommandCompact) SetArgs(args []string) (err error) {
+	if len(args) > 0 {
+		c.id, err = strconv.ParseInt(strings.Trim(args[0], " "), 10, 64)
+	}
+	return
+}
+func (c *RpcCommandCompact) Print() {
+	if c.result {
+		fmt.Println("Compaction started")
+	}
+}
+func (c *RpcCommandCompact) Data() interface{} { return c.result }
+func (c *RpcCommandCompact) Execute(client *rpc.Client) (err error) {
+	return client.Call(c.RpcName(), c.id, &c.result)
+}
+
+// REBUILD
+type RpcCommandRebuild struct {
+	path   string
+	result storage.RebuildResult
+}
+
+func (c *RpcCommandRebuild) ShortName() string { return "REBUILD" }
+func (c *RpcCommandRebuild) RpcName() string   { return "Storage.Rebuild" }
+func (c *RpcCommandRebuild) Help() string {
+	return "Restore parts of containers with redundancy on the given data path (e.g. after replacing of disk)"
+}
+func (c *RpcCommandRebuild) SetArgs(args []string) (err error) {
+	if len(args) < 1 {
+		err = errors.New("Missing path argument")
+		return
+	}
+	c.path = strings.Trim(args[0], " ")
+	return
+}
+func (c *RpcCommandRebuild) Print() {
+	r := c.result
+	fmt.Printf("Data path %s rebuilt\n  Containers: %d\n  Size: %s\n  Duration: %v\n",
+		r.Path, r.Containers, utils.HumanBytes(r.Size), r.Duration)
+}
+func (c *RpcCommandRebuild) Data() interface{} { return &c.result }
+func (c *RpcCommandRebuild) Execute(client *rpc.Client) (err error) {
+	if c.path == "" {
+		return errors.New("Missing path argument")
+	}
+	return client.Call(c.RpcName(), c.path, &c.result)
+}
+
+// SCRUB
+type RpcCommandScrub struct {
+	result bool
+}
+
+func (c *RpcCommandScrub) ShortName() string { return "SCRUB" }
+func (c *RpcCommandScrub) RpcName() string   { return "Storage.Scrub" }
+func (c *RpcCommandScrub) Help() string {
+	return "Start background verification of all files or resume interrupted one"
+}
+func (c *RpcCommandScrub) SetArgs(args []string) (err error) { return }
+func (c *RpcCommandScrub) Print() {
+	if c.result {
+		fmt.Println("Scrub started")
+	}
+}
+func (c *RpcCommandScrub) Data() interface{} { return c.result }
+func (c *RpcCommandScrub) Execute(client *rpc.Client) (err error) {
+	return client.Call(c.RpcName(), true, &c.result)
+}
+
+// SCRUBSTATUS
+type RpcCommandScrubStatus storage.ScrubStatus
+
+func (c *RpcCommandScrubStatus) ShortName() string { return "SCRUBSTATUS" }
+func (c *RpcCommandScrubStatus) RpcName() string   { return "Storage.ScrubStatus" }
+func (c *RpcCommandScrubStatus) Help() string {
+	return "Return progress of running (or result of last) verification and list of corrupted files"
+}
+func (c *RpcCommandScrubStatus) SetArgs(args []string) (err error) { return }
+func (c *RpcCommandScrubStatus) Print() {
+	if c.Pass == 0 {
+		fmt.Println("Scrub not started")
+		return
+	}
+	state := "done"
+	if c.Running {
+		state = "running"
+	} else if c.Started.After(c.Finished) {
+		state = "interrupted"
+	}
+	fmt.Printf("Scrub pass %d (%s)\n  Started: %v\n", c.Pass, state, c.Started)
+	if state == "done" {
+		fmt.Printf("  Finished: %v\n", c.Finished)
+	} else {
+		fmt.Printf("  Position: container %d, offset %d\n", c.Container, c.Offset)
+	}
+	fmt.Printf("  Checked: %d files (%s)\n  Quarantine: %d\n", c.Files, utils.HumanBytes(c.Bytes), len(c.Quarantine))
+	for _, e := range c.Quarantine {
+		name := e.Name
+		if name == "" {
+			name = "(chain of spaces)"
+		}
+		fmt.Printf("    %s: container %d, offset %d, %v: %s\n", name, e.Container, e.Offset, e.Time, e.Error)
+	}
+}
+func (c *RpcCommandScrubStatus) Data() interface{} { return c }
+func (c *RpcCommandScrubStatus) Execute(client *rpc.Client) (err error) {
+	return client.Call(c.RpcName(), true, (*storage.ScrubStatus)(c))
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/cheggaaa/Anteater/aelog"
 	"github.com/cheggaaa/Anteater/backup"
 	"github.com/cheggaaa/Anteater/cnst"
+	"github.com/cheggaaa/Anteater/replication"
 	"github.com/cheggaaa/Anteater/stats"
 	"github.com/cheggaaa/Anteater/storage"
 	"net"
@@ -66,9 +67,62 @@ func (r *Storage) Check(args *bool, reply *error) error {
 	return nil
 }
 
-func (r *Storage) Backup(args *string, reply *bool) error {
-	*reply = true
-	return backup.CreateBackup(r.s, *args)
+func (r *Storage) Backup(args *string, reply *backup.Result) error {
+	res, err := backup.CreateBackup(r.s, *args)
+	if res != nil {
+		*reply = *res
+	}
+	return err
+}
+
+func (r *Storage) BackupStatus(args *bool, reply *backup.Result) error {
+	*reply = *backup.Status()
+	return nil
+}
+
+func (r *Storage) Snapshot(args *string, reply *storage.SnapshotResult) error {
+	res, err := r.s.Snapshot(*args)
+	if res != nil {
+		*reply = *res
+	}
+	return err
+}
+
+func (r *Storage) Rebuild(args *string, reply *storage.RebuildResult) error {
+	res, err := r.s.RebuildDisk(*args)
+	if res != nil {
+		*reply = *res
+	}
+	return err
+}
+
+func (r *Storage) Scrub(args *bool, reply *bool) (err error) {
+	err = r.s.Scrub()
+	*reply = err == nil
+	return
+}
+
+func (r *Storage) ScrubStatus(args *bool, reply *storage.ScrubStatus) error {
+	*reply = r.s.ScrubStatus()
+	return nil
+}
+
+func (r *Storage) Compact(args *int64, reply *bool) (err error) {
+	err = r.s.Compact(*args)
+	*reply = err == nil
+	return
+}
+
+func (r *Storage) ReplicationEvents(args *replication.EventsArgs, reply *replication.EventsReply) error {
+	return replication.Events(r.s, args, reply)
+}
+
+func (r *Storage) ReplicationList(args *bool, reply *replication.ListReply) error {
+	return replication.List(r.s, reply)
+}
+
+func (r *Storage) ReplicationRead(args *replication.ReadArgs, reply *[]byte) error {
+	return replication.Read(r.s, args, reply)
 }
 
 func (r *Storage) FileList(prefix *string, reply *[]string) (err error) {
@@ -1,89 +1,273 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
 package backup
 
 import (
-	"github.com/cheggaaa/Anteater/storage"
-	/*"github.com/cheggaaa/Anteater/config"
-	"time"
+	"bytes"
 	"errors"
+	"fmt"
 	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/config"
+	"github.com/cheggaaa/Anteater/storage"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
-	*/)
-
-func CreateBackup(s *storage.Storage, toPath string) (err error) {
-	/*
-			toPath = strings.TrimRight(toPath, "/") + "/"
-
-			var backup *storage.Storage
-			defer func() {
-				if backup != nil {
-			        backup.Close()
-			        backup = nil
-		        }
-				if r := recover(); r != nil {
-		        	aelog.Warnf("Panic while backup: %v\n", r)
-		        	err = r.(error)
-		        }
-			}()
-
-			// create config for backup storage
-			conf := &config.Config{}
-			conf.ContainerSize = s.Conf.ContainerSize
-			conf.DumpTime = 0
-			conf.DataPath = toPath
-			if conf.DataPath == s.Conf.DataPath {
-				return errors.New("Can't backup data to same dir")
-			}
-			// init backup storage
-			backup = storage.GetStorage(conf)
-
-			syncFile := func(name string) (sync bool) {
-				file, ok := s.Index.Get(name)
-				if ! ok {
-					sync = backup.Delete(name)
-					return
-				}
-				file.Open()
-				defer file.Close()
-
-				bfile, bok := backup.Get(name)
-				if bok {
-					if bfile.Size == file.Size && bfile.Md5S() == file.Md5S() {
-						return false
-					} else {
-						backup.Delete(name)
-					}
-				}
+	"sync"
+	"time"
+)
 
-				bfile = backup.Add(name, file.GetReader(), file.Size)
-				bfile.Time = file.Time
-				sync = true
-				return
-			}
+var (
+	ErrSameDir = errors.New("Can't backup data to same dir")
+	ErrRunning = errors.New("Backup already running")
+)
 
+// Backup progress and result counters
+type Result struct {
+	Path     string
+	Running  bool
+	Started  time.Time
+	Duration time.Duration
+	// files in source storage
+	Total int64
+	// files compared with backup
+	Checked int64
+	// new files copied to backup
+	Added int64
+	// changed files copied to backup
+	Updated int64
+	// files deleted from backup
+	Deleted int64
+	// unchanged files
+	Skipped int64
+	// files failed to copy
+	Errors int64
+}
 
-			aelog.Infof("BACKUP: Started %v", time.Now())
-			if backup.Index.Version() > 0 {
-				i := 0
-				for name, _ := range backup.Index.Files {
-					_, ok := s.Index.Get(name)
-					if ! ok {
-						backup.Delete(name)
-						i++
-					}
-				}
-				aelog.Infof("BACKUP: Deleted %d files from backup", i)
-			}
+const (
+	syncSkip = iota
+	syncAdd
+	syncUpdate
+	syncDelete
+)
+
+var (
+	current *Result
+	m       sync.Mutex
+)
+
+// Return copy of current (or last) backup progress
+func Status() (res *Result) {
+	m.Lock()
+	defer m.Unlock()
+	if current == nil {
+		return &Result{}
+	}
+	res = new(Result)
+	*res = *current
+	if res.Running {
+		res.Duration = time.Since(res.Started)
+	}
+	return
+}
 
-			i := 0
+// Sync all files from storage s to storage placed in toPath
+// New or changed (by size, md5 or attributes) files will be copied with attributes, files that are not exists in source will be deleted from backup
+func CreateBackup(s *storage.Storage, toPath string) (res *Result, err error) {
+	if toPath, err = filepath.Abs(toPath); err != nil {
+		return
+	}
+	if sameDir(s, toPath) {
+		return nil, ErrSameDir
+	}
 
-			for name, _ := range s.Index.Files {
-				if syncFile(name) {
-					i++
+	m.Lock()
+	if current != nil && current.Running {
+		m.Unlock()
+		return nil, ErrRunning
+	}
+	res = &Result{Path: toPath, Running: true, Started: time.Now()}
+	current = res
+	m.Unlock()
+
+	defer func() {
+		m.Lock()
+		res.Running = false
+		res.Duration = time.Since(res.Started)
+		m.Unlock()
+		if err != nil {
+			aelog.Warnf("BACKUP: Failed: %v", err)
+		} else {
+			aelog.Infof("BACKUP: Done for a %v. Added: %d, updated: %d, deleted: %d, skipped: %d, errors: %d",
+				res.Duration, res.Added, res.Updated, res.Deleted, res.Skipped, res.Errors)
+		}
+	}()
+
+	if err = os.MkdirAll(toPath, 0755); err != nil {
+		return
+	}
+
+	// create config for backup storage
+	// backup keeps encryption, compression and deduplication of source, but it is written to one data path without redundancy
+	conf := &config.Config{
+		DataPath:        toPath + "/",
+		ContainerSize:   s.Conf.ContainerSize,
+		MinEmptySpace:   s.Conf.MinEmptySpace,
+		TmpDir:          s.Conf.TmpDir,
+		FileHeaders:     s.Conf.FileHeaders,
+		Dedup:           s.Conf.Dedup,
+		KeyFile:         s.Conf.KeyFile,
+		CompressCodec:   s.Conf.CompressCodec,
+		CompressTypes:   s.Conf.CompressTypes,
+		CompressMinSize: s.Conf.CompressMinSize,
+		CompressMaxSize: s.Conf.CompressMaxSize,
+		DumpTime:        0,
+	}
+
+	// init backup storage
+	backup := new(storage.Storage)
+	backup.Init(conf)
+	if err = backup.Open(); err != nil {
+		return
+	}
+	defer backup.Close()
+	// previous backup made without encryption must be re-encrypted first
+	if conf.KeyFile != "" {
+		if ids := backup.PlainContainers(); len(ids) > 0 {
+			return res, fmt.Errorf("Containers %v of backup are not encrypted, use aerekey to encrypt them", ids)
+		}
+	}
+
+	aelog.Infof("BACKUP: Started to %s", toPath)
+
+	names, err := s.Index.List("", 0)
+	if err != nil {
+		return
+	}
+	inc := func(c *int64) {
+		m.Lock()
+		*c++
+		m.Unlock()
+	}
+	m.Lock()
+	res.Total = int64(len(names))
+	m.Unlock()
+
+	// delete files removed from source
+	if backup.Index.Count() > 0 {
+		bnames, e := backup.Index.List("", 0)
+		if e != nil {
+			return res, e
+		}
+		for _, name := range bnames {
+			if _, ok := s.Get(name); !ok {
+				if backup.Delete(name) {
+					inc(&res.Deleted)
 				}
 			}
-			aelog.Infof("BACKUP: %d files was sync", i)
+		}
+	}
+
+	// copy new and changed files
+	for _, name := range names {
+		action, e := syncFile(s, backup, name)
+		if e != nil {
+			aelog.Warnf("BACKUP: Can't sync file %s: %v", name, e)
+			inc(&res.Errors)
+		} else {
+			switch action {
+			case syncAdd:
+				inc(&res.Added)
+			case syncUpdate:
+				inc(&res.Updated)
+			case syncDelete:
+				inc(&res.Deleted)
+			default:
+				inc(&res.Skipped)
+			}
+		}
+		inc(&res.Checked)
+	}
+	return
+}
+
+// Check that dir is not any of data paths of storage, is not placed in one of them and doesn't contain them
+func sameDir(s *storage.Storage, dir string) bool {
+	paths := []string{s.Conf.DataPath}
+	for _, d := range s.Conf.DataPaths {
+		paths = append(paths, d.Path)
+	}
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		if p, err := filepath.Abs(p); err == nil && (within(dir, p) || within(p, dir)) {
+			return true
+		}
+	}
+	return s.IsDataPath(dir)
+}
+
+// Return true if path is dir or is placed in it
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Compare attributes stored with file except modification time
+func sameAttrs(a, b storage.FileAttrs) bool {
+	return a.Expires.Unix() == b.Expires.Unix() && a.ContentType == b.ContentType &&
+		a.Disposition == b.Disposition && reflect.DeepEqual(a.Meta, b.Meta)
+}
+
+func syncFile(s, backup *storage.Storage, name string) (action int, err error) {
+	file, ok := s.Get(name)
+	if !ok {
+		// deleted while backup in progress
+		if backup.Delete(name) {
+			action = syncDelete
+		}
+		return
+	}
+	if err = file.Open(); err != nil {
+		return
+	}
+	defer file.Close()
+
+	attrs := file.Attrs()
+	if bfile, ok := backup.Get(name); ok {
+		if bfile.FSize == file.FSize && bytes.Equal(bfile.Md5, file.Md5) && sameAttrs(bfile.Attrs(), attrs) {
+			return
+		}
+		backup.Delete(name)
+		action = syncUpdate
+	}
 
-			err = backup.Dump()
-	*/
+	bfile, err := backup.AddWith(name, file.GetReader(), file.FSize, attrs)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(bfile.Md5, file.Md5) {
+		backup.Delete(name)
+		err = fmt.Errorf("MD5 mismatched: %s vs %s", bfile.Md5S(), file.Md5S())
+		return
+	}
+	if action != syncUpdate {
+		action = syncAdd
+	}
 	return
 }
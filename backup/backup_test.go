@@ -0,0 +1,215 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/config"
+	"github.com/cheggaaa/Anteater/storage"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openStorage(t *testing.T, path string) *storage.Storage {
+	s := new(storage.Storage)
+	s.Init(&config.Config{
+		DataPath:      path + "/",
+		ContainerSize: 1024 * 1024 * 10,
+	})
+	if err := s.Open(); err != nil {
+		t.Fatalf("Can't open storage: %v", err)
+	}
+	return s
+}
+
+func addFile(t *testing.T, s *storage.Storage, name, content string) {
+	if _, err := s.Add(name, bytes.NewReader([]byte(content)), int64(len(content))); err != nil {
+		t.Fatalf("Can't add file %s: %v", name, err)
+	}
+}
+
+func assertResult(t *testing.T, res *Result, added, updated, deleted, skipped int64) {
+	if res.Added != added || res.Updated != updated || res.Deleted != deleted || res.Skipped != skipped || res.Errors != 0 {
+		t.Errorf("Unexpected backup result: %+v", res)
+	}
+}
+
+func TestCreateBackup(t *testing.T) {
+	aelog.InitDefault(aelog.LOG_WARN)
+	src, dst := t.TempDir(), t.TempDir()
+
+	s := openStorage(t, src)
+	defer s.Drop()
+	for i := 0; i < 10; i++ {
+		addFile(t, s, fmt.Sprintf("dir/%d", i), fmt.Sprintf("content %d", i))
+	}
+	f, _ := s.Get("dir/0")
+	f.Time = time.Unix(1000, 0)
+
+	if _, err := CreateBackup(s, src); err != ErrSameDir {
+		t.Errorf("Expected ErrSameDir, got: %v", err)
+	}
+
+	res, err := CreateBackup(s, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertResult(t, res, 10, 0, 0, 0)
+
+	// change one file, delete one file
+	s.Delete("dir/1")
+	s.Delete("dir/2")
+	addFile(t, s, "dir/2", "new content")
+
+	res, err = CreateBackup(s, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertResult(t, res, 0, 1, 1, 8)
+	if st := Status(); st.Running || st.Checked != 9 {
+		t.Errorf("Unexpected status: %+v", st)
+	}
+
+	b := openStorage(t, dst)
+	defer b.Drop()
+	if b.Index.Count() != 9 {
+		t.Errorf("Unexpected files count in backup: %d", b.Index.Count())
+	}
+	if _, ok := b.Get("dir/1"); ok {
+		t.Error("Deleted file exists in backup")
+	}
+	bf, ok := b.Get("dir/0")
+	if !ok {
+		t.Fatal("File not found in backup")
+	}
+	if bf.Time.Unix() != 1000 {
+		t.Errorf("File time not preserved: %v", bf.Time)
+	}
+	if err = b.Check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBackupEncrypted(t *testing.T) {
+	aelog.InitDefault(aelog.LOG_WARN)
+	src, dst, plain := t.TempDir(), t.TempDir(), t.TempDir()
+	keyFile := t.TempDir() + "/keys"
+	if err := os.WriteFile(keyFile, []byte("1 000102030405060708090a0b0c0d0e0f\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := new(storage.Storage)
+	s.Init(&config.Config{
+		DataPath:      src + "/",
+		ContainerSize: 1024 * 1024 * 10,
+		KeyFile:       keyFile,
+	})
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Drop()
+	addFile(t, s, "secret", "secret content")
+
+	if _, err := CreateBackup(s, dst); err != nil {
+		t.Fatal(err)
+	}
+	// backup can't be opened without key
+	b := new(storage.Storage)
+	b.Init(&config.Config{DataPath: dst + "/", ContainerSize: 1024 * 1024 * 10})
+	if err := b.Open(); err == nil {
+		b.Close()
+		t.Error("Backup is not encrypted")
+	}
+
+	// backup made without encryption is not mixed with encrypted one
+	openStorage(t, plain).Close()
+	if _, err := CreateBackup(s, plain); err == nil {
+		t.Error("Expected error for plaintext backup")
+	}
+}
+
+func TestBackupAttrs(t *testing.T) {
+	aelog.InitDefault(aelog.LOG_WARN)
+	src, dst := t.TempDir(), t.TempDir()
+
+	s := openStorage(t, src)
+	defer s.Drop()
+	attrs := storage.FileAttrs{
+		Expires:     time.Now().Add(time.Hour).Truncate(time.Second),
+		Meta:        map[string]string{"color": "red"},
+		ContentType: "text/plain",
+		Disposition: "attachment",
+	}
+	if _, err := s.AddWith("f", bytes.NewReader([]byte("content")), 7, attrs); err != nil {
+		t.Fatal(err)
+	}
+	check := func(res *Result, updated int64) {
+		b := openStorage(t, dst)
+		defer b.Close()
+		f, ok := b.Get("f")
+		if !ok {
+			t.Fatal("File not found in backup")
+		}
+		if ba := f.Attrs(); !sameAttrs(ba, attrs) {
+			t.Errorf("Attributes not preserved: %+v", ba)
+		}
+		if res.Updated != updated {
+			t.Errorf("Unexpected backup result: %+v", res)
+		}
+	}
+	res, err := CreateBackup(s, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(res, 0)
+
+	// changed attributes of the same content are synced
+	attrs.Meta = map[string]string{"color": "blue"}
+	attrs.Replace = true
+	if _, err = s.AddWith("f", bytes.NewReader([]byte("content")), 7, attrs); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = CreateBackup(s, dst); err != nil {
+		t.Fatal(err)
+	}
+	check(res, 1)
+}
+
+func TestBackupDataPaths(t *testing.T) {
+	aelog.InitDefault(aelog.LOG_WARN)
+	d1, d2 := t.TempDir(), t.TempDir()
+
+	s := new(storage.Storage)
+	s.Init(&config.Config{
+		DataPath:      d1 + "/",
+		DataPaths:     []config.DataDir{{Path: d1 + "/"}, {Path: d2 + "/"}},
+		ContainerSize: 1024 * 1024 * 10,
+	})
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Drop()
+	for _, dir := range []string{d1, d2, d2 + "/backup", filepath.Dir(d2)} {
+		if _, err := CreateBackup(s, dir); err != ErrSameDir {
+			t.Errorf("Expected ErrSameDir for %s, got: %v", dir, err)
+		}
+	}
+}
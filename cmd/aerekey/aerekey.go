@@ -0,0 +1,119 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/cnst"
+	"github.com/cheggaaa/Anteater/config"
+	"github.com/cheggaaa/Anteater/storage"
+	"github.com/cheggaaa/Anteater/utils"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const HELP = cnst.SIGN + ` rekey tool
+Re-encrypts data files of containers with the current key (key with the biggest id in key_file).
+Plaintext containers will be encrypted. Re-encrypted container needs free disk space for a copy of data file.
+Anteater server must be stopped.
+
+Usage:
+
+	-f=/path/to/config/file
+
+	-c=1,2 - containers to re-encrypt, by default all containers
+
+	-decrypt - store containers as plaintext
+
+	-h - show this page
+`
+
+var (
+	configFile   = flag.String("f", "", "Path to your config file")
+	containerIds = flag.String("c", "", "Comma separated list of containers")
+	decrypt      = flag.Bool("decrypt", false, "Decrypt containers")
+	isPrintHelp  = flag.Bool("h", false, "Show help")
+)
+
+func main() {
+	flag.Parse()
+	if *isPrintHelp || *configFile == "" {
+		fmt.Print(HELP)
+		return
+	}
+
+	c := &config.Config{}
+	c.ReadFile(*configFile)
+
+	var err error
+	aelog.DefaultLogger, err = aelog.New("", aelog.LOG_INFO)
+	if err != nil {
+		panic(err)
+	}
+
+	s := &storage.Storage{}
+	s.Init(c)
+
+	ids, err := s.ContainerIds()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *containerIds != "" {
+		ids = ids[:0]
+		for _, v := range strings.Split(*containerIds, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				fmt.Println("Incorrect container id:", v)
+				os.Exit(1)
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	for _, id := range ids {
+		st := time.Now()
+		res, err := s.RekeyContainer(id, *decrypt)
+		if err != nil {
+			fmt.Printf("Can't re-encrypt container %d: %v\n", id, err)
+			os.Exit(1)
+		}
+		if res.Size == 0 {
+			fmt.Printf("Container %d: key %d, skipped\n", id, res.OldKey)
+			continue
+		}
+		fmt.Printf("Container %d: key %d -> %d, %s for a %v\n", id, res.OldKey, res.NewKey, utils.HumanBytes(res.Size), time.Since(st))
+	}
+
+	// check that storage can be opened now
+	s = &storage.Storage{}
+	s.Init(c)
+	if err = s.Open(); err != nil {
+		fmt.Println("Can't open storage after rekey:", err)
+		os.Exit(1)
+	}
+	if err = s.Check(); err != nil {
+		fmt.Println("Storage check failed:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Storage opened, %d files in index\n", s.Index.Count())
+	s.Close()
+}
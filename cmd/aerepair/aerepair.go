@@ -0,0 +1,135 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/cnst"
+	"github.com/cheggaaa/Anteater/config"
+	"github.com/cheggaaa/Anteater/storage"
+	"github.com/cheggaaa/Anteater/utils"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const HELP = cnst.SIGN + ` repair tool
+Rebuilds lost or corrupted container indexes by scanning data files.
+Files are recognized by headers, so data must be written with data.file_headers enabled.
+Anteater server must be stopped.
+
+Usage:
+
+	-f=/path/to/config/file
+
+	-c=1,2 - containers to repair, by default all containers with broken or missing index
+
+	-verify - check md5 of recovered files
+
+	-drop - don't quarantine unrecognized data, mark it as free space
+
+	-h - show this page
+`
+
+var (
+	configFile   = flag.String("f", "", "Path to your config file")
+	containerIds = flag.String("c", "", "Comma separated list of containers to repair")
+	verify       = flag.Bool("verify", false, "Check md5 of recovered files")
+	drop         = flag.Bool("drop", false, "Don't quarantine unrecognized data")
+	isPrintHelp  = flag.Bool("h", false, "Show help")
+)
+
+func main() {
+	flag.Parse()
+	if *isPrintHelp || *configFile == "" {
+		fmt.Print(HELP)
+		return
+	}
+
+	c := &config.Config{}
+	c.ReadFile(*configFile)
+
+	var err error
+	aelog.DefaultLogger, err = aelog.New("", aelog.LOG_INFO)
+	if err != nil {
+		panic(err)
+	}
+
+	s := &storage.Storage{}
+	s.Init(c)
+
+	ids, err := s.ContainerIds()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *containerIds != "" {
+		ids = ids[:0]
+		for _, v := range strings.Split(*containerIds, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				fmt.Println("Incorrect container id:", v)
+				os.Exit(1)
+			}
+			ids = append(ids, id)
+		}
+	} else {
+		var broken []int64
+		for _, id := range ids {
+			if err = s.CheckIndex(id); err != nil {
+				fmt.Printf("Container %d: %v\n", id, err)
+				broken = append(broken, id)
+			}
+		}
+		ids = broken
+	}
+
+	if len(ids) == 0 {
+		fmt.Println("Nothing to repair")
+		return
+	}
+
+	for _, id := range ids {
+		fmt.Printf("Repair container %d...\n", id)
+		res, err := s.RepairContainer(id, *verify, !*drop)
+		if err != nil {
+			fmt.Printf("Can't repair container %d: %v\n", id, err)
+			os.Exit(1)
+		}
+		fmt.Printf("  Files recovered: %d (%s)\n", res.Files, utils.HumanBytes(res.FilesSize))
+		if *verify {
+			fmt.Printf("  Files corrupted: %d\n", res.Corrupted)
+		}
+		fmt.Printf("  Quarantined: %d (%s)\n", res.Quarantined, utils.HumanBytes(res.QuarantinedSize))
+		fmt.Printf("  Time: %v\n", res.Duration)
+	}
+	if !*drop {
+		fmt.Printf("Quarantined data available as files in /%s/\n", storage.QUARANTINE_DIR)
+	}
+
+	// check that storage can be opened now
+	s = &storage.Storage{}
+	s.Init(c)
+	if err = s.Open(); err != nil {
+		fmt.Println("Can't open storage after repair:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Storage opened, %d files in index\n", s.Index.Count())
+	s.Close()
+}
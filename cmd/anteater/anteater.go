@@ -24,6 +24,8 @@ import (
 	"github.com/cheggaaa/Anteater/cnst"
 	"github.com/cheggaaa/Anteater/config"
 	"github.com/cheggaaa/Anteater/http"
+	"github.com/cheggaaa/Anteater/replication"
+	"github.com/cheggaaa/Anteater/s3"
 	"github.com/cheggaaa/Anteater/storage"
 	"log"
 	ghttp "net/http"
@@ -124,9 +126,22 @@ func main() {
 		}
 	}
 
+	// Start replication
+	switch c.ReplicationRole {
+	case config.REPLICATION_PRIMARY:
+		replication.StartPrimary(stor)
+	case config.REPLICATION_FOLLOWER:
+		replication.StartFollower(stor)
+	}
+
 	// Run server
 	http.RunServer(stor, al)
 
+	// Run s3 server
+	if c.S3Addr != "" {
+		s3.RunServer(stor, al)
+	}
+
 	// Run rpc server
 	rpcserver.StartRpcServer(stor)
 
@@ -18,23 +18,93 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	config "github.com/akrennmair/goconf"
 	"github.com/cheggaaa/Anteater/aelog"
 	"github.com/cheggaaa/Anteater/utils"
 	"mime"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// Replication roles
+const (
+	REPLICATION_PRIMARY  = "primary"
+	REPLICATION_FOLLOWER = "follower"
+)
+
+// Placement policies of new containers
+const (
+	PLACEMENT_FREE        = "free"
+	PLACEMENT_ROUND_ROBIN = "round_robin"
+)
+
+// Redundancy modes of containers
+const (
+	REDUNDANCY_MIRROR = "mirror"
+	REDUNDANCY_RS     = "rs"
+)
+
+// Data directory, usually one per disk
+type DataDir struct {
+	Path string
+	// max size of containers in directory, 0 - limited by free space of disk
+	Capacity int64
+	// share of new containers
+	Weight int
+}
+
 type Config struct {
 	// Data
+	// first of data paths, it also keeps replication state
 	DataPath      string
+	DataPaths     []DataDir
+	Placement     string
 	ContainerSize int64
+	MaxFileSize   int64
 	MinEmptySpace int64
 	DumpTime      time.Duration
 	TmpDir        string
 	CpuNum        int
+	Journal       bool
+	JournalSync   time.Duration
+	FileHeaders   bool
+	UploadTTL     time.Duration
+	TrashDelay    time.Duration
+	Dedup         bool
+	KeyFile       string
+
+	// Redundancy, empty mode - off
+	// Container is split to RedundancyData parts and RedundancyParity parity parts on different data paths
+	Redundancy       string
+	RedundancyData   int
+	RedundancyParity int
+
+	// Compaction
+	CompactHoleRatio float64
+	CompactRate      int64
+	// merged holes of this size and bigger are released to file system, 0 - never
+	PunchHoleSize int64
+	// remove empty containers except ContainersReserve of them
+	RetireContainers  bool
+	ContainersReserve int
+
+	// Scrubbing, interval 0 - disabled
+	ScrubInterval time.Duration
+	ScrubRate     int64
+
+	// Compression
+	CompressCodec   string
+	CompressTypes   []string
+	CompressMinSize int64
+	CompressMaxSize int64
+
+	// Versioning
+	VersionPrefixes []string
+	VersionsMax     int
+	VersionsMaxAge  time.Duration
 
 	// Http
 	HttpWriteAddr    string
@@ -50,6 +120,20 @@ type Config struct {
 	// Rpc
 	RpcAddr string
 
+	// S3
+	S3Addr   string
+	S3Region string
+	S3Domain string
+	// access key -> secret key
+	S3Keys map[string]string
+	// unsigned requests are allowed to read
+	S3Anonymous bool
+
+	// Replication
+	ReplicationRole    string
+	ReplicationPrimary string
+	ReplicationLogSize int
+
 	// Http Headers
 	Headers map[string]string
 
@@ -78,20 +162,50 @@ func (conf *Config) ReadFile(filename string) {
 		panic(err)
 	}
 
-	// Data path
-	conf.DataPath, err = c.GetString("data", "path")
+	// Data paths
+	s, err := c.GetString("data", "path")
 	if err != nil {
 		panic(err)
 	}
-	conf.DataPath = strings.TrimRight(conf.DataPath, "/") + "/"
+	if conf.DataPaths, err = ParseDataPaths(s); err != nil {
+		panic("Incorrect data.path: " + err.Error())
+	}
+	conf.DataPath = conf.DataPaths[0].Path
+
+	// Placement of new containers
+	conf.Placement, err = c.GetString("data", "placement")
+	switch conf.Placement {
+	case PLACEMENT_FREE, PLACEMENT_ROUND_ROBIN:
+	case "":
+		conf.Placement = PLACEMENT_FREE
+	default:
+		panic("Incorrect data.placement: " + conf.Placement)
+	}
+
+	// Redundancy of containers
+	s, _ = c.GetString("data", "redundancy")
+	if conf.Redundancy, conf.RedundancyData, conf.RedundancyParity, err = ParseRedundancy(s); err != nil {
+		panic("Incorrect data.redundancy: " + err.Error())
+	}
+	if n := conf.RedundancyData + conf.RedundancyParity; conf.Redundancy != "" && n > len(conf.DataPaths) {
+		panic(fmt.Sprintf("data.redundancy needs %d data paths", n))
+	}
 
 	// Container size
-	s, err := c.GetString("data", "container_size")
+	s, err = c.GetString("data", "container_size")
 	if err != nil {
 		panic(err)
 	}
 	conf.ContainerSize, err = utils.BytesFromString(s)
 
+	// Max file size (0 - unlimited). Files bigger than container will be stored in several containers
+	s, err = c.GetString("data", "max_file_size")
+	if err == nil && s != "0" && s != "" {
+		if conf.MaxFileSize, err = utils.BytesFromString(s); err != nil {
+			panic("Incorrect data.max_file_size")
+		}
+	}
+
 	// Min empty space
 	s, err = c.GetString("data", "min_empty_space")
 	if err != nil {
@@ -119,6 +233,150 @@ func (conf *Config) ReadFile(filename string) {
 		conf.TmpDir = strings.TrimRight(conf.TmpDir, "/")
 	}
 
+	// Journal
+	conf.Journal, _ = c.GetBool("data", "journal")
+
+	// Journal fsync period
+	s, err = c.GetString("data", "journal_sync")
+	if err == nil && s != "0" && s != "" {
+		conf.JournalSync, err = time.ParseDuration(s)
+		if err != nil || conf.JournalSync < 0 {
+			panic("Incorrect data.journal_sync time duration")
+		}
+	}
+
+	// Self-describing file headers in data files
+	conf.FileHeaders, _ = c.GetBool("data", "file_headers")
+
+	// Store files with the same content once
+	conf.Dedup, _ = c.GetBool("data", "dedup")
+
+	// Encryption keys
+	conf.KeyFile, _ = c.GetString("data", "key_file")
+
+	// Unfinished uploads lifetime
+	s, err = c.GetString("data", "upload_ttl")
+	if err != nil {
+		conf.UploadTTL = 24 * time.Hour
+	} else if s != "0" && s != "" {
+		conf.UploadTTL, err = time.ParseDuration(s)
+		if err != nil || conf.UploadTTL < 0 {
+			panic("Incorrect data.upload_ttl time duration")
+		}
+	}
+
+	// Deleted files lifetime in trash
+	s, err = c.GetString("data", "trash_delay")
+	if err == nil && s != "0" && s != "" {
+		conf.TrashDelay, err = time.ParseDuration(s)
+		if err != nil || conf.TrashDelay < 0 {
+			panic("Incorrect data.trash_delay time duration")
+		}
+	}
+
+	// Compaction threshold
+	conf.CompactHoleRatio, err = c.GetFloat64("data", "compact_hole_ratio")
+	if err != nil {
+		conf.CompactHoleRatio = 0
+	} else if conf.CompactHoleRatio < 0 || conf.CompactHoleRatio >= 1 {
+		panic("Incorrect data.compact_hole_ratio, must be in range 0..1")
+	}
+
+	// Compaction rate
+	s, err = c.GetString("data", "compact_rate")
+	if err != nil {
+		s = "10M"
+	}
+	if conf.CompactRate, err = utils.BytesFromString(s); err != nil {
+		panic("Incorrect data.compact_rate: " + err.Error())
+	}
+
+	// Release of big holes
+	s, _ = c.GetString("data", "punch_hole_size")
+	if conf.PunchHoleSize, err = utils.BytesFromString(s); err != nil || conf.PunchHoleSize < 0 {
+		panic("Incorrect data.punch_hole_size")
+	}
+
+	// Empty containers
+	if conf.ContainersReserve, err = c.GetInt("data", "containers_reserve"); err == nil {
+		if conf.ContainersReserve < 0 {
+			panic("Incorrect data.containers_reserve, must be 0 or more")
+		}
+		conf.RetireContainers = true
+	}
+
+	// Background verification of files
+	s, err = c.GetString("data", "scrub_interval")
+	if err == nil && s != "0" && s != "" {
+		conf.ScrubInterval, err = time.ParseDuration(s)
+		if err != nil || conf.ScrubInterval < 0 {
+			panic("Incorrect data.scrub_interval time duration")
+		}
+	}
+	s, err = c.GetString("data", "scrub_rate")
+	if err != nil {
+		s = "10M"
+	}
+	if conf.ScrubRate, err = utils.BytesFromString(s); err != nil {
+		panic("Incorrect data.scrub_rate: " + err.Error())
+	}
+
+	// Compression
+	conf.CompressCodec, err = c.GetString("compress", "codec")
+	switch conf.CompressCodec {
+	case "gzip", "zstd", "br":
+	case "", "off":
+		conf.CompressCodec = ""
+	default:
+		panic("Incorrect compress.codec: " + conf.CompressCodec)
+	}
+	s, err = c.GetString("compress", "types")
+	if err != nil {
+		s = "text/*, application/json, application/javascript, application/xml, image/svg+xml"
+	}
+	conf.CompressTypes = nil
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			conf.CompressTypes = append(conf.CompressTypes, t)
+		}
+	}
+	s, err = c.GetString("compress", "min_size")
+	if err != nil {
+		s = "1K"
+	}
+	if conf.CompressMinSize, err = utils.BytesFromString(s); err != nil {
+		panic("Incorrect compress.min_size: " + err.Error())
+	}
+	s, err = c.GetString("compress", "max_size")
+	if err != nil {
+		s = "4M"
+	}
+	if conf.CompressMaxSize, err = utils.BytesFromString(s); err != nil {
+		panic("Incorrect compress.max_size: " + err.Error())
+	}
+
+	// Versioning
+	s, _ = c.GetString("versioning", "prefixes")
+	conf.VersionPrefixes = nil
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.Trim(strings.TrimSpace(p), "/"); p != "" {
+			conf.VersionPrefixes = append(conf.VersionPrefixes, p)
+		}
+	}
+	conf.VersionsMax, err = c.GetInt("versioning", "max_versions")
+	if err != nil {
+		conf.VersionsMax = 10
+	} else if conf.VersionsMax < 0 {
+		panic("Incorrect versioning.max_versions, must be >= 0")
+	}
+	s, err = c.GetString("versioning", "max_age")
+	if err == nil && s != "0" && s != "" {
+		conf.VersionsMaxAge, err = time.ParseDuration(s)
+		if err != nil || conf.VersionsMaxAge < 0 {
+			panic("Incorrect versioning.max_age time duration")
+		}
+	}
+
 	// Num cpu
 	conf.CpuNum, err = c.GetInt("data", "cpu_num")
 	if conf.CpuNum < 1 || conf.CpuNum > runtime.NumCPU() {
@@ -202,6 +460,52 @@ func (conf *Config) ReadFile(filename string) {
 		conf.RpcAddr = ":32032"
 	}
 
+	// S3
+	conf.S3Addr, err = c.GetString("s3", "addr")
+	if err != nil {
+		conf.S3Addr = ""
+	}
+	conf.S3Region, err = c.GetString("s3", "region")
+	if err != nil || conf.S3Region == "" {
+		conf.S3Region = "us-east-1"
+	}
+	conf.S3Domain, err = c.GetString("s3", "domain")
+	if err != nil {
+		conf.S3Domain = ""
+	}
+	conf.S3Keys = make(map[string]string)
+	kOpts, err := c.GetOptions("s3-keys")
+	if err == nil {
+		for _, o := range kOpts {
+			// option names are case insensitive, so keys are in values: "name : ACCESS_KEY SECRET_KEY"
+			v, err := c.GetString("s3-keys", o)
+			if f := strings.Fields(v); err == nil && len(f) == 2 {
+				conf.S3Keys[f[0]] = f[1]
+			}
+		}
+	}
+	conf.S3Anonymous, _ = c.GetBool("s3", "anonymous")
+	if conf.S3Addr != "" && len(conf.S3Keys) == 0 && !conf.S3Anonymous {
+		panic("s3-keys must be defined for s3 api, or s3.anonymous enabled for read-only access")
+	}
+
+	// Replication
+	conf.ReplicationRole, err = c.GetString("replication", "role")
+	switch conf.ReplicationRole {
+	case REPLICATION_PRIMARY:
+	case REPLICATION_FOLLOWER:
+		conf.ReplicationPrimary, err = c.GetString("replication", "primary")
+		if err != nil || conf.ReplicationPrimary == "" {
+			panic("replication.primary must be defined for follower")
+		}
+	default:
+		conf.ReplicationRole = ""
+	}
+	conf.ReplicationLogSize, err = c.GetInt("replication", "log_size")
+	if err != nil || conf.ReplicationLogSize <= 0 {
+		conf.ReplicationLogSize = 100000
+	}
+
 	// Headers
 	headers := make(map[string]string, 0)
 	hOpts, err := c.GetOptions("http-headers")
@@ -300,3 +604,70 @@ func (conf *Config) RegisterMime() {
 		}
 	}
 }
+
+// Parse comma separated list of data directories: path[:capacity[:weight]]
+func ParseDataPaths(s string) (dirs []DataDir, err error) {
+	seen := make(map[string]bool)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		parts := strings.Split(v, ":")
+		if len(parts) > 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid data path %q", v)
+		}
+		dir := DataDir{Path: strings.TrimRight(parts[0], "/") + "/", Weight: 1}
+		if len(parts) > 1 {
+			if dir.Capacity, err = utils.BytesFromString(parts[1]); err != nil || dir.Capacity < 0 {
+				return nil, fmt.Errorf("invalid capacity of %s", dir.Path)
+			}
+		}
+		if len(parts) > 2 {
+			if dir.Weight, err = strconv.Atoi(parts[2]); err != nil || dir.Weight < 1 {
+				return nil, fmt.Errorf("invalid weight of %s", dir.Path)
+			}
+		}
+		if seen[dir.Path] {
+			return nil, fmt.Errorf("duplicate data path %s", dir.Path)
+		}
+		seen[dir.Path] = true
+		dirs = append(dirs, dir)
+	}
+	if len(dirs) == 0 {
+		return nil, errors.New("no data path")
+	}
+	return dirs, nil
+}
+
+// Parse redundancy mode: "off", "mirror:N" (N copies) or "rs:K+M" (K data and M parity parts)
+func ParseRedundancy(s string) (mode string, data, parity int, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "off" {
+		return
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return "", 0, 0, fmt.Errorf("invalid redundancy %q", s)
+	}
+	switch mode = parts[0]; mode {
+	case REDUNDANCY_MIRROR:
+		var n int
+		if n, err = strconv.Atoi(parts[1]); err != nil || n < 2 {
+			return "", 0, 0, fmt.Errorf("invalid count of copies %q", parts[1])
+		}
+		return mode, 1, n - 1, nil
+	case REDUNDANCY_RS:
+		km := strings.SplitN(parts[1], "+", 2)
+		if len(km) == 2 {
+			data, err = strconv.Atoi(km[0])
+			if err == nil {
+				parity, err = strconv.Atoi(km[1])
+			}
+			if err == nil && data >= 2 && parity >= 1 && data+parity <= 255 {
+				return mode, data, parity, nil
+			}
+		}
+		return "", 0, 0, fmt.Errorf("invalid count of parts %q", parts[1])
+	}
+	return "", 0, 0, fmt.Errorf("unknown redundancy mode %q", mode)
+}
@@ -61,6 +61,41 @@ func TestReadFile(t *testing.T) {
 	}
 }
 
+func TestParseDataPaths(t *testing.T) {
+	dirs, err := ParseDataPaths("/mnt/d1/:2T:3, /mnt/d2:0, /mnt/d3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DataDir{{"/mnt/d1/", 2 << 40, 3}, {"/mnt/d2/", 0, 1}, {"/mnt/d3/", 0, 1}}
+	if fmt.Sprint(dirs) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected data paths: %v", dirs)
+	}
+	for _, s := range []string{"", "/mnt/d1:1T:0", "/mnt/d1:x", "/mnt/d1, /mnt/d1/", ":1T"} {
+		if _, err = ParseDataPaths(s); err == nil {
+			t.Errorf("Expected error for %q", s)
+		}
+	}
+}
+
+func TestParseRedundancy(t *testing.T) {
+	for s, expected := range map[string]string{
+		"":         " 0 0",
+		"off":      " 0 0",
+		"mirror:3": "mirror 1 2",
+		"rs:4+2":   "rs 4 2",
+	} {
+		mode, data, parity, err := ParseRedundancy(s)
+		if err != nil || fmt.Sprint(mode, " ", data, " ", parity) != expected {
+			t.Errorf("Unexpected redundancy for %q: %s %d %d %v", s, mode, data, parity, err)
+		}
+	}
+	for _, s := range []string{"mirror", "mirror:1", "rs:4", "rs:1+1", "rs:4+0", "raid:5"} {
+		if _, _, _, err := ParseRedundancy(s); err == nil {
+			t.Errorf("Expected error for %q", s)
+		}
+	}
+}
+
 var TestConfig *Config = &Config{
 	// Data path
 	DataPath:      "/opt/DB/anteater/",
@@ -4,16 +4,16 @@ go 1.19
 
 require (
 	github.com/akrennmair/goconf v0.0.0-20120129010547-c6367f3454b8
+	github.com/andybalholm/brotli v1.0.4
 	github.com/cheggaaa/pb v1.0.29
 	github.com/ipfs/go-datastore v0.6.0
+	github.com/klauspost/compress v1.15.0
 	github.com/valyala/fasthttp v1.39.0
 )
 
 require (
-	github.com/andybalholm/brotli v1.0.4 // indirect
 	github.com/google/uuid v1.1.1 // indirect
 	github.com/jbenet/goprocess v0.1.4 // indirect
-	github.com/klauspost/compress v1.15.0 // indirect
 	github.com/mattn/go-runewidth v0.0.4 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	golang.org/x/sys v0.0.0-20220227234510-4e6760a101f9 // indirect
@@ -0,0 +1,62 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package http
+
+import (
+	"github.com/cheggaaa/Anteater/storage"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Return encoding of stored data if client accepts it, otherwise empty string - content must be decoded
+// Range requests always refer to the original content, so they are served decoded
+func acceptEncoding(r *http.Request, f *storage.File) string {
+	enc := f.Encoding()
+	if enc == "" || r.Header.Get("Range") != "" {
+		return ""
+	}
+	if acceptsEncoding(r.Header.Get("Accept-Encoding"), enc) {
+		return enc
+	}
+	return ""
+}
+
+// Check Accept-Encoding header value for encoding with non-zero quality
+func acceptsEncoding(header, enc string) bool {
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != enc && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok && strings.ToLower(k) == "q" {
+				if v, err := strconv.ParseFloat(v, 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if name == enc {
+			return q > 0
+		}
+		wildcard = q > 0
+	}
+	return wildcard
+}
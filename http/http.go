@@ -33,6 +33,12 @@ import (
 	"time"
 )
 
+// Expiry headers
+const (
+	EXPIRES = "X-Ae-Expires"
+	TTL     = "X-Ae-TTL"
+)
+
 const (
 	ERROR_PAGE = "<html><head><title>%s</title></head><body><center><h1>%d %s</h1></center><hr><center>" + cnst.SIGN + "</center></body></html>\n"
 )
@@ -142,10 +148,7 @@ func (s *Server) ReadWrite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	m := r.Header.Get("X-Http-Method-Override")
-	if m == "" {
-		m = r.Method
-	}
+	m := requestMethod(r)
 	sm := m
 
 	du := s.downloadUrl(r)
@@ -153,9 +156,24 @@ func (s *Server) ReadWrite(w http.ResponseWriter, r *http.Request) {
 		sm = "DOWNLOAD"
 	}
 
+	// follower accepts changes only from primary
+	if s.conf.ReplicationRole == config.REPLICATION_FOLLOWER {
+		switch sm {
+		case "OPTIONS", "GET", "HEAD":
+		default:
+			s.Err(http.StatusForbidden, r, w)
+			return
+		}
+	}
+
+	if isUpload(r) {
+		s.Upload(sm, filename, w, r)
+		return
+	}
+
 	switch sm {
 	case "OPTIONS":
-		w.Header().Set("Allow", "GET,HEAD,POST,PUT,DELETE")
+		w.Header().Set("Allow", "GET,HEAD,POST,PUT,PATCH,DELETE")
 		w.WriteHeader(http.StatusOK)
 		return
 	case "GET":
@@ -168,17 +186,13 @@ func (s *Server) ReadWrite(w http.ResponseWriter, r *http.Request) {
 		s.Save(filename, w, r)
 		return
 	case "PUT":
-		s.Delete(filename, nil, nil)
-		s.Save(filename, w, r)
+		s.Put(filename, w, r)
 		return
 	case "DELETE":
 		s.Delete(filename, w, r)
 		return
 	case "DOWNLOAD":
-		if m == "PUT" {
-			s.Delete(filename, nil, nil)
-		}
-		s.Download(filename, w, r)
+		s.Download(filename, w, r, m == "PUT")
 		return
 	case "COMMAND":
 		s.Command(filename, w, r)
@@ -192,33 +206,111 @@ func (s *Server) ReadWrite(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) Get(name string, w http.ResponseWriter, r *http.Request, writeBody bool) {
-	f, ok := s.stor.Get(name)
+	get := s.stor.Get
+	if id := r.URL.Query().Get("versionId"); id != "" {
+		get = func(name string) (*storage.File, bool) {
+			return s.stor.GetVersion(name, id)
+		}
+	}
+	f, ok := get(name)
+	// file can be replaced or deleted between Get and Open
+	for ok && f.Open() != nil {
+		f, ok = get(name)
+	}
 	if !ok {
 		s.Err(404, r, w)
 		s.stor.Stats.Counters.NotFound.Add()
 		return
 	}
-	f.Open()
 	defer f.Close()
 
-	// Check cache
-	cont, status := s.checkCache(r, f)
-	if !cont {
-		w.WriteHeader(status)
-		s.stor.Stats.Counters.NotModified.Add()
-		s.accessLog(status, r)
-		return
+	// Compressed file is sent as is if client accepts its encoding
+	enc := acceptEncoding(r, f)
+	size := f.FSize
+	etag := f.ETag()
+	if enc != "" {
+		size = f.StoredSize()
+		etag += "-" + enc
+	}
+	if f.Encoding() != "" {
+		w.Header().Set("Vary", "Accept-Encoding")
+	}
+
+	if id := f.VersionId(); id != "" {
+		w.Header().Set("X-Ae-Version-Id", id)
+	}
+
+	// preconditions accept the same tags as for writes, whether ETag is sent or not
+	etags := fileETags(f)
+	if enc != "" {
+		etags = append(etags, etag)
 	}
-	w.Header().Set("Accept-Ranges", "bytes")
-	w.Header().Set("Content-Type", f.ContentType())
-	w.Header().Set("Content-Length", strconv.Itoa(int(f.FSize)))
 	w.Header().Set("Last-Modified", f.Time.UTC().Format(http.TimeFormat))
 	if s.conf.ETagSupport {
-		w.Header().Set("E-Tag", f.ETag())
+		w.Header().Set("ETag", quoteETag(etag))
+		w.Header().Set("E-Tag", etag)
+	}
+
+	// Check preconditions, Get is also called after commands and renames to return headers
+	switch requestMethod(r) {
+	case "GET", "HEAD":
+		if status := checkPreconditions(r, true, f.Time, etags...); status == http.StatusNotModified {
+			w.WriteHeader(status)
+			s.stor.Stats.Counters.NotModified.Add()
+			s.accessLog(status, r)
+			return
+		} else if status != 0 {
+			s.Err(status, r, w)
+			return
+		}
+	}
+
+	// Check range request, ranges refer to decoded content
+	var ranges []byteRange
+	if rh := r.Header.Get("Range"); rh != "" && enc == "" && checkIfRange(r, f.Time, etags...) {
+		var err error
+		ranges, err = parseRange(rh, f.FSize)
+		if err == errRangeUnsatisfiable {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", f.FSize))
+			s.Err(http.StatusRequestedRangeNotSatisfiable, r, w)
+			return
+		}
+		if err != nil || !rangesAcceptable(ranges, f.FSize) {
+			ranges = nil
+		}
+	}
+
+	ctype := f.ContentType()
+	status := http.StatusOK
+	var multi *byteRanges
+	switch {
+	case len(ranges) == 1:
+		status = http.StatusPartialContent
+		size = ranges[0].length
+		w.Header().Set("Content-Range", ranges[0].contentRange(f.FSize))
+	case len(ranges) > 1:
+		status = http.StatusPartialContent
+		multi = newByteRanges(ranges, ctype, f.FSize)
+		size = multi.Length()
+		ctype = multi.ContentType()
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if enc != "" {
+		w.Header().Set("Content-Encoding", enc)
 	}
 	if s.conf.Md5Header {
 		w.Header().Set("X-Ae-Md5", f.Md5S())
 	}
+	if !f.Expires.IsZero() {
+		w.Header().Set(EXPIRES, f.Expires.UTC().Format(http.TimeFormat))
+	}
+	if disposition := f.Disposition(); disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	storage.MetaToHeader(f.Meta(), w.Header())
 
 	// Add headers from config
 	for k, v := range s.conf.Headers {
@@ -227,40 +319,28 @@ func (s *Server) Get(name string, w http.ResponseWriter, r *http.Request, writeB
 
 	s.stor.Stats.Counters.Get.Add()
 
-	// check range request
-	goServe := false
-	partial := false
-	ranges := r.Header.Get("Range")
-	if ranges != "" {
-		if strings.TrimSpace(strings.ToLower(ranges)) == "bytes=0-" {
-			partial = true
-		} else {
-			goServe = true
-		}
-	}
-
-	// fix http go lib bug for a "0-" requests
-	if partial {
-		status = http.StatusPartialContent
-		w.Header().Add("Content-Range", fmt.Sprintf("bytes 0-%d/%d", f.FSize-1, f.FSize))
-	}
-
 	if !writeBody {
 		if status == http.StatusOK || status == http.StatusPartialContent {
 			status = http.StatusNoContent
 		}
-		w.Header().Set("X-Ae-Content-Length", strconv.Itoa(int(f.FSize)))
+		w.Header().Set("X-Ae-Content-Length", strconv.FormatInt(size, 10))
 		w.WriteHeader(status)
 		s.accessLog(status, r)
 		return
 	}
 
 	reader := f.GetReader()
+	if enc != "" {
+		reader = f.GetRawReader()
+	}
 
-	if goServe {
-		http.ServeContent(w, r, name, f.Time, reader)
-	} else {
-		w.WriteHeader(status)
+	w.WriteHeader(status)
+	switch {
+	case multi != nil:
+		multi.write(w, reader)
+	case len(ranges) == 1:
+		io.Copy(w, io.NewSectionReader(reader, ranges[0].start, ranges[0].length))
+	default:
 		reader.WriteTo(w)
 	}
 
@@ -271,20 +351,25 @@ func (s *Server) Save(name string, w http.ResponseWriter, r *http.Request) {
 	_, ok := s.stor.Get(name)
 	if ok {
 		// File exists
-		s.Err(409, r, w)
+		s.Err(conflictStatus(r), r, w)
 		return
 	}
 
 	reader := r.Body
 	size := r.ContentLength
-	s.save(name, size, reader, r, w)
+	s.save(name, size, reader, false, r, w)
 }
 
-func (s *Server) Download(name string, w http.ResponseWriter, r *http.Request) {
+// Save file replacing existing one, readers get old file until new one is saved
+func (s *Server) Put(name string, w http.ResponseWriter, r *http.Request) {
+	s.save(name, r.ContentLength, r.Body, true, r, w)
+}
+
+func (s *Server) Download(name string, w http.ResponseWriter, r *http.Request, replace bool) {
 	_, ok := s.stor.Get(name)
-	if ok {
+	if ok && !replace {
 		// File exists
-		s.Err(409, r, w)
+		s.Err(conflictStatus(r), r, w)
 		return
 	}
 	url := s.downloadUrl(r)
@@ -299,11 +384,11 @@ func (s *Server) Download(name string, w http.ResponseWriter, r *http.Request) {
 	}
 	// again check for exists
 	_, ok = s.stor.Get(name)
-	if ok {
-		s.Err(409, r, w)
+	if ok && !replace {
+		s.Err(conflictStatus(r), r, w)
 		return
 	}
-	s.save(name, tf.Size, tf.File, r, w)
+	s.save(name, tf.Size, tf.File, replace, r, w)
 }
 
 func (s *Server) Command(name string, w http.ResponseWriter, r *http.Request) {
@@ -331,22 +416,32 @@ func (s *Server) Rename(name string, w http.ResponseWriter, r *http.Request) {
 	case "1", "true":
 		force = true
 	}
-	if _, ok = s.stor.Get(newName); ok {
-		if !force {
-			s.Err(http.StatusConflict, r, w)
-			return
-		} else {
-			s.stor.Delete(newName)
-		}
+	// If-None-Match: * means new name must not exist, other preconditions refer to renamed file
+	createOnly := strings.TrimSpace(r.Header.Get("If-None-Match")) == "*"
+	var cond storage.Condition
+	conflict := http.StatusConflict
+	if createOnly {
+		sr := r.Clone(r.Context())
+		sr.Header.Del("If-None-Match")
+		cond = writeCondition(sr)
+		conflict = http.StatusPreconditionFailed
+	} else {
+		cond = writeCondition(r)
 	}
-
-	_, err := s.stor.Index.Rename(name, newName)
+	// existing file is replaced atomically with check of preconditions
+	_, err := s.stor.RenameIf(name, newName, cond, force && !createOnly)
 	switch err {
+	case storage.ErrPreconditionFailed:
+		s.Err(http.StatusPreconditionFailed, r, w)
+		return
 	case storage.ErrFileNotFound:
 		s.Err(http.StatusNotFound, r, w)
 		return
 	case storage.ErrConflict:
-		s.Err(http.StatusConflict, r, w)
+		s.Err(conflict, r, w)
+		return
+	case storage.ErrNameTooLong:
+		s.Err(http.StatusBadRequest, r, w)
 		return
 	default:
 		if err != nil {
@@ -359,22 +454,60 @@ func (s *Server) Rename(name string, w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func (s *Server) save(name string, size int64, reader io.Reader, r *http.Request, w http.ResponseWriter) {
+func (s *Server) save(name string, size int64, reader io.Reader, replace bool, r *http.Request, w http.ResponseWriter) {
 	if size <= 0 {
 		s.Err(411, r, w)
 		return
 	}
-	if size > s.conf.ContainerSize {
+	if s.conf.MaxFileSize > 0 && size > s.conf.MaxFileSize {
 		s.Err(413, r, w)
 		return
 	}
-	f, err := s.stor.Add(name, reader, size)
+	expires, err := requestExpires(r)
+	if err != nil {
+		s.Err(400, r, w)
+		return
+	}
+	// preconditions are checked before upload and again atomically with adding to index
+	cond := writeCondition(r)
+	if cond != nil {
+		f, _ := s.stor.Get(name)
+		if cond(f) != nil {
+			s.Err(http.StatusPreconditionFailed, r, w)
+			return
+		}
+	}
+	attrs := storage.FileAttrs{
+		Expires: expires,
+		Meta:    storage.MetaFromHeader(r.Header),
+		Replace: replace,
+		Cond:    cond,
+	}
+	attrs.ContentType, attrs.Disposition = storage.TypeFromHeader(r.Header)
+	f, err := s.stor.AddWith(name, reader, size, attrs)
+	if err == storage.ErrMetaTooBig || err == storage.ErrInvalidType {
+		s.Err(400, r, w)
+		return
+	}
+	if err == storage.ErrFileExists {
+		s.Err(conflictStatus(r), r, w)
+		return
+	}
+	if err == storage.ErrPreconditionFailed {
+		s.Err(http.StatusPreconditionFailed, r, w)
+		return
+	}
 	if err != nil {
 		s.Err(500, r, w)
 		return
 	}
 	w.Header().Set("X-Ae-Md5", f.Md5S())
+	// legacy unquoted value goes first, names are case-insensitive so quoted one is second value of the same header
 	w.Header().Set("Etag", f.ETag())
+	w.Header().Add("ETag", quoteETag(f.ETag()))
+	if id := f.VersionId(); id != "" {
+		w.Header().Set("X-Ae-Version-Id", id)
+	}
 	w.Header().Set("Location", name)
 	if err = module.OnSave(f, w, r, s.stor); err != nil {
 		s.Err(500, r, w)
@@ -384,20 +517,75 @@ func (s *Server) save(name string, size int64, reader io.Reader, r *http.Request
 	s.accessLog(http.StatusCreated, r)
 }
 
+// Return expiry time from X-Ae-Expires (http date or unix time) or X-Ae-TTL (seconds or duration like 1h30m) header
+func requestExpires(r *http.Request) (t time.Time, err error) {
+	if v := r.Header.Get(EXPIRES); v != "" {
+		if ts, e := strconv.ParseInt(v, 10, 64); e == nil {
+			t = time.Unix(ts, 0)
+		} else if t, err = http.ParseTime(v); err != nil {
+			return
+		}
+	} else if v = r.Header.Get(TTL); v != "" {
+		var ttl time.Duration
+		if sec, e := strconv.ParseInt(v, 10, 64); e == nil {
+			ttl = time.Duration(sec) * time.Second
+		} else if ttl, err = time.ParseDuration(v); err != nil {
+			return
+		}
+		if ttl <= 0 {
+			return t, fmt.Errorf("Incorrect ttl: %s", v)
+		}
+		t = time.Now().Add(ttl)
+	} else {
+		return
+	}
+	if !t.After(time.Now()) {
+		err = fmt.Errorf("Expiry time in the past: %v", t)
+	}
+	return
+}
+
+// Delete file. Preconditions refer to the named file, not to its childs
 func (s *Server) Delete(name string, w http.ResponseWriter, r *http.Request) {
 	var ok bool
 	var mode string
+	var cond storage.Condition
 	if r != nil {
+		if id := r.URL.Query().Get("versionId"); id != "" {
+			s.deleteVersion(name, id, w, r)
+			return
+		}
 		mode = strings.ToLower(r.Header.Get("X-Ae-Delete"))
+		cond = writeCondition(r)
+	}
+	deleteFile := func() bool {
+		_, err := s.stor.DeleteIf(name, cond)
+		if err == storage.ErrPreconditionFailed {
+			s.Err(http.StatusPreconditionFailed, r, w)
+			return false
+		}
+		ok = ok || err == nil
+		return true
 	}
 	switch mode {
 	case "childs":
+		if cond != nil {
+			f, _ := s.stor.Get(name)
+			if cond(f) != nil {
+				s.Err(http.StatusPreconditionFailed, r, w)
+				return
+			}
+		}
 		ok = s.stor.DeleteChilds(name)
 	case "all":
-		cok := s.stor.DeleteChilds(name)
-		ok = s.stor.Delete(name) || cok
+		if !deleteFile() {
+			return
+		}
+		ok = s.stor.DeleteChilds(name) || ok
 	default:
-		ok = s.stor.Delete(name)
+		if !deleteFile() {
+			return
+		}
 	}
 
 	if ok {
@@ -414,6 +602,25 @@ func (s *Server) Delete(name string, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Delete version of file permanently
+func (s *Server) deleteVersion(name, id string, w http.ResponseWriter, r *http.Request) {
+	if _, err := s.stor.DeleteVersion(name, id); err != nil {
+		s.Err(404, r, w)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	s.accessLog(http.StatusNoContent, r)
+	s.stor.Stats.Counters.Delete.Add()
+}
+
+// Return status for write to existing file: 412 for conditional request, otherwise 409
+func conflictStatus(r *http.Request) int {
+	if hasWriteConditions(r) {
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusConflict
+}
+
 func (s *Server) StatsJson(w http.ResponseWriter, r *http.Request) {
 	b := s.stor.GetStats().AsJson()
 	w.Header().Add("Content-Type", "application/json;charset=utf-8")
@@ -431,6 +638,14 @@ func (s *Server) Err(code int, r *http.Request, w http.ResponseWriter) {
 	s.accessLog(code, r)
 }
 
+// Return method from X-Http-Method-Override header or request method
+func requestMethod(r *http.Request) string {
+	if m := r.Header.Get("X-Http-Method-Override"); m != "" {
+		return m
+	}
+	return r.Method
+}
+
 /**
  * Return slash-trimmed filename
  */
@@ -454,26 +669,6 @@ func (s *Server) downloadUrl(r *http.Request) (url string) {
 	return
 }
 
-func (s *Server) checkCache(r *http.Request, f *storage.File) (cont bool, status int) {
-	// Check etag
-	if s.conf.ETagSupport {
-		if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
-			if ifNoneMatch == f.ETag() {
-				status = http.StatusNotModified
-				return
-			}
-		}
-	}
-	// Check if modified
-	if tm, err := time.Parse(http.TimeFormat, r.Header.Get("If-Modified-Since")); err == nil && f.Time.Before(tm.Add(1*time.Second)) {
-		status = http.StatusNotModified
-		return
-	}
-	cont = true
-	status = http.StatusOK
-	return
-}
-
 func (s *Server) accessLog(status int, r *http.Request) {
 	if s.aL != nil {
 		st := http.StatusText(status)
@@ -0,0 +1,175 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package http
+
+import (
+	"github.com/cheggaaa/Anteater/storage"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Conditional requests (RFC 9110 section 13)
+// Entity tags are sent quoted in ETag header and unquoted in legacy E-Tag header, both forms are accepted
+
+// Return quoted entity tag
+func quoteETag(etag string) string {
+	return `"` + etag + `"`
+}
+
+// Check list of entity tags (or "*") for any of etags of representation. Weak comparison ignores W/ prefix,
+// strong comparison doesn't match weak tags
+func matchETag(header string, etags []string, exists, weak bool) bool {
+	for header != "" {
+		header = strings.TrimLeft(header, " \t,")
+		if header == "" {
+			break
+		}
+		if header[0] == '*' {
+			if exists {
+				return true
+			}
+			header = header[1:]
+			continue
+		}
+		isWeak := strings.HasPrefix(header, "W/")
+		if isWeak {
+			header = header[2:]
+		}
+		var tag string
+		if strings.HasPrefix(header, `"`) {
+			end := strings.IndexByte(header[1:], '"')
+			if end < 0 {
+				return false
+			}
+			tag, header = header[1:end+1], header[end+2:]
+		} else {
+			// unquoted legacy tag
+			end := strings.IndexAny(header, " \t,")
+			if end < 0 {
+				end = len(header)
+			}
+			tag, header = header[:end], header[end:]
+		}
+		if weak || !isWeak {
+			for _, etag := range etags {
+				if tag == etag {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Parse http date from header, ok is false if header is missing or invalid
+func headerTime(r *http.Request, name string) (t time.Time, ok bool) {
+	v := r.Header.Get(name)
+	if v == "" {
+		return
+	}
+	t, err := http.ParseTime(v)
+	return t, err == nil
+}
+
+// Evaluate preconditions of request in order of RFC 9110 13.2.2
+// read is true for GET and HEAD, modified is zero if there is no current representation
+// Return 0 if request must be performed, otherwise 304 or 412
+func checkPreconditions(r *http.Request, read bool, modified time.Time, etags ...string) int {
+	exists := !modified.IsZero()
+	modified = modified.Truncate(time.Second)
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !matchETag(im, etags, exists, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if t, ok := headerTime(r, "If-Unmodified-Since"); ok && exists && modified.After(t) {
+		return http.StatusPreconditionFailed
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if matchETag(inm, etags, exists, true) {
+			if read {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if t, ok := headerTime(r, "If-Modified-Since"); ok && read && exists && !modified.After(t) {
+		return http.StatusNotModified
+	}
+	return 0
+}
+
+// Return true if Range header must be used: there is no If-Range or it matches representation
+// Entity tag must match strongly, date must be equal to modification time
+func checkIfRange(r *http.Request, modified time.Time, etags ...string) bool {
+	ir := strings.TrimSpace(r.Header.Get("If-Range"))
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return matchETag(ir, etags, true, false)
+	}
+	if t, err := http.ParseTime(ir); err == nil {
+		return t.Equal(modified.Truncate(time.Second))
+	}
+	// unquoted legacy tag
+	return matchETag(ir, etags, true, false)
+}
+
+// Headers of write preconditions
+var writeConditionHeaders = []string{"If-Match", "If-None-Match", "If-Unmodified-Since"}
+
+// Return true if request has preconditions for write
+func hasWriteConditions(r *http.Request) bool {
+	return r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Unmodified-Since") != ""
+}
+
+// Return copy of write precondition headers, nil if request has no preconditions
+func writeConditionHeader(r *http.Request) (h http.Header) {
+	for _, k := range writeConditionHeaders {
+		if v := r.Header.Values(k); len(v) > 0 {
+			if h == nil {
+				h = make(http.Header)
+			}
+			h[k] = append([]string(nil), v...)
+		}
+	}
+	return
+}
+
+// Entity tags of file accepted by If-Match, If-None-Match and If-Range
+func fileETags(f *storage.File) []string {
+	return []string{f.ETag()}
+}
+
+// Return condition of write request for storage, nil if request has no preconditions
+func writeCondition(r *http.Request) storage.Condition {
+	if !hasWriteConditions(r) {
+		return nil
+	}
+	return func(f *storage.File) error {
+		var status int
+		if f == nil {
+			status = checkPreconditions(r, false, time.Time{})
+		} else {
+			status = checkPreconditions(r, false, f.Time, fileETags(f)...)
+		}
+		if status != 0 {
+			return storage.ErrPreconditionFailed
+		}
+		return nil
+	}
+}
@@ -0,0 +1,364 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package http
+
+import (
+	"bytes"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/config"
+	"github.com/cheggaaa/Anteater/storage"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 9110 8.8.3.2
+func TestMatchETag(t *testing.T) {
+	cases := []struct {
+		header, etag string
+		strong, weak bool
+	}{
+		{`W/"1"`, "1", false, true},
+		{`W/"2"`, "1", false, false},
+		{`"1"`, "1", true, true},
+		{`"2", "1"`, "1", true, true},
+		{`"a,b", "1"`, "1", true, true},
+		{"1", "1", true, true},
+		{"*", "1", true, true},
+	}
+	for _, c := range cases {
+		if m := matchETag(c.header, []string{c.etag}, true, false); m != c.strong {
+			t.Errorf("%s vs %s: strong comparison %v", c.header, c.etag, m)
+		}
+		if m := matchETag(c.header, []string{c.etag}, true, true); m != c.weak {
+			t.Errorf("%s vs %s: weak comparison %v", c.header, c.etag, m)
+		}
+	}
+	if matchETag("*", []string{"1"}, false, true) {
+		t.Error("* matches missing representation")
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 500, time.UTC)
+	before := modified.Add(-time.Hour).Format(http.TimeFormat)
+	after := modified.Add(time.Hour).Format(http.TimeFormat)
+	same := modified.Format(http.TimeFormat)
+	cases := []struct {
+		headers []string
+		read    bool
+		status  int
+	}{
+		{nil, true, 0},
+		{[]string{"If-Match", `"1"`}, true, 0},
+		{[]string{"If-Match", `"2"`}, true, 412},
+		{[]string{"If-Match", `W/"1"`}, true, 412},
+		{[]string{"If-Unmodified-Since", before}, true, 412},
+		{[]string{"If-Unmodified-Since", same}, true, 0},
+		// If-Unmodified-Since is ignored with If-Match
+		{[]string{"If-Match", "*", "If-Unmodified-Since", before}, true, 0},
+		{[]string{"If-Unmodified-Since", "invalid date"}, true, 0},
+		{[]string{"If-None-Match", `"2", W/"1"`}, true, 304},
+		{[]string{"If-None-Match", `"2"`}, true, 0},
+		{[]string{"If-None-Match", "*"}, false, 412},
+		{[]string{"If-None-Match", `"1"`}, false, 412},
+		{[]string{"If-Modified-Since", same}, true, 304},
+		{[]string{"If-Modified-Since", before}, true, 0},
+		{[]string{"If-Modified-Since", same}, false, 0},
+		// If-Modified-Since is ignored with If-None-Match
+		{[]string{"If-None-Match", `"2"`, "If-Modified-Since", after}, true, 0},
+		// If-Match is evaluated first
+		{[]string{"If-Match", `"2"`, "If-None-Match", `"1"`}, true, 412},
+	}
+	for i, c := range cases {
+		r := httptest.NewRequest("GET", "/f", nil)
+		for j := 0; j+1 < len(c.headers); j += 2 {
+			r.Header.Set(c.headers[j], c.headers[j+1])
+		}
+		if st := checkPreconditions(r, c.read, modified, "1"); st != c.status {
+			t.Errorf("Case %d %v: status %d, expected %d", i, c.headers, st, c.status)
+		}
+	}
+
+	// no current representation
+	r := httptest.NewRequest("PUT", "/f", nil)
+	r.Header.Set("If-Match", "*")
+	if st := checkPreconditions(r, false, time.Time{}); st != 412 {
+		t.Errorf("If-Match: * for missing file: %d", st)
+	}
+	r = httptest.NewRequest("PUT", "/f", nil)
+	r.Header.Set("If-None-Match", "*")
+	if st := checkPreconditions(r, false, time.Time{}); st != 0 {
+		t.Errorf("If-None-Match: * for missing file: %d", st)
+	}
+}
+
+func TestCheckIfRange(t *testing.T) {
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 500, time.UTC)
+	cases := map[string]bool{
+		"":                               true,
+		`"1"`:                            true,
+		`"2"`:                            false,
+		`W/"1"`:                          false,
+		"1":                              true,
+		modified.Format(http.TimeFormat): true,
+		modified.Add(-time.Second).Format(http.TimeFormat): false,
+	}
+	for h, res := range cases {
+		r := httptest.NewRequest("GET", "/f", nil)
+		r.Header.Set("If-Range", h)
+		if checkIfRange(r, modified, "1") != res {
+			t.Errorf("If-Range %s: expected %v", h, res)
+		}
+	}
+}
+
+// RFC 9110 14.1.2
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		header string
+		ranges []byteRange
+		err    error
+	}{
+		{"bytes=0-499", []byteRange{{0, 500}}, nil},
+		{"bytes=500-999", []byteRange{{500, 500}}, nil},
+		{"bytes=-500", []byteRange{{9500, 500}}, nil},
+		{"bytes=9500-", []byteRange{{9500, 500}}, nil},
+		{"bytes=0-0,-1", []byteRange{{0, 1}, {9999, 1}}, nil},
+		{"bytes= 500-600 , 601-999", []byteRange{{500, 101}, {601, 399}}, nil},
+		{"bytes=9000-20000", []byteRange{{9000, 1000}}, nil},
+		{"bytes=-20000", []byteRange{{0, 10000}}, nil},
+		{"bytes=20000-,0-9", []byteRange{{0, 10}}, nil},
+		{"bytes=20000-", nil, errRangeUnsatisfiable},
+		{"bytes=-0", nil, errRangeUnsatisfiable},
+		{"bytes=10-5", nil, errRangeInvalid},
+		{"bytes=a-b", nil, errRangeInvalid},
+		{"items=0-5", nil, errRangeInvalid},
+	}
+	for _, c := range cases {
+		ranges, err := parseRange(c.header, 10000)
+		if err != c.err {
+			t.Errorf("%s: unexpected error %v", c.header, err)
+			continue
+		}
+		if len(ranges) != len(c.ranges) {
+			t.Errorf("%s: unexpected ranges %v", c.header, ranges)
+			continue
+		}
+		for i := range ranges {
+			if ranges[i] != c.ranges[i] {
+				t.Errorf("%s: unexpected ranges %v", c.header, ranges)
+			}
+		}
+	}
+}
+
+func newTestServer(t *testing.T) *Server {
+	if aelog.DefaultLogger == nil {
+		aelog.InitDefault(aelog.LOG_WARN)
+	}
+	stor := new(storage.Storage)
+	stor.Init(&config.Config{
+		ContainerSize: 1024 * 1024 * 10,
+		DataPath:      t.TempDir() + "/",
+		TmpDir:        t.TempDir(),
+		ETagSupport:   true,
+	})
+	if err := stor.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stor.Close)
+	return &Server{stor: stor, conf: stor.Conf}
+}
+
+func TestGetRanges(t *testing.T) {
+	s := newTestServer(t)
+	content := make([]byte, 10000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	f, err := s.stor.Add("file", bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/file", nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		s.Get("file", w, r, true)
+		return w
+	}
+
+	w := get("Range", "bytes=100-199")
+	if w.Code != 206 || w.Header().Get("Content-Range") != "bytes 100-199/10000" || !bytes.Equal(w.Body.Bytes(), content[100:200]) {
+		t.Errorf("Unexpected single range response: %d %v", w.Code, w.Header())
+	}
+
+	w = get("Range", "bytes=0-9,-10")
+	mt, params, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if w.Code != 206 || mt != "multipart/byteranges" {
+		t.Fatalf("Unexpected multi range response: %d %v", w.Code, w.Header())
+	}
+	if w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("Content-Length %s, but body is %d", w.Header().Get("Content-Length"), w.Body.Len())
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	expected := [][]byte{content[:10], content[9990:]}
+	for i := 0; ; i++ {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			if i != 2 {
+				t.Errorf("Unexpected parts count: %d", i)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(p)
+		if i >= 2 || !bytes.Equal(b, expected[i]) {
+			t.Errorf("Unexpected part %d: %s", i, p.Header.Get("Content-Range"))
+		}
+	}
+
+	if w = get("Range", "bytes=20000-"); w.Code != 416 || w.Header().Get("Content-Range") != "bytes */10000" {
+		t.Errorf("Unexpected unsatisfiable range response: %d %v", w.Code, w.Header())
+	}
+	if w = get("Range", "bytes=0-9", "If-Range", `"other"`); w.Code != 200 || w.Body.Len() != 10000 {
+		t.Errorf("If-Range mismatch must return whole content: %d", w.Code)
+	}
+	if w = get("Range", "bytes=0-9", "If-Range", quoteETag(f.ETag())); w.Code != 206 {
+		t.Errorf("If-Range match must return range: %d", w.Code)
+	}
+	if w = get("If-None-Match", quoteETag(f.ETag())); w.Code != 304 {
+		t.Errorf("Unexpected If-None-Match status: %d", w.Code)
+	}
+	if w = get("If-Match", `"other"`); w.Code != 412 {
+		t.Errorf("Unexpected If-Match status: %d", w.Code)
+	}
+	if w = get("If-None-Match", f.Md5S()); w.Code != 304 {
+		t.Errorf("Unexpected If-None-Match status with md5: %d", w.Code)
+	}
+
+	// same tags are checked when ETag header is disabled, as for writes
+	s.conf.ETagSupport = false
+	if w = get("If-None-Match", quoteETag(f.ETag())); w.Code != 304 || w.Header().Get("ETag") != "" {
+		t.Errorf("Unexpected If-None-Match status without ETag support: %d %v", w.Code, w.Header())
+	}
+	if w = get("If-Match", f.Md5S()); w.Code != 200 {
+		t.Errorf("Unexpected If-Match status without ETag support: %d", w.Code)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	s := newTestServer(t)
+	do := func(method, name, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/"+name, strings.NewReader(body))
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		s.ReadWrite(w, r)
+		return w
+	}
+
+	w := do("PUT", "f", "first", "If-None-Match", "*")
+	if w.Code != 201 {
+		t.Fatalf("Create-only PUT of new file: %d", w.Code)
+	}
+	f, _ := s.stor.Get("f")
+	etag := quoteETag(f.ETag())
+	// legacy unquoted header is kept
+	if v := w.Header().Values("Etag"); len(v) != 2 || v[0] != f.ETag() || v[1] != etag {
+		t.Errorf("Unexpected E-Tag headers of upload: %v", v)
+	}
+	if w := do("PUT", "f", "second", "If-None-Match", "*"); w.Code != 412 {
+		t.Errorf("Create-only PUT of existing file: %d", w.Code)
+	}
+	if w := do("POST", "f", "second", "If-None-Match", "*"); w.Code != 412 {
+		t.Errorf("Create-only POST of existing file: %d", w.Code)
+	}
+	if w := do("PUT", "f", "second", "If-Match", `"other"`); w.Code != 412 {
+		t.Errorf("PUT with wrong If-Match: %d", w.Code)
+	}
+	if w := do("PUT", "f", "second", "If-Match", etag); w.Code != 201 {
+		t.Fatalf("PUT with If-Match: %d", w.Code)
+	}
+	// etag of replaced file doesn't match anymore
+	if w := do("PUT", "f", "third", "If-Match", etag); w.Code != 412 {
+		t.Errorf("PUT with stale If-Match: %d", w.Code)
+	}
+	f, _ = s.stor.Get("f")
+	if w := do("PUT", "f", "third", "If-Match", f.Md5S()); w.Code != 201 {
+		t.Errorf("PUT with md5 in If-Match: %d", w.Code)
+	}
+
+	f, _ = s.stor.Get("f")
+	etag = quoteETag(f.ETag())
+	rename := func(name, newName string, headers ...string) int {
+		headers = append(headers, "X-Http-Method-Override", "RENAME", "X-Ae-Name", newName)
+		return do("POST", name, "", headers...).Code
+	}
+	if st := rename("f", "g", "If-Match", `"other"`); st != 412 {
+		t.Errorf("RENAME with wrong If-Match: %d", st)
+	}
+	do("PUT", "h", "other")
+	if st := rename("f", "h", "If-None-Match", "*", "X-Ae-Force", "1"); st != 412 {
+		t.Errorf("Create-only RENAME to existing name: %d", st)
+	}
+	if st := rename("f", "h", "If-Match", `"other"`, "X-Ae-Force", "1"); st != 412 {
+		t.Errorf("Forced RENAME with wrong If-Match: %d", st)
+	}
+	if _, ok := s.stor.Get("h"); !ok {
+		t.Error("Target was deleted despite failed precondition")
+	}
+	if st := rename("f", "g", "If-Match", etag, "If-None-Match", "*"); st != 204 {
+		t.Errorf("RENAME with If-Match: %d", st)
+	}
+	if st := rename("h", "g", "X-Ae-Force", "1"); st != 204 {
+		t.Errorf("Forced RENAME: %d", st)
+	}
+	if _, ok := s.stor.Get("h"); ok {
+		t.Error("File is not renamed by forced RENAME")
+	}
+	f, _ = s.stor.Get("g")
+	if quoteETag(f.ETag()) == etag {
+		t.Error("Target is not replaced by forced RENAME")
+	}
+	etag = quoteETag(f.ETag())
+
+	if w := do("DELETE", "g", "", "If-Match", `"other"`); w.Code != 412 {
+		t.Errorf("DELETE with wrong If-Match: %d", w.Code)
+	}
+	if _, ok := s.stor.Get("g"); !ok {
+		t.Error("File was deleted despite failed precondition")
+	}
+	if w := do("DELETE", "g", "", "If-Match", etag); w.Code != 204 {
+		t.Errorf("DELETE with If-Match: %d", w.Code)
+	}
+	if w := do("DELETE", "g", "", "If-Match", "*"); w.Code != 412 {
+		t.Errorf("DELETE of missing file with If-Match: %d", w.Code)
+	}
+}
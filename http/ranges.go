@@ -0,0 +1,177 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package http
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Max count of ranges in one request, whole content is sent if there are more
+const MAX_RANGES = 64
+
+var (
+	errRangeInvalid       = errors.New("Invalid range")
+	errRangeUnsatisfiable = errors.New("Range not satisfiable")
+)
+
+type byteRange struct {
+	start, length int64
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.start+br.length-1, size)
+}
+
+func (br byteRange) mimeHeader(ctype string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {br.contentRange(size)},
+		"Content-Type":  {ctype},
+	}
+}
+
+// Parse Range header (RFC 9110 14.1.2). Unsatisfiable ranges are skipped,
+// errRangeUnsatisfiable is returned if nothing left. Invalid header must be ignored
+func parseRange(header string, size int64) (ranges []byteRange, err error) {
+	unit, set, ok := strings.Cut(header, "=")
+	if !ok || strings.ToLower(strings.TrimSpace(unit)) != "bytes" {
+		return nil, errRangeInvalid
+	}
+	for _, spec := range strings.Split(set, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errRangeInvalid
+		}
+		var br byteRange
+		if first == "" {
+			// suffix range
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errRangeInvalid
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			br = byteRange{size - n, n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errRangeInvalid
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+					return nil, errRangeInvalid
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue
+			}
+			br = byteRange{start, end - start + 1}
+		}
+		ranges = append(ranges, br)
+	}
+	if len(ranges) == 0 {
+		return nil, errRangeUnsatisfiable
+	}
+	return
+}
+
+// Return true if ranges are worth serving: not too many and not bigger than content
+func rangesAcceptable(ranges []byteRange, size int64) bool {
+	if len(ranges) > MAX_RANGES {
+		return false
+	}
+	var sum int64
+	for _, br := range ranges {
+		sum += br.length
+	}
+	return sum <= size
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// Body of multipart/byteranges response
+type byteRanges struct {
+	ranges   []byteRange
+	ctype    string
+	size     int64
+	boundary string
+}
+
+func newByteRanges(ranges []byteRange, ctype string, size int64) *byteRanges {
+	return &byteRanges{
+		ranges:   ranges,
+		ctype:    ctype,
+		size:     size,
+		boundary: multipart.NewWriter(io.Discard).Boundary(),
+	}
+}
+
+func (b *byteRanges) ContentType() string {
+	return "multipart/byteranges; boundary=" + b.boundary
+}
+
+// Return size of response body
+func (b *byteRanges) Length() int64 {
+	var w countingWriter
+	var n int64
+	mw := multipart.NewWriter(&w)
+	mw.SetBoundary(b.boundary)
+	for _, br := range b.ranges {
+		mw.CreatePart(br.mimeHeader(b.ctype, b.size))
+		n += br.length
+	}
+	mw.Close()
+	return n + int64(w)
+}
+
+// Write parts with content from r
+func (b *byteRanges) write(w io.Writer, r io.ReaderAt) (err error) {
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(b.boundary)
+	for _, br := range b.ranges {
+		part, err := mw.CreatePart(br.mimeHeader(b.ctype, b.size))
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(part, io.NewSectionReader(r, br.start, br.length)); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
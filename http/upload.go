@@ -0,0 +1,194 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package http
+
+import (
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/module"
+	"github.com/cheggaaa/Anteater/multiupload"
+	"github.com/cheggaaa/Anteater/storage"
+	"net/http"
+	"strconv"
+)
+
+// Resumable upload headers
+const (
+	UPLOAD_ID     = "X-Ae-Upload-Id"
+	UPLOAD_LENGTH = "X-Ae-Upload-Length"
+	UPLOAD_OFFSET = "X-Ae-Upload-Offset"
+)
+
+// Check request for resumable upload headers
+func isUpload(r *http.Request) bool {
+	return r.Header.Get(UPLOAD_ID) != "" || r.Header.Get(UPLOAD_LENGTH) != ""
+}
+
+// Resumable upload protocol:
+//
+//	POST|PUT with X-Ae-Upload-Length - create upload, returns X-Ae-Upload-Id
+//	PATCH with X-Ae-Upload-Id and X-Ae-Upload-Offset - append data, file will be saved when all data received
+//	HEAD with X-Ae-Upload-Id - returns current offset
+//	DELETE with X-Ae-Upload-Id - abort upload
+func (s *Server) Upload(method, name string, w http.ResponseWriter, r *http.Request) {
+	um, err := multiupload.Get(s.stor)
+	if err != nil {
+		aelog.Warnf("Can't init uploads: %v", err)
+		s.Err(500, r, w)
+		return
+	}
+	id := r.Header.Get(UPLOAD_ID)
+	if id == "" {
+		switch method {
+		case "POST", "PUT":
+			s.uploadCreate(um, method, name, w, r)
+		default:
+			s.Err(400, r, w)
+		}
+		return
+	}
+	u, ok := um.Get(id)
+	if !ok || u.Name != name {
+		s.Err(404, r, w)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	switch method {
+	case "PATCH":
+		off, err := strconv.ParseInt(r.Header.Get(UPLOAD_OFFSET), 10, 64)
+		if err != nil || off < 0 {
+			s.Err(400, r, w)
+			return
+		}
+		s.uploadAppend(um, u, off, http.StatusNoContent, w, r)
+	case "HEAD":
+		w.Header().Set(UPLOAD_OFFSET, strconv.FormatInt(u.Offset(), 10))
+		w.Header().Set(UPLOAD_LENGTH, strconv.FormatInt(u.Size, 10))
+		w.WriteHeader(http.StatusNoContent)
+		s.accessLog(http.StatusNoContent, r)
+	case "DELETE":
+		if err = um.Abort(id); err != nil {
+			s.Err(404, r, w)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		s.accessLog(http.StatusNoContent, r)
+	default:
+		s.Err(405, r, w)
+	}
+}
+
+func (s *Server) uploadCreate(um *multiupload.Manager, method, name string, w http.ResponseWriter, r *http.Request) {
+	size, err := strconv.ParseInt(r.Header.Get(UPLOAD_LENGTH), 10, 64)
+	if err != nil || size <= 0 {
+		s.Err(411, r, w)
+		return
+	}
+	if s.conf.MaxFileSize > 0 && size > s.conf.MaxFileSize {
+		s.Err(413, r, w)
+		return
+	}
+	// attributes of file are taken from create request
+	attrs := multiupload.Attrs{
+		Replace: method == "PUT",
+		Meta:    storage.MetaFromHeader(r.Header),
+	}
+	attrs.ContentType, attrs.Disposition = storage.TypeFromHeader(r.Header)
+	if attrs.Expires, err = requestExpires(r); err != nil {
+		s.Err(400, r, w)
+		return
+	}
+	f, ok := s.stor.Get(name)
+	if ok && !attrs.Replace {
+		s.Err(409, r, w)
+		return
+	}
+	// preconditions are checked on create and again atomically with adding to index
+	if cond := writeCondition(r); cond != nil && cond(f) != nil {
+		s.Err(http.StatusPreconditionFailed, r, w)
+		return
+	}
+	attrs.Conditions = writeConditionHeader(r)
+	u, err := um.CreateWith(name, size, attrs)
+	if err == storage.ErrMetaTooBig || err == storage.ErrInvalidType {
+		s.Err(400, r, w)
+		return
+	}
+	if err != nil {
+		aelog.Warnf("Can't create upload for %s: %v", name, err)
+		s.Err(500, r, w)
+		return
+	}
+	w.Header().Set(UPLOAD_ID, u.Id)
+	// first chunk can be sent with create request
+	if r.ContentLength != 0 {
+		s.uploadAppend(um, u, 0, http.StatusCreated, w, r)
+		return
+	}
+	w.Header().Set(UPLOAD_OFFSET, "0")
+	w.WriteHeader(http.StatusCreated)
+	s.accessLog(http.StatusCreated, r)
+}
+
+// Append request body to upload, status will be sent if upload is not complete yet
+func (s *Server) uploadAppend(um *multiupload.Manager, u *multiupload.Upload, off int64, status int, w http.ResponseWriter, r *http.Request) {
+	n, err := u.Append(off, r.Body)
+	if err == multiupload.ErrWrongOffset {
+		w.Header().Set(UPLOAD_OFFSET, strconv.FormatInt(u.Offset(), 10))
+		s.Err(409, r, w)
+		return
+	}
+	if err != nil {
+		// received data stays in upload, client will continue from actual offset
+		aelog.Debugf("Upload %s interrupted: %v", u.Id, err)
+		w.Header().Set(UPLOAD_OFFSET, strconv.FormatInt(u.Offset(), 10))
+		s.Err(500, r, w)
+		return
+	}
+	off += n
+	w.Header().Set(UPLOAD_OFFSET, strconv.FormatInt(off, 10))
+	if off < u.Size {
+		w.WriteHeader(status)
+		s.accessLog(status, r)
+		return
+	}
+	f, err := um.CompleteIf(u.Id, nil, writeCondition(&http.Request{Header: u.Conditions}))
+	switch err {
+	case nil:
+	case storage.ErrFileExists:
+		s.Err(409, r, w)
+		return
+	case storage.ErrPreconditionFailed:
+		s.Err(http.StatusPreconditionFailed, r, w)
+		return
+	case multiupload.ErrUploadRunning:
+		s.Err(409, r, w)
+		return
+	default:
+		aelog.Warnf("Can't complete upload %s: %v", u.Id, err)
+		s.Err(500, r, w)
+		return
+	}
+	w.Header().Set("X-Ae-Md5", f.Md5S())
+	w.Header().Set("ETag", quoteETag(f.ETag()))
+	w.Header().Set("Location", f.Name)
+	if err = module.OnSave(f, w, r, s.stor); err != nil {
+		s.Err(500, r, w)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	s.accessLog(http.StatusCreated, r)
+}
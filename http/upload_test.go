@@ -0,0 +1,115 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package http
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadAttrs(t *testing.T) {
+	s := newTestServer(t)
+	upload := func(name, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PUT", "/"+name, strings.NewReader(body))
+		r.Header.Set(UPLOAD_LENGTH, strconv.Itoa(len(body)))
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		s.ReadWrite(w, r)
+		return w
+	}
+
+	if w := upload("ttl", "content", TTL, "1h"); w.Code != 201 {
+		t.Fatalf("Unexpected upload status: %d", w.Code)
+	}
+	if f, _ := s.stor.Get("ttl"); f.Expires.Before(time.Now().Add(time.Minute*59)) || f.Expires.After(time.Now().Add(time.Hour)) {
+		t.Errorf("Unexpected expiry time: %v", f.Expires)
+	}
+	if w := upload("ttl", "content", TTL, "-1"); w.Code != 400 {
+		t.Errorf("Unexpected status for wrong ttl: %d", w.Code)
+	}
+
+	if w := upload("meta", "content", "X-Ae-Meta-Color", "red"); w.Code != 201 {
+		t.Fatalf("Unexpected upload status: %d", w.Code)
+	}
+	if f, _ := s.stor.Get("meta"); f.Meta()["color"] != "red" {
+		t.Errorf("Unexpected metadata: %v", f.Meta())
+	}
+	if w := upload("meta", "content", "X-Ae-Meta-Big", strings.Repeat("a", 10000)); w.Code != 400 {
+		t.Errorf("Unexpected status for too big metadata: %d", w.Code)
+	}
+
+	if w := upload("type", "content", "Content-Type", "image/png", "Content-Disposition", "attachment"); w.Code != 201 {
+		t.Fatalf("Unexpected upload status: %d", w.Code)
+	}
+	if f, _ := s.stor.Get("type"); f.ContentType() != "image/png" || f.Disposition() != "attachment" {
+		t.Errorf("Unexpected content type: %s, %s", f.ContentType(), f.Disposition())
+	}
+	if w := upload("type", "content", "Content-Disposition", "attachment; ="); w.Code != 400 {
+		t.Errorf("Unexpected status for invalid disposition: %d", w.Code)
+	}
+
+}
+
+func TestConditionalUpload(t *testing.T) {
+	s := newTestServer(t)
+	do := func(method, name, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/"+name, strings.NewReader(body))
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		s.ReadWrite(w, r)
+		return w
+	}
+	do("PUT", "f", "first")
+	f, _ := s.stor.Get("f")
+	etag := quoteETag(f.ETag())
+
+	if w := do("PUT", "f", "second", UPLOAD_LENGTH, "6", "If-Match", `"other"`); w.Code != 412 {
+		t.Errorf("Upload with wrong If-Match: %d", w.Code)
+	}
+	if w := do("PUT", "f", "second", UPLOAD_LENGTH, "6", "If-None-Match", "*"); w.Code != 412 {
+		t.Errorf("Create-only upload of existing file: %d", w.Code)
+	}
+
+	// file is changed while upload is in progress
+	w := do("PUT", "f", "", UPLOAD_LENGTH, "6", "If-Match", etag)
+	if w.Code != 201 {
+		t.Fatalf("Unexpected create status: %d", w.Code)
+	}
+	id := w.Header().Get(UPLOAD_ID)
+	do("PUT", "f", "changed")
+	if w = do("PATCH", "f", "second", UPLOAD_ID, id, UPLOAD_OFFSET, "0"); w.Code != 412 {
+		t.Errorf("Upload completed despite changed file: %d", w.Code)
+	}
+	if f, _ = s.stor.Get("f"); f.FSize != 7 {
+		t.Error("File was replaced despite failed precondition")
+	}
+
+	etag = quoteETag(f.ETag())
+	if w = do("PUT", "f", "second", UPLOAD_LENGTH, "6", "If-Match", etag); w.Code != 201 {
+		t.Errorf("Upload with If-Match: %d", w.Code)
+	}
+	if f, _ = s.stor.Get("f"); f.FSize != 6 {
+		t.Error("File was not replaced")
+	}
+}
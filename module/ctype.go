@@ -0,0 +1,45 @@
+package module
+
+import (
+	"github.com/cheggaaa/Anteater/storage"
+	"net/http"
+)
+
+const (
+	typeCommand = "type"
+)
+
+// Store content type and disposition of existing file
+// Content-Type header sets type, without header detected type is stored
+// Content-Disposition header sets disposition, header with empty value removes it
+type typeUpdate struct{}
+
+func (t typeUpdate) OnSave(file *storage.File, w http.ResponseWriter, r *http.Request, s *storage.Storage) (err error) {
+	return
+}
+
+func (t typeUpdate) OnCommand(command, filename string, w http.ResponseWriter, r *http.Request, s *storage.Storage) (cont bool, err error) {
+	if command != typeCommand {
+		return true, nil
+	}
+	f, ok := s.Get(filename)
+	if !ok {
+		return true, nil
+	}
+	ctype, disposition := storage.TypeFromHeader(r.Header)
+	if ctype == "" {
+		ctype = f.ContentType()
+	}
+	if _, ok = r.Header["Content-Disposition"]; !ok {
+		disposition = f.Disposition()
+	}
+	if _, err = s.SetType(filename, ctype, disposition); err != nil {
+		if err == storage.ErrInvalidType || err == storage.ErrMetaTooBig {
+			w.WriteHeader(http.StatusBadRequest)
+			return false, err
+		}
+		// file was deleted
+		return true, nil
+	}
+	return true, nil
+}
@@ -10,6 +10,7 @@ import (
 
 const (
 	fileListCommand = "filelist"
+	versionsCommand = "versions"
 )
 
 type FileList struct {
@@ -18,11 +19,15 @@ type FileList struct {
 }
 
 type FileInfo struct {
-	Name        string `json:"name"`
-	Size        int64  `json:"size"`
-	ContentType string `json:"content-type,omitmepty"`
-	MD5         string `json:"md5,omitempty"`
-	Modified    int64  `json:"modified,omitempty"`
+	Name        string            `json:"name"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"content-type,omitmepty"`
+	Disposition string            `json:"disposition,omitempty"`
+	MD5         string            `json:"md5,omitempty"`
+	Modified    int64             `json:"modified,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+	VersionId   string            `json:"version-id,omitempty"`
+	Noncurrent  int64             `json:"noncurrent,omitempty"`
 }
 
 type fileList struct{}
@@ -32,6 +37,10 @@ func (fl fileList) OnSave(file *storage.File, w http.ResponseWriter, r *http.Req
 }
 
 func (fl fileList) OnCommand(command, filename string, w http.ResponseWriter, r *http.Request, s *storage.Storage) (cont bool, err error) {
+	if command == versionsCommand {
+		fl.versions(filename, w, s)
+		return false, nil
+	}
 	if command != fileListCommand {
 		return true, nil
 	}
@@ -45,14 +54,17 @@ func (fl fileList) OnCommand(command, filename string, w http.ResponseWriter, r
 	}
 	s.Stats.Counters.Get.Add()
 	response.List = make([]FileInfo, 0)
+	filter := storage.MetaFromHeader(r.Header)
 	for _, fn := range list {
-		if f, ok := s.Get(fn); ok {
+		if f, ok := s.Get(fn); ok && fl.matchMeta(f.Meta(), filter) {
 			response.List = append(response.List, FileInfo{
 				Name:        f.Name[len(filename)+1:],
 				Size:        f.FSize,
 				ContentType: f.ContentType(),
+				Disposition: f.Disposition(),
 				MD5:         f.Md5S(),
 				Modified:    f.Time.Unix(),
+				Meta:        f.Meta(),
 			})
 		}
 	}
@@ -60,6 +72,46 @@ func (fl fileList) OnCommand(command, filename string, w http.ResponseWriter, r
 	return false, nil
 }
 
+// List current file and noncurrent versions of file, newest first
+func (fl fileList) versions(filename string, w http.ResponseWriter, s *storage.Storage) {
+	var response = FileList{List: make([]FileInfo, 0)}
+	s.Stats.Counters.Get.Add()
+	if f, ok := s.Get(filename); ok {
+		response.List = append(response.List, fl.versionInfo(f))
+	}
+	for _, f := range s.Versions(filename) {
+		response.List = append(response.List, fl.versionInfo(f))
+	}
+	s.Stats.Traffic.Output.AddN(fl.jsonResponse(w, response))
+}
+
+func (fl fileList) versionInfo(f *storage.File) FileInfo {
+	info := FileInfo{
+		Name:        f.Name,
+		Size:        f.FSize,
+		ContentType: f.ContentType(),
+		Disposition: f.Disposition(),
+		MD5:         f.Md5S(),
+		Modified:    f.Time.Unix(),
+		Meta:        f.Meta(),
+		VersionId:   f.VersionId(),
+	}
+	if t := f.Noncurrent(); !t.IsZero() {
+		info.Noncurrent = t.Unix()
+	}
+	return info
+}
+
+// Files can be filtered by X-Ae-Meta-* headers, "*" matches any value of key
+func (fl fileList) matchMeta(meta, filter map[string]string) bool {
+	for k, v := range filter {
+		if mv, ok := meta[k]; !ok || (v != "*" && v != mv) {
+			return false
+		}
+	}
+	return true
+}
+
 func (fl fileList) parseNested(r *http.Request) int {
 	if nestedS := r.Header.Get("X-Ae-Filelist-Depth"); nestedS != "" {
 		if nested, _ := strconv.Atoi(nestedS); nested > 0 {
@@ -0,0 +1,48 @@
+package module
+
+import (
+	"github.com/cheggaaa/Anteater/storage"
+	"net/http"
+)
+
+const (
+	metaCommand = "meta"
+)
+
+// Update metadata of file without rewriting content
+// X-Ae-Meta-* headers set values, header with empty value removes key
+type metaUpdate struct{}
+
+func (m metaUpdate) OnSave(file *storage.File, w http.ResponseWriter, r *http.Request, s *storage.Storage) (err error) {
+	return
+}
+
+func (m metaUpdate) OnCommand(command, filename string, w http.ResponseWriter, r *http.Request, s *storage.Storage) (cont bool, err error) {
+	if command != metaCommand {
+		return true, nil
+	}
+	f, ok := s.Get(filename)
+	if !ok {
+		return true, nil
+	}
+	meta := make(map[string]string)
+	for k, v := range f.Meta() {
+		meta[k] = v
+	}
+	for k, v := range storage.MetaFromHeader(r.Header) {
+		if v == "" {
+			delete(meta, k)
+		} else {
+			meta[k] = v
+		}
+	}
+	if _, err = s.SetMeta(filename, meta); err != nil {
+		if err == storage.ErrMetaTooBig {
+			w.WriteHeader(http.StatusBadRequest)
+			return false, err
+		}
+		// file was deleted
+		return true, nil
+	}
+	return true, nil
+}
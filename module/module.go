@@ -29,7 +29,7 @@ type Module interface {
 var modules = make([]Module, 0)
 
 func RegisterModules() {
-	modules = append(modules, unZip{}, fileList{})
+	modules = append(modules, unZip{}, fileList{}, metaUpdate{}, typeUpdate{}, trashRestore{})
 }
 
 func OnSave(file *storage.File, w http.ResponseWriter, r *http.Request, s *storage.Storage) (err error) {
@@ -0,0 +1,29 @@
+package module
+
+import (
+	"github.com/cheggaaa/Anteater/storage"
+	"net/http"
+)
+
+const (
+	restoreCommand = "restore"
+)
+
+// Bring back deleted file from trash
+type trashRestore struct{}
+
+func (t trashRestore) OnSave(file *storage.File, w http.ResponseWriter, r *http.Request, s *storage.Storage) (err error) {
+	return
+}
+
+func (t trashRestore) OnCommand(command, filename string, w http.ResponseWriter, r *http.Request, s *storage.Storage) (cont bool, err error) {
+	if command != restoreCommand {
+		return true, nil
+	}
+	if _, err = s.Restore(filename); err == storage.ErrFileExists {
+		w.WriteHeader(http.StatusConflict)
+		return false, err
+	}
+	// headers of restored file or 404
+	return true, nil
+}
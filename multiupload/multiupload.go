@@ -0,0 +1,528 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+// Resumable uploads. Parts of upload are stored in tmp dir and survive restart,
+// on completion they are assembled to one storage file
+package multiupload
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/storage"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DIR_NAME  = "ae-uploads"
+	META_FILE = "upload.json"
+	MAX_PARTS = 10000
+)
+
+var (
+	ErrNotFound      = errors.New("Upload not found")
+	ErrInvalidPart   = errors.New("Invalid part number")
+	ErrPartNotFound  = errors.New("Part not found")
+	ErrWrongOffset   = errors.New("Wrong upload offset")
+	ErrTooLarge      = errors.New("Upload exceeds maximum file size")
+	ErrIncomplete    = errors.New("Upload is not complete")
+	ErrShortPart     = errors.New("Part is shorter than Content-Length")
+	ErrUploadRunning = errors.New("Upload is in progress")
+	ErrPartOrder     = errors.New("Parts must be in ascending order")
+)
+
+type Manager struct {
+	s       *storage.Storage
+	dir     string
+	m       sync.Mutex
+	uploads map[string]*Upload
+}
+
+var (
+	managers = make(map[*storage.Storage]*Manager)
+	mm       sync.Mutex
+)
+
+// Return upload manager for storage. Manager is created on first call, unfinished uploads are loaded from tmp dir
+func Get(s *storage.Storage) (m *Manager, err error) {
+	mm.Lock()
+	defer mm.Unlock()
+	if m = managers[s]; m != nil {
+		return
+	}
+	tmp := s.Conf.TmpDir
+	if tmp == "" {
+		tmp = os.TempDir()
+	}
+	m = &Manager{
+		s:       s,
+		dir:     filepath.Join(tmp, DIR_NAME),
+		uploads: make(map[string]*Upload),
+	}
+	if err = m.load(); err != nil {
+		return nil, err
+	}
+	managers[s] = m
+	if s.Conf.UploadTTL > 0 {
+		go m.cleanupLoop()
+	}
+	return
+}
+
+// Load unfinished uploads
+func (m *Manager) load() (err error) {
+	if err = os.MkdirAll(m.dir, 0755); err != nil {
+		return
+	}
+	dirs, err := os.ReadDir(m.dir)
+	if err != nil {
+		return
+	}
+	for _, d := range dirs {
+		u := &Upload{m: m}
+		b, e := os.ReadFile(filepath.Join(m.dir, d.Name(), META_FILE))
+		if e == nil {
+			e = json.Unmarshal(b, u)
+		}
+		if e != nil || u.Id != d.Name() {
+			aelog.Warnf("Uploads: remove broken upload %s: %v", d.Name(), e)
+			os.RemoveAll(filepath.Join(m.dir, d.Name()))
+			continue
+		}
+		m.uploads[u.Id] = u
+	}
+	if len(m.uploads) > 0 {
+		aelog.Infof("Uploads: %d unfinished uploads loaded", len(m.uploads))
+	}
+	return
+}
+
+// Start new upload. Size is a total size of file if it known (0 otherwise)
+func (m *Manager) Create(name string, size int64, replace bool) (u *Upload, err error) {
+	return m.CreateWith(name, size, Attrs{Replace: replace})
+}
+
+// Start new upload of file with given attributes
+func (m *Manager) CreateWith(name string, size int64, attrs Attrs) (u *Upload, err error) {
+	if m.tooLarge(size) {
+		return nil, ErrTooLarge
+	}
+	fa := attrs.fileAttrs()
+	if err = fa.Check(); err != nil {
+		return
+	}
+	var id [16]byte
+	if _, err = rand.Read(id[:]); err != nil {
+		return
+	}
+	u = &Upload{
+		Id:      hex.EncodeToString(id[:]),
+		Name:    name,
+		Size:    size,
+		Attrs:   attrs,
+		Created: time.Now(),
+		m:       m,
+	}
+	if err = os.Mkdir(u.dir(), 0755); err != nil {
+		return
+	}
+	if err = u.save(); err != nil {
+		os.RemoveAll(u.dir())
+		return
+	}
+	m.m.Lock()
+	m.uploads[u.Id] = u
+	m.m.Unlock()
+	return
+}
+
+func (m *Manager) tooLarge(size int64) bool {
+	return m.s.Conf.MaxFileSize > 0 && size > m.s.Conf.MaxFileSize
+}
+
+func (m *Manager) Get(id string) (u *Upload, ok bool) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	u, ok = m.uploads[id]
+	return
+}
+
+// Return all unfinished uploads sorted by creation time
+func (m *Manager) List() (uploads []*Upload) {
+	m.m.Lock()
+	for _, u := range m.uploads {
+		uploads = append(uploads, u)
+	}
+	m.m.Unlock()
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].Created.Before(uploads[j].Created) })
+	return
+}
+
+// Remove upload and all its parts
+func (m *Manager) Abort(id string) (err error) {
+	m.m.Lock()
+	u, ok := m.uploads[id]
+	delete(m.uploads, id)
+	m.m.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return os.RemoveAll(u.dir())
+}
+
+func (m *Manager) cleanupLoop() {
+	for {
+		time.Sleep(time.Minute)
+		for _, u := range m.List() {
+			if time.Since(u.Updated()) > m.s.Conf.UploadTTL {
+				aelog.Infof("Uploads: remove expired upload %s (%s)", u.Id, u.Name)
+				m.Abort(u.Id)
+			}
+		}
+	}
+}
+
+// Attributes of file, applied on completion
+type Attrs struct {
+	Replace     bool              `json:"replace"`
+	Expires     time.Time         `json:"expires"`
+	Meta        map[string]string `json:"meta,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Disposition string            `json:"disposition,omitempty"`
+	// request headers of preconditions, checked by server on completion
+	Conditions http.Header `json:"conditions,omitempty"`
+}
+
+// Return attributes for storage
+func (a Attrs) fileAttrs() storage.FileAttrs {
+	return storage.FileAttrs{
+		Replace:     a.Replace,
+		Expires:     a.Expires,
+		Meta:        a.Meta,
+		ContentType: a.ContentType,
+		Disposition: a.Disposition,
+	}
+}
+
+type Upload struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Attrs
+	Created time.Time `json:"created"`
+
+	m       *Manager
+	mu      sync.Mutex
+	updated time.Time
+}
+
+type Part struct {
+	Number int
+	Size   int64
+	Md5    []byte
+	Time   time.Time
+}
+
+func (u *Upload) dir() string {
+	return filepath.Join(u.m.dir, u.Id)
+}
+
+func (u *Upload) partName(n int) string {
+	return filepath.Join(u.dir(), fmt.Sprintf("%d.part", n))
+}
+
+func (u *Upload) md5Name(n int) string {
+	return filepath.Join(u.dir(), fmt.Sprintf("%d.md5", n))
+}
+
+func (u *Upload) save() error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(u.dir(), META_FILE), b, 0644)
+}
+
+// Time of last change
+func (u *Upload) Updated() time.Time {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.updated.IsZero() {
+		u.updated = u.Created
+		for _, p := range u.parts() {
+			if p.Time.After(u.updated) {
+				u.updated = p.Time
+			}
+		}
+	}
+	return u.updated
+}
+
+// Write part with number n. Existing part will be replaced
+func (u *Upload) WritePart(n int, r io.Reader, size int64) (p *Part, err error) {
+	return u.WritePartIf(n, r, size, nil)
+}
+
+// Write part with number n if check returns nil for received part, existing part is kept otherwise
+func (u *Upload) WritePartIf(n int, r io.Reader, size int64, check func(p *Part) error) (p *Part, err error) {
+	if n < 1 || n > MAX_PARTS {
+		return nil, ErrInvalidPart
+	}
+	if u.m.tooLarge(size) {
+		return nil, ErrTooLarge
+	}
+	tmp, err := os.CreateTemp(u.dir(), "tmp-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	h := md5.New()
+	w, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(r, size))
+	if err != nil {
+		return
+	}
+	if w != size {
+		return nil, ErrShortPart
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	p = &Part{Number: n, Size: size, Md5: h.Sum(nil)}
+	if check != nil {
+		if err = check(p); err != nil {
+			return nil, err
+		}
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	os.Remove(u.md5Name(n))
+	if err = os.Rename(tmp.Name(), u.partName(n)); err != nil {
+		return nil, err
+	}
+	// md5 of part is cached for listing and completion
+	if e := os.WriteFile(u.md5Name(n), []byte(hex.EncodeToString(p.Md5)), 0644); e != nil {
+		aelog.Debugf("Uploads: can't save md5 of part %d of %s: %v", n, u.Id, e)
+	}
+	u.updated = time.Now()
+	p.Time = u.updated
+	return
+}
+
+// Current size of the first part, used for offset-based (tus-style) uploads
+func (u *Upload) Offset() int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if info, err := os.Stat(u.partName(1)); err == nil {
+		return info.Size()
+	}
+	return 0
+}
+
+// Append data to the first part. Offset must be equal to current size of part
+// If connection breaks, all received data stays in part, so client can continue from new offset
+func (u *Upload) Append(off int64, r io.Reader) (n int64, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	fh, err := os.OpenFile(u.partName(1), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	info, err := fh.Stat()
+	if err != nil {
+		return
+	}
+	if info.Size() != off {
+		return 0, ErrWrongOffset
+	}
+	if _, err = fh.Seek(off, 0); err != nil {
+		return
+	}
+	os.Remove(u.md5Name(1))
+	if u.Size > 0 {
+		r = io.LimitReader(r, u.Size-off)
+	} else if max := u.m.s.Conf.MaxFileSize; max > 0 {
+		r = io.LimitReader(r, max-off)
+	}
+	n, err = io.Copy(fh, r)
+	u.updated = time.Now()
+	if e := fh.Sync(); err == nil {
+		err = e
+	}
+	return
+}
+
+// Return all uploaded parts sorted by number
+func (u *Upload) Parts() (parts []*Part) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.parts()
+}
+
+func (u *Upload) parts() (parts []*Part) {
+	entries, err := os.ReadDir(u.dir())
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		n, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".part"))
+		if err != nil || !strings.HasSuffix(e.Name(), ".part") {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			parts = append(parts, &Part{Number: n, Size: info.Size(), Time: info.ModTime()})
+		}
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return
+}
+
+// Return md5 of part
+func (u *Upload) PartMd5(n int) (md5s []byte, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if b, e := os.ReadFile(u.md5Name(n)); e == nil {
+		if md5s, e = hex.DecodeString(string(b)); e == nil && len(md5s) == md5.Size {
+			return
+		}
+	}
+	fh, err := os.Open(u.partName(n))
+	if err != nil {
+		return nil, ErrPartNotFound
+	}
+	defer fh.Close()
+	h := md5.New()
+	if _, err = io.Copy(h, fh); err != nil {
+		return
+	}
+	return h.Sum(nil), nil
+}
+
+// Assemble given parts (all uploaded parts if numbers is nil) to storage file and remove upload
+func (m *Manager) Complete(id string, numbers []int) (f *storage.File, err error) {
+	return m.CompleteIf(id, numbers, nil)
+}
+
+// Complete upload if cond returns nil for existing file, check and adding to index are atomic
+func (m *Manager) CompleteIf(id string, numbers []int, cond storage.Condition) (f *storage.File, err error) {
+	u, ok := m.Get(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !u.mu.TryLock() {
+		return nil, ErrUploadRunning
+	}
+	defer u.mu.Unlock()
+
+	if numbers == nil {
+		for _, p := range u.parts() {
+			numbers = append(numbers, p.Number)
+		}
+	}
+	if len(numbers) == 0 {
+		return nil, ErrIncomplete
+	}
+	var size int64
+	for i, n := range numbers {
+		if i > 0 && n <= numbers[i-1] {
+			return nil, ErrPartOrder
+		}
+		info, e := os.Stat(u.partName(n))
+		if e != nil {
+			return nil, ErrPartNotFound
+		}
+		size += info.Size()
+	}
+	if u.Size > 0 && size != u.Size {
+		return nil, ErrIncomplete
+	}
+	if m.tooLarge(size) {
+		return nil, ErrTooLarge
+	}
+	if size == 0 {
+		return nil, ErrIncomplete
+	}
+	if !u.Replace {
+		if _, exists := m.s.Get(u.Name); exists {
+			return nil, storage.ErrFileExists
+		}
+	}
+	// md5 will be calculated by storage while writing
+	pr := &partsReader{u: u, numbers: numbers}
+	attrs := u.fileAttrs()
+	attrs.Cond = cond
+	f, err = m.s.AddWith(u.Name, pr, size, attrs)
+	pr.Close()
+	if err != nil {
+		return
+	}
+	m.m.Lock()
+	delete(m.uploads, u.Id)
+	m.m.Unlock()
+	if e := os.RemoveAll(u.dir()); e != nil {
+		aelog.Warnf("Uploads: can't remove upload %s: %v", u.Id, e)
+	}
+	return
+}
+
+// Sequential reader of parts, only one part file is opened at a time
+type partsReader struct {
+	u       *Upload
+	numbers []int
+	fh      *os.File
+}
+
+func (r *partsReader) Read(p []byte) (n int, err error) {
+	for r.fh != nil || len(r.numbers) > 0 {
+		if r.fh == nil {
+			if r.fh, err = os.Open(r.u.partName(r.numbers[0])); err != nil {
+				return
+			}
+			r.numbers = r.numbers[1:]
+		}
+		if n, err = r.fh.Read(p); err == io.EOF {
+			r.Close()
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return
+		}
+	}
+	return 0, io.EOF
+}
+
+func (r *partsReader) Close() (err error) {
+	if r.fh != nil {
+		err = r.fh.Close()
+		r.fh = nil
+	}
+	return
+}
@@ -0,0 +1,175 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package multiupload
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/config"
+	"github.com/cheggaaa/Anteater/storage"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStorage(t *testing.T) *storage.Storage {
+	if aelog.DefaultLogger == nil {
+		aelog.InitDefault(aelog.LOG_WARN)
+	}
+	s := new(storage.Storage)
+	s.Init(&config.Config{
+		ContainerSize: 1024 * 1024 * 10,
+		DataPath:      t.TempDir() + "/",
+		TmpDir:        t.TempDir(),
+		FileHeaders:   true,
+	})
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestResumableUpload(t *testing.T) {
+	s := newTestStorage(t)
+	defer s.Close()
+	m, err := Get(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := strings.Repeat("0123456789", 1000)
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	u, err := m.CreateWith("dir/file", int64(len(data)), Attrs{
+		Expires:     expires,
+		Meta:        map[string]string{"color": "red"},
+		ContentType: "text/csv",
+		Disposition: "attachment",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := u.Append(0, strings.NewReader(data[:3000])); err != nil || n != 3000 {
+		t.Fatalf("Unexpected append result: %d %v", n, err)
+	}
+	if _, err = u.Append(1000, strings.NewReader(data)); err != ErrWrongOffset {
+		t.Errorf("Expected ErrWrongOffset, got %v", err)
+	}
+
+	// restart: upload must be loaded from tmp dir
+	m2 := &Manager{s: s, dir: m.dir, uploads: make(map[string]*Upload)}
+	if err = m2.load(); err != nil {
+		t.Fatal(err)
+	}
+	u2, ok := m2.Get(u.Id)
+	if !ok || u2.Name != "dir/file" || u2.Offset() != 3000 {
+		t.Fatalf("Upload was not restored: %+v", u2)
+	}
+	if _, err = m2.Complete(u.Id, nil); err != ErrIncomplete {
+		t.Errorf("Expected ErrIncomplete, got %v", err)
+	}
+	// data over declared length must be ignored
+	if _, err = u2.Append(3000, strings.NewReader(data[3000:]+"tail")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := m2.Complete(u.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Expires.Equal(expires) {
+		t.Errorf("Unexpected expiry time: %v", f.Expires)
+	}
+	if f.Meta()["color"] != "red" {
+		t.Errorf("Unexpected metadata: %v", f.Meta())
+	}
+	if ctype, disposition := f.StoredType(); ctype != "text/csv" || disposition != "attachment" {
+		t.Errorf("Unexpected content type: %s, %s", ctype, disposition)
+	}
+	if f.Md5S() != fmt.Sprintf("%x", md5.Sum([]byte(data))) {
+		t.Errorf("Unexpected md5: %s", f.Md5S())
+	}
+	if _, ok = m2.Get(u.Id); ok {
+		t.Error("Upload was not removed after completion")
+	}
+	b, _ := io.ReadAll(f.GetReader())
+	if string(b) != data {
+		t.Error("Unexpected file content")
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	s := newTestStorage(t)
+	defer s.Close()
+	m, err := Get(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := m.Create("file", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = u.WritePart(0, strings.NewReader("a"), 1); err != ErrInvalidPart {
+		t.Errorf("Expected ErrInvalidPart, got %v", err)
+	}
+	if _, err = u.WritePart(1, strings.NewReader("a"), 2); err != ErrShortPart {
+		t.Errorf("Expected ErrShortPart, got %v", err)
+	}
+	for i, p := range []string{"first", "second", "third"} {
+		part, err := u.WritePart(i+1, strings.NewReader(p), int64(len(p)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md5s, _ := u.PartMd5(i + 1); fmt.Sprintf("%x", md5s) != fmt.Sprintf("%x", part.Md5) {
+			t.Errorf("Unexpected part md5: %x", md5s)
+		}
+	}
+	// part failed check doesn't replace existing one
+	failed := errors.New("failed")
+	if _, err = u.WritePartIf(1, strings.NewReader("broken"), 6, func(p *Part) error { return failed }); err != failed {
+		t.Errorf("Expected check error, got %v", err)
+	}
+	if md5s, _ := u.PartMd5(1); fmt.Sprintf("%x", md5s) != fmt.Sprintf("%x", md5.Sum([]byte("first"))) {
+		t.Error("Part was replaced despite failed check")
+	}
+	if parts := u.Parts(); len(parts) != 3 || parts[1].Size != 6 {
+		t.Errorf("Unexpected parts: %v", parts)
+	}
+	if _, err = m.Complete(u.Id, []int{1, 4}); err != ErrPartNotFound {
+		t.Errorf("Expected ErrPartNotFound, got %v", err)
+	}
+	for _, numbers := range [][]int{{3, 1}, {1, 1, 3}} {
+		if _, err = m.Complete(u.Id, numbers); err != ErrPartOrder {
+			t.Errorf("Expected ErrPartOrder for %v, got %v", numbers, err)
+		}
+	}
+	f, err := m.Complete(u.Id, []int{1, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(f.GetReader()); string(b) != "firstthird" {
+		t.Errorf("Unexpected content: %s", b)
+	}
+
+	u, _ = m.Create("file2", 0, false)
+	if err = m.Abort(u.Id); err != nil {
+		t.Error(err)
+	}
+	if len(m.List()) != 0 {
+		t.Error("Aborted upload still exists")
+	}
+}
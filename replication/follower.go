@@ -0,0 +1,318 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package replication
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/aerpc/rpcclient"
+	"github.com/cheggaaa/Anteater/stats"
+	"github.com/cheggaaa/Anteater/storage"
+	"io"
+	"net/rpc"
+	"os"
+	"time"
+)
+
+// File in data path with the last applied position
+const StateFile = "replication.state"
+
+const (
+	eventsBatch = 1000
+	pollWait    = 10 * time.Second
+	retryDelay  = 5 * time.Second
+	readSize    = 1024 * 1024
+)
+
+// Position of follower in primary changes stream
+type State struct {
+	Epoch   int64 `json:"epoch"`
+	Version int64 `json:"version"`
+}
+
+type Follower struct {
+	s     *storage.Storage
+	addr  string
+	state State
+}
+
+// Start applying changes from primary in background
+func StartFollower(s *storage.Storage) (fl *Follower) {
+	fl = NewFollower(s, s.Conf.ReplicationPrimary)
+	go fl.run()
+	return
+}
+
+func NewFollower(s *storage.Storage, addr string) (fl *Follower) {
+	fl = &Follower{s: s, addr: addr}
+	if b, err := os.ReadFile(fl.stateName()); err == nil {
+		if err = json.Unmarshal(b, &fl.state); err != nil {
+			aelog.Warnf("Replication: can't read state: %v", err)
+		}
+	}
+	s.Stats.UpdateReplication(func(st *stats.Replication) {
+		st.Role = s.Conf.ReplicationRole
+		st.Primary = addr
+		st.Epoch, st.Version = fl.state.Epoch, fl.state.Version
+	})
+	return
+}
+
+func (fl *Follower) State() State {
+	return fl.state
+}
+
+func (fl *Follower) run() {
+	for {
+		client, err := rpcclient.NewClient(fl.addr)
+		if err == nil {
+			for err == nil {
+				_, err = fl.Sync(client, pollWait)
+			}
+			client.Close()
+		}
+		fl.s.Stats.UpdateReplication(func(st *stats.Replication) {
+			st.Errors++
+			st.LastError = err.Error()
+		})
+		aelog.Warnf("Replication: %v", err)
+		time.Sleep(retryDelay)
+	}
+}
+
+// Request changes from primary and apply them. Return count of applied changes
+// Must not be called concurrently
+func (fl *Follower) Sync(client *rpc.Client, wait time.Duration) (n int, err error) {
+	args := &EventsArgs{
+		Epoch:   fl.state.Epoch,
+		Version: fl.state.Version,
+		Limit:   eventsBatch,
+		Wait:    wait,
+	}
+	reply := &EventsReply{}
+	if err = client.Call("Storage.ReplicationEvents", args, reply); err != nil {
+		return
+	}
+	if reply.Reset {
+		return fl.catchUp(client)
+	}
+	for _, e := range reply.Events {
+		if err = fl.apply(client, e); err != nil {
+			return
+		}
+		fl.state.Version = e.Version
+		n++
+	}
+	fl.s.Stats.UpdateReplication(func(st *stats.Replication) {
+		st.Applied += int64(n)
+		st.Version, st.PrimaryVersion = fl.state.Version, reply.Version
+		st.Lag = reply.Version - fl.state.Version
+		st.LastSync = time.Now()
+		st.LastError = ""
+		if st.Lag > 0 && len(reply.Events) > 0 {
+			st.LagTime = time.Since(reply.Events[len(reply.Events)-1].Time)
+		} else {
+			st.LagTime = 0
+		}
+	})
+	if n > 0 {
+		err = fl.saveState()
+	}
+	return
+}
+
+// Apply one change. Changes can be applied more than once
+func (fl *Follower) apply(client *rpc.Client, e *storage.Event) (err error) {
+	switch e.Op {
+	case storage.EVENT_ADD:
+		err = fl.fetch(client, eventInfo(e, e.Name))
+	case storage.EVENT_DELETE:
+		fl.s.Delete(e.Name)
+	case storage.EVENT_UPDATE:
+		err = fl.fetch(client, eventInfo(e, e.Name))
+	case storage.EVENT_RENAME:
+		if f, ok := fl.s.Get(e.Name); ok && bytes.Equal(f.Md5, e.Md5) {
+			fl.s.Delete(e.NewName)
+			if _, err = fl.s.Rename(e.Name, e.NewName); err == nil {
+				return
+			}
+		}
+		fl.s.Delete(e.Name)
+		err = fl.fetch(client, eventInfo(e, e.NewName))
+	}
+	return
+}
+
+// Copy file from primary if local file is not the same
+func (fl *Follower) fetch(client *rpc.Client, fi FileInfo) (err error) {
+	if f, ok := fl.s.Get(fi.Name); ok {
+		if bytes.Equal(f.Md5, fi.Md5) {
+			if !sameMeta(f.Meta(), fi.Meta) {
+				if _, err = fl.s.SetMeta(fi.Name, fi.Meta); err != nil {
+					return
+				}
+			}
+			if !sameType(f, fi) {
+				_, err = fl.s.SetType(fi.Name, fi.ContentType, fi.Disposition)
+			}
+			return
+		}
+	}
+	rd := &remoteReader{client: client, name: fi.Name, md5: fi.Md5, size: fi.Size}
+	f, err := fl.s.AddWith(fi.Name, rd, fi.Size, storage.FileAttrs{
+		Time:        fi.Time,
+		Expires:     fi.Expires,
+		Meta:        fi.Meta,
+		ContentType: fi.ContentType,
+		Disposition: fi.Disposition,
+		Replace:     true,
+	})
+	if err != nil {
+		if rd.changed {
+			// will be fixed by next changes
+			return nil
+		}
+		return fmt.Errorf("Can't copy %s: %v", fi.Name, err)
+	}
+	if !bytes.Equal(f.Md5, fi.Md5) {
+		fl.s.Delete(fi.Name)
+		return fmt.Errorf("Can't copy %s: MD5 mismatched: %s vs %x", fi.Name, f.Md5S(), fi.Md5)
+	}
+	return
+}
+
+// Full resync with primary
+func (fl *Follower) catchUp(client *rpc.Client) (n int, err error) {
+	st := time.Now()
+	aelog.Infof("Replication: full resync with %s", fl.addr)
+	list := &ListReply{}
+	if err = client.Call("Storage.ReplicationList", true, list); err != nil {
+		return
+	}
+	remote := make(map[string]bool, len(list.Files))
+	for _, fi := range list.Files {
+		remote[fi.Name] = true
+	}
+	names, err := fl.s.Index.List("", 0)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if !remote[name] && fl.s.Delete(name) {
+			n++
+		}
+	}
+	for _, fi := range list.Files {
+		if f, ok := fl.s.Get(fi.Name); ok && bytes.Equal(f.Md5, fi.Md5) && sameMeta(f.Meta(), fi.Meta) && sameType(f, fi) {
+			continue
+		}
+		if err = fl.fetch(client, fi); err != nil {
+			return
+		}
+		n++
+	}
+	fl.state = State{Epoch: list.Epoch, Version: list.Version}
+	fl.s.Stats.UpdateReplication(func(st *stats.Replication) {
+		st.CatchUps++
+		st.Epoch, st.Version = list.Epoch, list.Version
+	})
+	aelog.Infof("Replication: resync done, %d files changed for a %v", n, time.Since(st))
+	err = fl.saveState()
+	return
+}
+
+// Return FileInfo of file changed by event
+func eventInfo(e *storage.Event, name string) FileInfo {
+	return FileInfo{
+		Name:        name,
+		Md5:         e.Md5,
+		Size:        e.Size,
+		Time:        e.Time,
+		Expires:     e.Expires,
+		Meta:        e.Meta,
+		ContentType: e.ContentType,
+		Disposition: e.Disposition,
+	}
+}
+
+func sameType(f *storage.File, fi FileInfo) bool {
+	ctype, disposition := f.StoredType()
+	return ctype == fi.ContentType && disposition == fi.Disposition
+}
+
+func sameMeta(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (fl *Follower) stateName() string {
+	return fl.s.Conf.DataPath + StateFile
+}
+
+func (fl *Follower) saveState() (err error) {
+	b, err := json.Marshal(fl.state)
+	if err != nil {
+		return
+	}
+	tmp := fl.stateName() + ".tmp"
+	if err = os.WriteFile(tmp, b, 0644); err != nil {
+		return
+	}
+	return os.Rename(tmp, fl.stateName())
+}
+
+// Read file content from primary by chunks
+type remoteReader struct {
+	client  *rpc.Client
+	name    string
+	md5     []byte
+	size    int64
+	off     int64
+	buf     []byte
+	changed bool
+}
+
+func (r *remoteReader) Read(p []byte) (n int, err error) {
+	if len(r.buf) == 0 {
+		if r.off >= r.size {
+			return 0, io.EOF
+		}
+		args := &ReadArgs{Name: r.name, Md5: r.md5, Offset: r.off, Limit: readSize}
+		if err = r.client.Call("Storage.ReplicationRead", args, &r.buf); err != nil {
+			if err.Error() == ErrFileChanged.Error() {
+				r.changed = true
+			}
+			return
+		}
+		if len(r.buf) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		r.off += int64(len(r.buf))
+	}
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return
+}
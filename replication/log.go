@@ -0,0 +1,107 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package replication
+
+import (
+	"github.com/cheggaaa/Anteater/storage"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Ring buffer of last index changes on primary
+type Log struct {
+	// unique id of log, changes after every primary restart because index version is not persistent
+	Epoch  int64
+	events []*storage.Event
+	// position of the oldest event
+	start, count int
+	// index version before the oldest event
+	base   int64
+	m      sync.Mutex
+	notify chan struct{}
+}
+
+func NewLog(size int, version int64) *Log {
+	return &Log{
+		Epoch:  time.Now().UnixNano(),
+		events: make([]*storage.Event, size),
+		base:   version,
+		notify: make(chan struct{}),
+	}
+}
+
+func (l *Log) Append(e *storage.Event) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.count == len(l.events) {
+		l.base = l.events[l.start].Version
+		l.start = (l.start + 1) % len(l.events)
+		l.count--
+	}
+	l.events[(l.start+l.count)%len(l.events)] = e
+	l.count++
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// Return current version
+func (l *Log) Version() int64 {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.version()
+}
+
+func (l *Log) version() int64 {
+	if l.count == 0 {
+		return l.base
+	}
+	return l.events[(l.start+l.count-1)%len(l.events)].Version
+}
+
+// Return up to limit events made after version
+// If there are no such events - wait for them up to wait duration
+// ok will be false if events after version already dropped from log
+func (l *Log) Since(version int64, limit int, wait time.Duration) (events []*storage.Event, ok bool) {
+	l.m.Lock()
+	if version < l.base {
+		l.m.Unlock()
+		return
+	}
+	if version >= l.version() && wait > 0 {
+		ch := l.notify
+		l.m.Unlock()
+		select {
+		case <-ch:
+		case <-time.After(wait):
+		}
+		l.m.Lock()
+		if version < l.base {
+			l.m.Unlock()
+			return
+		}
+	}
+	defer l.m.Unlock()
+	// versions are increasing
+	i := sort.Search(l.count, func(i int) bool {
+		return l.events[(l.start+i)%len(l.events)].Version > version
+	})
+	for ; i < l.count && len(events) < limit; i++ {
+		events = append(events, l.events[(l.start+i)%len(l.events)])
+	}
+	return events, true
+}
@@ -0,0 +1,166 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package replication
+
+import (
+	"bytes"
+	"errors"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/stats"
+	"github.com/cheggaaa/Anteater/storage"
+	"time"
+)
+
+// Max values requested by followers
+const (
+	MAX_EVENTS    = 10000
+	MAX_READ_SIZE = 4 * 1024 * 1024
+	MAX_WAIT      = time.Minute
+)
+
+var (
+	ErrNotPrimary  = errors.New("Replication: node is not a primary")
+	ErrFileChanged = errors.New("Replication: file was changed or deleted")
+)
+
+type EventsArgs struct {
+	Epoch   int64
+	Version int64
+	Limit   int
+	Wait    time.Duration
+}
+
+type EventsReply struct {
+	Epoch   int64
+	Version int64
+	// follower must do full resync
+	Reset  bool
+	Events []*storage.Event
+}
+
+type FileInfo struct {
+	Name    string
+	Md5     []byte
+	Size    int64
+	Time    time.Time
+	Expires time.Time
+	Meta    map[string]string
+	// content type and disposition supplied by uploader
+	ContentType string
+	Disposition string
+}
+
+type ListReply struct {
+	Epoch   int64
+	Version int64
+	Files   []FileInfo
+}
+
+type ReadArgs struct {
+	Name   string
+	Md5    []byte
+	Offset int64
+	Limit  int
+}
+
+var primaryLog *Log
+
+// Start collecting index changes for followers
+func StartPrimary(s *storage.Storage) {
+	primaryLog = NewLog(s.Conf.ReplicationLogSize, s.Index.Version())
+	s.Index.SetListener(primaryLog.Append)
+	s.Stats.UpdateReplication(func(st *stats.Replication) {
+		st.Role = s.Conf.ReplicationRole
+		st.Epoch = primaryLog.Epoch
+	})
+	aelog.Infof("Replication: primary started, epoch %d", primaryLog.Epoch)
+}
+
+// Return changes made after args.Version
+func Events(s *storage.Storage, args *EventsArgs, reply *EventsReply) error {
+	if primaryLog == nil {
+		return ErrNotPrimary
+	}
+	if args.Limit <= 0 || args.Limit > MAX_EVENTS {
+		args.Limit = MAX_EVENTS
+	}
+	if args.Wait > MAX_WAIT {
+		args.Wait = MAX_WAIT
+	}
+	reply.Epoch = primaryLog.Epoch
+	if args.Epoch != primaryLog.Epoch {
+		reply.Reset = true
+	} else {
+		var ok bool
+		reply.Events, ok = primaryLog.Since(args.Version, args.Limit, args.Wait)
+		reply.Reset = !ok
+	}
+	reply.Version = primaryLog.Version()
+	return nil
+}
+
+// Return list of all files. Version of the list is taken before listing,
+// so changes made after it can be already in list
+func List(s *storage.Storage, reply *ListReply) (err error) {
+	if primaryLog == nil {
+		return ErrNotPrimary
+	}
+	reply.Epoch = primaryLog.Epoch
+	reply.Version = primaryLog.Version()
+	names, err := s.Index.List("", 0)
+	if err != nil {
+		return
+	}
+	reply.Files = make([]FileInfo, 0, len(names))
+	for _, name := range names {
+		if f, ok := s.Get(name); ok {
+			fi := FileInfo{Name: name, Md5: f.Md5, Size: f.FSize, Time: f.Time, Expires: f.Expires, Meta: f.Meta()}
+			fi.ContentType, fi.Disposition = f.StoredType()
+			reply.Files = append(reply.Files, fi)
+		}
+	}
+	return
+}
+
+// Read part of file content. Return ErrFileChanged if file with given md5 is not exists now
+func Read(s *storage.Storage, args *ReadArgs, reply *[]byte) (err error) {
+	f, ok := s.Get(args.Name)
+	if !ok || !bytes.Equal(f.Md5, args.Md5) {
+		return ErrFileChanged
+	}
+	if err = f.Open(); err != nil {
+		return ErrFileChanged
+	}
+	defer f.Close()
+	if args.Limit <= 0 || args.Limit > MAX_READ_SIZE {
+		args.Limit = MAX_READ_SIZE
+	}
+	if args.Offset < 0 || args.Offset >= f.FSize {
+		*reply = nil
+		return
+	}
+	n := f.FSize - args.Offset
+	if n > int64(args.Limit) {
+		n = int64(args.Limit)
+	}
+	buf := make([]byte, n)
+	if _, err = f.GetReader().ReadAt(buf, args.Offset); err != nil {
+		return
+	}
+	*reply = buf
+	return
+}
@@ -0,0 +1,173 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package replication
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/aerpc/rpcclient"
+	"github.com/cheggaaa/Anteater/config"
+	"github.com/cheggaaa/Anteater/storage"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/rpc"
+	"testing"
+)
+
+// rpc methods of primary, same as in rpcserver
+type testPrimary struct {
+	s *storage.Storage
+}
+
+func (p *testPrimary) ReplicationEvents(args *EventsArgs, reply *EventsReply) error {
+	return Events(p.s, args, reply)
+}
+
+func (p *testPrimary) ReplicationList(args *bool, reply *ListReply) error {
+	return List(p.s, reply)
+}
+
+func (p *testPrimary) ReplicationRead(args *ReadArgs, reply *[]byte) error {
+	return Read(p.s, args, reply)
+}
+
+func newTestStorage(t *testing.T, role string) *storage.Storage {
+	if aelog.DefaultLogger == nil {
+		aelog.InitDefault(aelog.LOG_WARN)
+	}
+	s := new(storage.Storage)
+	s.Init(&config.Config{
+		ContainerSize:      1024 * 1024 * 10,
+		DataPath:           t.TempDir() + "/",
+		ReplicationRole:    role,
+		ReplicationLogSize: 10,
+	})
+	if err := s.Open(); err != nil {
+		t.Fatalf("Can't open storage: %v", err)
+	}
+	return s
+}
+
+func addFile(t *testing.T, s *storage.Storage, name string) {
+	b := make([]byte, rand.Intn(10000)+1)
+	rand.Read(b)
+	if _, err := s.Add(name, bytes.NewReader(b), int64(len(b))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkSame(t *testing.T, p, f *storage.Storage) {
+	names, _ := p.Index.List("", 0)
+	if int64(len(names)) != f.Index.Count() {
+		t.Errorf("Files count mismatched: %d vs %d", len(names), f.Index.Count())
+	}
+	for _, name := range names {
+		pf, _ := p.Get(name)
+		ff, ok := f.Get(name)
+		if !ok {
+			t.Errorf("File %s not replicated", name)
+		} else if !bytes.Equal(pf.Md5, ff.Md5) || !pf.Time.Equal(ff.Time) {
+			t.Errorf("File %s replicated with wrong content or time", name)
+		}
+	}
+}
+
+func TestReplication(t *testing.T) {
+	p := newTestStorage(t, config.REPLICATION_PRIMARY)
+	defer p.Close()
+	for i := 0; i < 20; i++ {
+		addFile(t, p, fmt.Sprint(i))
+	}
+	StartPrimary(p)
+
+	srv := rpc.NewServer()
+	srv.RegisterName("Storage", &testPrimary{p})
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, srv)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, mux)
+	client, err := rpcclient.NewClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	f := newTestStorage(t, config.REPLICATION_FOLLOWER)
+	defer f.Close()
+	fl := NewFollower(f, l.Addr().String())
+	// stats are read while follower applies changes
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				f.Stats.GetReplication()
+			}
+		}
+	}()
+
+	// initial resync
+	if _, err = fl.Sync(client, 0); err != nil {
+		t.Fatal(err)
+	}
+	checkSame(t, p, f)
+	if f.GetStats().Replication.CatchUps != 1 {
+		t.Errorf("Expected full resync, got %+v", f.GetStats().Replication)
+	}
+
+	// changes
+	addFile(t, p, "new1")
+	addFile(t, p, "new2")
+	p.Delete("1")
+	p.Rename("2", "renamed")
+	p.Delete("3")
+	addFile(t, p, "3")
+	n, err := fl.Sync(client, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 || f.GetStats().Replication.Lag != 0 || fl.State().Version != p.Index.Version() {
+		t.Errorf("Unexpected sync result: %d, %+v", n, f.GetStats().Replication)
+	}
+	checkSame(t, p, f)
+
+	// follower fell behind the log
+	for i := 0; i < 15; i++ {
+		addFile(t, p, fmt.Sprint("more", i))
+	}
+	if _, err = fl.Sync(client, 0); err != nil {
+		t.Fatal(err)
+	}
+	checkSame(t, p, f)
+	if f.GetStats().Replication.CatchUps != 2 {
+		t.Errorf("Expected full resync, got %+v", f.GetStats().Replication)
+	}
+
+	// state must be restored after restart
+	if fl2 := NewFollower(f, l.Addr().String()); fl2.State() != fl.State() {
+		t.Errorf("State was not saved: %+v vs %+v", fl2.State(), fl.State())
+	}
+}
@@ -0,0 +1,262 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4
+const (
+	SIGN_ALGORITHM    = "AWS4-HMAC-SHA256"
+	UNSIGNED_PAYLOAD  = "UNSIGNED-PAYLOAD"
+	STREAMING_PAYLOAD = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	EMPTY_SHA256      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	amzDateFormat     = "20060102T150405Z"
+	maxClockSkew      = 15 * time.Minute
+)
+
+// Parsed request signature
+type signature struct {
+	accessKey     string
+	date          string // yyyymmdd
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	time          time.Time
+	payloadHash   string
+	presigned     bool
+	expires       time.Duration
+}
+
+func (sig *signature) scope() string {
+	return sig.date + "/" + sig.region + "/" + sig.service + "/aws4_request"
+}
+
+// Return true if request has signature in Authorization header or in query
+func signed(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.URL.Query().Get("X-Amz-Algorithm") != ""
+}
+
+// Parse signature from Authorization header or from query for presigned url
+func parseSignature(r *http.Request) (sig *signature, err *Error) {
+	sig = &signature{}
+	var credential, signedHeaders, amzDate string
+	q := r.URL.Query()
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if !strings.HasPrefix(auth, SIGN_ALGORITHM+" ") {
+			return nil, ErrSignatureVersion
+		}
+		for _, part := range strings.Split(auth[len(SIGN_ALGORITHM)+1:], ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) != 2 {
+				return nil, ErrAuthorizationHeaderMalformed
+			}
+			switch kv[0] {
+			case "Credential":
+				credential = kv[1]
+			case "SignedHeaders":
+				signedHeaders = kv[1]
+			case "Signature":
+				sig.signature = kv[1]
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		if amzDate == "" {
+			// Date header also can be used
+			if t, e := http.ParseTime(r.Header.Get("Date")); e == nil {
+				amzDate = t.UTC().Format(amzDateFormat)
+			}
+		}
+		sig.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if sig.payloadHash == "" {
+			sig.payloadHash = UNSIGNED_PAYLOAD
+		}
+	} else if q.Get("X-Amz-Algorithm") != "" {
+		if q.Get("X-Amz-Algorithm") != SIGN_ALGORITHM {
+			return nil, ErrSignatureVersion
+		}
+		sig.presigned = true
+		credential = q.Get("X-Amz-Credential")
+		signedHeaders = q.Get("X-Amz-SignedHeaders")
+		sig.signature = q.Get("X-Amz-Signature")
+		amzDate = q.Get("X-Amz-Date")
+		exp, e := strconv.ParseInt(q.Get("X-Amz-Expires"), 10, 64)
+		if e != nil || exp < 0 || exp > 7*24*3600 {
+			return nil, ErrAuthorizationQueryParametersError
+		}
+		sig.expires = time.Duration(exp) * time.Second
+		sig.payloadHash = UNSIGNED_PAYLOAD
+	} else {
+		return nil, ErrAccessDenied
+	}
+
+	cred := strings.Split(credential, "/")
+	if len(cred) != 5 || cred[4] != "aws4_request" || signedHeaders == "" || sig.signature == "" {
+		return nil, ErrAuthorizationHeaderMalformed
+	}
+	sig.accessKey, sig.date, sig.region, sig.service = cred[0], cred[1], cred[2], cred[3]
+	sig.signedHeaders = strings.Split(signedHeaders, ";")
+	// signature without host can be replayed to other server
+	hostSigned := false
+	for _, h := range sig.signedHeaders {
+		if h == "host" {
+			hostSigned = true
+		}
+	}
+	if !hostSigned {
+		if sig.presigned {
+			return nil, ErrAuthorizationQueryParametersError
+		}
+		return nil, ErrAuthorizationHeaderMalformed
+	}
+	t, e := time.Parse(amzDateFormat, amzDate)
+	if e != nil || t.Format("20060102") != sig.date {
+		return nil, ErrAccessDenied
+	}
+	sig.time = t
+	return
+}
+
+// Check request signature
+func (s *Server) authenticate(r *http.Request) (sig *signature, err *Error) {
+	if sig, err = parseSignature(r); err != nil {
+		return
+	}
+	secret, ok := s.conf.S3Keys[sig.accessKey]
+	if !ok {
+		return nil, ErrInvalidAccessKeyId
+	}
+	if sig.region != s.conf.S3Region || sig.service != "s3" {
+		return nil, ErrAuthorizationHeaderMalformed
+	}
+	now := s.now()
+	if sig.presigned {
+		if now.Before(sig.time.Add(-maxClockSkew)) || now.After(sig.time.Add(sig.expires)) {
+			return nil, ErrExpiredToken
+		}
+	} else if d := now.Sub(sig.time); d > maxClockSkew || d < -maxClockSkew {
+		return nil, ErrRequestTimeTooSkewed
+	}
+	expected := sig.calculate(r, secret)
+	if !hmac.Equal([]byte(expected), []byte(sig.signature)) {
+		return nil, ErrSignatureDoesNotMatch
+	}
+	return
+}
+
+// Calculate signature of request with given secret key
+func (sig *signature) calculate(r *http.Request, secret string) string {
+	return hex.EncodeToString(hmacSHA256(sig.signingKey(secret), sig.stringToSign(r)))
+}
+
+func (sig *signature) signingKey(secret string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), sig.date)
+	k = hmacSHA256(k, sig.region)
+	k = hmacSHA256(k, sig.service)
+	return hmacSHA256(k, "aws4_request")
+}
+
+func (sig *signature) stringToSign(r *http.Request) string {
+	h := sha256.Sum256([]byte(sig.canonicalRequest(r)))
+	return SIGN_ALGORITHM + "\n" + sig.time.Format(amzDateFormat) + "\n" + sig.scope() + "\n" + hex.EncodeToString(h[:])
+}
+
+func (sig *signature) canonicalRequest(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte('\n')
+	b.WriteString(uriEncode(r.URL.Path, false))
+	b.WriteByte('\n')
+	b.WriteString(canonicalQuery(r.URL.Query()))
+	b.WriteByte('\n')
+	for _, name := range sig.signedHeaders {
+		b.WriteString(name)
+		b.WriteByte(':')
+		if name == "host" {
+			b.WriteString(r.Host)
+		} else {
+			values := r.Header.Values(name)
+			for i, v := range values {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				b.WriteString(strings.Join(strings.Fields(v), " "))
+			}
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.WriteString(strings.Join(sig.signedHeaders, ";"))
+	b.WriteByte('\n')
+	b.WriteString(sig.payloadHash)
+	return b.String()
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		if k != "X-Amz-Signature" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Encode string by AWS rules: all bytes except unreserved characters are percent-encoded
+func uriEncode(s string, encodeSlash bool) string {
+	const hexUpper = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexUpper[c>>4])
+			b.WriteByte(hexUpper[c&15])
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
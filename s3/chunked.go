@@ -0,0 +1,93 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package s3
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Decoder of aws-chunked body (STREAMING-AWS4-HMAC-SHA256-PAYLOAD), checks signature of every chunk
+// Chunk format: hex(size);chunk-signature=signature\r\n data \r\n
+type chunkedReader struct {
+	rd      *bufio.Reader
+	sig     *signature
+	key     []byte
+	prevSig string
+	chunk   []byte
+	eof     bool
+}
+
+func newChunkedReader(r io.Reader, sig *signature, secret string) *chunkedReader {
+	return &chunkedReader{
+		rd:      bufio.NewReader(r),
+		sig:     sig,
+		key:     sig.signingKey(secret),
+		prevSig: sig.signature,
+	}
+}
+
+func (c *chunkedReader) Read(p []byte) (n int, err error) {
+	for len(c.chunk) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if err = c.next(); err != nil {
+			return
+		}
+	}
+	n = copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return
+}
+
+func (c *chunkedReader) next() (err error) {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return ErrIncompleteBody
+	}
+	line = strings.TrimRight(line, "\r\n")
+	i := strings.Index(line, ";chunk-signature=")
+	if i < 0 {
+		return ErrInvalidRequest
+	}
+	size, err := strconv.ParseInt(line[:i], 16, 64)
+	if err != nil || size < 0 || size > 16*1024*1024 {
+		return ErrInvalidRequest
+	}
+	chunkSig := line[i+len(";chunk-signature="):]
+	data := make([]byte, size+2)
+	if _, err = io.ReadFull(c.rd, data); err != nil || string(data[size:]) != "\r\n" {
+		return ErrIncompleteBody
+	}
+	data = data[:size]
+	h := sha256.Sum256(data)
+	sts := "AWS4-HMAC-SHA256-PAYLOAD\n" + c.sig.time.Format(amzDateFormat) + "\n" + c.sig.scope() + "\n" +
+		c.prevSig + "\n" + EMPTY_SHA256 + "\n" + hex.EncodeToString(h[:])
+	if expected := hex.EncodeToString(hmacSHA256(c.key, sts)); !hmac.Equal([]byte(expected), []byte(chunkSig)) {
+		return ErrSignatureDoesNotMatch
+	}
+	c.prevSig = chunkSig
+	c.chunk = data
+	c.eof = size == 0
+	return nil
+}
@@ -0,0 +1,62 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package s3
+
+import (
+	"net/http"
+)
+
+// S3 error response
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	ErrAccessDenied                      = &Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	ErrAuthorizationHeaderMalformed      = &Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed"}
+	ErrAuthorizationQueryParametersError = &Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "Query-string authentication parameters are malformed"}
+	ErrBadDigest                         = &Error{http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received"}
+	ErrBucketNotEmpty                    = &Error{http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty"}
+	ErrContentSHA256Mismatch             = &Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed"}
+	ErrEntityTooLarge                    = &Error{http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size"}
+	ErrExpiredToken                      = &Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	ErrIncompleteBody                    = &Error{http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header"}
+	ErrInternalError                     = &Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again"}
+	ErrInvalidAccessKeyId                = &Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key Id you provided does not exist in our records"}
+	ErrInvalidArgument                   = &Error{http.StatusBadRequest, "InvalidArgument", "Invalid Argument"}
+	ErrInvalidBucketName                 = &Error{http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid"}
+	ErrInvalidPart                       = &Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found"}
+	ErrInvalidPartOrder                  = &Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order"}
+	ErrInvalidDigest                     = &Error{http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified is not valid"}
+	ErrInvalidRequest                    = &Error{http.StatusBadRequest, "InvalidRequest", "Invalid Request"}
+	ErrMetadataTooLarge                  = &Error{http.StatusBadRequest, "MetadataTooLarge", "Your metadata headers exceed the maximum allowed metadata size"}
+	ErrMalformedXML                      = &Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema"}
+	ErrMissingContentLength              = &Error{http.StatusLengthRequired, "MissingContentLength", "You must provide the Content-Length HTTP header"}
+	ErrNoSuchBucket                      = &Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	ErrNoSuchUpload                      = &Error{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist"}
+	ErrNoSuchKey                         = &Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	ErrNotImplemented                    = &Error{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented"}
+	ErrRequestTimeTooSkewed              = &Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	ErrSignatureDoesNotMatch             = &Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided"}
+	ErrSignatureVersion                  = &Error{http.StatusBadRequest, "InvalidRequest", "Only AWS4-HMAC-SHA256 signature is supported"}
+)
@@ -0,0 +1,150 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package s3
+
+import (
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxKeys = 1000
+
+// ListObjectsV2 (list-type=2) and ListObjects
+func (s *Server) listObjects(req *request) *Error {
+	q := req.r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	res := &ListBucketResult{
+		Xmlns:     xmlns,
+		Name:      req.bucket,
+		Prefix:    prefix,
+		Delimiter: delimiter,
+		MaxKeys:   maxKeys,
+	}
+	if mk := q.Get("max-keys"); mk != "" {
+		n, err := strconv.Atoi(mk)
+		if err != nil || n < 0 {
+			return ErrInvalidArgument
+		}
+		if n < maxKeys {
+			res.MaxKeys = n
+		}
+	}
+	encode := func(s string) string { return s }
+	switch q.Get("encoding-type") {
+	case "":
+	case "url":
+		res.EncodingType = "url"
+		encode = func(s string) string { return uriEncode(s, false) }
+	default:
+		return ErrInvalidArgument
+	}
+
+	// keys after this one will be returned
+	var after string
+	if v2 {
+		res.StartAfter = q.Get("start-after")
+		after = res.StartAfter
+		if token := q.Get("continuation-token"); token != "" {
+			b, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				return &Error{http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect"}
+			}
+			res.ContinuationToken = token
+			if string(b) > after {
+				after = string(b)
+			}
+		}
+	} else {
+		res.Marker = q.Get("marker")
+		after = res.Marker
+	}
+
+	keys := s.keys(req.bucket, prefix)
+	i := sort.SearchStrings(keys, after)
+	if i < len(keys) && keys[i] == after {
+		i++
+	}
+	var last string
+	count := 0
+	for ; i < len(keys) && count < res.MaxKeys; i++ {
+		key := keys[i]
+		if delimiter != "" {
+			if d := strings.Index(key[len(prefix):], delimiter); d >= 0 {
+				cp := key[:len(prefix)+d+len(delimiter)]
+				res.CommonPrefixes = append(res.CommonPrefixes, CommonPrefix{Prefix: encode(cp)})
+				count++
+				// skip all keys of this prefix
+				for i+1 < len(keys) && strings.HasPrefix(keys[i+1], cp) {
+					i++
+				}
+				last = keys[i]
+				continue
+			}
+		}
+		if f, ok := s.stor.Get(req.bucket + "/" + key); ok {
+			res.Contents = append(res.Contents, Object{
+				Key:          encode(key),
+				LastModified: isoTime(f.Time),
+				ETag:         etag(f),
+				Size:         f.FSize,
+				StorageClass: "STANDARD",
+			})
+			count++
+		}
+		last = key
+	}
+	if i < len(keys) {
+		res.IsTruncated = true
+		if v2 {
+			res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		} else if delimiter != "" {
+			res.NextMarker = encode(last)
+		}
+	}
+	if v2 {
+		res.KeyCount = &count
+	}
+	if res.EncodingType != "" {
+		res.Prefix, res.Delimiter, res.StartAfter = encode(prefix), encode(delimiter), encode(res.StartAfter)
+	}
+	s.writeXml(req.w, http.StatusOK, res)
+	return nil
+}
+
+// Return sorted keys of bucket with given prefix
+func (s *Server) keys(bucket, prefix string) (keys []string) {
+	// list only the deepest folder of prefix
+	dir := bucket
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir += "/" + prefix[:i]
+	}
+	names, err := s.stor.Index.List(dir, 0)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if key := strings.TrimPrefix(name, bucket+"/"); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
@@ -0,0 +1,225 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package s3
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/multiupload"
+	"github.com/cheggaaa/Anteater/storage"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func (s *Server) uploads() (*multiupload.Manager, *Error) {
+	um, err := multiupload.Get(s.stor)
+	if err != nil {
+		aelog.Warnf("S3: can't init uploads: %v", err)
+		return nil, ErrInternalError
+	}
+	return um, nil
+}
+
+// Return upload from uploadId query param
+func (s *Server) upload(req *request) (*multiupload.Manager, *multiupload.Upload, *Error) {
+	um, e := s.uploads()
+	if e != nil {
+		return nil, nil, e
+	}
+	u, ok := um.Get(req.r.URL.Query().Get("uploadId"))
+	if !ok || u.Name != req.name() {
+		return nil, nil, ErrNoSuchUpload
+	}
+	return um, u, nil
+}
+
+func (s *Server) createUpload(req *request) *Error {
+	um, e := s.uploads()
+	if e != nil {
+		return e
+	}
+	attrs := multiupload.Attrs{Replace: true, Meta: amzMeta(req.r.Header)}
+	attrs.ContentType, attrs.Disposition = storage.TypeFromHeader(req.r.Header)
+	u, err := um.CreateWith(req.name(), 0, attrs)
+	if e := attrsError(err); e != nil {
+		return e
+	}
+	if err != nil {
+		aelog.Warnf("S3: can't create upload for %s: %v", req.name(), err)
+		return ErrInternalError
+	}
+	s.writeXml(req.w, http.StatusOK, &InitiateMultipartUploadResult{
+		Xmlns:    xmlns,
+		Bucket:   req.bucket,
+		Key:      req.key,
+		UploadId: u.Id,
+	})
+	return nil
+}
+
+func (s *Server) uploadPart(req *request) *Error {
+	if req.r.Header.Get("X-Amz-Copy-Source") != "" {
+		return ErrNotImplemented
+	}
+	_, u, e := s.upload(req)
+	if e != nil {
+		return e
+	}
+	n, err := strconv.Atoi(req.r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > multiupload.MAX_PARTS {
+		return &Error{http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive"}
+	}
+	p, e := s.payload(req)
+	if e != nil {
+		return e
+	}
+	// previous part is replaced only by verified one
+	part, err := u.WritePartIf(n, p.body, p.size, func(part *multiupload.Part) error {
+		if e := p.verify(req, part.Md5); e != nil {
+			return e
+		}
+		return nil
+	})
+	if err != nil {
+		if e, ok := err.(*Error); ok {
+			return e
+		}
+		aelog.Infof("S3: can't save part %d of %s: %v", n, req.name(), err)
+		return ErrIncompleteBody
+	}
+	req.w.Header().Set("ETag", `"`+hex.EncodeToString(part.Md5)+`"`)
+	req.w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *Server) completeUpload(req *request) *Error {
+	um, u, e := s.upload(req)
+	if e != nil {
+		return e
+	}
+	body, err := io.ReadAll(io.LimitReader(req.r.Body, 1024*1024))
+	if err != nil {
+		return ErrIncompleteBody
+	}
+	cmu := &CompleteMultipartUpload{}
+	if err = xml.Unmarshal(body, cmu); err != nil || len(cmu.Parts) == 0 {
+		return ErrMalformedXML
+	}
+	numbers := make([]int, len(cmu.Parts))
+	for i, p := range cmu.Parts {
+		if i > 0 && p.PartNumber <= numbers[i-1] {
+			return ErrInvalidPartOrder
+		}
+		md5, err := u.PartMd5(p.PartNumber)
+		if err != nil || strings.Trim(p.ETag, `"`) != hex.EncodeToString(md5) {
+			return ErrInvalidPart
+		}
+		numbers[i] = p.PartNumber
+	}
+	f, err := um.Complete(u.Id, numbers)
+	switch err {
+	case nil:
+	case multiupload.ErrNotFound, multiupload.ErrUploadRunning:
+		return ErrNoSuchUpload
+	case multiupload.ErrPartNotFound:
+		return ErrInvalidPart
+	case multiupload.ErrPartOrder:
+		return ErrInvalidPartOrder
+	case multiupload.ErrTooLarge:
+		return ErrEntityTooLarge
+	case multiupload.ErrIncomplete:
+		return &Error{http.StatusBadRequest, "InvalidRequest", "Empty objects are not supported"}
+	default:
+		aelog.Warnf("S3: can't complete upload %s of %s: %v", u.Id, req.name(), err)
+		return ErrInternalError
+	}
+	s.stor.Stats.Counters.Add.Add()
+	s.writeXml(req.w, http.StatusOK, &CompleteMultipartUploadResult{
+		Xmlns:    xmlns,
+		Location: "/" + req.name(),
+		Bucket:   req.bucket,
+		Key:      req.key,
+		ETag:     etag(f),
+	})
+	return nil
+}
+
+func (s *Server) abortUpload(req *request) *Error {
+	um, u, e := s.upload(req)
+	if e != nil {
+		return e
+	}
+	if err := um.Abort(u.Id); err != nil {
+		return ErrNoSuchUpload
+	}
+	req.w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) listParts(req *request) *Error {
+	_, u, e := s.upload(req)
+	if e != nil {
+		return e
+	}
+	res := &ListPartsResult{
+		Xmlns:    xmlns,
+		Bucket:   req.bucket,
+		Key:      req.key,
+		UploadId: u.Id,
+	}
+	for _, p := range u.Parts() {
+		md5, err := u.PartMd5(p.Number)
+		if err != nil {
+			continue
+		}
+		res.Parts = append(res.Parts, UploadPart{
+			PartNumber:   p.Number,
+			LastModified: isoTime(p.Time),
+			ETag:         `"` + hex.EncodeToString(md5) + `"`,
+			Size:         p.Size,
+		})
+	}
+	s.writeXml(req.w, http.StatusOK, res)
+	return nil
+}
+
+func (s *Server) listUploads(req *request) *Error {
+	um, e := s.uploads()
+	if e != nil {
+		return e
+	}
+	prefix := req.r.URL.Query().Get("prefix")
+	res := &ListMultipartUploadsResult{
+		Xmlns:  xmlns,
+		Bucket: req.bucket,
+		Prefix: prefix,
+	}
+	for _, u := range um.List() {
+		if key := strings.TrimPrefix(u.Name, req.bucket+"/"); key != u.Name && strings.HasPrefix(key, prefix) {
+			res.Uploads = append(res.Uploads, MultipartUpload{
+				Key:       key,
+				UploadId:  u.Id,
+				Initiated: isoTime(u.Created),
+			})
+		}
+	}
+	s.writeXml(req.w, http.StatusOK, res)
+	return nil
+}
@@ -0,0 +1,285 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/storage"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func (s *Server) listBuckets(req *request) *Error {
+	names := s.stor.Index.Dirs("")
+	sort.Strings(names)
+	res := &ListAllMyBucketsResult{Xmlns: xmlns}
+	created := isoTime(s.stor.Stats.Anteater.StartTime)
+	for _, name := range names {
+		if bucketNameRe.MatchString(name) {
+			res.Buckets = append(res.Buckets, Bucket{Name: name, CreationDate: created})
+		}
+	}
+	s.writeXml(req.w, http.StatusOK, res)
+	return nil
+}
+
+func (s *Server) deleteBucket(req *request) *Error {
+	if names, _ := s.stor.Index.List(req.bucket, 1); len(names) > 0 || len(s.stor.Index.Dirs(req.bucket)) > 0 {
+		return ErrBucketNotEmpty
+	}
+	req.w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func etag(f *storage.File) string {
+	return `"` + f.Md5S() + `"`
+}
+
+// Prefix of user metadata headers
+const META_PREFIX = "X-Amz-Meta-"
+
+// Return user metadata from x-amz-meta-* headers
+func amzMeta(h http.Header) map[string]string {
+	var meta map[string]string
+	for k, v := range h {
+		if len(v) == 0 || len(k) <= len(META_PREFIX) || !strings.EqualFold(k[:len(META_PREFIX)], META_PREFIX) {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[strings.ToLower(k[len(META_PREFIX):])] = v[0]
+	}
+	return meta
+}
+
+// Return S3 error for invalid attributes of new object, nil for other errors
+func attrsError(err error) *Error {
+	switch err {
+	case storage.ErrInvalidType:
+		return ErrInvalidArgument
+	case storage.ErrMetaTooBig:
+		return ErrMetadataTooLarge
+	}
+	return nil
+}
+
+func (s *Server) getObject(req *request) *Error {
+	f, ok := s.stor.Get(req.name())
+	if !ok {
+		return ErrNoSuchKey
+	}
+	if f.Open() != nil {
+		return ErrNoSuchKey
+	}
+	defer f.Close()
+	h := req.w.Header()
+	h.Set("ETag", etag(f))
+	h.Set("Content-Type", f.ContentType())
+	if disposition := f.Disposition(); disposition != "" {
+		h.Set("Content-Disposition", disposition)
+	}
+	for k, v := range f.Meta() {
+		h.Set(META_PREFIX+k, v)
+	}
+	s.stor.Stats.Counters.Get.Add()
+	// ranges and conditional requests
+	http.ServeContent(req.w, req.r, "", f.Time, f.GetReader())
+	return nil
+}
+
+// Request body with verification of signed payload and Content-Md5
+type payload struct {
+	body io.Reader
+	size int64
+	sha  hash.Hash
+	md5  []byte
+}
+
+func (s *Server) payload(req *request) (p *payload, e *Error) {
+	r := req.r
+	p = &payload{body: r.Body, size: r.ContentLength}
+	if req.sig != nil {
+		switch req.sig.payloadHash {
+		case UNSIGNED_PAYLOAD:
+		case STREAMING_PAYLOAD:
+			var err error
+			if p.size, err = strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64); err != nil {
+				return nil, ErrMissingContentLength
+			}
+			p.body = newChunkedReader(r.Body, req.sig, s.conf.S3Keys[req.sig.accessKey])
+		default:
+			p.sha = sha256.New()
+			p.body = io.TeeReader(p.body, p.sha)
+		}
+	}
+	if p.size < 0 {
+		return nil, ErrMissingContentLength
+	}
+	if s.conf.MaxFileSize > 0 && p.size > s.conf.MaxFileSize {
+		return nil, ErrEntityTooLarge
+	}
+	p.body = &sizedReader{r: io.LimitReader(p.body, p.size+1), left: p.size}
+	if cm := r.Header.Get("Content-Md5"); cm != "" {
+		var err error
+		if p.md5, err = base64.StdEncoding.DecodeString(cm); err != nil || len(p.md5) != 16 {
+			return nil, ErrInvalidDigest
+		}
+	}
+	return
+}
+
+// Body of declared size. Reading of the last byte checks that body has no more data,
+// so aws-chunked body is read up to the terminating chunk
+type sizedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (s *sizedReader) Read(p []byte) (n int, err error) {
+	if s.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > s.left {
+		p = p[:s.left]
+	}
+	n, err = s.r.Read(p)
+	s.left -= int64(n)
+	if s.left > 0 {
+		if err == io.EOF {
+			err = ErrIncompleteBody
+		}
+		return
+	}
+	if err == nil || err == io.EOF {
+		var b [1]byte
+		if m, e := io.ReadFull(s.r, b[:]); m > 0 {
+			err = ErrInvalidRequest
+		} else if e != io.EOF {
+			err = e
+		} else {
+			err = io.EOF
+		}
+	}
+	return
+}
+
+// Check received data, must be called after body was read
+func (p *payload) verify(req *request, md5 []byte) *Error {
+	if p.sha != nil && hex.EncodeToString(p.sha.Sum(nil)) != req.sig.payloadHash {
+		return ErrContentSHA256Mismatch
+	}
+	if p.md5 != nil && !bytes.Equal(p.md5, md5) {
+		return ErrBadDigest
+	}
+	return nil
+}
+
+func (s *Server) putObject(req *request) *Error {
+	p, e := s.payload(req)
+	if e != nil {
+		return e
+	}
+	if p.size == 0 {
+		return &Error{http.StatusBadRequest, "InvalidRequest", "Empty objects are not supported"}
+	}
+
+	// payload is verified before new object replaces old one
+	h := md5.New()
+	attrs := storage.FileAttrs{Replace: true, Meta: amzMeta(req.r.Header)}
+	attrs.ContentType, attrs.Disposition = storage.TypeFromHeader(req.r.Header)
+	attrs.Cond = func(old *storage.File) error {
+		if e := p.verify(req, h.Sum(nil)); e != nil {
+			return e
+		}
+		return nil
+	}
+	f, err := s.stor.AddWith(req.name(), io.TeeReader(p.body, h), p.size, attrs)
+	if e := attrsError(err); e != nil {
+		return e
+	}
+	if err != nil {
+		if e, ok := err.(*Error); ok {
+			return e
+		}
+		aelog.Infof("S3: can't save %s: %v", req.name(), err)
+		return ErrIncompleteBody
+	}
+	s.stor.Stats.Counters.Add.Add()
+	req.w.Header().Set("ETag", etag(f))
+	req.w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *Server) copyObject(req *request) *Error {
+	source, err := url.PathUnescape(req.r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return ErrInvalidArgument
+	}
+	if i := strings.Index(source, "?"); i >= 0 {
+		// versionId
+		return ErrNotImplemented
+	}
+	source = strings.TrimPrefix(source, "/")
+	if i := strings.Index(source, "/"); i <= 0 || !bucketNameRe.MatchString(source[:i]) {
+		return ErrInvalidArgument
+	}
+	if source == req.name() {
+		return &Error{http.StatusBadRequest, "InvalidRequest", "This copy request is illegal because it is trying to copy an object to itself"}
+	}
+	src, ok := s.stor.Get(source)
+	if !ok || src.Open() != nil {
+		return ErrNoSuchKey
+	}
+	defer src.Close()
+	if cond := req.r.Header.Get("X-Amz-Copy-Source-If-Match"); cond != "" && cond != etag(src) && cond != src.Md5S() {
+		return &Error{http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold"}
+	}
+
+	attrs := storage.FileAttrs{Replace: true, Meta: src.Meta()}
+	attrs.ContentType, attrs.Disposition = src.StoredType()
+	f, err := s.stor.AddWith(req.name(), src.GetReader(), src.FSize, attrs)
+	if err != nil {
+		aelog.Warnf("S3: can't copy %s to %s: %v", source, req.name(), err)
+		return ErrInternalError
+	}
+	s.stor.Stats.Counters.Add.Add()
+	s.writeXml(req.w, http.StatusOK, &CopyObjectResult{
+		Xmlns:        xmlns,
+		LastModified: isoTime(f.Time),
+		ETag:         etag(f),
+	})
+	return nil
+}
+
+func (s *Server) deleteObject(req *request) *Error {
+	if s.stor.Delete(req.name()) {
+		s.stor.Stats.Counters.Delete.Add()
+	}
+	req.w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,305 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package s3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/config"
+	"github.com/cheggaaa/Anteater/storage"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClient struct {
+	t   *testing.T
+	url string
+}
+
+func (c *testClient) do(method, path string, body string, headers ...string) (*http.Response, string) {
+	r, _ := http.NewRequest(method, c.url+path, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	h := sha256.Sum256([]byte(body))
+	signRequest(r, hex.EncodeToString(h[:]), testSecretKey)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp, string(b)
+}
+
+func signRequest(r *http.Request, payloadHash, secret string) {
+	now := time.Now().UTC()
+	r.Host = r.URL.Host
+	r.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	sig := &signature{
+		accessKey:     testAccessKey,
+		date:          now.Format("20060102"),
+		region:        "us-east-1",
+		service:       "s3",
+		signedHeaders: []string{"host", "x-amz-content-sha256", "x-amz-date"},
+		time:          now,
+		payloadHash:   payloadHash,
+	}
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		SIGN_ALGORITHM, sig.accessKey, sig.scope(), strings.Join(sig.signedHeaders, ";"), sig.calculate(r, secret)))
+}
+
+func newTestServer(t *testing.T) (*storage.Storage, *testClient, func()) {
+	if aelog.DefaultLogger == nil {
+		aelog.InitDefault(aelog.LOG_WARN)
+	}
+	s := new(storage.Storage)
+	s.Init(&config.Config{
+		ContainerSize: 1024 * 1024 * 10,
+		DataPath:      t.TempDir() + "/",
+		TmpDir:        t.TempDir(),
+		S3Region:      "us-east-1",
+		S3Keys:        map[string]string{testAccessKey: testSecretKey},
+	})
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(NewServer(s, nil))
+	return s, &testClient{t, ts.URL}, func() {
+		ts.Close()
+		s.Close()
+	}
+}
+
+func TestObjects(t *testing.T) {
+	s, c, done := newTestServer(t)
+	defer done()
+
+	resp, _ := c.do("PUT", "/bucket/dir/a.txt", "0123456789")
+	if resp.StatusCode != 200 || resp.Header.Get("ETag") != `"781e5e245d69b566979b86e28d23f2c7"` {
+		t.Fatalf("Unexpected put response: %d %v", resp.StatusCode, resp.Header)
+	}
+	if f, ok := s.Get("bucket/dir/a.txt"); !ok || f.FSize != 10 {
+		t.Error("Object was not saved to index")
+	}
+
+	resp, body := c.do("GET", "/bucket/dir/a.txt", "", "Range", "bytes=2-5")
+	if resp.StatusCode != 206 || body != "2345" {
+		t.Errorf("Unexpected range response: %d %s", resp.StatusCode, body)
+	}
+	resp, body = c.do("HEAD", "/bucket/dir/a.txt", "")
+	if resp.StatusCode != 200 || resp.ContentLength != 10 || body != "" {
+		t.Errorf("Unexpected head response: %d %d", resp.StatusCode, resp.ContentLength)
+	}
+	resp, _ = c.do("GET", "/bucket/dir/a.txt", "", "If-None-Match", `"781e5e245d69b566979b86e28d23f2c7"`)
+	if resp.StatusCode != 304 {
+		t.Errorf("Expected 304, got %d", resp.StatusCode)
+	}
+
+	// bad signature
+	r, _ := http.NewRequest("GET", c.url+"/bucket/dir/a.txt", nil)
+	signRequest(r, UNSIGNED_PAYLOAD, "wrong")
+	if resp, _ := http.DefaultClient.Do(r); resp.StatusCode != 403 {
+		t.Errorf("Expected 403, got %d", resp.StatusCode)
+	}
+
+	// anonymous requests are allowed to read only if enabled
+	if resp, _ := http.Get(c.url + "/bucket/dir/a.txt"); resp.StatusCode != 403 {
+		t.Errorf("Expected 403 for anonymous request, got %d", resp.StatusCode)
+	}
+	s.Conf.S3Anonymous = true
+	if resp, _ := http.Get(c.url + "/bucket/dir/a.txt"); resp.StatusCode != 200 {
+		t.Errorf("Expected 200 for anonymous request, got %d", resp.StatusCode)
+	}
+	r, _ = http.NewRequest("DELETE", c.url+"/bucket/dir/a.txt", nil)
+	if resp, _ := http.DefaultClient.Do(r); resp.StatusCode != 403 {
+		t.Errorf("Expected 403 for anonymous delete, got %d", resp.StatusCode)
+	}
+	s.Conf.S3Anonymous = false
+
+	// bad digest
+	resp, body = c.do("PUT", "/bucket/bad.txt", "data", "Content-Md5", "1B2M2Y8AsgTpgAmY7PhCfg==")
+	if resp.StatusCode != 400 || !strings.Contains(body, "BadDigest") {
+		t.Errorf("Expected BadDigest, got %d %s", resp.StatusCode, body)
+	}
+	if _, ok := s.Get("bucket/bad.txt"); ok {
+		t.Error("Object with bad digest was saved")
+	}
+
+	// metadata
+	c.do("PUT", "/bucket/meta.txt", "data", "X-Amz-Meta-Color", "red")
+	if resp, _ = c.do("HEAD", "/bucket/meta.txt", ""); resp.Header.Get("X-Amz-Meta-Color") != "red" {
+		t.Errorf("Unexpected metadata: %v", resp.Header)
+	}
+	if resp, body = c.do("PUT", "/bucket/meta.txt", "data", "X-Amz-Meta-Big", strings.Repeat("a", 10000)); resp.StatusCode != 400 || !strings.Contains(body, "MetadataTooLarge") {
+		t.Errorf("Expected MetadataTooLarge, got %d %s", resp.StatusCode, body)
+	}
+
+	// copy
+	resp, body = c.do("PUT", "/other/copy.txt", "", "X-Amz-Copy-Source", "/bucket/dir/a.txt")
+	if resp.StatusCode != 200 || !strings.Contains(body, "781e5e245d69b566979b86e28d23f2c7") {
+		t.Errorf("Unexpected copy response: %d %s", resp.StatusCode, body)
+	}
+	if _, body = c.do("GET", "/other/copy.txt", ""); body != "0123456789" {
+		t.Errorf("Unexpected copy content: %s", body)
+	}
+	if _, body = c.do("GET", "/", ""); !strings.Contains(body, "<Name>bucket</Name>") || !strings.Contains(body, "<Name>other</Name>") {
+		t.Errorf("Unexpected buckets list: %s", body)
+	}
+
+	// delete
+	if resp, _ = c.do("DELETE", "/other/copy.txt", ""); resp.StatusCode != 204 {
+		t.Errorf("Expected 204, got %d", resp.StatusCode)
+	}
+	if resp, body = c.do("GET", "/other/copy.txt", ""); resp.StatusCode != 404 || !strings.Contains(body, "NoSuchKey") {
+		t.Errorf("Expected NoSuchKey, got %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	s, c, done := newTestServer(t)
+	defer done()
+
+	resp, body := c.do("POST", "/bucket/big.bin?uploads", "", "X-Amz-Meta-Color", "red", "Content-Type", "image/png")
+	res := &InitiateMultipartUploadResult{}
+	if resp.StatusCode != 200 || xml.Unmarshal([]byte(body), res) != nil || res.UploadId == "" {
+		t.Fatalf("Unexpected initiate response: %d %s", resp.StatusCode, body)
+	}
+	parts := []string{strings.Repeat("a", 1000), strings.Repeat("b", 500), "c"}
+	cmu := &CompleteMultipartUpload{}
+	// upload in reverse order
+	for i := len(parts) - 1; i >= 0; i-- {
+		resp, _ = c.do("PUT", fmt.Sprintf("/bucket/big.bin?partNumber=%d&uploadId=%s", i+1, res.UploadId), parts[i])
+		if resp.StatusCode != 200 || resp.Header.Get("ETag") == "" {
+			t.Fatalf("Unexpected part response: %d", resp.StatusCode)
+		}
+		cmu.Parts = append([]CompletePart{{i + 1, resp.Header.Get("ETag")}}, cmu.Parts...)
+	}
+	// part with wrong digest doesn't replace uploaded one
+	resp, _ = c.do("PUT", "/bucket/big.bin?partNumber=2&uploadId="+res.UploadId, "broken", "Content-Md5", "AAAAAAAAAAAAAAAAAAAAAA==")
+	if resp.StatusCode != 400 {
+		t.Errorf("Unexpected status of part with wrong digest: %d", resp.StatusCode)
+	}
+	if _, body = c.do("GET", "/bucket/big.bin?uploadId="+res.UploadId, ""); strings.Count(body, "<Part>") != 3 {
+		t.Errorf("Unexpected parts list: %s", body)
+	}
+	if _, body = c.do("GET", "/bucket?uploads", ""); !strings.Contains(body, res.UploadId) {
+		t.Errorf("Upload not in list: %s", body)
+	}
+
+	// wrong etag
+	bad := &CompleteMultipartUpload{Parts: []CompletePart{{1, `"00"`}}}
+	b, _ := xml.Marshal(bad)
+	if resp, body = c.do("POST", "/bucket/big.bin?uploadId="+res.UploadId, string(b)); resp.StatusCode != 400 || !strings.Contains(body, "InvalidPart") {
+		t.Errorf("Expected InvalidPart, got %d %s", resp.StatusCode, body)
+	}
+
+	b, _ = xml.Marshal(cmu)
+	resp, body = c.do("POST", "/bucket/big.bin?uploadId="+res.UploadId, string(b))
+	if resp.StatusCode != 200 || !strings.Contains(body, "CompleteMultipartUploadResult") {
+		t.Fatalf("Unexpected complete response: %d %s", resp.StatusCode, body)
+	}
+	if resp, body = c.do("GET", "/bucket/big.bin", ""); body != strings.Join(parts, "") {
+		t.Errorf("Unexpected content: %d bytes", len(body))
+	}
+	if resp.Header.Get("X-Amz-Meta-Color") != "red" || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("Unexpected metadata: %v", resp.Header)
+	}
+	if f, ok := s.Get("bucket/big.bin"); !ok || f.FSize != 1501 {
+		t.Error("Object was not saved")
+	}
+	if resp, _ = c.do("DELETE", "/bucket/big.bin?uploadId="+res.UploadId, ""); resp.StatusCode != 404 {
+		t.Errorf("Completed upload still exists: %d", resp.StatusCode)
+	}
+}
+
+func TestListObjectsV2(t *testing.T) {
+	_, c, done := newTestServer(t)
+	defer done()
+	keys := []string{"dir/a.txt", "dir/b.txt", "dir/sub/c.txt", "dir/sub/d.txt", "dir2/e.txt", "f.txt"}
+	for _, key := range keys {
+		if resp, _ := c.do("PUT", "/bucket/"+key, key); resp.StatusCode != 200 {
+			t.Fatalf("Can't put %s: %d", key, resp.StatusCode)
+		}
+	}
+
+	list := func(query string) *ListBucketResult {
+		resp, body := c.do("GET", "/bucket?list-type=2&"+query, "")
+		if resp.StatusCode != 200 {
+			t.Fatalf("Unexpected list response: %d %s", resp.StatusCode, body)
+		}
+		res := &ListBucketResult{}
+		if err := xml.Unmarshal([]byte(body), res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := list("prefix=dir/&delimiter=/")
+	if len(res.Contents) != 2 || res.Contents[0].Key != "dir/a.txt" || len(res.CommonPrefixes) != 1 || res.CommonPrefixes[0].Prefix != "dir/sub/" {
+		t.Errorf("Unexpected list result: %+v", res)
+	}
+	res = list("prefix=dir&delimiter=/")
+	if len(res.Contents) != 0 || len(res.CommonPrefixes) != 2 {
+		t.Errorf("Unexpected list result: %+v", res)
+	}
+
+	// pagination
+	var got []string
+	token := ""
+	for i := 0; i < 10; i++ {
+		res = list("max-keys=2&continuation-token=" + token)
+		for _, o := range res.Contents {
+			got = append(got, o.Key)
+		}
+		if !res.IsTruncated {
+			break
+		}
+		token = res.NextContinuationToken
+	}
+	if strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Errorf("Unexpected keys: %v", got)
+	}
+
+	// pagination with common prefixes
+	got = got[:0]
+	token = ""
+	for i := 0; i < 10; i++ {
+		res = list("delimiter=/&max-keys=1&continuation-token=" + token)
+		for _, o := range res.Contents {
+			got = append(got, o.Key)
+		}
+		for _, p := range res.CommonPrefixes {
+			got = append(got, p.Prefix)
+		}
+		if !res.IsTruncated {
+			break
+		}
+		token = res.NextContinuationToken
+	}
+	if strings.Join(got, ",") != "dir/,dir2/,f.txt" {
+		t.Errorf("Unexpected keys: %v", got)
+	}
+}
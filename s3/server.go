@@ -0,0 +1,248 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+// S3-compatible api. Buckets are top-level folders of storage index
+package s3
+
+import (
+	"encoding/xml"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/cnst"
+	"github.com/cheggaaa/Anteater/config"
+	"github.com/cheggaaa/Anteater/storage"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var bucketNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+type Server struct {
+	stor *storage.Storage
+	conf *config.Config
+	aL   *aelog.AntLog
+	now  func() time.Time
+}
+
+func NewServer(s *storage.Storage, accessLog *aelog.AntLog) *Server {
+	return &Server{
+		stor: s,
+		conf: s.Conf,
+		aL:   accessLog,
+		now:  time.Now,
+	}
+}
+
+// Create new server and run it on Conf.S3Addr
+func RunServer(s *storage.Storage, accessLog *aelog.AntLog) (server *Server) {
+	server = NewServer(s, accessLog)
+	go func() {
+		serv := &http.Server{
+			Addr:         s.Conf.S3Addr,
+			Handler:      server,
+			ReadTimeout:  s.Conf.HttpReadTimeout,
+			WriteTimeout: s.Conf.HttpWriteTimeout,
+		}
+		log.Fatal(serv.ListenAndServe())
+	}()
+	return
+}
+
+// Request context
+type request struct {
+	w      *statusWriter
+	r      *http.Request
+	sig    *signature
+	bucket string
+	key    string
+}
+
+// Index name of the object
+func (req *request) name() string {
+	return req.bucket + "/" + req.key
+}
+
+func (s *Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+	w.Header().Set("Server", cnst.SIGN)
+	defer func() {
+		if rec := recover(); rec != nil {
+			s.err(w, r, ErrInternalError)
+			aelog.Warnf("Error on s3 request: %v", rec)
+		}
+		r.Body.Close()
+		s.accessLog(w.status, r)
+	}()
+
+	req := &request{w: w, r: r}
+	if s.conf.S3Anonymous && !signed(r) {
+		// anonymous access is read-only
+		if r.Method != "GET" && r.Method != "HEAD" {
+			s.err(w, r, ErrAccessDenied)
+			return
+		}
+	} else {
+		var e *Error
+		if req.sig, e = s.authenticate(r); e != nil {
+			s.err(w, r, e)
+			return
+		}
+	}
+	req.bucket, req.key = s.parsePath(r)
+	if req.bucket != "" && !bucketNameRe.MatchString(req.bucket) {
+		s.err(w, r, ErrInvalidBucketName)
+		return
+	}
+
+	if s.conf.ReplicationRole == config.REPLICATION_FOLLOWER {
+		switch r.Method {
+		case "GET", "HEAD":
+		default:
+			s.err(w, r, ErrAccessDenied)
+			return
+		}
+	}
+
+	var e *Error
+	q := r.URL.Query()
+	_, isUploads := q["uploads"]
+	isPart := q.Get("uploadId") != ""
+	switch {
+	case req.bucket == "":
+		if r.Method != "GET" {
+			e = ErrNotImplemented
+		} else {
+			e = s.listBuckets(req)
+		}
+	case req.key == "":
+		switch r.Method {
+		case "GET":
+			if isUploads {
+				e = s.listUploads(req)
+			} else {
+				e = s.listObjects(req)
+			}
+		case "HEAD", "PUT":
+			// buckets always exist
+		case "DELETE":
+			e = s.deleteBucket(req)
+		default:
+			e = ErrNotImplemented
+		}
+	default:
+		switch r.Method {
+		case "GET", "HEAD":
+			if isPart {
+				e = s.listParts(req)
+			} else {
+				e = s.getObject(req)
+			}
+		case "POST":
+			switch {
+			case isUploads:
+				e = s.createUpload(req)
+			case isPart:
+				e = s.completeUpload(req)
+			default:
+				e = ErrNotImplemented
+			}
+		case "PUT":
+			if isPart {
+				e = s.uploadPart(req)
+			} else if r.Header.Get("X-Amz-Copy-Source") != "" {
+				e = s.copyObject(req)
+			} else {
+				e = s.putObject(req)
+			}
+		case "DELETE":
+			if isPart {
+				e = s.abortUpload(req)
+			} else {
+				e = s.deleteObject(req)
+			}
+		default:
+			e = ErrNotImplemented
+		}
+	}
+	if e != nil {
+		s.err(w, r, e)
+	}
+}
+
+// Return bucket and key from path or host (virtual-hosted style)
+func (s *Server) parsePath(r *http.Request) (bucket, key string) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if s.conf.S3Domain != "" {
+		host := r.Host
+		if i := strings.LastIndex(host, ":"); i > 0 && !strings.HasSuffix(host, "]") {
+			host = host[:i]
+		}
+		if strings.HasSuffix(host, "."+s.conf.S3Domain) {
+			return strings.TrimSuffix(host, "."+s.conf.S3Domain), path
+		}
+	}
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+func (s *Server) err(w http.ResponseWriter, r *http.Request, e *Error) {
+	res := &ErrorResult{
+		Code:     e.Code,
+		Message:  e.Message,
+		Resource: r.URL.Path,
+	}
+	if e.Status == http.StatusNotFound {
+		s.stor.Stats.Counters.NotFound.Add()
+	}
+	if r.Method == "HEAD" {
+		w.WriteHeader(e.Status)
+		return
+	}
+	s.writeXml(w, e.Status, res)
+}
+
+func (s *Server) writeXml(w http.ResponseWriter, status int, v interface{}) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+}
+
+func (s *Server) accessLog(status int, r *http.Request) {
+	if s.aL != nil {
+		st := http.StatusText(status)
+		s.aL.Printf(aelog.LOG_PRINT, "S3 %s %s (%s): %d %s", r.Method, r.URL.Path, r.RemoteAddr, status, st)
+	}
+}
+
+// Remember response status for access log
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -22,13 +22,16 @@ import (
 )
 
 type StatsInfo struct {
-	Anteater *Anteater         `json:"anteater"`
-	Storage  *Storage          `json:"github.com/cheggaaa/Anteater/storage"`
-	Allocate map[string]uint64 `json:"allocate"`
-	Counters map[string]uint64 `json:"counters"`
-	Traffic  map[string]uint64 `json:"traffic"`
-	TrafficH map[string]string `json:"trafficHuman"`
-	Env      *Env              `json:"env"`
+	Anteater    *Anteater         `json:"anteater"`
+	Storage     *Storage          `json:"github.com/cheggaaa/Anteater/storage"`
+	Allocate    map[string]uint64 `json:"allocate"`
+	Counters    map[string]uint64 `json:"counters"`
+	Traffic     map[string]uint64 `json:"traffic"`
+	TrafficH    map[string]string `json:"trafficHuman"`
+	Compact     map[string]uint64 `json:"compact"`
+	Replication *Replication      `json:"replication"`
+	Scrub       *Scrub            `json:"scrub"`
+	Env         *Env              `json:"env"`
 }
 
 func (s *Stats) AsJson() (b []byte) {
@@ -43,13 +46,16 @@ func (s *Stats) AsJson() (b []byte) {
 func (s *Stats) Info() *StatsInfo {
 	s.Refresh()
 	sj := &StatsInfo{
-		Anteater: s.Anteater,
-		Storage:  s.Storage,
-		Env:      s.Env,
-		Traffic:  map[string]uint64{"in": 0, "out": 0},
-		TrafficH: map[string]string{"in": "0", "out": "0"},
-		Allocate: map[string]uint64{"append": 0, "in": 0, "replace": 0},
-		Counters: map[string]uint64{"add": 0, "get": 0, "delete": 0, "notFound": 0, "notModified": 0},
+		Anteater:    s.Anteater,
+		Storage:     s.Storage,
+		Replication: s.Replication,
+		Scrub:       s.Scrub,
+		Env:         s.Env,
+		Traffic:     map[string]uint64{"in": 0, "out": 0},
+		TrafficH:    map[string]string{"in": "0", "out": "0"},
+		Allocate:    map[string]uint64{"append": 0, "in": 0, "replace": 0},
+		Counters:    map[string]uint64{"add": 0, "get": 0, "delete": 0, "notFound": 0, "notModified": 0, "expired": 0},
+		Compact:     map[string]uint64{"runs": 0, "files": 0, "bytes": 0, "truncated": 0, "punched": 0, "retired": 0},
 	}
 
 	sj.Allocate["append"] = s.Allocate.Append.GetValue()
@@ -61,10 +67,18 @@ func (s *Stats) Info() *StatsInfo {
 	sj.Counters["delete"] = s.Counters.Delete.GetValue()
 	sj.Counters["notFound"] = s.Counters.NotFound.GetValue()
 	sj.Counters["notModified"] = s.Counters.NotModified.GetValue()
+	sj.Counters["expired"] = s.Counters.Expired.GetValue()
+
+	sj.Compact["runs"] = s.Compact.Runs.GetValue()
+	sj.Compact["files"] = s.Compact.Files.GetValue()
+	sj.Compact["bytes"] = s.Compact.Bytes.GetValue()
+	sj.Compact["truncated"] = s.Compact.Truncated.GetValue()
+	sj.Compact["punched"] = s.Compact.Punched.GetValue()
+	sj.Compact["retired"] = s.Compact.Retired.GetValue()
 
 	sj.Traffic["in"] = s.Traffic.Input.GetValue()
 	sj.Traffic["out"] = s.Traffic.Output.GetValue()
 	sj.TrafficH["in"] = utils.HumanBytes(int64(sj.Traffic["in"]))
 	sj.TrafficH["out"] = utils.HumanBytes(int64(sj.Traffic["out"]))
 	return sj
-}
\ No newline at end of file
+}
@@ -18,16 +18,24 @@ package stats
 
 import (
 	"github.com/cheggaaa/Anteater/cnst"
+	"sync"
 	"time"
 )
 
 type Stats struct {
-	Anteater *Anteater
-	Storage  *Storage
-	Allocate *Allocate
-	Counters *StorageCounters
-	Traffic  *Traffic
-	Env      *Env
+	Anteater    *Anteater
+	Storage     *Storage
+	Allocate    *Allocate
+	Counters    *StorageCounters
+	Traffic     *Traffic
+	Compact     *Compact
+	Replication *Replication
+	Scrub       *Scrub
+	Env         *Env
+
+	// replication stats changed by follower, Replication is a copy made on refresh
+	repl  Replication
+	replM sync.Mutex
 }
 
 type Allocate struct {
@@ -40,13 +48,53 @@ type Anteater struct {
 }
 
 type StorageCounters struct {
-	Get, Add, Delete, NotFound, NotModified *Counter
+	Get, Add, Delete, NotFound, NotModified, Expired *Counter
 }
 
 type Traffic struct {
 	Input, Output *Counter
 }
 
+type Compact struct {
+	Runs, Files, Bytes, Truncated *Counter
+	// space of holes released to file system
+	Punched *Counter
+	// removed empty containers
+	Retired *Counter
+}
+
+type Replication struct {
+	Role           string
+	Primary        string
+	Epoch          int64
+	Version        int64
+	PrimaryVersion int64
+	// count of index changes not applied yet
+	Lag int64
+	// age of the last applied change while follower is behind primary
+	LagTime   time.Duration
+	LastSync  time.Time
+	LastError string
+	Applied   int64
+	Errors    int64
+	CatchUps  int64
+}
+
+// Background verification of files (see storage/scrub.go)
+type Scrub struct {
+	Running bool
+	Pass    int64
+	// container in progress
+	Container int64
+	// checked in current (or last) pass
+	Files int64
+	Bytes int64
+	// count of entries in quarantine list
+	Corrupt  int
+	Started  time.Time
+	Finished time.Time
+}
+
 type Storage struct {
 	ContainersCount int
 	FilesCount      int64
@@ -61,6 +109,30 @@ type Storage struct {
 	DumpSaveTime    time.Duration
 	DumpLockTime    time.Duration
 	DumpTime        time.Time
+	// deduplicated files and saved space
+	DedupFiles int64
+	DedupSize  int64
+	// data directories
+	Disks []*Disk
+	// redundancy mode, containers with failed parts and reads restored from other parts
+	Redundancy         string
+	DegradedContainers int
+	Reconstructed      int64
+	// space taken by data files on disks, less than TotalSize if holes are released to file system
+	PhysicalSize int64
+}
+
+type Disk struct {
+	Path            string
+	Capacity        int64
+	Weight          int
+	ContainersCount int
+	TotalSize       int64
+	FilesSize       int64
+	// free space of file system
+	FreeSpace int64
+	Degraded  bool
+	Error     string
 }
 
 func New() *Stats {
@@ -74,8 +146,11 @@ func New() *Stats {
 	st.Storage = &Storage{}
 
 	st.Allocate = &Allocate{&Counter{}, &Counter{}, &Counter{}}
-	st.Counters = &StorageCounters{&Counter{}, &Counter{}, &Counter{}, &Counter{}, &Counter{}}
+	st.Counters = &StorageCounters{&Counter{}, &Counter{}, &Counter{}, &Counter{}, &Counter{}, &Counter{}}
 	st.Traffic = &Traffic{&Counter{}, &Counter{}}
+	st.Compact = &Compact{&Counter{}, &Counter{}, &Counter{}, &Counter{}, &Counter{}, &Counter{}}
+	st.Replication = &Replication{}
+	st.Scrub = &Scrub{}
 	st.Env = &Env{}
 	st.Env.Refresh()
 
@@ -84,4 +159,19 @@ func New() *Stats {
 
 func (s *Stats) Refresh() {
 	s.Env.Refresh()
+	*s.Replication = s.GetReplication()
+}
+
+// Return copy of replication stats
+func (s *Stats) GetReplication() Replication {
+	s.replM.Lock()
+	defer s.replM.Unlock()
+	return s.repl
+}
+
+// Change replication stats, fn is called under lock
+func (s *Stats) UpdateReplication(fn func(r *Replication)) {
+	s.replM.Lock()
+	defer s.replM.Unlock()
+	fn(&s.repl)
 }
@@ -0,0 +1,244 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Compression codecs. FSize and Md5 of compressed file are size and md5 of original content,
+// size of stored data is kept in the index along with the codec
+const (
+	CODEC_NONE   = 0
+	CODEC_GZIP   = 1
+	CODEC_ZSTD   = 2
+	CODEC_BROTLI = 3
+)
+
+// Content-Encoding names of codecs
+var codecNames = map[byte]string{
+	CODEC_GZIP:   "gzip",
+	CODEC_ZSTD:   "zstd",
+	CODEC_BROTLI: "br",
+}
+
+// Return codec by Content-Encoding name
+func CodecByName(name string) (codec byte, ok bool) {
+	for c, n := range codecNames {
+		if n == name {
+			return c, true
+		}
+	}
+	return
+}
+
+// Compressed data must be smaller than original at least on this ratio, otherwise file will be stored as is
+const compressMinProfit = 0.9
+
+func newEncoder(codec byte, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case CODEC_GZIP:
+		return gzip.NewWriter(w), nil
+	case CODEC_ZSTD:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	case CODEC_BROTLI:
+		return brotli.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("Unknown codec: %d", codec)
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+func newDecoder(codec byte, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case CODEC_GZIP:
+		return gzip.NewReader(r)
+	case CODEC_ZSTD:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{d}, nil
+	case CODEC_BROTLI:
+		return io.NopCloser(brotli.NewReader(r)), nil
+	}
+	return nil, fmt.Errorf("Unknown codec: %d", codec)
+}
+
+// Content-Encoding of stored data or empty string for not compressed file
+func (f *File) Encoding() string {
+	if f.link != nil {
+		return f.link.Encoding()
+	}
+	return codecNames[f.codec]
+}
+
+// Size of stored data
+func (f *File) StoredSize() int64 {
+	if f.link != nil {
+		return f.link.StoredSize()
+	}
+	return f.dataSize()
+}
+
+// Return reader of stored (possibly compressed) data
+func (f *File) GetRawReader() *Reader {
+	if f.link != nil {
+		return f.link.GetRawReader()
+	}
+	if f.codec == CODEC_NONE {
+		return f.GetReader()
+	}
+	return newReader(f.data(), f.dataOff(), f.csize, f.c.s)
+}
+
+// Check content type of file for compression, return reader with whole content
+func (s *Storage) compressible(name string, r io.Reader, size int64) (ok bool, rd io.Reader, err error) {
+	ctype := mime.TypeByExtension(filepath.Ext(name))
+	if ctype == "" {
+		head := make([]byte, 512)
+		if size < int64(len(head)) {
+			head = head[:size]
+		}
+		var n int
+		n, err = io.ReadFull(r, head)
+		if err != nil {
+			return
+		}
+		ctype = http.DetectContentType(head[:n])
+		r = io.MultiReader(bytes.NewReader(head[:n]), r)
+	}
+	if i := strings.Index(ctype, ";"); i >= 0 {
+		ctype = ctype[:i]
+	}
+	for _, t := range s.Conf.CompressTypes {
+		if t == ctype || (strings.HasSuffix(t, "/*") && strings.HasPrefix(ctype, t[:len(t)-1])) {
+			return true, r, nil
+		}
+	}
+	return false, r, nil
+}
+
+// Compress content of new file if it is allowed by config. Return reader with data that must be written
+// and md5 of original content (nil if file will be stored as is)
+// Content is compressed while it's read, only compressed data is kept in memory until file is allocated
+func (s *Storage) compress(f *File, r io.Reader) (rd io.Reader, sum []byte, err error) {
+	codec, _ := CodecByName(s.Conf.CompressCodec)
+	if codec == CODEC_NONE || f.FSize < s.Conf.CompressMinSize || f.FSize > s.Conf.CompressMaxSize || s.needSpan(f.FSize, 0) {
+		return r, nil, nil
+	}
+	ok, r, err := s.compressible(f.Name, r, f.FSize)
+	if err != nil || !ok {
+		return r, nil, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, f.FSize/2))
+	enc, err := newEncoder(codec, buf)
+	if err != nil {
+		return
+	}
+	h := md5.New()
+	n, err := io.Copy(enc, io.TeeReader(io.LimitReader(r, f.FSize), h))
+	if err == nil {
+		err = enc.Close()
+	}
+	if err != nil {
+		return
+	}
+	if n != f.FSize {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	if err = checkEOF(r); err != nil {
+		return
+	}
+	if float64(buf.Len()) > float64(f.FSize)*compressMinProfit {
+		// original content is restored from compressed data
+		dec, e := newDecoder(codec, buf)
+		return eofCloser{dec}, nil, e
+	}
+	f.codec = codec
+	f.csize = int64(buf.Len())
+	return buf, h.Sum(nil), nil
+}
+
+// Closes decoder when content is read to the end
+type eofCloser struct {
+	io.ReadCloser
+}
+
+func (e eofCloser) Read(p []byte) (n int, err error) {
+	if n, err = e.ReadCloser.Read(p); err == io.EOF {
+		e.ReadCloser.Close()
+	}
+	return
+}
+
+// Implements io.ReaderAt over decoded content. Content is decoded sequentially,
+// reading before the current position restarts decoding
+type decodeReader struct {
+	f   *File
+	dec io.ReadCloser
+	pos int64
+}
+
+func (d *decodeReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if d.dec == nil || off < d.pos {
+		if d.dec != nil {
+			d.dec.Close()
+		}
+		raw := io.NewSectionReader(d.f.data(), d.f.dataOff(), d.f.csize)
+		if d.dec, err = newDecoder(d.f.codec, raw); err != nil {
+			d.dec = nil
+			return
+		}
+		d.pos = 0
+	}
+	if off > d.pos {
+		var k int64
+		k, err = io.CopyN(io.Discard, d.dec, off-d.pos)
+		d.pos += k
+		if err != nil {
+			return
+		}
+	}
+	n, err = io.ReadFull(d.dec, p)
+	d.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	if err == io.EOF {
+		d.dec.Close()
+		d.dec = nil
+	}
+	return
+}
@@ -0,0 +1,301 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/utils"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+var ErrCompactRunning = errors.New("Compaction already running")
+
+// Start background compaction for container with given id or for all containers if id == 0
+func (s *Storage) Compact(id int64) (err error) {
+	var containers []*Container
+	s.m.RLock()
+	if id == 0 {
+		for _, c := range s.Containers {
+			containers = append(containers, c)
+		}
+	} else if c, ok := s.Containers[id]; ok {
+		containers = append(containers, c)
+	}
+	s.m.RUnlock()
+	if len(containers) == 0 {
+		return fmt.Errorf("Container %d not found", id)
+	}
+	if !atomic.CompareAndSwapInt32(&s.compacting, 0, 1) {
+		return ErrCompactRunning
+	}
+	go func() {
+		defer atomic.StoreInt32(&s.compacting, 0)
+		for _, c := range containers {
+			s.compactContainer(c)
+		}
+	}()
+	return
+}
+
+// Start compaction for containers with hole ratio more than Conf.CompactHoleRatio
+func (s *Storage) compactIfNeeded() {
+	if s.Conf.CompactHoleRatio <= 0 {
+		return
+	}
+	var containers []*Container
+	s.m.RLock()
+	for _, c := range s.Containers {
+		if c.holeRatio() > s.Conf.CompactHoleRatio {
+			containers = append(containers, c)
+		}
+	}
+	s.m.RUnlock()
+	if len(containers) == 0 || !atomic.CompareAndSwapInt32(&s.compacting, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&s.compacting, 0)
+		for _, c := range containers {
+			s.compactContainer(c)
+		}
+	}()
+}
+
+// Return true if compaction in progress
+func (s *Storage) Compacting() bool {
+	return atomic.LoadInt32(&s.compacting) == 1
+}
+
+// Move files to the begin of container while it possible
+func (s *Storage) compactContainer(c *Container) {
+	st := time.Now()
+	s.Stats.Compact.Runs.Add()
+	var moved, size int64
+	for {
+		var pass int64
+		for _, f := range c.tailFiles() {
+			if c.holesCount() == 0 {
+				break
+			}
+			ok, err := s.moveFile(c, f)
+			if err != nil {
+				aelog.Warnf("Compact: can't move file %s: %v", f.Name, err)
+				continue
+			}
+			if ok {
+				pass++
+				size += f.FSize
+				s.Stats.Compact.Files.Add()
+				s.Stats.Compact.Bytes.AddN(int(f.FSize))
+				// rate limit
+				if s.Conf.CompactRate > 0 {
+					time.Sleep(time.Duration(float64(f.FSize) / float64(s.Conf.CompactRate) * float64(time.Second)))
+				}
+			}
+		}
+		moved += pass
+		if pass == 0 {
+			break
+		}
+	}
+	if n, err := c.truncateTail(); err != nil {
+		aelog.Warnf("Compact: can't truncate container %d: %v", c.Id, err)
+	} else if n > 0 {
+		s.Stats.Compact.Truncated.AddN(int(n))
+	}
+	aelog.Infof("Compact: container %d, moved %d files (%s) for a %v", c.Id, moved, utils.HumanBytes(size), time.Since(st))
+}
+
+// Copy file to a hole placed before it and replace file in index
+// Storage is not frozen while data is copied, as while content of new file is read (see AddWith),
+// md5 is set after copy so snapshot stores not yet copied file as hole
+func (s *Storage) moveFile(c *Container, f *File) (ok bool, err error) {
+	if f.Open() != nil {
+		return
+	}
+	defer f.Close()
+	// manifest of spanning file refers to offsets of extents, shared content is referenced by links
+	if f.c != c || f.spanned() || f.shared() {
+		return
+	}
+	nf := &File{
+		Name:  f.Name,
+		FSize: f.FSize,
+		Time:  f.Time,
+		Hdr:   f.Hdr,
+		codec: f.codec,
+		csize: f.csize,
+	}
+	nf.Indx = f.Indx
+	if hdr := headerSize(f.Name, s.encrypted()); f.Hdr > 0 && hdr > f.Hdr {
+		// file can be moved to place with own nonce
+		nf.Hdr = hdr
+		nf.Indx = R.Index(nf.dataSize() + int64(hdr))
+	}
+	nf.copyAttrs(f)
+	s.fm.RLock()
+	allocated := c.allocateBefore(nf, f.Offset())
+	s.fm.RUnlock()
+	if !allocated {
+		return
+	}
+	if err = copyData(nf, f); err != nil {
+		nf.Delete()
+		return
+	}
+
+	// replace
+	s.fm.RLock()
+	defer s.fm.RUnlock()
+	nf.Md5 = f.Md5
+	if err = nf.writeHeader(); err != nil {
+		nf.Delete()
+		return
+	}
+	name := nf.Name
+	if !s.dedupMove(f, nf) || !s.Index.Replace(f, nf) {
+		// file was deleted or replaced while copying
+		nf.Delete()
+		return
+	}
+	// file was renamed while copying
+	if nf.Name != name {
+		if e := nf.writeHeader(); e != nil {
+			aelog.Debugf("Compact: can't rewrite header of %s: %v", nf.Name, e)
+		}
+	}
+	c.journalWrite(&journalRecord{op: JOURNAL_MOVE, off: f.Off, f: nf})
+	f.Delete()
+	s.expireAdd(nf)
+	return true, nil
+}
+
+// Copy data from one file to another and check md5
+func copyData(dst, src *File) (err error) {
+	h := md5.New()
+	buf := make([]byte, 64*1024)
+	var off int64
+	size := src.dataSize()
+	for off < size {
+		n := int64(len(buf))
+		if size-off < n {
+			n = size - off
+		}
+		if _, err = src.data().ReadAt(buf[:n], src.dataOff()+off); err != nil {
+			return
+		}
+		h.Write(buf[:n])
+		if _, err = dst.WriteAt(buf[:n], off); err != nil {
+			return
+		}
+		off += n
+	}
+	// md5 of compressed file is md5 of original content
+	if src.codec != CODEC_NONE {
+		h.Reset()
+		if _, err = io.Copy(h, dst.GetReader()); err != nil {
+			return
+		}
+	}
+	if md5 := h.Sum(nil); !bytes.Equal(md5, src.Md5) {
+		return fmt.Errorf("MD5 mismatched: %x vs %x", md5, src.Md5)
+	}
+	return
+}
+
+// Allocate file in the hole placed before limit offset
+func (c *Container) allocateBefore(f *File, limit int64) (ok bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	h := c.holeIndex.GetBefore(f.Index(), limit)
+	if h == nil {
+		return
+	}
+	c.allocToHole(f, h)
+	f.nonce = c.newNonce()
+	c.FileCount++
+	c.FileSize += f.dataSize()
+	c.FileRealSize += f.Size()
+	f.Init(c)
+	c.reserveSpace(f)
+	c.ch = true
+	return true
+}
+
+// Return all written files from the end of container to the begin
+func (c *Container) tailFiles() (files []*File) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	files = make([]*File, 0, c.FileCount)
+	var sp Space = c.last
+	for sp != nil {
+		if f, ok := sp.(*File); ok && !f.deleted && f.Md5 != nil {
+			files = append(files, f)
+		}
+		sp = sp.Prev()
+	}
+	return
+}
+
+func (c *Container) holesCount() int64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.holeIndex.Count
+}
+
+// Holes size / used space
+func (c *Container) holeRatio() float64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.last == nil || c.holeIndex.Size == 0 {
+		return 0
+	}
+	return float64(c.holeIndex.Size) / float64(c.last.End())
+}
+
+// Truncate free space in the end of data file, return count of released bytes
+// Container keeps its size, the tail is allocated again when new files are placed to it
+func (c *Container) truncateTail() (n int64, err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	// parts of group keep own size
+	if c.g != nil {
+		return
+	}
+	var end int64
+	if c.last != nil {
+		end = c.last.End()
+	}
+	info, err := c.f.Stat()
+	if err != nil {
+		return
+	}
+	if n = info.Size() - end; n <= 0 {
+		return 0, nil
+	}
+	if err = c.f.Truncate(end); err == nil {
+		// preallocation of the tail is lost, space is allocated again for new files (see reserveSpace)
+		c.sparse = true
+	}
+	return
+}
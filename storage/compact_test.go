@@ -0,0 +1,91 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	s := newTestStorage(t, t.TempDir())
+	defer s.Close()
+	s.Conf.CompactRate = 0
+	for i := 0; i < 100; i++ {
+		size := int64(1024 * (i%10 + 1))
+		if _, err := s.Add(fmt.Sprint(i), randReader(size), size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.AddWith("meta", randReader(1024), 1024, FileAttrs{Meta: map[string]string{"k": "v"}, ContentType: "text/plain"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 90; i++ {
+		if i%3 != 0 {
+			s.Delete(fmt.Sprint(i))
+		}
+	}
+	var c *Container
+	for _, c = range s.Containers {
+	}
+	// opened file must be readable after moving
+	opened, _ := s.Get("95")
+	opened.Open()
+
+	moved, _ := s.Get("meta")
+	endBefore := c.last.End()
+	s.compactContainer(c)
+
+	if c.last.End() >= endBefore {
+		t.Errorf("Container was not compacted: %d vs %d", c.last.End(), endBefore)
+	}
+	if info, _ := c.f.Stat(); info.Size() != c.last.End() || !c.sparse {
+		t.Errorf("Data file was not truncated: %d vs %d", info.Size(), c.last.End())
+	}
+	// moved file keeps attributes and has own header
+	f, _ := s.Get("meta")
+	if f == moved {
+		t.Error("File was not moved")
+	}
+	if ct, _ := f.StoredType(); f.Meta()["k"] != "v" || ct != "text/plain" {
+		t.Errorf("Attributes are lost: %v %s", f.Meta(), ct)
+	}
+	buf := make([]byte, f.Hdr)
+	c.d.ReadAt(buf, f.Off)
+	if hf, _, err := unmarshalHeader(buf); err != nil || hf.Name != "meta" {
+		t.Errorf("Unexpected header of moved file: %v %v", hf, err)
+	}
+
+	h := md5.New()
+	io.Copy(h, opened.GetReader())
+	if fmt.Sprintf("%x", h.Sum(nil)) != opened.Md5S() {
+		t.Error("Opened file was corrupted")
+	}
+	opened.Close()
+	if f, _ := s.Get("95"); f == opened {
+		t.Error("File was not moved")
+	}
+
+	if err := c.Check(); err != nil {
+		t.Error(err)
+	}
+	if s.Index.Count() != 41 || c.FileCount != 41 {
+		t.Errorf("Unexpected files count: %d (%d)", s.Index.Count(), c.FileCount)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	s := newTestStorage(t, t.TempDir())
+	s.Conf.Journal = false
+	s.Conf.CompressTypes = []string{"text/*"}
+	s.Conf.CompressMinSize = 1024
+	s.Conf.CompressMaxSize = 1024 * 1024
+
+	var text bytes.Buffer
+	for i := 0; text.Len() < 200000; i++ {
+		fmt.Fprintf(&text, "line %d of compressible text\n", i)
+	}
+	data := text.Bytes()
+	sum := md5.Sum(data)
+	if _, err := s.Add("filler", randReader(100000), 100000); err != nil {
+		t.Fatal(err)
+	}
+	for _, codec := range []string{"gzip", "zstd", "br"} {
+		s.Conf.CompressCodec = codec
+		f, err := s.Add(codec+".txt", bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Encoding() != codec || f.StoredSize() >= f.FSize || !bytes.Equal(f.Md5, sum[:]) {
+			t.Errorf("File was not compressed with %s: %d of %d", codec, f.StoredSize(), f.FSize)
+		}
+	}
+	// not matched type and incompressible content are stored as is
+	if f, _ := s.Add("bin", randReader(10000), 10000); f.Encoding() != "" {
+		t.Error("Binary file was compressed")
+	}
+	s.Conf.CompressTypes = []string{"application/*"}
+	var rnd bytes.Buffer
+	io.Copy(&rnd, randReader(10000))
+	rndSum := md5.Sum(rnd.Bytes())
+	if f, _ := s.Add("rand.json", bytes.NewReader(rnd.Bytes()), 10000); f.Encoding() != "" || f.StoredSize() != 10000 {
+		t.Error("Incompressible file was stored compressed")
+	} else if !bytes.Equal(f.Md5, rndSum[:]) || f.CheckMd5() != nil {
+		t.Error("Content of incompressible file was changed")
+	}
+
+	check := func(s *Storage) {
+		for _, codec := range []string{"gzip", "zstd", "br"} {
+			f, ok := s.Get(codec + ".txt")
+			if !ok {
+				t.Errorf("File %s.txt not found", codec)
+				continue
+			}
+			if f.Encoding() != codec {
+				t.Errorf("File %s.txt lost encoding: %q", codec, f.Encoding())
+			}
+			if err := f.CheckMd5(); err != nil {
+				t.Error(err)
+			}
+			r := f.GetReader()
+			if r.Size() != int64(len(data)) {
+				t.Errorf("Unexpected size of decoded content: %d", r.Size())
+			}
+			// backward and forward reads
+			for _, off := range []int64{150000, 10, 100000, 199990} {
+				buf := make([]byte, 100)
+				n, _ := r.ReadAt(buf, off)
+				if !bytes.Equal(buf[:n], data[off:off+int64(n)]) || n == 0 {
+					t.Errorf("%s: content mismatched at %d", codec, off)
+				}
+			}
+			dec, err := newDecoder(f.codec, f.GetRawReader())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b, _ := io.ReadAll(dec); !bytes.Equal(b, data) {
+				t.Errorf("%s: raw content can't be decoded", codec)
+			}
+		}
+		if err := s.Check(); err != nil {
+			t.Error(err)
+		}
+	}
+	check(s)
+
+	// compressed files are moved as is
+	s.Delete("filler")
+	var c *Container
+	for _, c = range s.Containers {
+	}
+	s.Conf.CompactRate = 0
+	before, _ := s.Get("br.txt")
+	s.compactContainer(c)
+	if f, _ := s.Get("br.txt"); f == before {
+		t.Error("Compressed file was not moved")
+	}
+	check(s)
+	s.Close()
+	s = reopenStorage(t, s)
+	check(s)
+	s.Close()
+
+	// recover compressed files from headers
+	if err := os.WriteFile(c.indexName(), []byte("broken index"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	s2 := new(Storage)
+	s2.Init(s.Conf)
+	s2.Open()
+	res, err := s2.RepairContainer(c.Id, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Files != 5 || res.Corrupted != 0 {
+		t.Errorf("Unexpected repair result: %+v", res)
+	}
+	s = reopenStorage(t, s)
+	defer s.Close()
+	check(s)
+}
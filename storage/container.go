@@ -45,9 +45,18 @@ type Container struct {
 	last                *File
 	holeIndex           *HoleIndex
 	s                   *Storage
+	disk                *Disk
 	f                   *os.File
-	m                   *sync.Mutex
-	ch                  bool
+	// parts of container on several disks if it is stored with redundancy (see group.go)
+	g *group
+	// data file accessor, encrypts data if container has a key (see crypt.go)
+	d   dataFile
+	key *containerKey
+	m   *sync.Mutex
+	ch  bool
+	j   *journal
+	// data file has ranges released to file system (see punchHole)
+	sparse bool
 }
 
 func (c *Container) Init(s *Storage, rr *dump.ResultReader) (err error) {
@@ -55,15 +64,39 @@ func (c *Container) Init(s *Storage, rr *dump.ResultReader) (err error) {
 	c.m = new(sync.Mutex)
 	c.s = s
 	// open file
-	c.f, err = os.OpenFile(c.fileName(), os.O_RDWR|os.O_CREATE, 0666)
+	if c.g == nil && c.Created {
+		if c.g, err = c.loadGroup(); err != nil {
+			return
+		}
+	}
+	if c.g != nil {
+		err = c.g.open(!c.Created)
+	} else {
+		c.f, err = os.OpenFile(c.fileName(), os.O_RDWR|os.O_CREATE, 0666)
+	}
 	if err != nil {
 		return
 	}
+	if err = c.openData(); err != nil {
+		return
+	}
 	c.holeIndex = new(HoleIndex)
 	c.holeIndex.Init(s.Conf.ContainerSize)
 	if err = c.restore(rr); err != nil {
 		return
 	}
+	if c.g == nil && c.Created {
+		// released ranges and truncated tail are not known after restart
+		c.sparse = c.physicalSize() < c.Size
+	}
+	if s.Conf.Journal {
+		if c.j, err = openJournal(c.journalName(), s.Conf.JournalSync == 0); err != nil {
+			return
+		}
+		if c.g != nil {
+			c.g.mirrorJournal(c.j)
+		}
+	}
 	c.ch = true
 	// build holeIndex
 	/*var last, next Space
@@ -100,6 +133,9 @@ func (c *Container) Init(s *Storage, rr *dump.ResultReader) (err error) {
 
 func (c *Container) create() (err error) {
 	c.Size = c.s.Conf.ContainerSize
+	if c.g != nil {
+		return c.g.create()
+	}
 	if err = c.falloc(); err != nil {
 		aelog.Infoln("Fallocate doesn't work:", err, "\nTry to truncate...")
 		if err = c.fallocTruncate(); err != nil {
@@ -117,15 +153,51 @@ func (c *Container) fallocTruncate() (err error) {
 	return
 }
 
+// Return space taken by data files of container on disks
+func (c *Container) physicalSize() (n int64) {
+	if c.g == nil {
+		if n, err := diskUsage(c.f); err == nil {
+			return n
+		}
+		return c.Size
+	}
+	for _, mb := range c.g.members {
+		if f := mb.f.Load(); f != nil && mb.getState() == MEMBER_OK {
+			if size, err := diskUsage(f); err == nil {
+				n += size
+			}
+		}
+	}
+	return
+}
+
 func (c *Container) fileName() string {
-	return fmt.Sprintf("%sc%d.data", c.s.Conf.DataPath, c.Id)
+	return fmt.Sprintf("%sc%d.data", c.disk.Path, c.Id)
 }
 
 func (c *Container) indexName() string {
-	return fmt.Sprintf("%sc%d.index", c.s.Conf.DataPath, c.Id)
+	return fmt.Sprintf("%sc%d.index", c.disk.Path, c.Id)
+}
+
+// Remove files of closed container. Index is removed first: container without index is not opened
+func (c *Container) removeFiles() {
+	if c.g != nil {
+		c.g.drop()
+		return
+	}
+	os.Remove(c.indexName())
+	os.Remove(c.fileName())
+	os.Remove(c.journalName())
+	os.Remove(c.keyName())
 }
 
 func (c *Container) Close() (err error) {
+	if c.j != nil {
+		c.j.close()
+	}
+	if c.g != nil {
+		return c.g.close()
+	}
 	return c.f.Close()
 }
 
@@ -146,6 +218,10 @@ func (d *dumper) Write(w io.Writer) error {
 	if d.next != nil {
 		toReturn := d.next
 		d.next = toReturn.Prev()
+		// deleted or not yet written files will be stored as holes
+		if f, ok := toReturn.(*File); ok && (f.deleted || f.Md5 == nil) {
+			return f.Hole.MarshalTo(w)
+		}
 		return toReturn.MarshalTo(w)
 	}
 	return io.EOF
@@ -162,33 +238,54 @@ func (c *Container) Dump() (err error) {
 	st := time.Now()
 	pr := time.Since(st)
 
-	n, err := dump.DumpTo(c.indexName(), &dumper{c: c})
+	var n int64
+	if c.g != nil {
+		n, err = c.g.dump()
+	} else {
+		n, err = c.dumpTo(c.indexName())
+	}
 	aelog.Debugf("Dump container %d, writed %s for a %v (prep: %v)", c.Id, utils.HumanBytes(n), time.Since(st), pr)
 	c.ch = false
+	if err == nil && c.j != nil {
+		err = c.j.truncate()
+	}
 	return
 }
 
+// Write container index to filename. Container must be locked
+func (c *Container) dumpTo(filename string) (n int64, err error) {
+	return dump.DumpTo(filename, &dumper{c: c})
+}
+
 func (c *Container) restore(rr *dump.ResultReader) (err error) {
 	var i int64
 	if rr == nil {
 		return nil
 	}
 
-	c.FileRealSize = 0
+	c.FileCount, c.FileSize, c.FileRealSize = 0, 0, 0
 	var sp, prev Space
-	sp, err = UnmarshallSpace(rr.B)
-	if err != nil {
-		if err == io.EOF {
-			return nil
+	// skip holes in the tail
+	for {
+		sp, err = UnmarshallSpace(rr.B)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return
+		}
+		if !sp.IsFree() {
+			break
 		}
-		return
 	}
 	if sp != nil {
 		c.last = sp.(*File)
 	}
 	if c.last != nil {
 		c.last.Init(c)
-		c.s.Index.Add(c.last)
+		c.s.Index.restore(c.last)
+		c.FileCount++
+		c.FileSize += c.last.dataSize()
 		c.FileRealSize += c.last.Size()
 		prev = c.last
 	}
@@ -206,7 +303,9 @@ func (c *Container) restore(rr *dump.ResultReader) (err error) {
 			lastF.SetNext(prev)
 			prev.SetPrev(lastF)
 			lastF.Init(c)
-			c.s.Index.Add(lastF)
+			c.s.Index.restore(lastF)
+			c.FileCount++
+			c.FileSize += lastF.dataSize()
 			c.FileRealSize += lastF.Size()
 		} else {
 			lastS := sp.(*Hole)
@@ -226,17 +325,19 @@ func (c *Container) Allocate(f *File, target int) (ok bool) {
 	c.m.Lock()
 	defer func() {
 		if ok {
+			f.nonce = c.newNonce()
 			c.FileCount++
-			c.FileSize += f.FSize
+			c.FileSize += f.dataSize()
 			c.FileRealSize += f.Size()
 			f.Init(c)
+			c.reserveSpace(f)
 			c.ch = true
 		}
 		c.m.Unlock()
 	}()
 
 	if f.Indx == 0 {
-		f.Indx = R.Index(f.FSize)
+		f.Indx = R.Index(f.dataSize())
 	}
 
 	// if first
@@ -279,36 +380,40 @@ func (c *Container) allocAppend(f *File) (ok bool) {
 
 func (c *Container) allocInsert(f *File) (ok bool) {
 	if s := c.holeIndex.GetBiggest(int(f.Index())); s != nil {
-		if s.Index() == f.Index() {
-			f.SetOffset(s.Offset())
-			c.replace(s, f)
-			ok = true
-			return
-		}
-
-		// insert to begin of hole
-		f.SetPrev(s.Prev())
-		f.SetNext(s)
-		f.SetOffset(s.Offset())
-		s.SetPrev(f)
-		s.SetOffset(s.Offset() + f.Size())
-		p := f.Prev()
-		if p != nil {
-			p.SetNext(f)
-		}
-		h := c.insertNormalizedHole(s, s.Size()-f.Size())
+		c.allocToHole(f, s)
 		ok = true
-		c.normalizeHole(h)
 	}
 	return
 }
 
+// Place file to begin of hole. Hole must be removed from holeIndex
+func (c *Container) allocToHole(f *File, s *Hole) {
+	if s.Index() == f.Index() {
+		f.SetOffset(s.Offset())
+		c.replace(s, f)
+		return
+	}
+
+	// insert to begin of hole
+	f.SetPrev(s.Prev())
+	f.SetNext(s)
+	f.SetOffset(s.Offset())
+	s.SetPrev(f)
+	s.SetOffset(s.Offset() + f.Size())
+	p := f.Prev()
+	if p != nil {
+		p.SetNext(f)
+	}
+	h := c.insertNormalizedHole(s, s.Size()-f.Size())
+	c.normalizeHole(h)
+}
+
 func (c *Container) Delete(f *File) {
 	c.m.Lock()
 	defer c.m.Unlock()
 	c.ch = true
 	c.FileCount--
-	c.FileSize -= f.FSize
+	c.FileSize -= f.dataSize()
 	c.FileRealSize -= f.Size()
 	// is last
 	if c.last.Offset() == f.Offset() {
@@ -387,12 +492,18 @@ func (c *Container) mergeHoles(start, end *Hole) (newHole *Hole) {
 	}
 
 	// remove old
+	var punched int64
 	rm := start
-	for rm != end {
+	for {
 		c.holeIndex.Delete(rm)
+		if rm.punched {
+			punched += rm.Size()
+		}
+		if rm == end {
+			break
+		}
 		rm = rm.Next().(*Hole)
 	}
-	c.holeIndex.Delete(end)
 
 	newHole.Indx = R.Index(newSize)
 	newHole.SetOffset(start.Offset())
@@ -404,9 +515,37 @@ func (c *Container) mergeHoles(start, end *Hole) (newHole *Hole) {
 	}
 	// add to index
 	c.holeIndex.Add(newHole)
+	c.punchHole(newHole, punched)
 	return
 }
 
+// Release space of big hole to file system, released is a size of already punched parts. Container must be locked
+func (c *Container) punchHole(h *Hole, released int64) {
+	size := h.Size()
+	if c.s.Conf.PunchHoleSize == 0 || size < c.s.Conf.PunchHoleSize || c.g != nil {
+		return
+	}
+	if err := c.punch(h.Offset(), size); err != nil {
+		aelog.Debugf("Container %d: can't punch hole: %v", c.Id, err)
+		return
+	}
+	h.punched = true
+	c.sparse = true
+	c.s.Stats.Compact.Punched.AddN(int(size - released))
+}
+
+// Allocate released range under new file again. Container must be locked
+func (c *Container) reserveSpace(f *File) {
+	if !c.sparse {
+		return
+	}
+	if err := c.reserve(f.Offset(), f.Size()); err != nil {
+		// don't try anymore, lack of space will be reported by write
+		aelog.Warnf("Container %d: can't allocate space for %s: %v", c.Id, f.Name, err)
+		c.sparse = false
+	}
+}
+
 // Replace s1 to s2. Move next and prev
 func (c *Container) replace(s1, s2 Space) {
 	n := s1.Next()
@@ -436,9 +575,10 @@ func (c *Container) insertNormalizedHole(h *Hole, size int64) *Hole {
 		panic("Check algo!")
 	}
 	next := &Hole{
-		Off:  h.End(),
-		prev: h,
-		next: h.Next(),
+		Off:     h.End(),
+		prev:    h,
+		next:    h.Next(),
+		punched: h.punched,
 	}
 	if next.next != nil {
 		next.next.SetPrev(next)
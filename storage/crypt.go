@@ -0,0 +1,559 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Encryption at rest. Data file of container is encrypted with AES-CTR, counter is IV of container + offset / 16,
+// so any range of data can be read or written independently and data file keeps the same layout
+// Id of key and IV are stored in cN.key file near data file, container without it is stored as plaintext
+// Every allocation gets random nonce, content and header of file are encrypted with IV of container XOR nonce,
+// so space reused by other file is never encrypted with the same keystream. Nonce is kept in the index
+// and in plaintext prefix of file header (see fileheader.go). Files without nonce (written by older versions
+// and free space) are encrypted with IV of container
+// Keys are rotated by adding new key to key file: new containers use the key with the biggest id,
+// old containers can be re-encrypted offline by aerekey
+
+var (
+	ErrKeyNotFound = errors.New("Encryption key not found")
+	errKeyCorrupt  = errors.New("Container key file corrupted")
+)
+
+var keyMagic = []byte("AEK1")
+
+const NONCE_SIZE = aes.BlockSize
+
+// Set of keys loaded from key file
+// Format: one key per line "id hexkey", id is a positive number, key is 16, 24 or 32 bytes (AES-128, 192, 256)
+type Keyring struct {
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// Load keys from file
+func LoadKeyring(filename string) (kr *Keyring, err error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	kr = &Keyring{keys: make(map[uint32][]byte)}
+	sc := bufio.NewScanner(fh)
+	for ln := 1; sc.Scan(); ln++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"id key\"", filename, ln)
+		}
+		id, e := strconv.ParseUint(fields[0], 10, 32)
+		if e != nil || id == 0 {
+			return nil, fmt.Errorf("%s:%d: incorrect key id", filename, ln)
+		}
+		key, e := hex.DecodeString(fields[1])
+		if e != nil {
+			return nil, fmt.Errorf("%s:%d: incorrect key: %v", filename, ln, e)
+		}
+		if _, e = aes.NewCipher(key); e != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, ln, e)
+		}
+		if _, ok := kr.keys[uint32(id)]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate key id %d", filename, ln, id)
+		}
+		kr.keys[uint32(id)] = key
+		if uint32(id) > kr.current {
+			kr.current = uint32(id)
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return nil, err
+	}
+	if kr.current == 0 {
+		return nil, fmt.Errorf("%s: no keys", filename)
+	}
+	return
+}
+
+// Id of key for new containers
+func (kr *Keyring) Current() uint32 {
+	return kr.current
+}
+
+// Return true if new containers are encrypted
+func (s *Storage) encrypted() bool {
+	kr, _ := s.keyring()
+	return kr != nil
+}
+
+// Return keyring from Conf.KeyFile, nil if encryption is not configured
+func (s *Storage) keyring() (*Keyring, error) {
+	s.krOnce.Do(func() {
+		if s.Conf.KeyFile != "" {
+			s.kr, s.krErr = LoadKeyring(s.Conf.KeyFile)
+		}
+	})
+	return s.kr, s.krErr
+}
+
+// Access to data file of container
+type dataFile interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Encrypting wrapper over data file
+type cryptFile struct {
+	f     dataFile
+	block cipher.Block
+	iv    [aes.BlockSize]byte
+}
+
+var cryptBufs = sync.Pool{New: func() interface{} { return make([]byte, 64*1024) }}
+
+// XOR b with keystream starting at off
+func (cf *cryptFile) xor(dst, src []byte, off int64) {
+	var ctr [aes.BlockSize]byte
+	copy(ctr[:], cf.iv[:])
+	// 128-bit big-endian addition of block number
+	n := uint64(off / aes.BlockSize)
+	lo := binary.BigEndian.Uint64(ctr[8:])
+	hi := binary.BigEndian.Uint64(ctr[:8])
+	if lo+n < lo {
+		hi++
+	}
+	binary.BigEndian.PutUint64(ctr[8:], lo+n)
+	binary.BigEndian.PutUint64(ctr[:8], hi)
+	stream := cipher.NewCTR(cf.block, ctr[:])
+	if skip := off % aes.BlockSize; skip > 0 {
+		var pad [aes.BlockSize]byte
+		stream.XORKeyStream(pad[:skip], pad[:skip])
+	}
+	stream.XORKeyStream(dst, src)
+}
+
+// Return accessor with keystream of allocation, plaintext accessor is returned as is
+func withNonce(d dataFile, nonce []byte) dataFile {
+	cf, ok := d.(*cryptFile)
+	if !ok || nonce == nil {
+		return d
+	}
+	nf := &cryptFile{f: cf.f, block: cf.block, iv: cf.iv}
+	for i := range nf.iv {
+		nf.iv[i] ^= nonce[i]
+	}
+	return nf
+}
+
+// Accessor of content and header of file
+func (f *File) data() dataFile {
+	return withNonce(f.c.d, f.nonce)
+}
+
+// Data file without encryption
+func (c *Container) raw() dataFile {
+	if cf, ok := c.d.(*cryptFile); ok {
+		return cf.f
+	}
+	return c.d
+}
+
+// Return random nonce for new allocation, nil for plaintext container. Container must be locked
+func (c *Container) newNonce() []byte {
+	if c.key == nil || c.key.id == 0 {
+		return nil
+	}
+	nonce := make([]byte, NONCE_SIZE)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return nonce
+}
+
+func (cf *cryptFile) ReadAt(p []byte, off int64) (n int, err error) {
+	n, err = cf.f.ReadAt(p, off)
+	cf.xor(p[:n], p[:n], off)
+	return
+}
+
+func (cf *cryptFile) WriteAt(p []byte, off int64) (n int, err error) {
+	buf := cryptBufs.Get().([]byte)
+	defer cryptBufs.Put(buf)
+	for len(p) > 0 {
+		l := len(p)
+		if l > len(buf) {
+			l = len(buf)
+		}
+		cf.xor(buf[:l], p[:l], off)
+		var w int
+		w, err = cf.f.WriteAt(buf[:l], off)
+		n += w
+		if err != nil {
+			return
+		}
+		p, off = p[l:], off+int64(l)
+	}
+	return
+}
+
+// Key of container: id of key in keyring and IV. Id 0 means plaintext
+type containerKey struct {
+	id uint32
+	iv [aes.BlockSize]byte
+}
+
+func newContainerKey(id uint32) (ck *containerKey, err error) {
+	ck = &containerKey{id: id}
+	_, err = rand.Read(ck.iv[:])
+	return
+}
+
+func (ck *containerKey) marshal() []byte {
+	buf := append([]byte(nil), keyMagic...)
+	buf = binary.LittleEndian.AppendUint32(buf, ck.id)
+	buf = append(buf, ck.iv[:]...)
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+func unmarshalContainerKey(b []byte) (ck *containerKey, err error) {
+	l := len(keyMagic) + 4 + aes.BlockSize
+	if len(b) != l+4 || !bytes.HasPrefix(b, keyMagic) || crc32.ChecksumIEEE(b[:l]) != binary.LittleEndian.Uint32(b[l:]) {
+		return nil, errKeyCorrupt
+	}
+	ck = &containerKey{id: binary.LittleEndian.Uint32(b[len(keyMagic):])}
+	copy(ck.iv[:], b[len(keyMagic)+4:])
+	return
+}
+
+// Write key file atomically
+func writeContainerKey(filename string, ck *containerKey) (err error) {
+	fh, err := os.OpenFile(filename+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	if _, err = fh.Write(ck.marshal()); err == nil {
+		err = fh.Sync()
+	}
+	fh.Close()
+	if err != nil {
+		return
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+func (c *Container) keyName() string {
+	return fmt.Sprintf("%sc%d.key", c.disk.Path, c.Id)
+}
+
+// Read key of container, plaintext container has key with id 0
+func (c *Container) readKey() (ck *containerKey, err error) {
+	b, err := os.ReadFile(c.keyName())
+	if os.IsNotExist(err) {
+		return &containerKey{}, nil
+	}
+	if err != nil {
+		return
+	}
+	return unmarshalContainerKey(b)
+}
+
+// Return data file accessor for given key
+func (c *Container) cipherFile(ck *containerKey, f dataFile) (d dataFile, err error) {
+	if ck.id == 0 {
+		return f, nil
+	}
+	kr, err := c.s.keyring()
+	if err != nil {
+		return
+	}
+	if kr == nil || kr.keys[ck.id] == nil {
+		return nil, fmt.Errorf("Container %d: %w (id %d)", c.Id, ErrKeyNotFound, ck.id)
+	}
+	block, err := aes.NewCipher(kr.keys[ck.id])
+	if err != nil {
+		return
+	}
+	return &cryptFile{f: f, block: block, iv: ck.iv}, nil
+}
+
+// Return ids of containers stored as plaintext
+func (s *Storage) PlainContainers() (ids []int64) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	for id, c := range s.Containers {
+		if c.key == nil || c.key.id == 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return
+}
+
+// Init data file accessor. New container will be encrypted with current key if encryption is configured
+func (c *Container) openData() (err error) {
+	if err = c.recoverRekey(); err != nil {
+		return
+	}
+	ck, err := c.readKey()
+	if err != nil {
+		return
+	}
+	if !c.Created && ck.id == 0 {
+		kr, e := c.s.keyring()
+		if e != nil {
+			return e
+		}
+		if kr != nil {
+			if ck, err = newContainerKey(kr.Current()); err != nil {
+				return
+			}
+			if c.g != nil {
+				err = c.g.writeKey(ck)
+			} else {
+				err = writeContainerKey(c.keyName(), ck)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	c.key = ck
+	if c.g != nil {
+		c.d, err = c.cipherFile(ck, c.g)
+	} else {
+		c.d, err = c.cipherFile(ck, c.f)
+	}
+	return
+}
+
+// Complete or rollback interrupted re-encryption
+// New data is written to cN.data.rekey, then new key to cN.key.new, then data is renamed and key is committed
+func (c *Container) recoverRekey() (err error) {
+	data, key := c.fileName()+".rekey", c.keyName()+".new"
+	if _, e := os.Stat(data); e == nil {
+		// data was not renamed - old data and key are valid
+		os.Remove(key)
+		return os.Remove(data)
+	}
+	b, e := os.ReadFile(key)
+	if os.IsNotExist(e) {
+		return nil
+	} else if e != nil {
+		return e
+	}
+	ck, err := unmarshalContainerKey(b)
+	if err != nil {
+		return
+	}
+	if ck.id == 0 {
+		if err = os.Remove(c.keyName()); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		return os.Remove(key)
+	}
+	return os.Rename(key, c.keyName())
+}
+
+type RekeyResult struct {
+	OldKey, NewKey uint32
+	Size           int64
+}
+
+// Re-encrypt data file of container with current key or decrypt it if decrypt is true
+// Container already encrypted with current key will be skipped (result.Size == 0)
+// Storage must not be opened
+func (s *Storage) RekeyContainer(id int64, decrypt bool) (res *RekeyResult, err error) {
+	c := &Container{
+		Id:      id,
+		Created: true,
+		s:       s,
+		disk:    s.containerDisk(id),
+		m:       new(sync.Mutex),
+	}
+	if c.isGroup() {
+		return nil, errGroupRepair
+	}
+	if c.f, err = os.Open(c.fileName()); err != nil {
+		return
+	}
+	defer c.f.Close()
+	if err = c.recoverRekey(); err != nil {
+		return
+	}
+	old, err := c.readKey()
+	if err != nil {
+		return
+	}
+	res = &RekeyResult{OldKey: old.id}
+	nk := &containerKey{}
+	if !decrypt {
+		kr, e := s.keyring()
+		if e != nil {
+			return nil, e
+		}
+		if kr == nil {
+			return nil, errors.New("Key file is not configured")
+		}
+		if nk, err = newContainerKey(kr.Current()); err != nil {
+			return
+		}
+	}
+	res.NewKey = nk.id
+	if nk.id == old.id {
+		return
+	}
+	src, err := c.cipherFile(old, c.f)
+	if err != nil {
+		return
+	}
+	info, err := c.f.Stat()
+	if err != nil {
+		return
+	}
+	files, err := s.nonceFiles(c)
+	if err != nil {
+		return
+	}
+
+	tmpName := c.fileName() + ".rekey"
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return
+	}
+	defer func() {
+		tmp.Close()
+		if err != nil {
+			os.Remove(tmpName)
+		}
+	}()
+	dst, err := c.cipherFile(nk, tmp)
+	if err != nil {
+		return
+	}
+	buf := make([]byte, 1024*1024)
+	size := info.Size()
+	var pos int64
+	// files with own nonce, the rest is encrypted with IV of container
+	for _, f := range files {
+		off, end := f.Off, f.End()
+		if end > size {
+			end = size
+		}
+		if off >= end {
+			break
+		}
+		if err = copyRange(dst, src, pos, off, buf); err != nil {
+			return
+		}
+		if f.Hdr > 0 {
+			// plaintext prefix of header
+			if err = copyRange(tmp, c.f, off, off+NONCE_HEADER_SIZE, buf); err != nil {
+				return
+			}
+			off += NONCE_HEADER_SIZE
+		}
+		if err = copyRange(withNonce(dst, f.nonce), withNonce(src, f.nonce), off, end, buf); err != nil {
+			return
+		}
+		pos = end
+	}
+	if err = copyRange(dst, src, pos, size, buf); err != nil {
+		return
+	}
+	if err = tmp.Sync(); err != nil {
+		return
+	}
+	if err = writeContainerKey(c.keyName()+".new", nk); err != nil {
+		return
+	}
+	if err = os.Rename(tmpName, c.fileName()); err != nil {
+		os.Remove(c.keyName() + ".new")
+		return
+	}
+	res.Size = info.Size()
+	err = c.recoverRekey()
+	return
+}
+
+// Return files with own nonce from index of container sorted by offset, storage must not be opened
+func (s *Storage) nonceFiles(c *Container) (files []*File, err error) {
+	if info, e := os.Stat(c.journalName()); e == nil && info.Size() > 0 {
+		return nil, fmt.Errorf("Container %d has not applied journal, open storage to apply it", c.Id)
+	}
+	conf := *s.Conf
+	conf.Journal = false
+	tmp := new(Storage)
+	tmp.Init(&conf)
+	if err = tmp.restoreContainer(c.disk, c.indexName()); err != nil {
+		return
+	}
+	for _, rc := range tmp.Containers {
+		rc.Close()
+	}
+	rc, ok := tmp.Containers[c.Id]
+	if !ok {
+		return nil, fmt.Errorf("Index %s contains wrong container", c.indexName())
+	}
+	for sp := Space(rc.last); sp != nil; sp = sp.Prev() {
+		if f, ok := sp.(*File); ok && f.nonce != nil {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Off < files[j].Off })
+	return
+}
+
+// Copy range of data file between accessors
+func copyRange(dst, src dataFile, off, end int64, buf []byte) error {
+	for off < end {
+		n := int64(len(buf))
+		if end-off < n {
+			n = end - off
+		}
+		r, err := src.ReadAt(buf[:n], off)
+		if r > 0 {
+			if _, e := dst.WriteAt(buf[:r], off); e != nil {
+				return e
+			}
+			off += int64(r)
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
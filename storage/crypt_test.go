@@ -0,0 +1,157 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := t.TempDir() + "/keys"
+	keys := "# test keys\n1 000102030405060708090a0b0c0d0e0f\n"
+	if err := os.WriteFile(keyFile, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestStorage(t, dir)
+	var c *Container
+	for _, c = range s.Containers {
+	}
+	// first container was created without key
+	s.Close()
+	s.Drop()
+	s.Conf.KeyFile = keyFile
+	s = reopenStorage(t, s)
+	for _, c = range s.Containers {
+	}
+	if c.key == nil || c.key.id != 1 {
+		t.Fatalf("Container was not encrypted: %+v", c.key)
+	}
+
+	secret := bytes.Repeat([]byte("secret content "), 1000)
+	for i := 0; i < 10; i++ {
+		if _, err := s.Add(fmt.Sprint("secret", i), bytes.NewReader(secret), int64(len(secret))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(s *Storage) {
+		for i := 0; i < 10; i++ {
+			f, ok := s.Get(fmt.Sprint("secret", i))
+			if !ok {
+				t.Fatalf("File secret%d not found", i)
+			}
+			b, _ := io.ReadAll(f.GetReader())
+			if !bytes.Equal(b, secret) {
+				t.Errorf("File secret%d content mismatched", i)
+			}
+			// unaligned range
+			buf := make([]byte, 7)
+			f.GetReader().ReadAt(buf, 21)
+			if !bytes.Equal(buf, secret[21:28]) {
+				t.Errorf("File secret%d range mismatched", i)
+			}
+		}
+		if err := s.Check(); err != nil {
+			t.Error(err)
+		}
+	}
+	plain := func() bool {
+		b, _ := os.ReadFile(c.fileName())
+		return bytes.Contains(b, []byte("secret content")) || bytes.Contains(b, []byte("secret1"))
+	}
+	check(s)
+
+	// space reused by other file is encrypted with other keystream
+	f, _ := s.Get("secret0")
+	off := f.dataOff()
+	raw := func() []byte {
+		b := make([]byte, len(secret))
+		c.raw().ReadAt(b, off)
+		return b
+	}
+	before := raw()
+	s.Delete("secret0")
+	if f, err := s.Add("secret0", bytes.NewReader(secret), int64(len(secret))); err != nil || f.dataOff() != off {
+		t.Fatalf("Space was not reused: %v", err)
+	}
+	if bytes.Equal(before, raw()) {
+		t.Error("Reused space is encrypted with the same keystream")
+	}
+	s.Close()
+	if plain() {
+		t.Error("Data file contains plaintext")
+	}
+
+	// key is required to open storage
+	conf := *s.Conf
+	conf.KeyFile = ""
+	s2 := new(Storage)
+	s2.Init(&conf)
+	if err := s2.Open(); err == nil {
+		t.Error("Encrypted storage was opened without key")
+	}
+
+	// rotate key
+	keys += "2 00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff\n"
+	if err := os.WriteFile(keyFile, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s = reopenStorage(t, s)
+	check(s)
+	s.Close()
+	conf.KeyFile = keyFile
+	s = new(Storage)
+	s.Init(&conf)
+	res, err := s.RekeyContainer(c.Id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OldKey != 1 || res.NewKey != 2 || res.Size == 0 {
+		t.Errorf("Unexpected rekey result: %+v", res)
+	}
+	if res, _ = s.RekeyContainer(c.Id, false); res.Size != 0 {
+		t.Error("Container was re-encrypted twice")
+	}
+	s = reopenStorage(t, s)
+	check(s)
+	s.Close()
+	if plain() {
+		t.Error("Data file contains plaintext after rekey")
+	}
+
+	// headers are readable by repair
+	s2 = new(Storage)
+	s2.Init(s.Conf)
+	if res, err := s2.RepairContainer(c.Id, true, false); err != nil || res.Files != 10 || res.Corrupted != 0 {
+		t.Errorf("Unexpected repair result: %+v, %v", res, err)
+	}
+
+	// decrypt
+	if _, err = s.RekeyContainer(c.Id, true); err != nil {
+		t.Fatal(err)
+	}
+	if !plain() {
+		t.Error("Data file was not decrypted")
+	}
+	s = reopenStorage(t, s)
+	defer s.Close()
+	check(s)
+}
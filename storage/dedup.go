@@ -0,0 +1,266 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"github.com/cheggaaa/Anteater/aelog"
+	"io"
+	"sync/atomic"
+)
+
+// Deduplication. When Conf.Dedup is on, a new file with content that already stored becomes a link -
+// a small file in the index that refers to the file with the same md5 and size
+// Reference count of content is not stored, it is restored from links on open
+// When the last name of shared content is deleted but links still exist, the file becomes a blob:
+// it is removed from the index, but keeps own space until the last link will be deleted
+
+// Return true if content of file is shared with links
+func (f *File) shared() bool {
+	return f.linked || f.blob || atomic.LoadInt32(&f.refs) > 0
+}
+
+// Return true if file must be added to the index
+func (f *File) listed() bool {
+	return f.extent == 0 && !f.blob && f.noncurrent.IsZero() && f.trashed.IsZero()
+}
+
+// Replace just written file with link to existing content. Return nil if content is not found
+// Content is compared byte by byte, so files with colliding md5 are not linked
+func (s *Storage) dedupLink(f *File) (l *File) {
+	s.dm.Lock()
+	t := s.dedup[string(f.Md5)]
+	if t == nil || t.deleted || t.FSize != f.FSize {
+		s.dm.Unlock()
+		return
+	}
+	t.refs++
+	s.dm.Unlock()
+	if same, err := sameContent(f, t); !same {
+		if err == nil {
+			aelog.Warnf("Dedup: content of %s differs from %s with the same md5", f.Name, t.Name)
+		}
+		s.unref(t)
+		return nil
+	}
+	l = &File{
+		Name:   f.Name,
+		Md5:    f.Md5,
+		FSize:  f.FSize,
+		Time:   f.Time,
+		linked: true,
+		link:   t,
+	}
+	l.copyAttrs(f)
+	l.Indx = R.Index(1)
+	if _, err := s.allocate(l); err != nil {
+		aelog.Warnf("Dedup: can't allocate link for %s: %v", f.Name, err)
+		s.unref(t)
+		return nil
+	}
+	atomic.AddInt64(&s.dedupLinks, 1)
+	atomic.AddInt64(&s.dedupSize, f.FSize)
+	return
+}
+
+// Return true if files have equal content
+func sameContent(a, b *File) (bool, error) {
+	ra, rb := a.GetReader(), b.GetReader()
+	ba, bb := make([]byte, 64*1024), make([]byte, 64*1024)
+	for {
+		n, err := io.ReadFull(ra, ba)
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return false, err
+		}
+		if _, err = io.ReadFull(rb, bb[:n]); err != nil {
+			return false, err
+		}
+		if !bytes.Equal(ba[:n], bb[:n]) {
+			return false, nil
+		}
+	}
+}
+
+// Remember content of new file
+func (s *Storage) dedupAdd(f *File) {
+	if f.linked {
+		return
+	}
+	s.dm.Lock()
+	defer s.dm.Unlock()
+	if s.dedup == nil {
+		return
+	}
+	if t := s.dedup[string(f.Md5)]; t == nil || t.deleted {
+		s.dedup[string(f.Md5)] = f
+	}
+}
+
+// Forget released file
+func (s *Storage) dedupForget(f *File) {
+	if f.linked || f.Md5 == nil {
+		return
+	}
+	s.dm.Lock()
+	defer s.dm.Unlock()
+	if s.dedup != nil && s.dedup[string(f.Md5)] == f {
+		delete(s.dedup, string(f.Md5))
+	}
+}
+
+// Move content of file to another file (see compaction). Return false if content is shared
+func (s *Storage) dedupMove(f, nf *File) bool {
+	s.dm.Lock()
+	defer s.dm.Unlock()
+	if f.refs > 0 {
+		return false
+	}
+	if s.dedup != nil && s.dedup[string(f.Md5)] == f {
+		s.dedup[string(f.Md5)] = nf
+	}
+	return true
+}
+
+// Called for file removed from the index. Return true if file was turned to blob and must not be released
+func (s *Storage) keepShared(f *File) bool {
+	s.dm.Lock()
+	if f.refs == 0 {
+		// new links can't be created for this content
+		if s.dedup != nil && s.dedup[string(f.Md5)] == f {
+			delete(s.dedup, string(f.Md5))
+		}
+		s.dm.Unlock()
+		return false
+	}
+	f.blob = true
+	s.dm.Unlock()
+	f.c.journalWrite(&journalRecord{op: JOURNAL_ADD, f: f})
+	return true
+}
+
+// Release reference to content, blob without references will be released
+func (s *Storage) unref(t *File) {
+	s.dm.Lock()
+	t.refs--
+	release := t.refs == 0 && t.blob
+	if release && s.dedup != nil && s.dedup[string(t.Md5)] == t {
+		delete(s.dedup, string(t.Md5))
+	}
+	s.dm.Unlock()
+	if release {
+		t.c.journalWrite(&journalRecord{op: JOURNAL_DELETE, off: t.Off, name: t.Name})
+		t.Delete()
+	}
+}
+
+// Release reference of deleted link
+func (f *File) unlink() {
+	if f.link == nil {
+		return
+	}
+	s := f.c.s
+	atomic.AddInt64(&s.dedupLinks, -1)
+	atomic.AddInt64(&s.dedupSize, -f.FSize)
+	s.unref(f.link)
+	f.link = nil
+}
+
+// Resolve links to content after open. Broken links will be removed from the index,
+// blobs without links will be released
+func (s *Storage) linkDedup() {
+	targets := make(map[string]*File)
+	var links []*File
+	s.m.RLock()
+	for _, c := range s.Containers {
+		c.m.Lock()
+		var sp Space
+		if c.last != nil {
+			sp = c.last
+		}
+		for sp != nil {
+			if f, ok := sp.(*File); ok && f.Md5 != nil && f.extent == 0 {
+				if f.linked {
+					links = append(links, f)
+				} else if t := targets[string(f.Md5)]; t == nil || t.blob {
+					targets[string(f.Md5)] = f
+				}
+			}
+			sp = sp.Prev()
+		}
+		c.m.Unlock()
+	}
+	s.m.RUnlock()
+
+	var broken int
+	for _, l := range links {
+		t := targets[string(l.Md5)]
+		if t == nil || t.FSize != l.FSize {
+			aelog.Warnf("Dedup: content of %s not found, file will be removed", l.Name)
+			broken++
+			if node, e := s.Index.Root.GetNode(s.Index.explode(l.Name), 0); e == nil && node.File == l {
+				s.Index.Delete(l.Name)
+			}
+			l.c.journalWrite(&journalRecord{op: JOURNAL_DELETE, off: l.Off, name: l.Name})
+			l.Delete()
+			continue
+		}
+		l.link = t
+		t.refs++
+		atomic.AddInt64(&s.dedupLinks, 1)
+		atomic.AddInt64(&s.dedupSize, l.FSize)
+	}
+
+	// blobs without links
+	var released int
+	s.m.RLock()
+	var blobs []*File
+	for _, c := range s.Containers {
+		c.m.Lock()
+		var sp Space
+		if c.last != nil {
+			sp = c.last
+		}
+		for sp != nil {
+			if f, ok := sp.(*File); ok && f.blob && f.refs == 0 {
+				blobs = append(blobs, f)
+			}
+			sp = sp.Prev()
+		}
+		c.m.Unlock()
+	}
+	s.m.RUnlock()
+	for _, b := range blobs {
+		if targets[string(b.Md5)] == b {
+			delete(targets, string(b.Md5))
+		}
+		b.c.journalWrite(&journalRecord{op: JOURNAL_DELETE, off: b.Off, name: b.Name})
+		b.Delete()
+		released++
+	}
+
+	if s.Conf.Dedup {
+		s.dm.Lock()
+		s.dedup = targets
+		s.dm.Unlock()
+	}
+	if broken > 0 || released > 0 {
+		aelog.Infof("Dedup: %d broken links, %d unused blobs released", broken, released)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestDedup(t *testing.T) {
+	s := newTestStorage(t, t.TempDir())
+	s.Close()
+	s.Conf.Dedup = true
+	s.Conf.Journal = true
+	s = reopenStorage(t, s)
+
+	data := make([]byte, 100000)
+	rand.Read(data)
+	if _, err := s.Add("a", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	var c *Container
+	for _, c = range s.Containers {
+	}
+	size := c.FileSize
+	for _, name := range []string{"b", "c"} {
+		f, err := s.Add(name, bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !f.linked || f.FSize != int64(len(data)) {
+			t.Errorf("File %s was not deduplicated", name)
+		}
+	}
+	if c.FileSize != size {
+		t.Errorf("Content was stored twice: %d vs %d", c.FileSize, size)
+	}
+	if st := s.GetStats(); st.Storage.DedupFiles != 2 || st.Storage.DedupSize != 200000 {
+		t.Errorf("Unexpected dedup stats: %d %d", st.Storage.DedupFiles, st.Storage.DedupSize)
+	}
+
+	// original name is deleted, content must stay for links
+	s.Delete("a")
+	check := func(s *Storage, names ...string) {
+		for _, name := range names {
+			f, ok := s.Get(name)
+			if !ok {
+				t.Errorf("File %s not found", name)
+				continue
+			}
+			b, _ := io.ReadAll(f.GetReader())
+			if !bytes.Equal(b, data) {
+				t.Errorf("File %s content mismatched", name)
+			}
+		}
+		if _, ok := s.Get("a"); ok {
+			t.Error("Deleted file exists")
+		}
+		if err := s.Check(); err != nil {
+			t.Error(err)
+		}
+	}
+	check(s, "b", "c")
+
+	// restore from journal and from index
+	s2 := reopenStorage(t, s)
+	check(s2, "b", "c")
+	s2.Close()
+	s3 := reopenStorage(t, s2)
+	defer s3.Close()
+	check(s3, "b", "c")
+
+	s3.Delete("b")
+	check(s3, "c")
+	s3.Delete("c")
+	for _, c := range s3.Containers {
+		if c.FileCount != 0 {
+			t.Errorf("Shared content was not released: %d files", c.FileCount)
+		}
+	}
+
+	// new file with the same content is not a link anymore
+	if f, _ := s3.Add("d", bytes.NewReader(data), int64(len(data))); f == nil || f.linked {
+		t.Error("Link to released content")
+	}
+}
+
+func TestDedupCollision(t *testing.T) {
+	s := newTestStorage(t, t.TempDir())
+	s.Close()
+	s.Conf.Dedup = true
+	s = reopenStorage(t, s)
+	defer s.Close()
+
+	a, b := make([]byte, 10000), make([]byte, 10000)
+	rand.Read(a)
+	rand.Read(b)
+	fa, err := s.Add("a", bytes.NewReader(a), int64(len(a)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// content with the same md5 and size
+	h := md5.Sum(b)
+	s.dm.Lock()
+	s.dedup[string(h[:])] = fa
+	s.dm.Unlock()
+	f, err := s.Add("b", bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.linked {
+		t.Error("File with different content was linked")
+	}
+	if content, _ := io.ReadAll(f.GetReader()); !bytes.Equal(content, b) {
+		t.Error("Unexpected content")
+	}
+	if fa.refs != 0 {
+		t.Errorf("Reference to content is not released: %d", fa.refs)
+	}
+}
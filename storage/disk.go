@@ -0,0 +1,312 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/config"
+	"github.com/cheggaaa/Anteater/stats"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrNoDisk = errors.New("No data path with free space for new container")
+
+// Data directory of storage, usually one per disk (see config data.path)
+// Disk that fails is marked as degraded: new containers are not created on it and its containers don't get new files
+type Disk struct {
+	Path     string
+	Capacity int64
+	Weight   int
+	// smooth weighted round robin state, storage must be locked
+	current int
+	// 1 if disk is degraded
+	degraded int32
+	m        sync.Mutex
+	err      error
+}
+
+func newDisks(conf *config.Config) (disks []*Disk) {
+	dirs := conf.DataPaths
+	if len(dirs) == 0 {
+		dirs = []config.DataDir{{Path: conf.DataPath}}
+	}
+	for _, dir := range dirs {
+		d := &Disk{Path: dir.Path, Capacity: dir.Capacity, Weight: dir.Weight}
+		if d.Weight < 1 {
+			d.Weight = 1
+		}
+		disks = append(disks, d)
+	}
+	return
+}
+
+func (d *Disk) Degraded() bool {
+	return atomic.LoadInt32(&d.degraded) == 1
+}
+
+// Return error that made disk degraded
+func (d *Disk) Err() error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.err
+}
+
+// Mark disk as degraded
+func (d *Disk) fail(err error) {
+	d.m.Lock()
+	if d.err == nil {
+		d.err = err
+	}
+	d.m.Unlock()
+	if atomic.CompareAndSwapInt32(&d.degraded, 0, 1) {
+		aelog.Warnf("Data path %s is degraded: %v", d.Path, err)
+	}
+}
+
+// Mark disk as degraded if err is an error of file on it. Return true if disk is degraded
+func (d *Disk) check(err error) bool {
+	var pe *os.PathError
+	if errors.As(err, &pe) && strings.HasPrefix(pe.Path, d.Path) {
+		d.fail(err)
+		return true
+	}
+	return false
+}
+
+// Clear degraded state after disk was replaced
+func (d *Disk) recover() {
+	d.m.Lock()
+	d.err = nil
+	d.m.Unlock()
+	if atomic.CompareAndSwapInt32(&d.degraded, 1, 0) {
+		aelog.Infof("Data path %s is restored", d.Path)
+	}
+}
+
+// Mark disk or part of group as failed if err is an error of file of container
+func (c *Container) check(err error) bool {
+	if c.g != nil {
+		return c.g.check(err)
+	}
+	return c.disk.check(err)
+}
+
+// Return false if new files can't be placed to container
+func (c *Container) writable() bool {
+	if c.g != nil {
+		return c.g.writable()
+	}
+	return !c.disk.Degraded()
+}
+
+// Disks with data files of container and size of data file on every disk
+func (c *Container) disks() (disks []*Disk, size int64) {
+	if c.g == nil {
+		return []*Disk{c.disk}, c.Size
+	}
+	for _, mb := range c.g.members {
+		if mb.disk != nil {
+			disks = append(disks, mb.disk)
+		}
+	}
+	return disks, c.g.memberSize()
+}
+
+// Return true if container has group descriptor
+func (c *Container) isGroup() bool {
+	_, err := os.Stat(c.groupName())
+	return err == nil
+}
+
+func (d *Disk) readDir() (files []os.FileInfo, err error) {
+	dir, err := os.Open(d.Path)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+	info, err := dir.Stat()
+	if err != nil {
+		return
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("Data path %s must be dir", d.Path)
+	}
+	return dir.Readdir(-1)
+}
+
+// Return true if dir is one of data paths
+func (s *Storage) IsDataPath(dir string) bool {
+	return s.dataPath(dir) != nil
+}
+
+// Return disk by path, nil if dir is not a data path
+func (s *Storage) dataPath(dir string) *Disk {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil
+	}
+	for _, d := range s.Disks {
+		if p, err := filepath.Abs(d.Path); err == nil && p == dir {
+			return d
+		}
+	}
+	return nil
+}
+
+// Return disk with files of container, first disk if container is not found
+func (s *Storage) containerDisk(id int64) *Disk {
+	for _, d := range s.Disks {
+		for _, ext := range []string{".index", ".data"} {
+			if _, err := os.Stat(fmt.Sprintf("%sc%d%s", d.Path, id, ext)); err == nil {
+				return d
+			}
+		}
+	}
+	return s.Disks[0]
+}
+
+// Return ids of containers in all data paths
+func (s *Storage) ContainerIds() (ids []int64, err error) {
+	// parts of group have the same id
+	seen := make(map[int64]bool)
+	for _, d := range s.Disks {
+		names, e := filepath.Glob(d.Path + "c*.data")
+		if e != nil {
+			return nil, e
+		}
+		for _, name := range names {
+			name = strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), "c"), ".data")
+			if id, e := strconv.ParseInt(name, 10, 64); e == nil && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return
+}
+
+// Choose n different disks for new container according to data.placement. Storage must be locked
+func (s *Storage) placeContainer(n int, size int64) (disks []*Disk, err error) {
+	used := make(map[*Disk]int64)
+	for _, c := range s.Containers {
+		cd, cs := c.disks()
+		for _, d := range cd {
+			used[d] += cs
+		}
+	}
+	var candidates []*Disk
+	var avail []int64
+	for _, d := range s.Disks {
+		if d.Degraded() {
+			continue
+		}
+		a := int64(-1)
+		if d.Capacity > 0 {
+			if a = d.Capacity - used[d]; a < size {
+				continue
+			}
+		}
+		if free, e := diskFree(d.Path); e == nil && (a < 0 || free < a) {
+			if a = free; a < size {
+				continue
+			}
+		}
+		candidates = append(candidates, d)
+		avail = append(avail, a)
+	}
+	if len(candidates) < n {
+		return nil, ErrNoDisk
+	}
+	chosen := make(map[*Disk]bool)
+	for len(disks) < n {
+		var d *Disk
+		if s.Conf.Placement == config.PLACEMENT_ROUND_ROBIN {
+			// smooth weighted round robin
+			var total int
+			for _, c := range candidates {
+				if chosen[c] {
+					continue
+				}
+				c.current += c.Weight
+				total += c.Weight
+				if d == nil || c.current > d.current {
+					d = c
+				}
+			}
+			d.current -= total
+		} else {
+			// the most free space, unknown free space is the least
+			var best int64
+			for i, c := range candidates {
+				if a := avail[i] * int64(c.Weight); !chosen[c] && (d == nil || a > best) {
+					d, best = c, a
+				}
+			}
+		}
+		chosen[d] = true
+		disks = append(disks, d)
+	}
+	return
+}
+
+// Stats of data paths
+func (s *Storage) diskStats() (res []*stats.Disk) {
+	byDisk := make(map[*Disk]*stats.Disk)
+	for _, d := range s.Disks {
+		ds := &stats.Disk{
+			Path:     d.Path,
+			Capacity: d.Capacity,
+			Weight:   d.Weight,
+			Degraded: d.Degraded(),
+		}
+		if err := d.Err(); err != nil {
+			ds.Error = err.Error()
+		}
+		ds.FreeSpace, _ = diskFree(d.Path)
+		byDisk[d] = ds
+		res = append(res, ds)
+	}
+	s.m.RLock()
+	defer s.m.RUnlock()
+	for _, c := range s.Containers {
+		cd, size := c.disks()
+		c.m.Lock()
+		files := c.FileSize
+		c.m.Unlock()
+		if c.g != nil {
+			// every part keeps 1/k of data
+			files /= int64(c.g.k)
+		}
+		for _, d := range cd {
+			if ds := byDisk[d]; ds != nil {
+				ds.ContainersCount++
+				ds.TotalSize += size
+				ds.FilesSize += files
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,80 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"github.com/cheggaaa/Anteater/config"
+	"os"
+	"testing"
+)
+
+func TestDisks(t *testing.T) {
+	d1, d2, d3 := t.TempDir()+"/", t.TempDir()+"/", t.TempDir()+"/"
+	s := newTestStorage(t, t.TempDir())
+	s.Close()
+	s.Conf.ContainerSize = 1024 * 1024
+	s.Conf.DataPaths = []config.DataDir{{Path: d1, Weight: 2}, {Path: d2, Weight: 1}, {Path: d3, Capacity: 1024 * 1024, Weight: 1}}
+	s.Conf.Placement = config.PLACEMENT_ROUND_ROBIN
+	s = reopenStorage(t, s)
+
+	for i := 0; i < 12; i++ {
+		if _, err := s.Add(fmt.Sprint(i), randReader(700*1024), 700*1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st := s.GetStats().Storage
+	// third disk has capacity for one container
+	if len(st.Disks) != 3 || st.Disks[0].ContainersCount != 8 || st.Disks[1].ContainersCount != 3 || st.Disks[2].ContainersCount != 1 {
+		for _, d := range st.Disks {
+			t.Logf("%s: %d", d.Path, d.ContainersCount)
+		}
+		t.Fatal("Unexpected placement of containers")
+	}
+	ids, err := s.ContainerIds()
+	if err != nil || len(ids) != 12 {
+		t.Errorf("Unexpected container ids: %v %v", ids, err)
+	}
+	s.Close()
+
+	// storage is opened without failed disk
+	if err = os.RemoveAll(d2); err != nil {
+		t.Fatal(err)
+	}
+	s2 := reopenStorage(t, s)
+	defer s2.Close()
+	if s2.Index.Count() != 9 {
+		t.Errorf("Unexpected files count: %d", s2.Index.Count())
+	}
+	if !s2.Disks[1].Degraded() || s2.Disks[0].Degraded() {
+		t.Error("Failed disk is not degraded")
+	}
+	if _, err = s2.Add("new", randReader(700*1024), 700*1024); err != nil {
+		t.Fatal(err)
+	}
+	if st = s2.GetStats().Storage; st.Disks[0].ContainersCount != 9 || !st.Disks[1].Degraded || st.Disks[1].Error == "" {
+		t.Errorf("Unexpected stats of disks: %+v %+v", st.Disks[0], st.Disks[1])
+	}
+
+	// no disk available
+	s2.Conf.DataPaths = []config.DataDir{{Path: d2}}
+	s3 := new(Storage)
+	s3.Init(s2.Conf)
+	if err = s3.Open(); err == nil {
+		t.Error("Storage without disks was opened")
+	}
+}
@@ -0,0 +1,129 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"container/heap"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/config"
+	"sync/atomic"
+	"time"
+)
+
+// Files with expiry time. Expired file is not returned by Get and can be replaced by new file with the same name,
+// its space is released by reaper. Follower doesn't reap files, it gets deletes from primary
+// Expiry time is stored in the index only, so files recovered by aerepair don't expire
+
+// How often reaper checks expiry queue
+const REAP_INTERVAL = time.Second
+
+// Return true if file has expiry time and it passed
+func (f *File) Expired() bool {
+	return !f.Expires.IsZero() && !time.Now().Before(f.Expires)
+}
+
+// Queue of files with expiry time, the nearest first
+type expiryQueue []*File
+
+func (q expiryQueue) Len() int            { return len(q) }
+func (q expiryQueue) Less(i, j int) bool  { return q[i].Expires.Before(q[j].Expires) }
+func (q expiryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x interface{}) { *q = append(*q, x.(*File)) }
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	f := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return f
+}
+
+// Add file to expiry queue
+func (s *Storage) expireAdd(f *File) {
+	if f.Expires.IsZero() {
+		return
+	}
+	s.em.Lock()
+	heap.Push(&s.expiry, f)
+	s.em.Unlock()
+}
+
+// Fill expiry queue after open
+func (s *Storage) loadExpiry() {
+	s.m.RLock()
+	for _, c := range s.Containers {
+		c.m.Lock()
+		var sp Space
+		if c.last != nil {
+			sp = c.last
+		}
+		for sp != nil {
+			if f, ok := sp.(*File); ok && !f.Expires.IsZero() && f.listed() {
+				s.expiry = append(s.expiry, f)
+			}
+			sp = sp.Prev()
+		}
+		c.m.Unlock()
+	}
+	s.m.RUnlock()
+	s.em.Lock()
+	heap.Init(&s.expiry)
+	s.em.Unlock()
+}
+
+// Delete expired file if it is still in the index. fm must be locked
+func (s *Storage) deleteExpired(f *File) (ok bool) {
+	if ok = s.Index.DeleteFile(f); ok {
+		s.release(f)
+		s.Stats.Counters.Expired.Add()
+	}
+	return
+}
+
+// Delete all expired files, return count of deleted
+func (s *Storage) Reap() (n int) {
+	now := time.Now()
+	for {
+		s.em.Lock()
+		if len(s.expiry) == 0 || s.expiry[0].Expires.After(now) {
+			s.em.Unlock()
+			return
+		}
+		f := heap.Pop(&s.expiry).(*File)
+		s.em.Unlock()
+		// deleted, moved by compaction or replaced files are skipped
+		if f.deleted {
+			continue
+		}
+		s.fm.RLock()
+		if s.deleteExpired(f) {
+			n++
+		}
+		s.fm.RUnlock()
+	}
+}
+
+func (s *Storage) reapLoop() {
+	if s.Conf.ReplicationRole == config.REPLICATION_FOLLOWER {
+		return
+	}
+	for atomic.LoadInt32(&s.closed) == 0 {
+		if n := s.Reap(); n > 0 {
+			aelog.Debugf("Reaper: %d expired files deleted", n)
+		}
+		time.Sleep(REAP_INTERVAL)
+	}
+}
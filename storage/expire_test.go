@@ -0,0 +1,70 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpire(t *testing.T) {
+	s := newTestStorage(t, t.TempDir())
+	s.Close()
+	s.Conf.Journal = true
+	s = reopenStorage(t, s)
+
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Second)
+	add := func(name string, expires time.Time) {
+		if _, err := s.AddWith(name, randReader(1000), 1000, FileAttrs{Expires: expires}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("future", future)
+	add("past", past)
+	add("replaced", past)
+	add("replaced", time.Time{})
+	add("renamed", past)
+
+	if _, ok := s.Get("past"); ok {
+		t.Error("Expired file is visible")
+	}
+	if f, ok := s.Get("replaced"); !ok || !f.Expires.IsZero() {
+		t.Error("Expired file was not replaced")
+	}
+	if _, err := s.Rename("renamed", "other"); err != ErrFileNotFound {
+		t.Errorf("Expired file was renamed: %v", err)
+	}
+
+	s.Reap()
+	if s.Index.Count() != 2 || s.Stats.Counters.Expired.GetValue() != 3 {
+		t.Errorf("Unexpected files count after reap: %d (%d reaped)", s.Index.Count(), s.Stats.Counters.Expired.GetValue())
+	}
+	if err := s.Check(); err != nil {
+		t.Error(err)
+	}
+
+	s.Close()
+	s = reopenStorage(t, s)
+	defer s.Close()
+	if f, ok := s.Get("future"); !ok || f.Expires.Unix() != future.Unix() {
+		t.Error("Expiry time was not restored")
+	}
+	if s.Index.Count() != 2 {
+		t.Errorf("Unexpected files count after reopen: %d", s.Index.Count())
+	}
+}
@@ -19,8 +19,25 @@ package storage
 
 import (
 	"errors"
+	"os"
 )
 
 func (c *Container) falloc() (err error) {
 	return errors.New("OS doesn't support falloc")
-}
\ No newline at end of file
+}
+
+func (c *Container) punch(off, size int64) error {
+	return errors.New("OS doesn't support punch hole")
+}
+
+func (c *Container) reserve(off, size int64) error {
+	return nil
+}
+
+func diskUsage(f *os.File) (n int64, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	return fi.Size(), nil
+}
@@ -18,9 +18,34 @@
 package storage
 
 import (
+	"os"
 	"syscall"
 )
 
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
 func (c *Container) falloc() (err error) {
 	return syscall.Fallocate(int(c.f.Fd()), 0, 0, c.Size)
-}
\ No newline at end of file
+}
+
+// Release range of data file to file system, container keeps its size
+func (c *Container) punch(off, size int64) error {
+	return syscall.Fallocate(int(c.f.Fd()), fallocPunchHole|fallocKeepSize, off, size)
+}
+
+// Allocate released range again
+func (c *Container) reserve(off, size int64) error {
+	return syscall.Fallocate(int(c.f.Fd()), fallocKeepSize, off, size)
+}
+
+// Return space allocated for file on disk
+func diskUsage(f *os.File) (n int64, err error) {
+	var st syscall.Stat_t
+	if err = syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return
+	}
+	return st.Blocks * 512, nil
+}
@@ -25,7 +25,6 @@ import (
 	"mime"
 	"net/http"
 	"path/filepath"
-	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -33,17 +32,51 @@ import (
 	"fmt"
 )
 
+// Content is bigger than size of file
+var ErrOverflow = errors.New("Content is bigger than declared size")
+
 type File struct {
 	Hole  // inherits
 	Name  string
 	Md5   []byte
 	FSize int64
 	Time  time.Time
+	// expiry time, zero - never (see expire.go)
+	Expires time.Time
+	// user metadata, content type and disposition supplied by uploader (see meta.go)
+	meta        map[string]string
+	stype       *CType
+	disposition string
+	// version id and time when file became noncurrent version (see version.go)
+	version    int64
+	noncurrent time.Time
+	// time when file was moved to trash (see trash.go)
+	trashed time.Time
+	// size of self-describing header before content (0 - no header)
+	Hdr int32
+	// extents of spanning file (see span.go)
+	span []extentRef
+	// number of extent in spanning file (0 - not an extent)
+	extent int32
+	// link to shared content (see dedup.go)
+	linked bool
+	link   *File
+	// content is shared, but file is not in the index
+	blob bool
+	// count of links to content
+	refs int32
+	// compression codec and size of stored data (see codec.go)
+	codec byte
+	csize int64
+	// nonce of allocation in encrypted container (see crypt.go)
+	nonce []byte
 
 	c         *Container
 	ctype     *CType
 	deleted   bool
 	openCount int32
+	// 1 after space was released
+	released int32
 }
 
 func (f *File) Init(c *Container) {
@@ -55,12 +88,14 @@ func (f *File) IsFree() bool {
 	return false
 }
 
-// mark file as Open
+// mark file as Open, deleted file can't be opened
 func (f *File) Open() (err error) {
+	// count first, so Delete can't release space between check and count
+	atomic.AddInt32(&f.openCount, 1)
 	if f.deleted {
+		f.Close()
 		return errors.New("File deleted")
 	}
-	atomic.AddInt32(&f.openCount, 1)
 	return
 }
 
@@ -71,34 +106,58 @@ func (f *File) Close() {
 	}
 }
 
-// mark as deleted
+// mark as deleted, space is released when file is not opened
 func (f *File) Delete() {
 	f.deleted = true
-	if atomic.LoadInt32(&f.openCount) == 0 && f.c != nil {
+	if atomic.LoadInt32(&f.openCount) == 0 && f.c != nil && atomic.CompareAndSwapInt32(&f.released, 0, 1) {
+		f.clearHeader()
 		f.c.Delete(f)
+		f.deleteSpan()
+		f.unlink()
+		f.c.s.dedupForget(f)
 	}
 }
 
 // return io.Reader
 func (f *File) GetReader() *Reader {
-	return newReader(f.c.f, f.Off, f.FSize, f.c.s)
+	if f.link != nil {
+		return f.link.GetReader()
+	}
+	if f.span != nil {
+		return newReader(spanReader{f}, 0, f.FSize, f.c.s)
+	}
+	if f.codec != CODEC_NONE {
+		return newReader(&decodeReader{f: f}, 0, f.FSize, f.c.s)
+	}
+	return newReader(f.data(), f.dataOff(), f.FSize, f.c.s)
+}
+
+// offset of file content in data file
+func (f *File) dataOff() int64 {
+	return f.Off + int64(f.Hdr)
 }
 
 func (f *File) WriteAt(b []byte, off int64) (int, error) {
-	if off+int64(len(b)) > f.FSize {
+	if f.span != nil {
+		return f.writeSpanAt(b, off)
+	}
+	if off+int64(len(b)) > f.dataSize() {
 		panic("Can't write. Overflow allocated size")
 	}
-	off = off + f.Off
-	return f.c.f.WriteAt(b, off)
+	off = off + f.dataOff()
+	return f.data().WriteAt(b, off)
 }
 
-// return http E-Tag
+// return http E-Tag, it's based on md5 of content so it stays the same after restart
 func (f *File) ETag() string {
-	return strconv.FormatInt(int64(f.c.Id), 36) + "." + strconv.FormatInt(f.Time.UnixNano(), 36)
+	return f.Md5S()
 }
 
 // Return content type file or application/octed-stream if can't
 func (f *File) ContentType() (ctype string) {
+	if ctype, _ = f.StoredType(); ctype != "" {
+		return
+	}
 	if f.ctype == nil {
 		ctype = mime.TypeByExtension(filepath.Ext(f.Name))
 		if ctype == "" {
@@ -114,6 +173,9 @@ func (f *File) ContentType() (ctype string) {
 
 // copy content from io.Reader
 func (f *File) ReadFrom(r io.Reader) (written int64, err error) {
+	if f.span != nil {
+		return f.readFromSpan(r)
+	}
 	h := md5.New()
 	var bs int
 	if f.FSize > 128*1024 {
@@ -124,6 +186,10 @@ func (f *File) ReadFrom(r io.Reader) (written int64, err error) {
 	buf := make([]byte, bs)
 	for {
 		nr, er := r.Read(buf)
+		if written+int64(nr) > f.dataSize() {
+			err = ErrOverflow
+			break
+		}
 		if nr > 0 {
 			nw, ew := f.WriteAt(buf[0:nr], written)
 			if nw > 0 {
@@ -176,7 +242,12 @@ func (f *File) MarshalTo(wr io.Writer) error {
 		binary.MaxVarintLen64 + // time
 		binary.MaxVarintLen64 + 1]byte // size
 	var buf = arr[:0]
-	buf = append(buf, 1)
+	ext := f.marshalExt()
+	if len(ext) > 0 {
+		buf = append(buf, 2)
+	} else {
+		buf = append(buf, 1)
+	}
 	buf = binary.AppendUvarint(buf, uint64(len(f.Name)))
 	buf = binary.AppendUvarint(buf, uint64(f.Time.Unix()))
 	buf = binary.AppendUvarint(buf, uint64(f.FSize))
@@ -193,5 +264,26 @@ func (f *File) MarshalTo(wr io.Writer) error {
 	if _, err := wr.Write(f.Md5); err != nil {
 		return err
 	}
+	if len(ext) > 0 {
+		if _, err := wr.Write(binary.AppendUvarint(arr[:0], uint64(len(ext)))); err != nil {
+			return err
+		}
+		if _, err := wr.Write(ext); err != nil {
+			return err
+		}
+	}
 	return f.Hole.MarshalTo(wr)
 }
+
+// Return ErrOverflow if reader has data beyond declared size
+func checkEOF(r io.Reader) error {
+	var b [1]byte
+	n, err := io.ReadFull(r, b[:])
+	if n > 0 {
+		return ErrOverflow
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,164 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Optional file fields. Stored in the index as list of tag, uvarint(len), data
+// Files without optional fields stored in the old format
+const (
+	FILE_EXT_HEADER      = 1
+	FILE_EXT_SPAN        = 2
+	FILE_EXT_EXTENT      = 3
+	FILE_EXT_LINK        = 4
+	FILE_EXT_BLOB        = 5
+	FILE_EXT_CODEC       = 6
+	FILE_EXT_EXPIRES     = 7
+	FILE_EXT_META        = 8
+	FILE_EXT_CTYPE       = 9
+	FILE_EXT_DISPOSITION = 10
+	FILE_EXT_VERSION     = 11
+	FILE_EXT_NONCURRENT  = 12
+	FILE_EXT_TRASHED     = 13
+	FILE_EXT_NONCE       = 14
+)
+
+var errExtCorrupt = errors.New("File extension block corrupted")
+
+func (f *File) marshalExt() (buf []byte) {
+	if f.Hdr > 0 {
+		buf = appendExtUvarint(buf, FILE_EXT_HEADER, uint64(f.Hdr))
+	}
+	if f.span != nil {
+		buf = appendExt(buf, FILE_EXT_SPAN, f.marshalSpan())
+	}
+	if f.extent > 0 {
+		buf = appendExtUvarint(buf, FILE_EXT_EXTENT, uint64(f.extent))
+	}
+	if f.linked {
+		buf = appendExt(buf, FILE_EXT_LINK, nil)
+	}
+	if f.blob {
+		buf = appendExt(buf, FILE_EXT_BLOB, nil)
+	}
+	if !f.Expires.IsZero() {
+		buf = appendExtUvarint(buf, FILE_EXT_EXPIRES, uint64(f.Expires.Unix()))
+	}
+	if meta := f.Meta(); meta != nil {
+		buf = appendExt(buf, FILE_EXT_META, marshalMeta(meta))
+	}
+	ctype, disposition := f.StoredType()
+	if ctype != "" {
+		buf = appendExt(buf, FILE_EXT_CTYPE, []byte(ctype))
+	}
+	if disposition != "" {
+		buf = appendExt(buf, FILE_EXT_DISPOSITION, []byte(disposition))
+	}
+	if f.version > 0 {
+		buf = appendExtUvarint(buf, FILE_EXT_VERSION, uint64(f.version))
+	}
+	if !f.noncurrent.IsZero() {
+		buf = appendExtUvarint(buf, FILE_EXT_NONCURRENT, uint64(f.noncurrent.Unix()))
+	}
+	if !f.trashed.IsZero() {
+		buf = appendExtUvarint(buf, FILE_EXT_TRASHED, uint64(f.trashed.Unix()))
+	}
+	if f.codec != CODEC_NONE {
+		buf = appendExt(buf, FILE_EXT_CODEC, binary.AppendUvarint([]byte{f.codec}, uint64(f.csize)))
+	}
+	if f.nonce != nil {
+		buf = appendExt(buf, FILE_EXT_NONCE, f.nonce)
+	}
+	return
+}
+
+func (f *File) unmarshalExt(b []byte) (err error) {
+	for len(b) > 0 {
+		tag := b[0]
+		l, n := binary.Uvarint(b[1:])
+		if n <= 0 || uint64(len(b)-1-n) < l {
+			return errExtCorrupt
+		}
+		data := b[1+n : 1+n+int(l)]
+		b = b[1+n+int(l):]
+		switch tag {
+		case FILE_EXT_HEADER:
+			v, _ := binary.Uvarint(data)
+			f.Hdr = int32(v)
+		case FILE_EXT_SPAN:
+			if err = f.unmarshalSpan(data); err != nil {
+				return
+			}
+		case FILE_EXT_EXTENT:
+			v, _ := binary.Uvarint(data)
+			f.extent = int32(v)
+		case FILE_EXT_LINK:
+			f.linked = true
+		case FILE_EXT_BLOB:
+			f.blob = true
+		case FILE_EXT_EXPIRES:
+			v, _ := binary.Uvarint(data)
+			f.Expires = time.Unix(int64(v), 0)
+		case FILE_EXT_META:
+			if f.meta, err = unmarshalMeta(data); err != nil {
+				return
+			}
+		case FILE_EXT_CTYPE:
+			f.stype = getCtype(string(data))
+		case FILE_EXT_DISPOSITION:
+			f.disposition = string(data)
+		case FILE_EXT_VERSION:
+			v, _ := binary.Uvarint(data)
+			f.version = int64(v)
+		case FILE_EXT_NONCURRENT:
+			v, _ := binary.Uvarint(data)
+			f.noncurrent = time.Unix(int64(v), 0)
+		case FILE_EXT_TRASHED:
+			v, _ := binary.Uvarint(data)
+			f.trashed = time.Unix(int64(v), 0)
+		case FILE_EXT_CODEC:
+			if len(data) < 2 {
+				return errExtCorrupt
+			}
+			f.codec = data[0]
+			v, _ := binary.Uvarint(data[1:])
+			f.csize = int64(v)
+		case FILE_EXT_NONCE:
+			if len(data) != NONCE_SIZE {
+				return errExtCorrupt
+			}
+			f.nonce = append([]byte(nil), data...)
+		}
+		// unknown tags are ignored
+	}
+	return
+}
+
+func appendExt(buf []byte, tag byte, data []byte) []byte {
+	buf = append(buf, tag)
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func appendExtUvarint(buf []byte, tag byte, v uint64) []byte {
+	var arr [binary.MaxVarintLen64]byte
+	return appendExt(buf, tag, binary.AppendUvarint(arr[:0], v))
+}
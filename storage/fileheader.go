@@ -0,0 +1,222 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"time"
+)
+
+// Self-describing file header, written into the data area before file content
+// Format: magic uvarint(hdr) uvarint(len(name)) name uvarint(fsize) uvarint(indx) uvarint(time) md5 crc32
+// Compressed files have own magic and codec uvarint(stored size) after md5
+// Header is written after content, so valid header means that content was written completely
+// When file is deleted magic replaces to deletedMagic, so scanner knows that space is free
+// Header of file with own nonce (see crypt.go) is prefixed with plaintext nonceMagic and nonce,
+// the rest is encrypted with keystream of the file. Deleted header has deletedNonceMagic
+const (
+	HEADER_ALIGN      = 64
+	HEADER_MAX        = 64 * 1024
+	NONCE_HEADER_SIZE = 4 + NONCE_SIZE
+)
+
+var (
+	headerMagic       = []byte("AEFH")
+	compressedMagic   = []byte("AEFC")
+	deletedMagic      = []byte("AEFD")
+	nonceMagic        = []byte("AEFN")
+	deletedNonceMagic = []byte("AEFE")
+)
+
+var (
+	errNoHeader      = errors.New("File header not found")
+	errHeaderCorrupt = errors.New("File header corrupted")
+	errHeaderTooBig  = errors.New("File header doesn't fit to reserved space")
+	ErrNameTooLong   = errors.New("Name doesn't fit to reserved file header")
+)
+
+// Return space reserved for header of file with given name or 0 if name is too long
+// Space for nonce is reserved if file can be placed to encrypted container
+func headerSize(name string, nonce bool) int32 {
+	l := len(headerMagic) + binary.MaxVarintLen32*2 + len(name) + binary.MaxVarintLen64*3 + 16 + 1 + binary.MaxVarintLen64 + 4
+	if nonce {
+		l += NONCE_HEADER_SIZE
+	}
+	l = (l + HEADER_ALIGN - 1) / HEADER_ALIGN * HEADER_ALIGN
+	if l > HEADER_MAX {
+		return 0
+	}
+	return int32(l)
+}
+
+func (f *File) marshalHeader() []byte {
+	buf := make([]byte, 0, f.Hdr)
+	if f.codec != CODEC_NONE {
+		buf = append(buf, compressedMagic...)
+	} else {
+		buf = append(buf, headerMagic...)
+	}
+	buf = binary.AppendUvarint(buf, uint64(f.Hdr))
+	buf = binary.AppendUvarint(buf, uint64(len(f.Name)))
+	buf = append(buf, f.Name...)
+	buf = binary.AppendUvarint(buf, uint64(f.FSize))
+	buf = binary.AppendUvarint(buf, uint64(f.Indx))
+	buf = binary.AppendUvarint(buf, uint64(f.Time.Unix()))
+	buf = append(buf, f.Md5...)
+	if f.codec != CODEC_NONE {
+		buf = append(buf, f.codec)
+		buf = binary.AppendUvarint(buf, uint64(f.csize))
+	}
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// Return true if header with new name fits to reserved space
+func (f *File) headerFits(name string) bool {
+	if f.Hdr == 0 {
+		return true
+	}
+	l := len(f.marshalHeader()) - uvarintLen(len(f.Name)) - len(f.Name) + uvarintLen(len(name)) + len(name)
+	if f.nonce != nil {
+		l += NONCE_HEADER_SIZE
+	}
+	return l <= int(f.Hdr)
+}
+
+func uvarintLen(v int) int {
+	return len(binary.AppendUvarint(nil, uint64(v)))
+}
+
+// Write header to data area. File must be allocated and written
+func (f *File) writeHeader() (err error) {
+	if f.Hdr == 0 {
+		return
+	}
+	buf := f.marshalHeader()
+	if f.nonce == nil {
+		if len(buf) > int(f.Hdr) {
+			return errHeaderTooBig
+		}
+		_, err = f.c.d.WriteAt(buf, f.Off)
+		return
+	}
+	if len(buf)+NONCE_HEADER_SIZE > int(f.Hdr) {
+		return errHeaderTooBig
+	}
+	if _, err = f.data().WriteAt(buf, f.Off+NONCE_HEADER_SIZE); err != nil {
+		return
+	}
+	_, err = f.c.raw().WriteAt(append(append([]byte(nil), nonceMagic...), f.nonce...), f.Off)
+	return
+}
+
+// Mark header as deleted, so scanner will not recover this file
+func (f *File) clearHeader() (err error) {
+	if f.Hdr == 0 || f.c == nil {
+		return
+	}
+	if f.nonce != nil {
+		_, err = f.c.raw().WriteAt(deletedNonceMagic, f.Off)
+		return
+	}
+	_, err = f.c.d.WriteAt(deletedMagic, f.Off)
+	return
+}
+
+// Parse header from the begin of buf
+func unmarshalHeader(buf []byte) (f *File, deleted bool, err error) {
+	switch {
+	case bytes.HasPrefix(buf, headerMagic), bytes.HasPrefix(buf, compressedMagic):
+		f, err = parseHeader(buf)
+	case bytes.HasPrefix(buf, deletedMagic):
+		deleted = true
+		// checksum calculated with original magic
+		for _, magic := range [][]byte{headerMagic, compressedMagic} {
+			if f, err = parseHeader(append(append([]byte(nil), magic...), buf[len(deletedMagic):]...)); err == nil {
+				break
+			}
+		}
+	default:
+		err = errNoHeader
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return
+}
+
+func parseHeader(buf []byte) (f *File, err error) {
+	compressed := bytes.HasPrefix(buf, compressedMagic)
+	b := buf[len(headerMagic):]
+	var vals [3]uint64
+	uv := func() (v uint64) {
+		if err != nil {
+			return
+		}
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			err = errHeaderCorrupt
+			return 0
+		}
+		b = b[n:]
+		return v
+	}
+	hdr := uv()
+	nl := uv()
+	if err != nil || hdr == 0 || hdr > HEADER_MAX || uint64(len(b)) < nl {
+		return nil, errHeaderCorrupt
+	}
+	name := string(b[:nl])
+	b = b[nl:]
+	for i := range vals {
+		vals[i] = uv()
+	}
+	if err != nil || len(b) < 16+4 {
+		return nil, errHeaderCorrupt
+	}
+	f = &File{
+		Name:  name,
+		Md5:   append([]byte(nil), b[:16]...),
+		FSize: int64(vals[0]),
+		Time:  time.Unix(int64(vals[2]), 0),
+	}
+	b = b[16:]
+	if compressed {
+		if len(b) < 1+4 {
+			return nil, errHeaderCorrupt
+		}
+		f.codec = b[0]
+		b = b[1:]
+		csize := uv()
+		if err != nil || codecNames[f.codec] == "" || csize == 0 || len(b) < 4 {
+			return nil, errHeaderCorrupt
+		}
+		f.csize = int64(csize)
+	}
+	l := len(buf) - len(b)
+	if crc32.ChecksumIEEE(buf[:l]) != binary.LittleEndian.Uint32(buf[l:]) || l+4 > int(hdr) {
+		return nil, errHeaderCorrupt
+	}
+	f.Indx = int32(vals[1])
+	f.Hdr = int32(hdr)
+	if vals[0] == 0 || vals[1] == 0 || vals[1] > 1<<20 || R.Size(f.Indx) < int64(hdr)+f.dataSize() {
+		return nil, errHeaderCorrupt
+	}
+	return
+}
@@ -0,0 +1,686 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/config"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Redundancy groups (see config data.redundancy)
+// Data file of container is split into rows of k stripe units, unit n of row is stored in data file cN.data
+// on data path of member n, members k..k+m-1 keep parity units of row (see rs.go). Mirror is a group with k = 1
+// Every member keeps copies of index, journal and key of container and descriptor cN.group with states of members
+// Failed member is skipped, its units are reconstructed from others on read. Storage.RebuildDisk restores failed members
+
+const (
+	RS_STRIPE_UNIT  = 64 * 1024
+	GROUP_ROW_LOCKS = 64
+)
+
+// States of group member
+const (
+	MEMBER_OK         = 0
+	MEMBER_FAILED     = 1
+	MEMBER_REBUILDING = 2
+)
+
+var (
+	ErrGroupLost   = errors.New("Too many failed parts of container, data can't be restored")
+	errGroupRepair = errors.New("Container is stored with redundancy, use REBUILD to restore it")
+)
+
+var groupMagic = "AEG1"
+
+type groupMember struct {
+	n    int
+	path string
+	// nil if data path is not configured anymore
+	disk  *Disk
+	f     atomic.Pointer[os.File]
+	state int32
+}
+
+func (mb *groupMember) getState() int32 {
+	return atomic.LoadInt32(&mb.state)
+}
+
+type group struct {
+	c       *Container
+	k, m    int
+	members []*groupMember
+	coder   *rsCoder
+	// rows are locked by write, reconstruction and rebuild
+	rows [GROUP_ROW_LOCKS]sync.Mutex
+	// descriptor writes and files replaced by rebuild
+	dm    sync.Mutex
+	stale []*os.File
+}
+
+func newGroup(c *Container, k, m int, paths []string) *group {
+	g := &group{c: c, k: k, m: m, coder: newRSCoder(k, m)}
+	for n, p := range paths {
+		g.members = append(g.members, &groupMember{n: n, path: p, disk: c.s.dataPath(p)})
+	}
+	return g
+}
+
+func (c *Container) groupName() string {
+	return fmt.Sprintf("%sc%d.group", c.disk.Path, c.Id)
+}
+
+// Load group from descriptor, nil if container is stored without redundancy
+func (c *Container) loadGroup() (g *group, err error) {
+	b, err := os.ReadFile(c.groupName())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	var k, m int
+	if !sc.Scan() {
+		return nil, fmt.Errorf("Empty group descriptor %s", c.groupName())
+	}
+	if _, err = fmt.Sscanf(sc.Text(), groupMagic+" %d %d", &k, &m); err != nil || k < 1 || m < 1 {
+		return nil, fmt.Errorf("Incorrect group descriptor %s", c.groupName())
+	}
+	var paths []string
+	var states []int32
+	for sc.Scan() {
+		fields := strings.SplitN(sc.Text(), " ", 2)
+		st, e := strconv.Atoi(fields[0])
+		if len(fields) != 2 || e != nil {
+			return nil, fmt.Errorf("Incorrect group descriptor %s", c.groupName())
+		}
+		paths = append(paths, fields[1])
+		states = append(states, int32(st))
+	}
+	if len(paths) != k+m {
+		return nil, fmt.Errorf("Incorrect group descriptor %s", c.groupName())
+	}
+	g = newGroup(c, k, m, paths)
+	for n, st := range states {
+		// rebuild was interrupted
+		if st != MEMBER_OK {
+			st = MEMBER_FAILED
+		}
+		g.members[n].state = st
+	}
+	return
+}
+
+func (g *group) name(mb *groupMember, ext string) string {
+	return fmt.Sprintf("%sc%d%s", mb.path, g.c.Id, ext)
+}
+
+// Size of data file of every member
+func (g *group) memberSize() int64 {
+	return partSize(g.c.Size, g.k)
+}
+
+// Size of part of container with k data parts: count of rows of stripe units
+func partSize(size int64, k int) int64 {
+	rs := int64(k) * RS_STRIPE_UNIT
+	return (size + rs - 1) / rs * RS_STRIPE_UNIT
+}
+
+// Count of members with valid data
+func (g *group) healthy() (n int) {
+	for _, mb := range g.members {
+		if mb.getState() == MEMBER_OK {
+			n++
+		}
+	}
+	return
+}
+
+// Container gets new files while data can be restored
+func (g *group) writable() bool {
+	return g.healthy() >= g.k
+}
+
+// Open data files of members, new container creates them
+func (g *group) open(create bool) (err error) {
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+	}
+	changed := false
+	for _, mb := range g.members {
+		if mb.getState() != MEMBER_OK {
+			continue
+		}
+		var f *os.File
+		e := fmt.Errorf("Data path %s is not available", mb.path)
+		if mb.disk != nil && !mb.disk.Degraded() {
+			f, e = os.OpenFile(g.name(mb, ".data"), flag, 0666)
+		}
+		if e != nil {
+			if create {
+				g.close()
+				return e
+			}
+			aelog.Warnf("Container %d: part on %s failed: %v", g.c.Id, mb.path, e)
+			atomic.StoreInt32(&mb.state, MEMBER_FAILED)
+			changed = true
+			continue
+		}
+		mb.f.Store(f)
+	}
+	if g.healthy() < g.k {
+		g.close()
+		return fmt.Errorf("Container %d: %w", g.c.Id, ErrGroupLost)
+	}
+	if changed {
+		g.save()
+	}
+	return
+}
+
+// Allocate data files of members and write descriptors
+func (g *group) create() (err error) {
+	size := g.memberSize()
+	for _, mb := range g.members {
+		f := mb.f.Load()
+		if err = f.Truncate(size); err != nil {
+			return
+		}
+		if _, err = f.WriteAt([]byte{1}, size-1); err != nil {
+			return
+		}
+	}
+	return g.save()
+}
+
+func (g *group) close() (err error) {
+	for _, mb := range g.members {
+		if f := mb.f.Load(); f != nil {
+			if e := f.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	g.dm.Lock()
+	defer g.dm.Unlock()
+	for _, f := range g.stale {
+		f.Close()
+	}
+	g.stale = nil
+	return
+}
+
+// Remove files of all members. Index copies are removed first: part of group without index is not opened
+func (g *group) drop() {
+	for _, ext := range []string{".index", ".data", ".journal", ".key", ".group"} {
+		for _, mb := range g.members {
+			os.Remove(g.name(mb, ext))
+		}
+	}
+}
+
+// Descriptor format: "AEG1 k m" line, then "state path" line for every member
+func (g *group) descriptor() []byte {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "%s %d %d\n", groupMagic, g.k, g.m)
+	for _, mb := range g.members {
+		fmt.Fprintf(buf, "%d %s\n", mb.getState(), mb.path)
+	}
+	return buf.Bytes()
+}
+
+// Write descriptor to all healthy members
+func (g *group) save() (err error) {
+	g.dm.Lock()
+	defer g.dm.Unlock()
+	b := g.descriptor()
+	for _, mb := range g.members {
+		if mb.getState() == MEMBER_FAILED {
+			continue
+		}
+		if e := writeFileSync(g.name(mb, ".group"), b); e != nil {
+			aelog.Warnf("Can't write group descriptor of container %d: %v", g.c.Id, e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return
+}
+
+// Mark member as failed
+func (g *group) fail(mb *groupMember, err error) {
+	if atomic.SwapInt32(&mb.state, MEMBER_FAILED) == MEMBER_FAILED {
+		return
+	}
+	aelog.Warnf("Container %d: part on %s failed: %v", g.c.Id, mb.path, err)
+	if mb.disk != nil {
+		mb.disk.check(err)
+	}
+	g.save()
+}
+
+// Mark member as failed if err is an error of its file. Return true if member is found
+func (g *group) check(err error) bool {
+	var pe *os.PathError
+	if !errors.As(err, &pe) {
+		return false
+	}
+	for _, mb := range g.members {
+		if strings.HasPrefix(pe.Path, mb.path) {
+			g.fail(mb, err)
+			return true
+		}
+	}
+	return false
+}
+
+func (g *group) lockRow(row int64) *sync.Mutex {
+	mu := &g.rows[row%GROUP_ROW_LOCKS]
+	mu.Lock()
+	return mu
+}
+
+func (g *group) ReadAt(p []byte, off int64) (n int, err error) {
+	rs := int64(g.k) * RS_STRIPE_UNIT
+	for n < len(p) {
+		row, pos := off/rs, off%rs
+		l := len(p) - n
+		if max := RS_STRIPE_UNIT - pos%RS_STRIPE_UNIT; int64(l) > max {
+			l = int(max)
+		}
+		if err = g.readUnit(row, int(pos/RS_STRIPE_UNIT), pos%RS_STRIPE_UNIT, p[n:n+l], false); err != nil {
+			return
+		}
+		n += l
+		off += int64(l)
+	}
+	return
+}
+
+// Read part of unit from member, reconstruct it from other members if member failed
+func (g *group) readUnit(row int64, n int, col int64, buf []byte, locked bool) (err error) {
+	mb := g.members[n]
+	if mb.getState() == MEMBER_OK {
+		if _, err = mb.f.Load().ReadAt(buf, row*RS_STRIPE_UNIT+col); err == nil {
+			return
+		}
+		g.fail(mb, err)
+	}
+	if !locked {
+		defer g.lockRow(row).Unlock()
+	}
+	shards, err := g.readShards(row, col, len(buf), n)
+	if err != nil {
+		return
+	}
+	copy(buf, shards[n])
+	atomic.AddInt64(&g.c.s.reconstructed, 1)
+	return
+}
+
+// Read the same part of units from k healthy members except skip one and reconstruct all units. Row must be locked
+func (g *group) readShards(row, col int64, l, skip int) (shards [][]byte, err error) {
+	shards = make([][]byte, len(g.members))
+	got := 0
+	for n, mb := range g.members {
+		if got == g.k {
+			break
+		}
+		if n == skip || mb.getState() != MEMBER_OK {
+			continue
+		}
+		buf := make([]byte, l)
+		if _, e := mb.f.Load().ReadAt(buf, row*RS_STRIPE_UNIT+col); e != nil {
+			g.fail(mb, e)
+			continue
+		}
+		shards[n] = buf
+		got++
+	}
+	if err = g.coder.reconstruct(shards); err != nil {
+		return nil, fmt.Errorf("Container %d: %w", g.c.Id, ErrGroupLost)
+	}
+	return
+}
+
+func (g *group) WriteAt(p []byte, off int64) (n int, err error) {
+	rs := int64(g.k) * RS_STRIPE_UNIT
+	for n < len(p) {
+		row, pos := off/rs, off%rs
+		l := len(p) - n
+		if max := rs - pos; int64(l) > max {
+			l = int(max)
+		}
+		if err = g.writeRow(row, pos, p[n:n+l]); err != nil {
+			return
+		}
+		n += l
+		off += int64(l)
+	}
+	return
+}
+
+// Write part of row and update parity
+// Parity byte depends only on bytes with the same position in data units, so only touched columns are read and written
+func (g *group) writeRow(row, pos int64, p []byte) (err error) {
+	end := pos + int64(len(p))
+	lo, hi := pos%RS_STRIPE_UNIT, (end-1)%RS_STRIPE_UNIT+1
+	if pos/RS_STRIPE_UNIT != (end-1)/RS_STRIPE_UNIT {
+		lo, hi = 0, RS_STRIPE_UNIT
+	}
+	defer g.lockRow(row).Unlock()
+
+	data := make([][]byte, g.k)
+	touched := make([]bool, g.k)
+	for n := range data {
+		// part of write in columns of unit
+		us, ue := int64(n)*RS_STRIPE_UNIT+lo, int64(n)*RS_STRIPE_UNIT+hi
+		ws, we := pos, end
+		if us > ws {
+			ws = us
+		}
+		if ue < we {
+			we = ue
+		}
+		touched[n] = ws < we
+		if ws == us && we == ue {
+			data[n] = p[ws-pos : we-pos]
+			continue
+		}
+		data[n] = make([]byte, hi-lo)
+		if err = g.readUnit(row, n, lo, data[n], true); err != nil {
+			return
+		}
+		if touched[n] {
+			copy(data[n][ws-us:], p[ws-pos:we-pos])
+		}
+	}
+	parity := make([][]byte, g.m)
+	for n := range parity {
+		parity[n] = make([]byte, hi-lo)
+	}
+	g.coder.encode(data, parity)
+
+	for n, mb := range g.members {
+		var b []byte
+		if n < g.k {
+			if !touched[n] {
+				continue
+			}
+			b = data[n]
+		} else {
+			b = parity[n-g.k]
+		}
+		// rebuilding member gets writes too
+		if mb.getState() == MEMBER_FAILED {
+			continue
+		}
+		if _, e := mb.f.Load().WriteAt(b, row*RS_STRIPE_UNIT+lo); e != nil {
+			g.fail(mb, e)
+		}
+	}
+	if g.healthy() < g.k {
+		return fmt.Errorf("Container %d: %w", g.c.Id, ErrGroupLost)
+	}
+	return
+}
+
+// Write index to all healthy members. Error is returned if no copy was written. Container must be locked
+func (g *group) dump() (n int64, err error) {
+	written := false
+	for _, mb := range g.members {
+		if mb.getState() != MEMBER_OK {
+			continue
+		}
+		w, e := g.c.dumpTo(g.name(mb, ".index"))
+		if e != nil {
+			g.fail(mb, e)
+			err = e
+			continue
+		}
+		n, written = w, true
+	}
+	if written {
+		err = nil
+	}
+	return
+}
+
+// Write key of container to all healthy members
+func (g *group) writeKey(ck *containerKey) (err error) {
+	for _, mb := range g.members {
+		if mb.getState() == MEMBER_FAILED {
+			continue
+		}
+		if err = writeContainerKey(g.name(mb, ".key"), ck); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Copy journal to all healthy members except the one with journal
+func (g *group) mirrorJournal(j *journal) {
+	for _, mb := range g.members {
+		if mb.getState() != MEMBER_OK || mb.disk == g.c.disk {
+			continue
+		}
+		if err := j.mirror(g.name(mb, ".journal")); err != nil {
+			g.fail(mb, err)
+		}
+	}
+}
+
+// Restore failed members on disk, return count of written bytes
+func (g *group) rebuild(d *Disk) (n int64, err error) {
+	for _, mb := range g.members {
+		if mb.disk != d {
+			continue
+		}
+		if mb.getState() == MEMBER_OK {
+			// disk was replaced while storage is running
+			_, e := os.Stat(g.name(mb, ".data"))
+			if e == nil {
+				continue
+			}
+			g.fail(mb, e)
+		}
+		w, e := g.rebuildMember(mb)
+		n += w
+		if e != nil {
+			g.fail(mb, e)
+			return n, e
+		}
+	}
+	return
+}
+
+func (g *group) rebuildMember(mb *groupMember) (n int64, err error) {
+	aelog.Infof("Container %d: rebuild part on %s", g.c.Id, mb.path)
+	// descriptor goes first, data file without index is a part of group
+	if err = writeFileSync(g.name(mb, ".group"), g.descriptor()); err != nil {
+		return
+	}
+	f, err := os.OpenFile(g.name(mb, ".data"), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return
+	}
+	size := g.memberSize()
+	if err = f.Truncate(size); err != nil {
+		f.Close()
+		return
+	}
+	g.dm.Lock()
+	if old := mb.f.Swap(f); old != nil {
+		// can be used by readers yet
+		g.stale = append(g.stale, old)
+	}
+	g.dm.Unlock()
+	atomic.StoreInt32(&mb.state, MEMBER_REBUILDING)
+
+	for row := int64(0); row*RS_STRIPE_UNIT < size; row++ {
+		mu := g.lockRow(row)
+		shards, e := g.readShards(row, 0, RS_STRIPE_UNIT, mb.n)
+		if e == nil {
+			_, e = f.WriteAt(shards[mb.n], row*RS_STRIPE_UNIT)
+		}
+		mu.Unlock()
+		if e != nil {
+			return n, e
+		}
+		n += RS_STRIPE_UNIT
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+
+	// copy metadata and enable member, journal records are written to it from now
+	c := g.c
+	c.m.Lock()
+	if c.key != nil && c.key.id != 0 {
+		err = writeContainerKey(g.name(mb, ".key"), c.key)
+	}
+	if err == nil && c.j != nil && mb.disk != c.disk {
+		err = c.j.mirror(g.name(mb, ".journal"))
+	}
+	if err == nil && !atomic.CompareAndSwapInt32(&mb.state, MEMBER_REBUILDING, MEMBER_OK) {
+		err = errors.New("Part failed while rebuilding")
+	}
+	c.ch = true
+	c.m.Unlock()
+	if err != nil {
+		return
+	}
+	if err = c.Dump(); err != nil {
+		return
+	}
+	err = g.save()
+	return
+}
+
+// Write file and sync it, file is replaced atomically
+func writeFileSync(filename string, b []byte) (err error) {
+	fh, err := os.OpenFile(filename+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return
+	}
+	if _, err = fh.Write(b); err == nil {
+		err = fh.Sync()
+	}
+	fh.Close()
+	if err != nil {
+		return
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+type RebuildResult struct {
+	Path       string
+	Containers int
+	Size       int64
+	Duration   time.Duration
+}
+
+// Restore parts of containers on replaced data path from other members of their groups
+// Containers stored without redundancy can't be restored
+func (s *Storage) RebuildDisk(path string) (res *RebuildResult, err error) {
+	d := s.dataPath(path)
+	if d == nil {
+		return nil, fmt.Errorf("%s is not a data path", path)
+	}
+	if _, err = d.readDir(); err != nil {
+		return
+	}
+	st := time.Now()
+	res = &RebuildResult{Path: d.Path}
+	var groups []*group
+	s.m.RLock()
+	for _, c := range s.Containers {
+		if c.g != nil {
+			groups = append(groups, c.g)
+		}
+	}
+	s.m.RUnlock()
+	for _, g := range groups {
+		n, e := g.rebuild(d)
+		if e != nil {
+			return res, fmt.Errorf("Container %d: %v", g.c.Id, e)
+		}
+		if n > 0 {
+			res.Containers++
+			res.Size += n
+		}
+	}
+	// containers without redundancy on failed disk are lost, so it stays degraded
+	s.m.RLock()
+	lost := false
+	for _, c := range s.Containers {
+		if c.g == nil && c.disk == d {
+			lost = true
+		}
+	}
+	s.m.RUnlock()
+	if !lost {
+		d.recover()
+	}
+	res.Duration = time.Since(st)
+	aelog.Infof("Rebuild: %s, %d containers restored for a %v", d.Path, res.Containers, res.Duration)
+	return
+}
+
+// Parts of new container: k data and m parity parts, m = 0 - container without redundancy
+func (s *Storage) groupParts() (k, m int) {
+	switch s.Conf.Redundancy {
+	case config.REDUNDANCY_MIRROR, config.REDUNDANCY_RS:
+		return s.Conf.RedundancyData, s.Conf.RedundancyParity
+	}
+	return 1, 0
+}
+
+// Index file found in data path
+type indexCopy struct {
+	d    *Disk
+	info os.FileInfo
+}
+
+// Every part of group has a copy of index, the newest one is restored. Copies of other containers are returned as is
+func groupIndex(name string, copies []indexCopy) []indexCopy {
+	if len(copies) < 2 {
+		return copies
+	}
+	if _, err := os.Stat(copies[0].d.Path + strings.TrimSuffix(name, ".index") + ".group"); err != nil {
+		return copies
+	}
+	newest := copies[0]
+	for _, ic := range copies[1:] {
+		if ic.info.ModTime().After(newest.info.ModTime()) {
+			newest = ic
+		}
+	}
+	return []indexCopy{newest}
+}
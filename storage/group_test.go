@@ -0,0 +1,149 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"github.com/cheggaaa/Anteater/config"
+	"os"
+	"testing"
+)
+
+func TestRSCoder(t *testing.T) {
+	rs := newRSCoder(4, 2)
+	shards := make([][]byte, 6)
+	for i := range shards {
+		shards[i] = make([]byte, 1000)
+		if i < 4 {
+			rand.Read(shards[i])
+		}
+	}
+	rs.encode(shards[:4], shards[4:])
+	for a := 0; a < 6; a++ {
+		for b := a + 1; b < 6; b++ {
+			broken := append([][]byte(nil), shards...)
+			broken[a], broken[b] = nil, nil
+			if err := rs.reconstruct(broken); err != nil {
+				t.Fatal(err)
+			}
+			for i := range shards {
+				if !bytes.Equal(broken[i], shards[i]) {
+					t.Fatalf("Shard %d is not restored without %d and %d", i, a, b)
+				}
+			}
+		}
+	}
+	shards[0], shards[1], shards[2] = nil, nil, nil
+	if err := rs.reconstruct(shards); err != errTooFewShards {
+		t.Errorf("Expected errTooFewShards, got %v", err)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	for _, redundancy := range []string{"mirror:3", "rs:2+1"} {
+		t.Run(redundancy, func(t *testing.T) {
+			testGroup(t, redundancy)
+		})
+	}
+}
+
+func testGroup(t *testing.T, redundancy string) {
+	dirs := []string{t.TempDir() + "/", t.TempDir() + "/", t.TempDir() + "/"}
+	s := newTestStorage(t, t.TempDir())
+	s.Close()
+	s.Conf.ContainerSize = 1024 * 1024
+	s.Conf.Journal = true
+	s.Conf.DataPaths = []config.DataDir{{Path: dirs[0]}, {Path: dirs[1]}, {Path: dirs[2]}}
+	s.Conf.Redundancy, s.Conf.RedundancyData, s.Conf.RedundancyParity, _ = config.ParseRedundancy(redundancy)
+	s = reopenStorage(t, s)
+
+	md5s := make(map[string]string)
+	add := func(s *Storage, name string, size int64) {
+		f, err := s.Add(name, randReader(size), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		md5s[name] = f.Md5S()
+	}
+	check := func(s *Storage) {
+		for name, sum := range md5s {
+			f, ok := s.Get(name)
+			if !ok || f.Md5S() != sum {
+				t.Fatalf("File %s is lost", name)
+			}
+			if err := f.CheckMd5(); err != nil {
+				t.Fatalf("File %s: %v", name, err)
+			}
+		}
+	}
+	for i := 0; i < 20; i++ {
+		add(s, fmt.Sprint(i), int64(1000+i*20000))
+	}
+	check(s)
+	if st := s.GetStats().Storage; st.Disks[0].ContainersCount != len(s.Containers) || st.Disks[2].ContainersCount != len(s.Containers) {
+		t.Errorf("Container is not placed on all data paths: %+v", st.Disks[0])
+	}
+	s.Close()
+
+	// disk with the first part is lost
+	if err := os.RemoveAll(dirs[0]); err != nil {
+		t.Fatal(err)
+	}
+	s = reopenStorage(t, s)
+	check(s)
+	if st := s.GetStats().Storage; st.Reconstructed == 0 || st.DegradedContainers == 0 {
+		t.Errorf("Unexpected stats: %d reconstructed, %d degraded", st.Reconstructed, st.DegradedContainers)
+	}
+	// degraded group gets new files
+	add(s, "degraded", 50000)
+	check(s)
+	s.Close()
+
+	// replaced disk stays failed until rebuild
+	if err := os.Mkdir(dirs[0], 0755); err != nil {
+		t.Fatal(err)
+	}
+	s = reopenStorage(t, s)
+	check(s)
+	if _, err := s.RebuildDisk(t.TempDir()); err == nil {
+		t.Error("Expected error for unknown data path")
+	}
+	res, err := s.RebuildDisk(dirs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Containers != len(s.Containers) || s.Disks[0].Degraded() {
+		t.Errorf("Unexpected rebuild result: %+v", res)
+	}
+	if st := s.GetStats().Storage; st.DegradedContainers != 0 {
+		t.Errorf("Containers are degraded after rebuild: %d", st.DegradedContainers)
+	}
+	add(s, "rebuilt", 50000)
+	s.Close()
+
+	// rebuilt part is enough to restore data
+	for _, dir := range dirs[1 : 1+s.Conf.RedundancyParity] {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s = reopenStorage(t, s)
+	defer s.Close()
+	check(s)
+}
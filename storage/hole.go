@@ -28,6 +28,8 @@ type Hole struct {
 	Off int64
 	// Index
 	Indx int32
+	// space is released to file system (see Container.punchHole)
+	punched bool
 }
 
 // implement Space
@@ -44,6 +44,20 @@ func (hi *HoleIndex) Get(index int) *Hole {
 	return nil
 }
 
+// Find hole (and remove it from index) for a given index placed before limit offset
+func (hi *HoleIndex) GetBefore(index int, limit int64) *Hole {
+	size := R.Size(int32(index))
+	for ; index <= hi.biggestIndex; index++ {
+		for _, s := range hi.index[index] {
+			if s.Offset()+size <= limit {
+				hi.Delete(s)
+				return s
+			}
+		}
+	}
+	return nil
+}
+
 func (hi *HoleIndex) Exists(h *Hole) bool {
 	if m := hi.index[h.Index()]; m != nil {
 		if eh, ok := m[h.Offset()]; ok {
@@ -23,28 +23,129 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var (
-	ErrConflict = errors.New("Conflict")
+	ErrConflict           = errors.New("Conflict")
+	ErrPreconditionFailed = errors.New("Precondition failed")
 )
 
+// Precondition of change, called under index lock. f is nil if there is no file
+// Change is not made if condition returns error
+type Condition func(f *File) error
+
+// Index change events
+const (
+	EVENT_ADD    = 1
+	EVENT_DELETE = 2
+	EVENT_RENAME = 3
+	EVENT_UPDATE = 4
+)
+
+// Index change. Version is a version of index after change
+type Event struct {
+	Version int64
+	Op      byte
+	Name    string
+	NewName string
+	Md5     []byte
+	Size    int64
+	Time    time.Time
+	Expires time.Time
+	Meta    map[string]string
+	// content type and disposition supplied by uploader
+	ContentType string
+	Disposition string
+}
+
 type Index struct {
 	Root *Node
 	m    *sync.Mutex
 	v, c int64
+	// called under index lock after every change made by Add, Delete, Rename or Update
+	listener func(e *Event)
+	// noncurrent versions by name, oldest first, and names with versioning enabled (see version.go)
+	versions  map[string][]*File
+	versioned func(name string) bool
+	// deleted files by name, oldest first (see trash.go)
+	trash    map[string][]*File
+	trashing bool
 }
 
 func (i *Index) Init() {
 	i.m = &sync.Mutex{}
 	i.Root = &Node{}
+	i.versions = make(map[string][]*File)
+	i.trash = make(map[string][]*File)
+}
+
+// Set function that will be called after every index change. Function must not block
+func (i *Index) SetListener(fn func(e *Event)) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	i.listener = fn
+}
+
+func (i *Index) notify(op byte, f *File, name string) {
+	if i.listener == nil {
+		return
+	}
+	e := &Event{
+		Version: atomic.LoadInt64(&i.v),
+		Op:      op,
+		Name:    name,
+	}
+	if op == EVENT_RENAME {
+		e.NewName = f.Name
+	}
+	if op != EVENT_DELETE {
+		e.Md5, e.Size, e.Time, e.Expires, e.Meta = f.Md5, f.FSize, f.Time, f.Expires, f.Meta()
+		e.ContentType, e.Disposition = f.StoredType()
+	}
+	i.listener(e)
 }
 
 // Add new file to index
 func (i *Index) Add(file *File) (err error) {
 	i.m.Lock()
 	defer i.m.Unlock()
-	return i.add(file)
+	if err = i.add(file); err == nil {
+		i.notify(EVENT_ADD, file, file.Name)
+	}
+	return
+}
+
+// Add file or replace file with the same name if cond returns nil for existing one, cond can be nil
+// Return replaced file, it is kept as noncurrent version if versioning is enabled for the name
+func (i *Index) Put(f *File, cond Condition) (old *File, err error) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	node, e := i.Root.GetNode(i.explode(f.Name), 0)
+	if e == nil && node.IsFile() {
+		old = node.File
+	}
+	if cond != nil {
+		if err = cond(old); err != nil {
+			return nil, err
+		}
+	}
+	if old != nil {
+		node.File = f
+		atomic.AddInt64(&i.v, 1)
+	} else if err = i.add(f); err != nil {
+		return
+	}
+	if i.isVersioned(f.Name) {
+		if f.version == 0 {
+			f.version = newVersion()
+		}
+		if old != nil {
+			i.retire(old)
+		}
+	}
+	i.notify(EVENT_ADD, f, f.Name)
+	return
 }
 
 func (i *Index) Get(name string) (f *File, ok bool) {
@@ -54,26 +155,108 @@ func (i *Index) Get(name string) (f *File, ok bool) {
 }
 
 func (i *Index) Delete(name string) (f *File, ok bool) {
+	f, err := i.DeleteIf(name, nil)
+	return f, err == nil
+}
+
+// Delete file if cond is true for it, cond can be nil
+// Deleted file is kept as noncurrent version if versioning is enabled for the name or moved to trash if enabled
+func (i *Index) DeleteIf(name string, cond Condition) (f *File, err error) {
+	return i.deleteIf(name, cond, true)
+}
+
+func (i *Index) deleteIf(name string, cond Condition, keep bool) (f *File, err error) {
 	i.m.Lock()
 	defer i.m.Unlock()
-	return i.delete(name)
+	if cond != nil {
+		f, _ = i.get(name)
+		if err = cond(f); err != nil {
+			return nil, err
+		}
+	}
+	f, ok := i.delete(name)
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+	if keep {
+		if i.isVersioned(name) {
+			i.retire(f)
+		} else if i.trashing {
+			i.toTrash(f)
+		}
+	}
+	i.notify(EVENT_DELETE, f, name)
+	return
+}
+
+// Call fn for file under index lock, listener will be notified about update if fn returns nil
+func (i *Index) Update(name string, fn func(f *File) error) (f *File, err error) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	f, ok := i.get(name)
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+	if err = fn(f); err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&i.v, 1)
+	i.notify(EVENT_UPDATE, f, name)
+	return
+}
+
+// Delete file from index if its name still refers to it
+func (i *Index) DeleteFile(f *File) (ok bool) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	node, err := i.Root.GetNode(i.explode(f.Name), 0)
+	if err != nil || node.File != f {
+		return
+	}
+	if _, ok = i.delete(f.Name); ok {
+		i.notify(EVENT_DELETE, f, f.Name)
+	}
+	return
 }
 
 func (i *Index) Rename(name, newName string) (f *File, err error) {
+	return i.RenameIf(name, newName, nil)
+}
+
+// Rename file if cond is true for it, cond can be nil
+func (i *Index) RenameIf(name, newName string, cond Condition) (f *File, err error) {
+	return i.renameIf(name, newName, cond, false)
+}
+
+// Rename file, existing file with new name is deleted as by Delete if replace is true
+func (i *Index) renameIf(name, newName string, cond Condition, replace bool) (f *File, err error) {
 	i.m.Lock()
 	defer i.m.Unlock()
 	// check file
 	f, ok := i.get(name)
+	if cond != nil {
+		if err = cond(f); err != nil {
+			return nil, err
+		}
+	}
 	if !ok {
 		err = ErrFileNotFound
 		return
 	}
 	// check new name
-	_, ok = i.get(newName)
-	if ok {
-		err = ErrConflict
-		f = nil
-		return
+	if old, ok := i.get(newName); ok {
+		if !replace || old == f {
+			err = ErrConflict
+			f = nil
+			return
+		}
+		i.delete(newName)
+		if i.isVersioned(newName) {
+			i.retire(old)
+		} else if i.trashing {
+			i.toTrash(old)
+		}
+		i.notify(EVENT_DELETE, old, newName)
 	}
 	// rename
 	f.Name = newName
@@ -86,10 +269,34 @@ func (i *Index) Rename(name, newName string) (f *File, err error) {
 		f = nil
 		return
 	}
+	i.notify(EVENT_RENAME, f, name)
 	return
 }
 
+// Replace file in index to another one with same name and attributes. Return false if old file is not in index now
+func (i *Index) Replace(old, f *File) (ok bool) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	f.version = old.version
+	if !old.noncurrent.IsZero() {
+		return i.replaceVersion(old, f)
+	}
+	if !old.trashed.IsZero() {
+		return i.replaceTrashed(old, f)
+	}
+	node, err := i.Root.GetNode(i.explode(old.Name), 0)
+	if err != nil || node.File != old {
+		return
+	}
+	f.Name = old.Name
+	f.copyAttrs(old)
+	node.File = f
+	return true
+}
+
 func (i *Index) List(prefix string, maxnesting int) (names []string, err error) {
+	i.m.Lock()
+	defer i.m.Unlock()
 	parts := make([]string, 0)
 	if prefix != "" {
 		parts = i.explode(prefix)
@@ -97,6 +304,25 @@ func (i *Index) List(prefix string, maxnesting int) (names []string, err error)
 	return i.Root.List(parts, 0, maxnesting)
 }
 
+// Return names of child folders of prefix
+func (i *Index) Dirs(prefix string) (names []string) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	node := i.Root
+	if prefix != "" {
+		var err error
+		if node, err = i.Root.GetNode(i.explode(prefix), 0); err != nil {
+			return
+		}
+	}
+	for name, child := range node.Childs {
+		if len(child.Childs) > 0 {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
 func (i *Index) Count() int64 {
 	return atomic.LoadInt64(&i.c)
 }
@@ -17,6 +17,7 @@
 package storage
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -146,3 +147,30 @@ func TestRename(t *testing.T) {
 	I.Root.Print("")
 }
 
+func TestListWhileAdd(t *testing.T) {
+	idx := &Index{}
+	idx.Init()
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			name := fmt.Sprintf("dir%d/file%d", i%10, i)
+			idx.Add(&File{Name: name})
+			if i%3 == 0 {
+				idx.Delete(name)
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if names, err := idx.List("", 0); err != nil || int64(len(names)) != idx.Count() {
+				t.Errorf("Unexpected list: %d names, count %d, %v", len(names), idx.Count(), err)
+			}
+			return
+		default:
+			idx.List("", 0)
+			idx.List("dir1", 0)
+		}
+	}
+}
@@ -0,0 +1,517 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Journal operations
+const (
+	JOURNAL_ADD     = 1
+	JOURNAL_DELETE  = 2
+	JOURNAL_RENAME  = 3
+	JOURNAL_MOVE    = 4
+	JOURNAL_UPDATE  = 5
+	JOURNAL_VERSION = 6
+	JOURNAL_TRASH   = 7
+)
+
+var errJournalCorrupt = errors.New("Journal record corrupted")
+
+// Append-only log of index changes of one container. Truncates after every successful container dump
+// Record format: uvarint(len) payload crc32(payload)
+// Payload: uvarint(seq) op data
+type journal struct {
+	f *os.File
+	// copies on other members of redundancy group (see group.go)
+	mirrors []*os.File
+	sync    bool
+	dirty   bool
+}
+
+func openJournal(filename string, sync bool) (j *journal, err error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return
+	}
+	return &journal{f: f, sync: sync}, nil
+}
+
+func (j *journal) write(payload []byte) (err error) {
+	buf := make([]byte, 0, len(payload)+binary.MaxVarintLen32+4)
+	buf = binary.AppendUvarint(buf, uint64(len(payload)))
+	buf = append(buf, payload...)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(payload))
+	err = j.each(func(f *os.File) (err error) {
+		_, err = f.Write(buf)
+		return
+	})
+	j.dirty = true
+	return
+}
+
+func (j *journal) flush() (err error) {
+	if j.dirty {
+		j.dirty = false
+		return j.each((*os.File).Sync)
+	}
+	return
+}
+
+func (j *journal) truncate() (err error) {
+	j.dirty = false
+	return j.each(func(f *os.File) error {
+		return f.Truncate(0)
+	})
+}
+
+func (j *journal) close() error {
+	j.flush()
+	for _, m := range j.mirrors {
+		m.Close()
+	}
+	return j.f.Close()
+}
+
+// Call fn for journal and its mirrors, failed mirror is closed and removed. Return the first error
+func (j *journal) each(fn func(f *os.File) error) (err error) {
+	err = fn(j.f)
+	for n := 0; n < len(j.mirrors); {
+		if e := fn(j.mirrors[n]); e != nil {
+			if err == nil {
+				err = e
+			}
+			j.mirrors[n].Close()
+			j.mirrors = append(j.mirrors[:n], j.mirrors[n+1:]...)
+			continue
+		}
+		n++
+	}
+	return
+}
+
+// Add copy of journal, existing records are copied to it
+func (j *journal) mirror(filename string) (err error) {
+	for n, m := range j.mirrors {
+		if m.Name() == filename {
+			m.Close()
+			j.mirrors = append(j.mirrors[:n], j.mirrors[n+1:]...)
+			break
+		}
+	}
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_TRUNC|os.O_APPEND, 0666)
+	if err != nil {
+		return
+	}
+	info, err := j.f.Stat()
+	if err == nil {
+		_, err = io.Copy(f, io.NewSectionReader(j.f, 0, info.Size()))
+	}
+	if err != nil {
+		f.Close()
+		return
+	}
+	j.mirrors = append(j.mirrors, f)
+	return
+}
+
+// Read all valid records. Torn record in the end of journal will be ignored
+func (j *journal) records(c *Container) (records []*journalRecord, err error) {
+	if _, err = j.f.Seek(0, 0); err != nil {
+		return
+	}
+	rd := bufio.NewReader(j.f)
+	for {
+		l, e := binary.ReadUvarint(rd)
+		if e != nil {
+			if e != io.EOF {
+				aelog.Warnf("Journal %s: broken record in the end: %v", j.f.Name(), e)
+			}
+			return
+		}
+		payload := make([]byte, l+4)
+		if _, e = io.ReadFull(rd, payload); e != nil {
+			aelog.Warnf("Journal %s: broken record in the end: %v", j.f.Name(), e)
+			return
+		}
+		if crc32.ChecksumIEEE(payload[:l]) != binary.LittleEndian.Uint32(payload[l:]) {
+			aelog.Warnf("Journal %s: %v", j.f.Name(), errJournalCorrupt)
+			return
+		}
+		rec, e := decodeJournalRecord(payload[:l])
+		if e != nil {
+			aelog.Warnf("Journal %s: can't decode record: %v", j.f.Name(), e)
+			return
+		}
+		rec.c = c
+		records = append(records, rec)
+	}
+}
+
+type journalRecord struct {
+	seq  int64
+	op   byte
+	c    *Container
+	f    *File
+	off  int64
+	name string
+}
+
+func (r *journalRecord) encode() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 128))
+	var arr [binary.MaxVarintLen64]byte
+	buf.Write(binary.AppendUvarint(arr[:0], uint64(r.seq)))
+	buf.WriteByte(r.op)
+	switch r.op {
+	case JOURNAL_ADD, JOURNAL_UPDATE, JOURNAL_VERSION, JOURNAL_TRASH:
+		r.f.MarshalTo(buf)
+	case JOURNAL_MOVE:
+		buf.Write(binary.AppendUvarint(arr[:0], uint64(r.off)))
+		r.f.MarshalTo(buf)
+	case JOURNAL_DELETE, JOURNAL_RENAME:
+		buf.Write(binary.AppendUvarint(arr[:0], uint64(r.off)))
+		buf.Write(binary.AppendUvarint(arr[:0], uint64(len(r.name))))
+		buf.WriteString(r.name)
+	}
+	return buf.Bytes()
+}
+
+func decodeJournalRecord(payload []byte) (r *journalRecord, err error) {
+	rd := bufio.NewReader(bytes.NewReader(payload))
+	r = &journalRecord{}
+	seq, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return
+	}
+	r.seq = int64(seq)
+	if r.op, err = rd.ReadByte(); err != nil {
+		return
+	}
+	readFile := func() (err error) {
+		sp, err := UnmarshallSpace(rd)
+		if err != nil {
+			return
+		}
+		var ok bool
+		if r.f, ok = sp.(*File); !ok {
+			err = fmt.Errorf("expected file, got hole")
+		}
+		return
+	}
+	switch r.op {
+	case JOURNAL_ADD, JOURNAL_UPDATE, JOURNAL_VERSION, JOURNAL_TRASH:
+		err = readFile()
+	case JOURNAL_MOVE:
+		var off uint64
+		if off, err = binary.ReadUvarint(rd); err != nil {
+			return
+		}
+		r.off = int64(off)
+		err = readFile()
+	case JOURNAL_DELETE, JOURNAL_RENAME:
+		var off, l uint64
+		if off, err = binary.ReadUvarint(rd); err != nil {
+			return
+		}
+		if l, err = binary.ReadUvarint(rd); err != nil {
+			return
+		}
+		name := make([]byte, l)
+		if _, err = io.ReadFull(rd, name); err != nil {
+			return
+		}
+		r.off, r.name = int64(off), string(name)
+	default:
+		err = fmt.Errorf("unexpected journal operation: %d", r.op)
+	}
+	return
+}
+
+// Mark container as changed and write record to journal, record is synced if journal_sync is 0
+func (c *Container) journalWrite(r *journalRecord) (err error) {
+	if err = c.journalAppend(r); err == nil {
+		err = c.journalSync()
+	}
+	return
+}
+
+// Mark container as changed and write record to journal without fsync
+func (c *Container) journalAppend(r *journalRecord) (err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.ch = true
+	if c.j == nil {
+		return
+	}
+	r.seq = atomic.AddInt64(&c.s.jseq, 1)
+	if err = c.j.write(r.encode()); err != nil {
+		aelog.Warnf("Can't write to journal of container %d: %v", c.Id, err)
+		c.check(err)
+	}
+	return
+}
+
+// Fsync journal if every record must be synced
+func (c *Container) journalSync() (err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.j == nil || !c.j.sync {
+		return
+	}
+	if err = c.j.flush(); err != nil {
+		aelog.Warnf("Can't sync journal of container %d: %v", c.Id, err)
+		c.check(err)
+	}
+	return
+}
+
+// Records written ahead of index change, journals are synced when change is applied
+type journalBatch []*Container
+
+// Write record without fsync, index must be locked
+func (b *journalBatch) append(c *Container, r *journalRecord) (err error) {
+	if err = c.journalAppend(r); err != nil {
+		return
+	}
+	for _, ex := range *b {
+		if ex == c {
+			return
+		}
+	}
+	*b = append(*b, c)
+	return
+}
+
+func (b journalBatch) sync() (err error) {
+	for _, c := range b {
+		if e := c.journalSync(); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+func (c *Container) journalName() string {
+	return fmt.Sprintf("%sc%d.journal", c.disk.Path, c.Id)
+}
+
+// Periodically fsync all journals (group commit)
+func (s *Storage) journalSyncLoop() {
+	for {
+		time.Sleep(s.Conf.JournalSync)
+		s.m.RLock()
+		for _, c := range s.Containers {
+			c.m.Lock()
+			if c.j != nil {
+				if err := c.j.flush(); err != nil {
+					aelog.Warnf("Can't sync journal of container %d: %v", c.Id, err)
+				}
+			}
+			c.m.Unlock()
+		}
+		s.m.RUnlock()
+	}
+}
+
+type replayFile struct {
+	f   *File
+	seq int64
+}
+
+// Apply all journals over restored containers
+func (s *Storage) replayJournals() (err error) {
+	var records []*journalRecord
+	for _, c := range s.Containers {
+		if c.j == nil {
+			continue
+		}
+		rs, e := c.j.records(c)
+		if e != nil {
+			return e
+		}
+		records = append(records, rs...)
+	}
+	if len(records) == 0 {
+		return
+	}
+	st := time.Now()
+	sort.Slice(records, func(i, j int) bool { return records[i].seq < records[j].seq })
+	if last := records[len(records)-1].seq; last > s.jseq {
+		s.jseq = last
+	}
+
+	// files of changed containers by offset
+	files := make(map[*Container]map[int64]*replayFile)
+	getFiles := func(c *Container) map[int64]*replayFile {
+		m, ok := files[c]
+		if !ok {
+			m = make(map[int64]*replayFile)
+			var sp Space
+			if c.last != nil {
+				sp = c.last
+			}
+			for sp != nil {
+				if f, ok := sp.(*File); ok {
+					m[f.Off] = &replayFile{f: f}
+				}
+				sp = sp.Prev()
+			}
+			files[c] = m
+		}
+		return m
+	}
+	remove := func(f *File) {
+		delete(getFiles(f.c), f.Off)
+		if node, e := s.Index.Root.GetNode(s.Index.explode(f.Name), 0); e == nil && node.File == f {
+			s.Index.Delete(f.Name)
+		}
+		s.Index.dropKept(f)
+	}
+	add := func(r *journalRecord) {
+		m := getFiles(r.c)
+		if ex, ok := m[r.f.Off]; ok {
+			remove(ex.f)
+		}
+		if ex, ok := s.Index.Get(r.f.Name); ok && r.f.listed() {
+			remove(ex)
+		}
+		r.f.Init(r.c)
+		m[r.f.Off] = &replayFile{f: r.f, seq: r.seq}
+		s.Index.restore(r.f)
+	}
+
+	for _, r := range records {
+		m := getFiles(r.c)
+		switch r.op {
+		case JOURNAL_ADD:
+			add(r)
+		case JOURNAL_DELETE:
+			if ex, ok := m[r.off]; ok && ex.f.Name == r.name {
+				remove(ex.f)
+			}
+		case JOURNAL_RENAME:
+			if ex, ok := m[r.off]; ok {
+				if node, e := s.Index.Root.GetNode(s.Index.explode(ex.f.Name), 0); e == nil && node.File == ex.f {
+					if target, ok := s.Index.Get(r.name); ok {
+						remove(target)
+					}
+					s.Index.Rename(ex.f.Name, r.name)
+				}
+			}
+		case JOURNAL_MOVE:
+			if ex, ok := m[r.off]; ok {
+				remove(ex.f)
+			}
+			add(r)
+		case JOURNAL_UPDATE:
+			if ex, ok := m[r.f.Off]; ok && ex.f.Name == r.f.Name {
+				ex.f.copyAttrs(r.f)
+			}
+		case JOURNAL_VERSION, JOURNAL_TRASH:
+			if ex, ok := m[r.f.Off]; ok && ex.f.Name == r.f.Name {
+				if node, e := s.Index.Root.GetNode(s.Index.explode(ex.f.Name), 0); e == nil && node.File == ex.f {
+					s.Index.Delete(ex.f.Name)
+				}
+				ex.f.version, ex.f.noncurrent, ex.f.trashed = r.f.version, r.f.noncurrent, r.f.trashed
+				s.Index.restore(ex.f)
+			}
+		}
+	}
+
+	for c, m := range files {
+		list := make([]*replayFile, 0, len(m))
+		for _, rf := range m {
+			list = append(list, rf)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].f.Off < list[j].f.Off })
+		// resolve overlaps: newer record wins
+		kept := make([]*replayFile, 0, len(list))
+		for _, rf := range list {
+			for len(kept) > 0 && kept[len(kept)-1].f.End() > rf.f.Off {
+				prev := kept[len(kept)-1]
+				if prev.seq > rf.seq {
+					break
+				}
+				remove(prev.f)
+				kept = kept[:len(kept)-1]
+			}
+			if len(kept) > 0 && kept[len(kept)-1].f.End() > rf.f.Off {
+				remove(rf.f)
+				continue
+			}
+			kept = append(kept, rf)
+		}
+		fl := make([]*File, len(kept))
+		for i, rf := range kept {
+			fl[i] = rf.f
+		}
+		c.m.Lock()
+		c.rebuild(fl)
+		c.ch = true
+		c.m.Unlock()
+	}
+	aelog.Infof("Replayed %d journal records for a %v", len(records), time.Since(st))
+	return
+}
+
+// Build container chain from files sorted by offset, spaces between files become holes. Container must be locked
+func (c *Container) rebuild(files []*File) {
+	c.last = nil
+	c.holeIndex = new(HoleIndex)
+	c.holeIndex.Init(c.Size)
+	c.FileCount, c.FileSize, c.FileRealSize = 0, 0, 0
+	var prev Space
+	var end int64
+	for _, f := range files {
+		f.Init(c)
+		f.SetPrev(nil)
+		f.SetNext(nil)
+		if f.Off > end {
+			h := &Hole{Off: end, prev: prev}
+			if prev != nil {
+				prev.SetNext(h)
+			}
+			c.insertNormalizedHole(h, f.Off-end)
+			for prev = h; prev.Next() != nil; prev = prev.Next() {
+			}
+		}
+		if prev != nil {
+			prev.SetNext(f)
+			f.SetPrev(prev)
+		}
+		prev = f
+		end = f.End()
+		c.FileCount++
+		c.FileSize += f.dataSize()
+		c.FileRealSize += f.Size()
+	}
+	if prev != nil {
+		c.last = prev.(*File)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestJournalReplay(t *testing.T) {
+	s := newTestStorage(t, t.TempDir())
+	s.Close()
+	s.Conf.Journal = true
+	s = reopenStorage(t, s)
+
+	for i := 0; i < 30; i++ {
+		size := int64(1000 * (i + 1))
+		if _, err := s.Add(fmt.Sprint(i), randReader(size), size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// dumped state
+	s.Dump()
+	for i := 0; i < 20; i += 2 {
+		s.Delete(fmt.Sprint(i))
+	}
+	if _, err := s.Rename("1", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RenameIf("3", "5", nil, false); err != ErrConflict {
+		t.Errorf("Unexpected error of rename to existing name: %v", err)
+	}
+	if _, err := s.RenameIf("3", "5", nil, true); err != nil {
+		t.Fatal(err)
+	}
+	var c *Container
+	for _, c = range s.Containers {
+	}
+	s.compactContainer(c)
+	if _, err := s.Add("new", randReader(12345), 12345); err != nil {
+		t.Fatal(err)
+	}
+	md5s := make(map[string]string)
+	names, _ := s.Index.List("", 0)
+	for _, name := range names {
+		f, _ := s.Get(name)
+		md5s[name] = f.Md5S()
+	}
+
+	// torn write in the end of journal
+	jf, _ := os.OpenFile(c.journalName(), os.O_APPEND|os.O_WRONLY, 0666)
+	jf.Write([]byte{200, 1, 2, 3})
+	jf.Close()
+
+	// open without dump
+	s2 := reopenStorage(t, s)
+	defer s2.Close()
+
+	if s2.Index.Count() != int64(len(md5s)) {
+		t.Errorf("Unexpected files count: %d vs %d", s2.Index.Count(), len(md5s))
+	}
+	for name, md5 := range md5s {
+		f, ok := s2.Get(name)
+		if !ok {
+			t.Errorf("File %s not found after replay", name)
+			continue
+		}
+		if f.Md5S() != md5 {
+			t.Errorf("File %s md5 mismatched", name)
+		}
+	}
+	if _, ok := s2.Get("1"); ok {
+		t.Error("Renamed file exists with old name")
+	}
+	if _, ok := s2.Get("3"); ok {
+		t.Error("File renamed with replace exists with old name")
+	}
+	if err := s2.Check(); err != nil {
+		t.Error(err)
+	}
+	for _, c2 := range s2.Containers {
+		if c2.FileCount != int64(len(md5s)) {
+			t.Errorf("Unexpected container files count: %d", c2.FileCount)
+		}
+		if info, _ := os.Stat(c2.journalName()); info.Size() != 0 {
+			t.Errorf("Journal was not truncated after replay")
+		}
+	}
+}
+
+func TestJournalWriteFail(t *testing.T) {
+	s := newTestStorage(t, t.TempDir())
+	s.Close()
+	s.Conf.Journal = true
+	s = reopenStorage(t, s)
+	defer s.Close()
+
+	if _, err := s.Add("a", randReader(1000), 1000); err != nil {
+		t.Fatal(err)
+	}
+	f, _ := s.Get("a")
+	// journal can't be written anymore
+	f.c.j.f.Close()
+
+	if _, err := s.Add("b", randReader(1000), 1000); err == nil {
+		t.Error("File is added without journal record")
+	}
+	if _, ok := s.Get("b"); ok {
+		t.Error("Not journaled file is in index")
+	}
+	if _, err := s.DeleteIf("a", nil); err == nil {
+		t.Error("File is deleted without journal record")
+	}
+	if _, ok := s.Get("a"); !ok {
+		t.Error("Not journaled delete is applied")
+	}
+	if _, err := s.Rename("a", "c"); err == nil {
+		t.Error("File is renamed without journal record")
+	}
+	if _, ok := s.Get("a"); !ok {
+		t.Error("Not journaled rename is applied")
+	}
+}
@@ -0,0 +1,267 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// User metadata: key/value pairs stored in the index. Keys are lower case
+// Metadata of file is replaced as a whole, so map returned by Meta must not be modified
+// Content type and disposition supplied by uploader are stored the same way
+// Metadata is not stored in file headers, so files recovered by aerepair have no metadata
+
+const (
+	META_HEADER_PREFIX = "X-Ae-Meta-"
+	// max size of all keys and values
+	META_MAX_SIZE = 8 * 1024
+)
+
+var (
+	ErrMetaTooBig  = errors.New("Metadata too big")
+	ErrInvalidType = errors.New("Invalid content type or disposition")
+)
+
+// guards attributes that can be changed after file was added
+var metaMu sync.RWMutex
+
+// Return metadata of file, nil if file has no metadata
+func (f *File) Meta() map[string]string {
+	metaMu.RLock()
+	defer metaMu.RUnlock()
+	return f.meta
+}
+
+func (f *File) setMeta(meta map[string]string) {
+	metaMu.Lock()
+	f.meta = meta
+	metaMu.Unlock()
+}
+
+// Return content type and disposition supplied by uploader, empty if not set
+func (f *File) StoredType() (ctype, disposition string) {
+	metaMu.RLock()
+	defer metaMu.RUnlock()
+	if f.stype != nil {
+		ctype = f.stype.String()
+	}
+	return ctype, f.disposition
+}
+
+// Return content disposition supplied by uploader
+func (f *File) Disposition() string {
+	_, disposition := f.StoredType()
+	return disposition
+}
+
+func (f *File) setType(ctype, disposition string) {
+	metaMu.Lock()
+	f.stype = nil
+	if ctype != "" {
+		f.stype = getCtype(ctype)
+	}
+	f.disposition = disposition
+	metaMu.Unlock()
+}
+
+// Copy attributes that can be changed without rewriting content
+// Return attributes of file that can be passed to AddWith
+func (f *File) Attrs() FileAttrs {
+	ctype, disposition := f.StoredType()
+	return FileAttrs{
+		Time:        f.Time,
+		Expires:     f.Expires,
+		Meta:        f.Meta(),
+		ContentType: ctype,
+		Disposition: disposition,
+	}
+}
+
+func (f *File) copyAttrs(src *File) {
+	f.Expires = src.Expires
+	f.setMeta(src.Meta())
+	f.setType(src.StoredType())
+}
+
+// Return copy of metadata with lower case keys and without empty values, nil if nothing left
+func normalizeMeta(meta map[string]string) (res map[string]string, err error) {
+	var size int
+	for k, v := range meta {
+		if k == "" || v == "" {
+			continue
+		}
+		if res == nil {
+			res = make(map[string]string, len(meta))
+		}
+		res[strings.ToLower(k)] = v
+		if size += len(k) + len(v); size > META_MAX_SIZE {
+			return nil, ErrMetaTooBig
+		}
+	}
+	return
+}
+
+// Check content type and disposition, empty values are allowed
+func checkType(ctype, disposition string) error {
+	if ctype != "" {
+		if _, _, err := mime.ParseMediaType(ctype); err != nil {
+			return ErrInvalidType
+		}
+	}
+	if disposition != "" {
+		if _, _, err := mime.ParseMediaType(disposition); err != nil {
+			return ErrInvalidType
+		}
+	}
+	if len(ctype)+len(disposition) > META_MAX_SIZE {
+		return ErrMetaTooBig
+	}
+	return nil
+}
+
+// Check metadata, content type and disposition, AddWith makes the same checks
+func (a *FileAttrs) Check() error {
+	if _, err := normalizeMeta(a.Meta); err != nil {
+		return err
+	}
+	return checkType(a.ContentType, a.Disposition)
+}
+
+// Return metadata from X-Ae-Meta-* headers
+func MetaFromHeader(h http.Header) map[string]string {
+	var meta map[string]string
+	for k, v := range h {
+		if len(v) == 0 || len(k) <= len(META_HEADER_PREFIX) || !strings.EqualFold(k[:len(META_HEADER_PREFIX)], META_HEADER_PREFIX) {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[strings.ToLower(k[len(META_HEADER_PREFIX):])] = v[0]
+	}
+	return meta
+}
+
+// Types that clients send by default, they are detected on read instead of stored
+var genericTypes = map[string]bool{
+	"application/octet-stream":          true,
+	"application/x-www-form-urlencoded": true,
+	"multipart/form-data":               true,
+}
+
+// Return content type and disposition from Content-Type and Content-Disposition headers
+// Invalid or generic content type is ignored
+func TypeFromHeader(h http.Header) (ctype, disposition string) {
+	ctype = h.Get("Content-Type")
+	if mt, _, err := mime.ParseMediaType(ctype); err != nil || genericTypes[mt] {
+		ctype = ""
+	}
+	return ctype, h.Get("Content-Disposition")
+}
+
+// Set X-Ae-Meta-* headers from metadata
+func MetaToHeader(meta map[string]string, h http.Header) {
+	for k, v := range meta {
+		h.Set(META_HEADER_PREFIX+k, v)
+	}
+}
+
+// Replace metadata of file, content is not rewritten
+func (s *Storage) SetMeta(name string, meta map[string]string) (f *File, err error) {
+	if meta, err = normalizeMeta(meta); err != nil {
+		return
+	}
+	return s.updateAttrs(name, func(f *File) {
+		f.setMeta(meta)
+	})
+}
+
+// Replace content type and disposition of file, empty values reset them
+func (s *Storage) SetType(name, ctype, disposition string) (f *File, err error) {
+	if err = checkType(ctype, disposition); err != nil {
+		return
+	}
+	return s.updateAttrs(name, func(f *File) {
+		f.setType(ctype, disposition)
+	})
+}
+
+func (s *Storage) updateAttrs(name string, fn func(f *File)) (f *File, err error) {
+	s.fm.RLock()
+	defer s.fm.RUnlock()
+	f, err = s.Index.Update(name, func(f *File) error {
+		if f.Expired() {
+			return ErrFileNotFound
+		}
+		fn(f)
+		return nil
+	})
+	if err == nil {
+		err = f.c.journalWrite(&journalRecord{op: JOURNAL_UPDATE, off: f.Off, f: f})
+	}
+	return
+}
+
+func marshalMeta(meta map[string]string) (buf []byte) {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf = binary.AppendUvarint(buf, uint64(len(keys)))
+	for _, k := range keys {
+		buf = binary.AppendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+		buf = binary.AppendUvarint(buf, uint64(len(meta[k])))
+		buf = append(buf, meta[k]...)
+	}
+	return
+}
+
+func unmarshalMeta(b []byte) (meta map[string]string, err error) {
+	cnt, n := binary.Uvarint(b)
+	if n <= 0 || cnt > uint64(len(b)) {
+		return nil, errExtCorrupt
+	}
+	b = b[n:]
+	str := func() (s string) {
+		l, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < l {
+			err = errExtCorrupt
+			return
+		}
+		s = string(b[n : n+int(l)])
+		b = b[n+int(l):]
+		return
+	}
+	meta = make(map[string]string, cnt)
+	for i := uint64(0); i < cnt && err == nil; i++ {
+		k := str()
+		v := str()
+		meta[k] = v
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
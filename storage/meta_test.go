@@ -0,0 +1,141 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMeta(t *testing.T) {
+	s := newTestStorage(t, t.TempDir())
+	s.Close()
+	s.Conf.Journal = true
+	s = reopenStorage(t, s)
+
+	h := http.Header{}
+	h.Set("X-Ae-Meta-Owner", "alice")
+	h.Set("X-Ae-Meta-Empty", "")
+	h.Set("Content-Type", "text/plain")
+	if _, err := s.AddWith("a", randReader(1000), 1000, FileAttrs{Meta: MetaFromHeader(h)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddWith("b", randReader(1000), 1000, FileAttrs{}); err != nil {
+		t.Fatal(err)
+	}
+	f, _ := s.Get("a")
+	if m := f.Meta(); len(m) != 1 || m["owner"] != "alice" {
+		t.Errorf("Unexpected meta: %v", m)
+	}
+	if _, err := s.AddWith("big", randReader(1000), 1000, FileAttrs{Meta: map[string]string{"k": strings.Repeat("v", META_MAX_SIZE)}}); err != ErrMetaTooBig {
+		t.Errorf("Expected ErrMetaTooBig, got %v", err)
+	}
+	if _, ok := s.Get("big"); ok {
+		t.Error("File with too big meta was added")
+	}
+
+	// dumped state
+	s.Dump()
+	if _, err := s.SetMeta("b", map[string]string{"Tag": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetMeta("none", map[string]string{"tag": "x"}); err != ErrFileNotFound {
+		t.Errorf("Expected ErrFileNotFound, got %v", err)
+	}
+	// compaction keeps meta
+	var c *Container
+	for _, c = range s.Containers {
+	}
+	s.compactContainer(c)
+
+	check := func(s *Storage) {
+		if f, _ := s.Get("a"); f == nil || f.Meta()["owner"] != "alice" {
+			t.Error("Meta of a was lost")
+		}
+		if f, _ := s.Get("b"); f == nil || len(f.Meta()) != 1 || f.Meta()["tag"] != "x" {
+			t.Error("Meta of b was not updated")
+		}
+	}
+	check(s)
+
+	// open without dump
+	s2 := reopenStorage(t, s)
+	check(s2)
+	s2.Close()
+	s2 = reopenStorage(t, s)
+	defer s2.Close()
+	check(s2)
+
+	h = http.Header{}
+	MetaToHeader(map[string]string{"tag": "x"}, h)
+	if h.Get("X-Ae-Meta-Tag") != "x" {
+		t.Errorf("Unexpected header: %v", h)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	s := newTestStorage(t, t.TempDir())
+	s.Close()
+	s.Conf.Journal = true
+	s = reopenStorage(t, s)
+
+	h := http.Header{}
+	h.Set("Content-Type", "image/webp")
+	h.Set("Content-Disposition", `attachment; filename="photo.webp"`)
+	attrs := FileAttrs{}
+	attrs.ContentType, attrs.Disposition = TypeFromHeader(h)
+	if _, err := s.AddWith("photo", randReader(1000), 1000, attrs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddWith("page.html", randReader(1000), 1000, FileAttrs{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddWith("bad", randReader(1000), 1000, FileAttrs{Disposition: "attachment; filename"}); err != ErrInvalidType {
+		t.Errorf("Expected ErrInvalidType, got %v", err)
+	}
+	h.Set("Content-Type", "application/x-www-form-urlencoded")
+	if ctype, _ := TypeFromHeader(h); ctype != "" {
+		t.Errorf("Generic type was not ignored: %s", ctype)
+	}
+
+	s.Dump()
+	if _, err := s.SetType("page.html", "text/plain; charset=utf-8", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetType("page.html", "text/", ""); err != ErrInvalidType {
+		t.Errorf("Expected ErrInvalidType, got %v", err)
+	}
+
+	check := func(s *Storage) {
+		if f, _ := s.Get("photo"); f == nil || f.ContentType() != "image/webp" || f.Disposition() != `attachment; filename="photo.webp"` {
+			t.Error("Content type of photo was lost")
+		}
+		if f, _ := s.Get("page.html"); f == nil || f.ContentType() != "text/plain; charset=utf-8" || f.Disposition() != "" {
+			t.Error("Content type of page.html was not updated")
+		}
+	}
+	check(s)
+
+	// open without dump
+	s2 := reopenStorage(t, s)
+	check(s2)
+	s2.Close()
+	s2 = reopenStorage(t, s)
+	defer s2.Close()
+	check(s2)
+}
@@ -55,6 +55,19 @@ func (n *Node) Get(parts []string, depth int) (f *File, err error) {
 	return
 }
 
+func (n *Node) GetNode(parts []string, depth int) (node *Node, err error) {
+	if len(parts) == depth {
+		return n, nil
+	}
+	if n.Childs != nil {
+		if child, ok := n.Childs[parts[depth]]; ok {
+			return child.GetNode(parts, depth+1)
+		}
+	}
+	err = ErrFileNotFound
+	return
+}
+
 func (n *Node) Add(parts []string, f *File, depth int) (err error) {
 	// is it last part - add file
 	if len(parts) == depth {
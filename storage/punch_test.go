@@ -0,0 +1,88 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/config"
+	"testing"
+)
+
+func TestPunchHole(t *testing.T) {
+	if aelog.DefaultLogger == nil {
+		aelog.InitDefault(aelog.LOG_WARN)
+	}
+	s := new(Storage)
+	s.Init(&config.Config{
+		ContainerSize: 4 * 1024 * 1024,
+		DataPath:      t.TempDir() + "/",
+		FileHeaders:   true,
+		PunchHoleSize: 1024 * 1024,
+	})
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { s.Close() }()
+
+	for i := 0; i < 16; i++ {
+		if _, err := s.Add(fmt.Sprint(i), randReader(200*1024), 200*1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := s.GetStats().Storage.PhysicalSize
+	// small hole is kept
+	s.Delete("2")
+	if s.Stats.Compact.Punched.GetValue() != 0 {
+		t.Fatal("Small hole is released")
+	}
+	for i := 3; i < 12; i++ {
+		s.Delete(fmt.Sprint(i))
+	}
+	punched := int64(s.Stats.Compact.Punched.GetValue())
+	if punched == 0 {
+		t.Skip("File system doesn't support punch hole")
+	}
+	st := s.GetStats().Storage
+	if st.PhysicalSize > before-punched || st.TotalSize != s.Conf.ContainerSize {
+		t.Errorf("Unexpected sizes: physical %d -> %d, punched %d, logical %d", before, st.PhysicalSize, punched, st.TotalSize)
+	}
+
+	// released range is known after restart and allocated again on reuse
+	s.Close()
+	s = reopenStorage(t, s)
+	if !s.Containers[1].sparse {
+		t.Error("Container is not sparse after restart")
+	}
+	for i := 0; i < 5; i++ {
+		f, err := s.Add(fmt.Sprint("new", i), randReader(200*1024), 200*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = f.CheckMd5(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after := s.GetStats().Storage.PhysicalSize; after <= st.PhysicalSize {
+		t.Errorf("Space is not allocated again: %d -> %d", st.PhysicalSize, after)
+	}
+	for _, name := range []string{"0", "1", "12", "15"} {
+		if f, ok := s.Get(name); !ok || f.CheckMd5() != nil {
+			t.Errorf("File %s is broken", name)
+		}
+	}
+}
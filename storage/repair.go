@@ -0,0 +1,377 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Unrecognized data found by scanner will be stored as files with this prefix
+const QUARANTINE_DIR = "_quarantine"
+
+var ErrNoHeaders = errors.New("No file headers found in data file. It was written with data.file_headers disabled, index can't be rebuilt")
+
+type RepairResult struct {
+	Id              int64
+	Files           int64
+	FilesSize       int64
+	Corrupted       int64
+	Quarantined     int64
+	QuarantinedSize int64
+	Duration        time.Duration
+}
+
+// Check that index of container can be restored
+func (s *Storage) CheckIndex(id int64) (err error) {
+	conf := *s.Conf
+	conf.Journal = false
+	tmp := new(Storage)
+	tmp.Init(&conf)
+	c := &Container{Id: id, s: tmp, disk: tmp.containerDisk(id)}
+	if err = tmp.restoreContainer(c.disk, c.indexName()); err != nil {
+		return
+	}
+	for _, rc := range tmp.Containers {
+		rc.Close()
+	}
+	if _, ok := tmp.Containers[id]; !ok {
+		err = fmt.Errorf("Index %s contains wrong container", c.indexName())
+	}
+	return
+}
+
+// Rebuild index of container by scanning data file for file headers
+// Old index will be renamed to cN.index.broken
+// If verify is true - md5 of every found file will be checked, files with wrong checksum will be quarantined
+// If quarantine is false - unrecognized data will be marked as free space
+// Storage must not be opened
+func (s *Storage) RepairContainer(id int64, verify, quarantine bool) (res *RepairResult, err error) {
+	st := time.Now()
+	c := &Container{
+		Id:      id,
+		Created: true,
+		s:       s,
+		disk:    s.containerDisk(id),
+		m:       new(sync.Mutex),
+	}
+	if c.isGroup() {
+		return nil, errGroupRepair
+	}
+	if c.f, err = os.OpenFile(c.fileName(), os.O_RDWR, 0666); err != nil {
+		return
+	}
+	defer c.f.Close()
+	if err = c.openData(); err != nil {
+		return
+	}
+	info, err := c.f.Stat()
+	if err != nil {
+		return
+	}
+	c.Size = s.Conf.ContainerSize
+	if info.Size() > c.Size {
+		c.Size = info.Size()
+	}
+
+	res = &RepairResult{Id: id}
+	sc := &scanner{
+		c:          c,
+		end:        info.Size(),
+		res:        res,
+		verify:     verify,
+		quarantine: quarantine,
+		buf:        make([]byte, 1024*1024),
+	}
+	files, err := sc.scan()
+	if err != nil {
+		return
+	}
+	// all data would be quarantined
+	if sc.headers == 0 && res.Quarantined > 0 {
+		return nil, ErrNoHeaders
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.rebuild(files)
+	if _, e := os.Stat(c.indexName()); e == nil {
+		if err = os.Rename(c.indexName(), c.indexName()+".broken"); err != nil {
+			return
+		}
+	}
+	if _, err = c.dumpTo(c.indexName()); err != nil {
+		return
+	}
+	res.Duration = time.Since(st)
+	aelog.Infof("Repair: container %d, %d files recovered, %d ranges quarantined for a %v", id, res.Files, res.Quarantined, res.Duration)
+	return
+}
+
+type scanner struct {
+	c          *Container
+	end        int64
+	res        *RepairResult
+	verify     bool
+	quarantine bool
+	buf        []byte
+	// decrypted buf of encrypted container
+	dec []byte
+	// end of space occupied by deleted files
+	freeEnd int64
+	// count of found headers, live and deleted
+	headers int64
+}
+
+func (sc *scanner) scan() (files []*File, err error) {
+	// begin of unrecognized range
+	var pos, start int64
+	for pos < sc.end {
+		p, e := sc.nextMagic(pos)
+		if e != nil {
+			return nil, e
+		}
+		if p < 0 {
+			break
+		}
+		f, deleted, e := sc.readHeader(p)
+		if e != nil || p+f.Size() > sc.end {
+			pos = p + 2
+			continue
+		}
+		sc.headers++
+		if deleted {
+			// space of deleted file can contain files allocated later, so continue scanning inside it
+			if files, err = sc.unknown(files, start, p); err != nil {
+				return
+			}
+			if p+f.Size() > sc.freeEnd {
+				sc.freeEnd = p + f.Size()
+			}
+			pos, start = p+2, p
+			continue
+		}
+		f.Off = p
+		f.Init(sc.c)
+		if p > start {
+			if files, err = sc.unknown(files, start, p); err != nil {
+				return
+			}
+		}
+		if sc.verify {
+			if e = sc.checkMd5(f); e != nil {
+				aelog.Warnf("Repair: file %s at %d: %v", f.Name, f.Off, e)
+				sc.res.Corrupted++
+				if files, err = sc.unknown(files, f.Off, f.End()); err != nil {
+					return
+				}
+				pos, start = f.End(), f.End()
+				continue
+			}
+		}
+		files = append(files, f)
+		sc.res.Files++
+		sc.res.FilesSize += f.FSize
+		pos, start = f.End(), f.End()
+	}
+	if sc.end > start {
+		files, err = sc.unknown(files, start, sc.end)
+	}
+	return
+}
+
+// Find next header (live or deleted) magic starting from pos. Return -1 if not found
+// Headers of files with own nonce start with plaintext magic, other headers are encrypted with IV of container
+func (sc *scanner) nextMagic(pos int64) (p int64, err error) {
+	cf, encrypted := sc.c.d.(*cryptFile)
+	for pos < sc.end {
+		n, e := sc.c.raw().ReadAt(sc.buf, pos)
+		if e != nil && e != io.EOF {
+			return -1, e
+		}
+		b := sc.buf[:n]
+		if !encrypted {
+			if i := indexMagic(b, pos, nil); i >= 0 {
+				return pos + int64(i), nil
+			}
+		} else {
+			i := indexMagic(b, pos, func(m []byte) bool {
+				return bytes.HasPrefix(m, nonceMagic) || bytes.HasPrefix(m, deletedNonceMagic)
+			})
+			if sc.dec == nil {
+				sc.dec = make([]byte, len(sc.buf))
+			}
+			cf.xor(sc.dec[:n], b, pos)
+			if j := indexMagic(sc.dec[:n], pos, nil); j >= 0 && (i < 0 || j < i) {
+				i = j
+			}
+			if i >= 0 {
+				return pos + int64(i), nil
+			}
+		}
+		if n < len(sc.buf) {
+			break
+		}
+		pos += int64(n - len(headerMagic))
+	}
+	return -1, nil
+}
+
+// Return index of the first magic in b accepted by match (any if match is nil), -1 if not found
+func indexMagic(b []byte, pos int64, match func(m []byte) bool) int {
+	for i := 0; ; {
+		j := bytes.Index(b[i:], headerMagic[:3])
+		if j < 0 {
+			return -1
+		}
+		// all allocations are 2-byte aligned
+		if i += j; (pos+int64(i))%2 == 0 && (match == nil || match(b[i:])) {
+			return i
+		}
+		i++
+	}
+}
+
+func (sc *scanner) readHeader(p int64) (f *File, deleted bool, err error) {
+	var m [NONCE_HEADER_SIZE]byte
+	n, _ := sc.c.raw().ReadAt(m[:], p)
+	if n == len(m) && (bytes.HasPrefix(m[:], nonceMagic) || bytes.HasPrefix(m[:], deletedNonceMagic)) {
+		nonce := append([]byte(nil), m[len(nonceMagic):]...)
+		if f, _, err = sc.readHeaderAt(withNonce(sc.c.d, nonce), p, p+NONCE_HEADER_SIZE); err != nil {
+			return
+		}
+		f.nonce = nonce
+		return f, bytes.HasPrefix(m[:], deletedNonceMagic), nil
+	}
+	return sc.readHeaderAt(sc.c.d, p, p)
+}
+
+// Read header placed at off of allocation started at p
+func (sc *scanner) readHeaderAt(d dataFile, p, off int64) (f *File, deleted bool, err error) {
+	var b [4 + binary.MaxVarintLen32]byte
+	n, _ := d.ReadAt(b[:], off)
+	if n < len(headerMagic) {
+		return nil, false, errHeaderCorrupt
+	}
+	hdr, k := binary.Uvarint(b[len(headerMagic):n])
+	if k <= 0 || hdr <= uint64(off-p) || hdr > HEADER_MAX || p+int64(hdr) > sc.end {
+		return nil, false, errHeaderCorrupt
+	}
+	buf := make([]byte, int64(hdr)-(off-p))
+	if _, err = d.ReadAt(buf, off); err != nil {
+		return
+	}
+	return unmarshalHeader(buf)
+}
+
+func (sc *scanner) checkMd5(f *File) (err error) {
+	h := md5.New()
+	var r io.Reader = io.NewSectionReader(f.data(), f.dataOff(), f.dataSize())
+	if f.codec != CODEC_NONE {
+		var dec io.ReadCloser
+		if dec, err = newDecoder(f.codec, r); err != nil {
+			return
+		}
+		defer dec.Close()
+		r = dec
+	}
+	if _, err = io.Copy(h, r); err != nil {
+		return
+	}
+	if md5 := h.Sum(nil); !bytes.Equal(md5, f.Md5) {
+		return fmt.Errorf("MD5 mismatched: %x vs %x", md5, f.Md5)
+	}
+	return
+}
+
+// Split unrecognized range to normalized chunks, non-zero chunks will be quarantined as files
+// Space of deleted files will be skipped
+func (sc *scanner) unknown(files []*File, off, end int64) ([]*File, error) {
+	if off < sc.freeEnd {
+		off = sc.freeEnd
+	}
+	if !sc.quarantine {
+		return files, nil
+	}
+	for off < end {
+		size := end - off
+		if R.Round(size) != size {
+			size = R.Size(R.Index(size) - 1)
+		}
+		f, err := sc.quarantineFile(off, size)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			files = append(files, f)
+			sc.res.Quarantined++
+			sc.res.QuarantinedSize += size
+		}
+		off += size
+	}
+	return files, nil
+}
+
+// Return file for data range or nil if range is empty
+func (sc *scanner) quarantineFile(off, size int64) (f *File, err error) {
+	h := md5.New()
+	empty := true
+	rd := io.NewSectionReader(sc.c.d, off, size)
+	for pos := off; ; {
+		n, e := rd.Read(sc.buf)
+		b := sc.buf[:n]
+		h.Write(b)
+		// file preallocated by truncate has 1 in the last byte
+		if pos += int64(n); pos == sc.end && n > 0 && b[n-1] == 1 {
+			b = b[:n-1]
+		}
+		if empty {
+			for _, v := range b {
+				if v != 0 {
+					empty = false
+					break
+				}
+			}
+		}
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return nil, e
+		}
+	}
+	if empty {
+		return
+	}
+	f = &File{
+		Name:  fmt.Sprintf("%s/c%d/%d-%d", QUARANTINE_DIR, sc.c.Id, off, size),
+		Md5:   h.Sum(nil),
+		FSize: size,
+		Time:  time.Now(),
+	}
+	f.Indx = R.Index(size)
+	f.Off = off
+	f.Init(sc.c)
+	return
+}
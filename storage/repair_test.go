@@ -0,0 +1,131 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRepairContainer(t *testing.T) {
+	s := newTestStorage(t, t.TempDir())
+	s.Conf.Journal = false
+	for i := 0; i < 50; i++ {
+		size := int64(1000 * (i%7 + 1))
+		if _, err := s.Add(fmt.Sprint(i), randReader(size), size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 50; i += 5 {
+		s.Delete(fmt.Sprint(i))
+	}
+	if _, err := s.Rename("1", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	// header with long name doesn't fit to reserved space
+	if _, err := s.Rename("2", strings.Repeat("n", 200)); err != ErrNameTooLong {
+		t.Errorf("Unexpected rename result: %v", err)
+	}
+	md5s := make(map[string]string)
+	names, _ := s.Index.List("", 0)
+	for _, name := range names {
+		f, _ := s.Get(name)
+		md5s[name] = f.Md5S()
+	}
+	// deleted file with broken header
+	f6, _ := s.Get("6")
+	s.Delete("6")
+	delete(md5s, "6")
+	var c *Container
+	for _, c = range s.Containers {
+	}
+	if _, err := c.f.WriteAt([]byte("garbage"), f6.Off); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// corrupt index
+	if err := os.WriteFile(c.indexName(), []byte("broken index"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	s2 := new(Storage)
+	s2.Init(s.Conf)
+	if err := s2.Open(); err == nil {
+		t.Fatal("Storage with broken index was opened")
+	}
+	if err := s2.CheckIndex(c.Id); err == nil {
+		t.Error("Broken index passed check")
+	}
+
+	res, err := s2.RepairContainer(c.Id, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Files != int64(len(md5s)) || res.Corrupted != 0 || res.Quarantined != 1 {
+		t.Errorf("Unexpected repair result: %+v", res)
+	}
+	if err = s2.CheckIndex(c.Id); err != nil {
+		t.Error(err)
+	}
+
+	s3 := reopenStorage(t, s)
+	defer s3.Close()
+	for name, md5 := range md5s {
+		f, ok := s3.Get(name)
+		if !ok {
+			t.Errorf("File %s was not recovered", name)
+		} else if f.Md5S() != md5 {
+			t.Errorf("File %s has wrong md5", name)
+		}
+	}
+	if _, ok := s3.Get("1"); ok {
+		t.Error("Renamed file was recovered with old name")
+	}
+	if names, _ := s3.Index.List(QUARANTINE_DIR, 0); len(names) != 1 {
+		t.Errorf("Unexpected quarantined files: %v", names)
+	}
+	if err = s3.Check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRepairWithoutHeaders(t *testing.T) {
+	s := newTestStorage(t, t.TempDir())
+	s.Conf.FileHeaders = false
+	for i := 0; i < 10; i++ {
+		if _, err := s.Add(fmt.Sprint(i), randReader(1000), 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var c *Container
+	for _, c = range s.Containers {
+	}
+	s.Close()
+	index, _ := os.ReadFile(c.indexName())
+
+	s2 := new(Storage)
+	s2.Init(s.Conf)
+	if _, err := s2.RepairContainer(c.Id, false, true); err != ErrNoHeaders {
+		t.Errorf("Expected ErrNoHeaders, got %v", err)
+	}
+	if b, _ := os.ReadFile(c.indexName()); !bytes.Equal(b, index) {
+		t.Error("Index was rewritten")
+	}
+}
@@ -0,0 +1,123 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"github.com/cheggaaa/Anteater/aelog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Retiring of empty containers
+// Containers without files beyond data.containers_reserve are closed and their files are removed.
+// Id of the last container is saved to containers.last in every data path before, so ids are not reused after restart
+
+const LAST_CONTAINER_FILE = "containers.last"
+
+// Read saved id of the last container, storage must be locked
+func (s *Storage) loadLastContainerId() {
+	for _, d := range s.Disks {
+		b, err := os.ReadFile(d.Path + LAST_CONTAINER_FILE)
+		if err != nil {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			aelog.Warnf("Can't read %s: %v", d.Path+LAST_CONTAINER_FILE, err)
+			continue
+		}
+		if id > s.LastContainerId {
+			s.LastContainerId = id
+		}
+	}
+}
+
+// Save id of the last container to available data paths, storage must be locked
+func (s *Storage) saveLastContainerId() (err error) {
+	b := []byte(strconv.FormatInt(s.LastContainerId, 10) + "\n")
+	saved := false
+	for _, d := range s.Disks {
+		if d.Degraded() {
+			continue
+		}
+		if e := writeFileSync(d.Path+LAST_CONTAINER_FILE, b); e != nil {
+			d.check(e)
+			err = e
+			continue
+		}
+		saved = true
+	}
+	if saved {
+		err = nil
+	}
+	return
+}
+
+// Remove empty containers beyond data.containers_reserve, at least one container is kept
+func (s *Storage) retireContainers() {
+	if !s.Conf.RetireContainers || s.Compacting() {
+		return
+	}
+	// no file can be allocated while storage is frozen
+	s.fm.Lock()
+	s.m.Lock()
+	var empty []*Container
+	for _, c := range s.Containers {
+		if c.empty() {
+			empty = append(empty, c)
+		}
+	}
+	keep := s.Conf.ContainersReserve
+	if keep == 0 && len(empty) == len(s.Containers) {
+		keep = 1
+	}
+	if len(empty) <= keep {
+		s.m.Unlock()
+		s.fm.Unlock()
+		return
+	}
+	// older containers are kept
+	sort.Slice(empty, func(i, j int) bool { return empty[i].Id < empty[j].Id })
+	retired := empty[keep:]
+	if err := s.saveLastContainerId(); err != nil {
+		s.m.Unlock()
+		s.fm.Unlock()
+		aelog.Warnf("Can't save id of the last container: %v", err)
+		return
+	}
+	for _, c := range retired {
+		delete(s.Containers, c.Id)
+	}
+	s.m.Unlock()
+	s.fm.Unlock()
+
+	for _, c := range retired {
+		c.Close()
+		c.removeFiles()
+		s.Stats.Compact.Retired.Add()
+		aelog.Infof("Empty container %d is removed", c.Id)
+	}
+}
+
+// Return true if container has no files and holes
+func (c *Container) empty() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.last == nil
+}
@@ -0,0 +1,119 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/config"
+	"os"
+	"testing"
+)
+
+func TestRetireContainers(t *testing.T) {
+	if aelog.DefaultLogger == nil {
+		aelog.InitDefault(aelog.LOG_WARN)
+	}
+	s := new(Storage)
+	s.Init(&config.Config{
+		ContainerSize:     1024 * 1024,
+		DataPath:          t.TempDir() + "/",
+		FileHeaders:       true,
+		Journal:           true,
+		RetireContainers:  true,
+		ContainersReserve: 1,
+	})
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := s.Add(fmt.Sprint(i), randReader(700*1024), 700*1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := s.LastContainerId
+	// files of the first container are kept
+	for i := 1; i < 5; i++ {
+		f, _ := s.Get(fmt.Sprint(i))
+		if f.c.Id == 1 {
+			t.Fatal("Unexpected placement of files")
+		}
+		s.Delete(fmt.Sprint(i))
+	}
+	count := len(s.Containers)
+	s.retireContainers()
+	if len(s.Containers) != count-3 || s.Stats.Compact.Retired.GetValue() != 3 {
+		t.Fatalf("Unexpected count of containers: %d -> %d", count, len(s.Containers))
+	}
+	if _, err := os.Stat(fmt.Sprintf("%sc%d.index", s.Conf.DataPath, last)); !os.IsNotExist(err) {
+		t.Errorf("Files of retired container are not removed: %v", err)
+	}
+	ids, err := s.ContainerIds()
+	if err != nil || len(ids) != len(s.Containers) {
+		t.Errorf("Unexpected container ids: %v %v", ids, err)
+	}
+	s.Close()
+
+	// ids of retired containers are not reused
+	s = reopenStorage(t, s)
+	if s.LastContainerId != last || len(s.Containers) != count-3 {
+		t.Errorf("Unexpected state after restart: last id %d (expected %d), %d containers", s.LastContainerId, last, len(s.Containers))
+	}
+	for i := 5; i < 7; i++ {
+		if _, err = s.Add(fmt.Sprint(i), randReader(700*1024), 700*1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f, _ := s.Get("6"); f.c.Id <= last {
+		t.Errorf("Id of retired container is reused: %d", f.c.Id)
+	}
+	if f, ok := s.Get("0"); !ok || f.CheckMd5() != nil {
+		t.Error("File is lost")
+	}
+
+	// at least one container is kept
+	s.Conf.ContainersReserve = 0
+	for _, name := range []string{"0", "5", "6"} {
+		s.Delete(name)
+	}
+	s.retireContainers()
+	if len(s.Containers) != 1 {
+		t.Errorf("Unexpected count of containers: %d", len(s.Containers))
+	}
+	s.Close()
+	s = reopenStorage(t, s)
+	if len(s.Containers) != 1 {
+		t.Errorf("Unexpected count of containers after restart: %d", len(s.Containers))
+	}
+
+	// interrupted removal leaves data file without index
+	c, err := s.createContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.saveLastContainerId(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	os.Remove(c.indexName())
+	s = reopenStorage(t, s)
+	defer s.Close()
+	if _, ok := s.Containers[c.Id]; ok || len(s.Containers) != 1 || s.LastContainerId != c.Id {
+		t.Errorf("Unexpected state after interrupted removal: last id %d, %d containers", s.LastContainerId, len(s.Containers))
+	}
+}
@@ -0,0 +1,191 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"errors"
+)
+
+// Reed-Solomon code over GF(2^8) with systematic Cauchy matrix
+// k data shards are stored as is, every parity shard is a linear combination of data shards,
+// so any k of k+m shards are enough to restore all of them
+
+var errTooFewShards = errors.New("Too few shards to reconstruct data")
+
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+func init() {
+	// generator 2, polynomial x^8 + x^4 + x^3 + x^2 + 1
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i], gfExp[i+255] = byte(x), byte(x)
+		gfLog[x] = byte(i)
+		if x <<= 1; x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// dst ^= c * src
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	t := &gfMul[c]
+	for i, b := range src {
+		dst[i] ^= t[b]
+	}
+}
+
+type rsCoder struct {
+	k, m int
+	// rows of encoding matrix: k rows of identity, then m parity rows
+	matrix [][]byte
+}
+
+func newRSCoder(k, m int) *rsCoder {
+	rs := &rsCoder{k: k, m: m, matrix: make([][]byte, k+m)}
+	for i := range rs.matrix {
+		rs.matrix[i] = make([]byte, k)
+		switch {
+		case i < k:
+			rs.matrix[i][i] = 1
+		case k == 1:
+			// mirror: parity is a copy
+			rs.matrix[i][0] = 1
+		default:
+			// Cauchy matrix 1 / (x_i + y_j), x_i = i, y_j = j for i >= k > j
+			for j := 0; j < k; j++ {
+				rs.matrix[i][j] = gfInv(byte(i ^ j))
+			}
+		}
+	}
+	return rs
+}
+
+// Calc parity shards from data shards, all shards have the same length
+func (rs *rsCoder) encode(data, parity [][]byte) {
+	for i, p := range parity {
+		for n := range p {
+			p[n] = 0
+		}
+		for j, d := range data {
+			gfMulAdd(p, d, rs.matrix[rs.k+i][j])
+		}
+	}
+}
+
+// Restore missing (nil) shards. At least k shards must be present
+func (rs *rsCoder) reconstruct(shards [][]byte) (err error) {
+	var present []int
+	size := 0
+	for i, s := range shards {
+		if s != nil {
+			present = append(present, i)
+			size = len(s)
+		}
+	}
+	if len(present) < rs.k {
+		return errTooFewShards
+	}
+	if len(present) == len(shards) {
+		return
+	}
+	present = present[:rs.k]
+	// decode matrix is inverse of encoding rows of present shards
+	sub := make([][]byte, rs.k)
+	for r, i := range present {
+		sub[r] = rs.matrix[i]
+	}
+	dec, err := gfInvert(sub)
+	if err != nil {
+		return
+	}
+	data := make([][]byte, rs.k)
+	for j := range data {
+		if shards[j] != nil {
+			data[j] = shards[j]
+			continue
+		}
+		data[j] = make([]byte, size)
+		for r, i := range present {
+			gfMulAdd(data[j], shards[i], dec[j][r])
+		}
+	}
+	for i := range shards {
+		if i < rs.k {
+			shards[i] = data[i]
+		} else if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			for j, d := range data {
+				gfMulAdd(shards[i], d, rs.matrix[i][j])
+			}
+		}
+	}
+	return
+}
+
+// Invert square matrix by Gauss-Jordan elimination
+func gfInvert(m [][]byte) (inv [][]byte, err error) {
+	n := len(m)
+	a := make([][]byte, n)
+	inv = make([][]byte, n)
+	for i := range m {
+		a[i] = append([]byte(nil), m[i]...)
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for c := 0; c < n; c++ {
+		p := c
+		for p < n && a[p][c] == 0 {
+			p++
+		}
+		if p == n {
+			return nil, errors.New("Singular matrix")
+		}
+		a[c], a[p] = a[p], a[c]
+		inv[c], inv[p] = inv[p], inv[c]
+		if v := a[c][c]; v != 1 {
+			iv := gfInv(v)
+			for j := 0; j < n; j++ {
+				a[c][j] = gfMul[iv][a[c][j]]
+				inv[c][j] = gfMul[iv][inv[c][j]]
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r != c && a[r][c] != 0 {
+				v := a[r][c]
+				gfMulAdd(a[r], a[c], v)
+				gfMulAdd(inv[r], inv[c], v)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,319 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/stats"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Scrubbing
+// Background pass over all containers in order of id: chain of spaces is checked under container lock,
+// then md5 of every file is verified without locks with rate limit (data.scrub_rate)
+// Corrupted files and broken chains are kept in quarantine list until the file is deleted or passes verification
+// Position of pass and quarantine list are saved to scrub.state in the first data path, so pass is resumed after restart
+
+const (
+	SCRUB_STATE_FILE     = "scrub.state"
+	SCRUB_SAVE_INTERVAL  = 10 * time.Second
+	SCRUB_CHECK_INTERVAL = time.Minute
+)
+
+var ErrScrubRunning = errors.New("Scrub already running")
+
+// Corrupted file or broken chain of spaces (empty name) found by scrubber
+type ScrubEntry struct {
+	Name      string    `json:"name"`
+	Container int64     `json:"container"`
+	Offset    int64     `json:"offset"`
+	Error     string    `json:"error"`
+	Time      time.Time `json:"time"`
+}
+
+type ScrubStatus struct {
+	Running bool  `json:"-"`
+	Pass    int64 `json:"pass"`
+	// start of current (or last) pass and end of last finished pass
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// position of unfinished pass: container and offset of next file
+	Container int64 `json:"container"`
+	Offset    int64 `json:"offset"`
+	// checked in current (or last) pass
+	Files      int64        `json:"files"`
+	Bytes      int64        `json:"bytes"`
+	Quarantine []ScrubEntry `json:"quarantine"`
+}
+
+// Return true if pass was started and not finished
+func (st *ScrubStatus) unfinished() bool {
+	return st.Started.After(st.Finished)
+}
+
+func (s *Storage) scrubStateName() string {
+	return s.Conf.DataPath + SCRUB_STATE_FILE
+}
+
+func (s *Storage) loadScrub() {
+	b, err := os.ReadFile(s.scrubStateName())
+	if err != nil {
+		return
+	}
+	s.scm.Lock()
+	defer s.scm.Unlock()
+	if err = json.Unmarshal(b, &s.scrub); err != nil {
+		aelog.Warnf("Scrub: can't read state: %v", err)
+	}
+}
+
+func (s *Storage) saveScrub() {
+	s.scm.Lock()
+	b, err := json.Marshal(&s.scrub)
+	s.scm.Unlock()
+	if err == nil {
+		err = writeFileSync(s.scrubStateName(), b)
+	}
+	if err != nil {
+		aelog.Warnf("Scrub: can't save state: %v", err)
+	}
+}
+
+// Return progress of running (or result of last) pass and quarantine list
+func (s *Storage) ScrubStatus() (st ScrubStatus) {
+	s.scm.Lock()
+	defer s.scm.Unlock()
+	st = s.scrub
+	st.Quarantine = append([]ScrubEntry(nil), s.scrub.Quarantine...)
+	st.Running = atomic.LoadInt32(&s.scrubbing) == 1
+	return
+}
+
+// Start scrub pass in background, unfinished pass is resumed
+func (s *Storage) Scrub() (err error) {
+	if !atomic.CompareAndSwapInt32(&s.scrubbing, 0, 1) {
+		return ErrScrubRunning
+	}
+	go func() {
+		defer atomic.StoreInt32(&s.scrubbing, 0)
+		s.scrubPass()
+	}()
+	return
+}
+
+// Start pass every data.scrub_interval, unfinished pass is resumed at once
+func (s *Storage) scrubLoop() {
+	for atomic.LoadInt32(&s.closed) == 0 {
+		st := s.ScrubStatus()
+		if st.unfinished() || time.Since(st.Finished) >= s.Conf.ScrubInterval {
+			if atomic.CompareAndSwapInt32(&s.scrubbing, 0, 1) {
+				s.scrubPass()
+				atomic.StoreInt32(&s.scrubbing, 0)
+			}
+		}
+		time.Sleep(SCRUB_CHECK_INTERVAL)
+	}
+}
+
+func (s *Storage) scrubPass() {
+	s.scm.Lock()
+	if !s.scrub.unfinished() {
+		s.scrub.Pass++
+		s.scrub.Started = time.Now()
+		s.scrub.Container, s.scrub.Offset = 0, 0
+		s.scrub.Files, s.scrub.Bytes = 0, 0
+	}
+	from, fromOff := s.scrub.Container, s.scrub.Offset
+	s.scm.Unlock()
+
+	var ids []int64
+	s.m.RLock()
+	for id := range s.Containers {
+		if id >= from {
+			ids = append(ids, id)
+		}
+	}
+	s.m.RUnlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		s.m.RLock()
+		c, ok := s.Containers[id]
+		s.m.RUnlock()
+		if !ok {
+			continue
+		}
+		off := int64(0)
+		if id == from {
+			off = fromOff
+		}
+		if !s.scrubContainer(c, off) {
+			// storage closed
+			s.saveScrub()
+			return
+		}
+	}
+	s.scm.Lock()
+	s.scrub.Finished = time.Now()
+	s.scrub.Container, s.scrub.Offset = 0, 0
+	st := s.scrub
+	s.scm.Unlock()
+	s.saveScrub()
+	aelog.Infof("Scrub: pass %d finished, %d files checked, %d in quarantine for a %v", st.Pass, st.Files, len(st.Quarantine), st.Finished.Sub(st.Started))
+}
+
+// Verify files of container from offset, return false if storage is closed
+func (s *Storage) scrubContainer(c *Container, from int64) bool {
+	s.scm.Lock()
+	s.scrub.Container, s.scrub.Offset = c.Id, from
+	s.scm.Unlock()
+	files, err := c.scrubFiles()
+	// entries of container found in this pass
+	found := make(map[scrubKey]bool)
+	if err != nil {
+		aelog.Warnf("Scrub: container %d: %v", c.Id, err)
+		found[s.quarantine(ScrubEntry{Container: c.Id, Error: err.Error()})] = true
+	}
+	saved := time.Now()
+	for _, f := range files {
+		if f.Off < from {
+			continue
+		}
+		if atomic.LoadInt32(&s.closed) != 0 {
+			return false
+		}
+		// deleted or moved file is skipped
+		if f.Open() != nil {
+			continue
+		}
+		err = f.CheckMd5()
+		f.Close()
+		if atomic.LoadInt32(&s.closed) != 0 {
+			// read could fail because of closed data file
+			return false
+		}
+		if err != nil {
+			aelog.Warnf("Scrub: container %d: %v", c.Id, err)
+			found[s.quarantine(ScrubEntry{Name: f.Name, Container: c.Id, Offset: f.Off, Error: err.Error()})] = true
+		}
+		s.scm.Lock()
+		s.scrub.Offset = f.Off + 1
+		s.scrub.Files++
+		s.scrub.Bytes += f.dataSize()
+		s.scm.Unlock()
+		if time.Since(saved) > SCRUB_SAVE_INTERVAL {
+			s.saveScrub()
+			saved = time.Now()
+		}
+		if s.Conf.ScrubRate > 0 {
+			time.Sleep(time.Duration(f.dataSize() * int64(time.Second) / s.Conf.ScrubRate))
+		}
+	}
+	// release entries of checked range that are not found anymore
+	s.scm.Lock()
+	q := s.scrub.Quarantine[:0]
+	for _, e := range s.scrub.Quarantine {
+		if e.Container != c.Id || (e.Name != "" && e.Offset < from) || found[e.key()] {
+			q = append(q, e)
+		}
+	}
+	s.scrub.Quarantine = q
+	s.scm.Unlock()
+	s.saveScrub()
+	return true
+}
+
+type scrubKey struct {
+	name      string
+	container int64
+	offset    int64
+}
+
+func (e *ScrubEntry) key() scrubKey {
+	return scrubKey{e.Name, e.Container, e.Offset}
+}
+
+// Add entry to quarantine list or update error of existing one, return key of entry
+func (s *Storage) quarantine(e ScrubEntry) scrubKey {
+	key := e.key()
+	s.scm.Lock()
+	defer s.scm.Unlock()
+	for i := range s.scrub.Quarantine {
+		if s.scrub.Quarantine[i].key() == key {
+			s.scrub.Quarantine[i].Error = e.Error
+			return key
+		}
+	}
+	e.Time = time.Now()
+	s.scrub.Quarantine = append(s.scrub.Quarantine, e)
+	return key
+}
+
+// Stats of scrubber
+func (s *Storage) scrubStats() stats.Scrub {
+	st := s.ScrubStatus()
+	return stats.Scrub{
+		Running:   st.Running,
+		Pass:      st.Pass,
+		Container: st.Container,
+		Files:     st.Files,
+		Bytes:     st.Bytes,
+		Corrupt:   len(st.Quarantine),
+		Started:   st.Started,
+		Finished:  st.Finished,
+	}
+}
+
+// Check chain of spaces and return files with own content ordered by offset
+// Content of span heads and links is verified in extents and blobs
+func (c *Container) scrubFiles() (files []*File, err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var sp, next Space
+	if c.last != nil {
+		sp = c.last
+		if end := c.last.End(); end > c.Size {
+			err = fmt.Errorf("Last file ends at %d after end of container %d", end, c.Size)
+		}
+	}
+	for sp != nil {
+		if next != nil && sp.End() != next.Offset() && err == nil {
+			err = fmt.Errorf("Range error: %d vs %d", sp.End(), next.Offset())
+		}
+		if h, ok := sp.(*Hole); ok {
+			if !c.holeIndex.Exists(h) && err == nil {
+				err = fmt.Errorf("Hole not indexed: %d", h.Offset())
+			}
+		} else if f := sp.(*File); !f.deleted && f.Md5 != nil && f.span == nil && f.link == nil {
+			files = append(files, f)
+		}
+		if sp.Prev() == nil && sp.Offset() != 0 && err == nil {
+			err = fmt.Errorf("First space starts at %d", sp.Offset())
+		}
+		next, sp = sp, sp.Prev()
+	}
+	for i, j := 0, len(files)-1; i < j; i, j = i+1, j-1 {
+		files[i], files[j] = files[j], files[i]
+	}
+	return
+}
@@ -0,0 +1,81 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestScrub(t *testing.T) {
+	s := newTestStorage(t, t.TempDir())
+	for i := 0; i < 10; i++ {
+		if _, err := s.Add(fmt.Sprint(i), randReader(10000), 10000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, _ := s.Get("5")
+	d, err := os.OpenFile(f.c.fileName(), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.WriteAt([]byte("corrupted"), f.dataOff()+100); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	if err = s.Scrub(); err != nil {
+		t.Fatal(err)
+	}
+	for s.ScrubStatus().Running {
+		time.Sleep(time.Millisecond * 10)
+	}
+	st := s.ScrubStatus()
+	if st.Pass != 1 || st.Files != 10 || st.unfinished() {
+		t.Errorf("Unexpected status: %+v", st)
+	}
+	if len(st.Quarantine) != 1 || st.Quarantine[0].Name != "5" || st.Quarantine[0].Offset != f.Off {
+		t.Fatalf("Unexpected quarantine: %+v", st.Quarantine)
+	}
+	if sst := s.GetStats().Scrub; sst.Corrupt != 1 || sst.Pass != 1 {
+		t.Errorf("Unexpected stats: %+v", sst)
+	}
+	s.Close()
+
+	// state survives restart, interrupted pass is resumed from saved position
+	s = reopenStorage(t, s)
+	if st = s.ScrubStatus(); st.Pass != 1 || len(st.Quarantine) != 1 {
+		t.Fatalf("State is not loaded: %+v", st)
+	}
+	f, _ = s.Get("7")
+	s.scrub.Started = time.Now()
+	s.scrub.Container, s.scrub.Offset, s.scrub.Files = f.c.Id, f.Off, 0
+	s.scrubPass()
+	if st = s.ScrubStatus(); st.Pass != 1 || st.Files != 3 || len(st.Quarantine) != 1 {
+		t.Errorf("Pass is not resumed: %+v", st)
+	}
+
+	// deleted file leaves quarantine
+	s.Delete("5")
+	s.scrubPass()
+	if st = s.ScrubStatus(); st.Pass != 2 || st.Files != 9 || len(st.Quarantine) != 0 {
+		t.Errorf("Unexpected status after delete: %+v", st)
+	}
+	s.Close()
+}
@@ -0,0 +1,221 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/cnst"
+	"github.com/cheggaaa/Anteater/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const SnapshotManifest = "snapshot.json"
+
+var ErrSnapshotSameDir = errors.New("Can't make snapshot to data dir")
+
+type SnapshotResult struct {
+	Path         string
+	IndexVersion int64
+	Containers   int
+	FilesCount   int64
+	Size         int64
+	FreezeTime   time.Duration
+	Duration     time.Duration
+}
+
+type SnapshotManifestData struct {
+	Anteater     string                      `json:"anteater"`
+	Created      time.Time                   `json:"created"`
+	IndexVersion int64                       `json:"indexVersion"`
+	FilesCount   int64                       `json:"filesCount"`
+	Containers   []SnapshotManifestContainer `json:"containers"`
+}
+
+type SnapshotManifestContainer struct {
+	Id        int64  `json:"id"`
+	Data      string `json:"data"`
+	DataSize  int64  `json:"dataSize"`
+	DataMd5   string `json:"dataMd5"`
+	Index     string `json:"index"`
+	IndexSize int64  `json:"indexSize"`
+	IndexMd5  string `json:"indexMd5"`
+	// key file of encrypted container
+	Key string `json:"key,omitempty"`
+}
+
+// Make consistent copy of all containers to dir
+// Storage will be frozen only while indexes are dumping, all files from snapshot will be opened until data will be copied
+// So they space can't be reused by new files
+func (s *Storage) Snapshot(dir string) (res *SnapshotResult, err error) {
+	st := time.Now()
+	if dir, err = filepath.Abs(dir); err != nil {
+		return
+	}
+	if s.IsDataPath(dir) {
+		return nil, ErrSnapshotSameDir
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	dir += "/"
+
+	res = &SnapshotResult{Path: dir}
+	manifest := &SnapshotManifestData{
+		Anteater: cnst.VERSION,
+		Created:  st,
+	}
+
+	// freeze
+	var opened []*File
+	defer func() {
+		for _, f := range opened {
+			f.Close()
+		}
+	}()
+	s.fm.Lock()
+	s.m.RLock()
+	containers := make([]*Container, 0, len(s.Containers))
+	for _, c := range s.Containers {
+		containers = append(containers, c)
+	}
+	s.m.RUnlock()
+	res.IndexVersion = s.Index.Version()
+	for _, c := range containers {
+		c.m.Lock()
+		_, err = c.dumpTo(dir + filepath.Base(c.indexName()))
+		if err == nil {
+			opened = append(opened, c.openFiles()...)
+		}
+		c.m.Unlock()
+		if err != nil {
+			s.fm.Unlock()
+			return
+		}
+	}
+	s.fm.Unlock()
+	res.FreezeTime = time.Since(st)
+	res.FilesCount = int64(len(opened))
+	aelog.Debugf("Snapshot: storage was frozen for a %v", res.FreezeTime)
+
+	// copy
+	for _, c := range containers {
+		mc, e := c.copyTo(dir)
+		if e != nil {
+			return res, e
+		}
+		res.Containers++
+		res.Size += mc.DataSize
+		manifest.Containers = append(manifest.Containers, mc)
+	}
+	manifest.IndexVersion = res.IndexVersion
+	manifest.FilesCount = res.FilesCount
+
+	mb, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return
+	}
+	if err = os.WriteFile(dir+SnapshotManifest, mb, 0644); err != nil {
+		return
+	}
+	res.Duration = time.Since(st)
+	aelog.Infof("Snapshot: %d containers (%s) was copied to %s for a %v", res.Containers, utils.HumanBytes(res.Size), dir, res.Duration)
+	return
+}
+
+// Mark all container files as opened and return them. Container must be locked
+func (c *Container) openFiles() (files []*File) {
+	var sp Space = c.last
+	for sp != nil {
+		if f, ok := sp.(*File); ok {
+			if f.Open() == nil {
+				files = append(files, f)
+			}
+		}
+		sp = sp.Prev()
+	}
+	return
+}
+
+// Copy data file and index (dumped before) to dir
+func (c *Container) copyTo(dir string) (mc SnapshotManifestContainer, err error) {
+	mc.Id = c.Id
+	mc.Data = filepath.Base(c.fileName())
+	mc.Index = filepath.Base(c.indexName())
+
+	var data io.ReaderAt
+	var size int64
+	if c.g != nil {
+		// container with redundancy is copied as plain data file
+		data, size = c.g, c.Size
+	} else {
+		info, e := c.f.Stat()
+		if e != nil {
+			return mc, e
+		}
+		data, size = c.f, info.Size()
+	}
+	if mc.DataSize, mc.DataMd5, err = copyFile(dir+mc.Data, io.NewSectionReader(data, 0, size)); err != nil {
+		return
+	}
+
+	// data is copied encrypted, so it needs the same key
+	if c.key != nil && c.key.id != 0 {
+		mc.Key = filepath.Base(c.keyName())
+		if err = writeContainerKey(dir+mc.Key, c.key); err != nil {
+			return
+		}
+	}
+
+	// index already written, just calc checksum
+	fi, err := os.Open(dir + mc.Index)
+	if err != nil {
+		return
+	}
+	defer fi.Close()
+	h := md5.New()
+	if mc.IndexSize, err = io.Copy(h, fi); err != nil {
+		return
+	}
+	mc.IndexMd5 = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+func copyFile(filename string, r io.Reader) (n int64, md5s string, err error) {
+	fh, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	h := md5.New()
+	if n, err = io.Copy(io.MultiWriter(fh, h), r); err != nil {
+		err = fmt.Errorf("Can't copy to %s: %v", filename, err)
+		return
+	}
+	if err = fh.Sync(); err != nil {
+		return
+	}
+	md5s = hex.EncodeToString(h.Sum(nil))
+	return
+}
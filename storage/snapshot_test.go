@@ -0,0 +1,140 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/config"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestStorage(t *testing.T, path string) *Storage {
+	if aelog.DefaultLogger == nil {
+		aelog.InitDefault(aelog.LOG_WARN)
+	}
+	s := new(Storage)
+	s.Init(&config.Config{
+		ContainerSize: 1024 * 1024 * 10,
+		DataPath:      path + "/",
+		FileHeaders:   true,
+	})
+	if err := s.Open(); err != nil {
+		t.Fatalf("Can't open storage: %v", err)
+	}
+	return s
+}
+
+func reopenStorage(t *testing.T, s *Storage) *Storage {
+	s2 := new(Storage)
+	s2.Init(s.Conf)
+	if err := s2.Open(); err != nil {
+		t.Fatalf("Can't open storage: %v", err)
+	}
+	return s2
+}
+
+func TestSnapshot(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	s := newTestStorage(t, src)
+	defer s.Close()
+	for i := 0; i < 50; i++ {
+		size := int64(1024 * (i + 1))
+		if _, err := s.Add(fmt.Sprint(i), randReader(size), size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// deleted, but still opened file must not be in snapshot
+	f, _ := s.Get("49")
+	f.Open()
+	s.Delete("49")
+	s.Delete("10")
+
+	if _, err := s.Snapshot(src); err != ErrSnapshotSameDir {
+		t.Errorf("Expected ErrSnapshotSameDir, got: %v", err)
+	}
+	res, err := s.Snapshot(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if res.FilesCount != 48 || res.IndexVersion != s.Index.Version() {
+		t.Errorf("Unexpected snapshot result: %+v", res)
+	}
+
+	b, err := os.ReadFile(dst + "/" + SnapshotManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := &SnapshotManifestData{}
+	if err = json.Unmarshal(b, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Containers) != 1 || manifest.Containers[0].DataMd5 == "" || manifest.Containers[0].IndexMd5 == "" {
+		t.Errorf("Unexpected manifest: %+v", manifest)
+	}
+
+	snap := newTestStorage(t, dst)
+	defer snap.Close()
+	if snap.Index.Count() != 48 {
+		t.Errorf("Unexpected files count in snapshot: %d", snap.Index.Count())
+	}
+	if _, ok := snap.Get("49"); ok {
+		t.Error("Deleted file exists in snapshot")
+	}
+	if err = snap.Check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSnapshotDuringUpload(t *testing.T) {
+	s := newTestStorage(t, t.TempDir())
+	defer s.Close()
+	// upload waits for content of slow client
+	pr, pw := io.Pipe()
+	added := make(chan error)
+	go func() {
+		_, err := s.Add("slow", pr, 2048)
+		added <- err
+	}()
+	if _, err := pw.Write(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := s.Snapshot(t.TempDir())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Snapshot waits for upload")
+	}
+	pw.Write(make([]byte, 1024))
+	pw.Close()
+	if err := <-added; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -44,7 +44,7 @@ func UnmarshallSpace(rd *bufio.Reader) (s Space, err error) {
 	if err != nil {
 		return
 	}
-	if tp == 1 {
+	if tp == 1 || tp == 2 {
 		f = &File{}
 		nl, e := binary.ReadUvarint(rd)
 		if e != nil {
@@ -69,6 +69,19 @@ func UnmarshallSpace(rd *bufio.Reader) (s Space, err error) {
 		f.Name = string(name)
 		f.FSize = int64(sz)
 		f.Time = time.Unix(int64(tm), 0)
+		if tp == 2 {
+			el, e := binary.ReadUvarint(rd)
+			if e != nil {
+				return nil, e
+			}
+			ext := make([]byte, el)
+			if _, err = io.ReadFull(rd, ext); err != nil {
+				return
+			}
+			if err = f.unmarshalExt(ext); err != nil {
+				return
+			}
+		}
 		tp, e = rd.ReadByte()
 		if e != nil {
 			return nil, e
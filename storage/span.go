@@ -0,0 +1,304 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"github.com/cheggaaa/Anteater/aelog"
+	"io"
+)
+
+// Files that don't fit to one container are stored as chain of extents
+// Head is a small file in the index, it has full size and md5 of content and the manifest - list of extents
+// Every extent is a file in own container, which is not added to the index
+// Extents are not moved by compaction and have no self-describing headers, so aerepair can't recover spanning files
+
+// Link from head to extent
+type extentRef struct {
+	Cid int64
+	Off int64
+	f   *File
+}
+
+// Return true if file is stored in several containers
+func (f *File) spanned() bool {
+	return f.span != nil || f.extent > 0
+}
+
+// Size of content stored in file space
+func (f *File) dataSize() int64 {
+	if f.span != nil || f.linked {
+		return 0
+	}
+	if f.codec != CODEC_NONE {
+		return f.csize
+	}
+	return f.FSize
+}
+
+// Max size of one extent - biggest size class that fits to container
+func (s *Storage) maxExtent() int64 {
+	return R.Size(R.Index(s.Conf.ContainerSize+1) - 1)
+}
+
+// Return true if file with given size must be split to extents
+func (s *Storage) needSpan(size int64, hdr int32) bool {
+	return size+int64(hdr) > s.Conf.ContainerSize
+}
+
+// Allocate head and extents for spanning file. All allocated space will be released on error
+func (s *Storage) allocateSpan(f *File) (err error) {
+	f.Hdr = 0
+	f.Indx = R.Index(1)
+	max := s.maxExtent()
+	defer func() {
+		if err != nil {
+			for _, ref := range f.span {
+				ref.f.Delete()
+			}
+			f.span = nil
+		}
+	}()
+	f.span = make([]extentRef, 0, f.FSize/max+1)
+	for off := int64(0); off < f.FSize; off += max {
+		size := max
+		if f.FSize-off < size {
+			size = f.FSize - off
+		}
+		ext := &File{
+			Name:   f.Name,
+			FSize:  size,
+			Time:   f.Time,
+			extent: int32(len(f.span) + 1),
+		}
+		if _, err = s.allocate(ext); err != nil {
+			return
+		}
+		f.span = append(f.span, extentRef{Cid: ext.c.Id, Off: ext.Off, f: ext})
+	}
+	_, err = s.allocate(f)
+	return
+}
+
+// Write content to extents. Every extent gets own md5, head gets md5 of the whole content
+func (f *File) readFromSpan(r io.Reader) (written int64, err error) {
+	h := md5.New()
+	for _, ref := range f.span {
+		var n int64
+		n, err = ref.f.ReadFrom(io.TeeReader(io.LimitReader(r, ref.f.FSize), h))
+		written += n
+		if err != nil || n != ref.f.FSize {
+			break
+		}
+	}
+	if err == nil && written == f.FSize {
+		err = checkEOF(r)
+	}
+	f.Md5 = h.Sum(nil)
+	return
+}
+
+// Find extent that contains offset, return index of extent and offset inside extent
+func (f *File) spanAt(off int64) (i int, local int64) {
+	for i = range f.span {
+		if off < f.span[i].f.FSize {
+			return i, off
+		}
+		off -= f.span[i].f.FSize
+	}
+	return len(f.span), off
+}
+
+func (f *File) writeSpanAt(b []byte, off int64) (n int, err error) {
+	i, local := f.spanAt(off)
+	for len(b) > 0 && i < len(f.span) {
+		ext := f.span[i].f
+		l := int64(len(b))
+		if ext.FSize-local < l {
+			l = ext.FSize - local
+		}
+		var w int
+		w, err = ext.WriteAt(b[:l], local)
+		n += w
+		if err != nil {
+			return
+		}
+		b = b[l:]
+		i, local = i+1, 0
+	}
+	return
+}
+
+// Implements io.ReaderAt over all extents
+type spanReader struct {
+	f *File
+}
+
+func (sr spanReader) ReadAt(p []byte, off int64) (n int, err error) {
+	f := sr.f
+	i, local := f.spanAt(off)
+	for len(p) > 0 {
+		if i >= len(f.span) {
+			return n, io.EOF
+		}
+		ext := f.span[i].f
+		l := int64(len(p))
+		if ext.FSize-local < l {
+			l = ext.FSize - local
+		}
+		var r int
+		r, err = ext.data().ReadAt(p[:l], ext.dataOff()+local)
+		n += r
+		if err != nil {
+			return
+		}
+		p = p[l:]
+		i, local = i+1, 0
+	}
+	return
+}
+
+// Release extents of deleted head
+func (f *File) deleteSpan() {
+	for _, ref := range f.span {
+		if ref.f != nil {
+			ref.f.Delete()
+		}
+	}
+}
+
+// Journal new extents, must be called before head will be journaled
+func (f *File) journalSpan(b *journalBatch) (err error) {
+	for _, ref := range f.span {
+		if err = b.append(ref.f.c, &journalRecord{op: JOURNAL_ADD, f: ref.f}); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Journal removal of file and extents journaled by journalSpan, but not added to index
+func (f *File) journalDrop() {
+	for _, ref := range f.span {
+		ref.f.c.journalWrite(&journalRecord{op: JOURNAL_DELETE, off: ref.f.Off, name: ref.f.Name})
+	}
+	f.c.journalWrite(&journalRecord{op: JOURNAL_DELETE, off: f.Off, name: f.Name})
+}
+
+func (f *File) marshalSpan() (buf []byte) {
+	buf = binary.AppendUvarint(buf, uint64(len(f.span)))
+	for _, ref := range f.span {
+		buf = binary.AppendUvarint(buf, uint64(ref.Cid))
+		buf = binary.AppendUvarint(buf, uint64(ref.Off))
+	}
+	return
+}
+
+func (f *File) unmarshalSpan(b []byte) (err error) {
+	cnt, n := binary.Uvarint(b)
+	if n <= 0 || cnt == 0 || cnt > uint64(len(b)) {
+		return errExtCorrupt
+	}
+	b = b[n:]
+	f.span = make([]extentRef, cnt)
+	for i := range f.span {
+		var vals [2]uint64
+		for j := range vals {
+			if vals[j], n = binary.Uvarint(b); n <= 0 {
+				return errExtCorrupt
+			}
+			b = b[n:]
+		}
+		f.span[i] = extentRef{Cid: int64(vals[0]), Off: int64(vals[1])}
+	}
+	return
+}
+
+type extentKey struct {
+	cid, off int64
+}
+
+// Resolve manifests of restored heads. Heads with lost extents will be removed from index,
+// extents without head (left after crash or deleted with head) will be released
+func (s *Storage) linkSpans() {
+	extents := make(map[extentKey]*File)
+	var heads []*File
+	s.m.RLock()
+	for _, c := range s.Containers {
+		c.m.Lock()
+		var sp Space
+		if c.last != nil {
+			sp = c.last
+		}
+		for sp != nil {
+			if f, ok := sp.(*File); ok {
+				if f.extent > 0 {
+					extents[extentKey{c.Id, f.Off}] = f
+				} else if f.span != nil {
+					heads = append(heads, f)
+				}
+			}
+			sp = sp.Prev()
+		}
+		c.m.Unlock()
+	}
+	s.m.RUnlock()
+
+	var broken int
+	for _, h := range heads {
+		var size int64
+		var err error
+		for i := range h.span {
+			ext, ok := extents[extentKey{h.span[i].Cid, h.span[i].Off}]
+			if !ok {
+				err = fmt.Errorf("extent %d (c%d:%d) not found", i+1, h.span[i].Cid, h.span[i].Off)
+				break
+			}
+			h.span[i].f = ext
+			size += ext.FSize
+		}
+		if err == nil && size != h.FSize {
+			err = fmt.Errorf("extents size mismatched: %d vs %d", size, h.FSize)
+		}
+		if err != nil {
+			aelog.Warnf("Spanning file %s is broken and will be removed: %v", h.Name, err)
+			broken++
+			if node, e := s.Index.Root.GetNode(s.Index.explode(h.Name), 0); e == nil && node.File == h {
+				s.Index.Delete(h.Name)
+			}
+			h.c.journalWrite(&journalRecord{op: JOURNAL_DELETE, off: h.Off, name: h.Name})
+			// resolved extents will be released as orphans
+			for i := range h.span {
+				h.span[i].f = nil
+			}
+			h.Delete()
+			continue
+		}
+		for i := range h.span {
+			delete(extents, extentKey{h.span[i].Cid, h.span[i].Off})
+		}
+	}
+	// orphans
+	for _, ext := range extents {
+		ext.Delete()
+	}
+	if broken > 0 || len(extents) > 0 {
+		aelog.Infof("Spanning files: %d broken, %d orphaned extents released", broken, len(extents))
+	}
+}
@@ -0,0 +1,139 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"github.com/cheggaaa/Anteater/aelog"
+	"github.com/cheggaaa/Anteater/config"
+	"io"
+	"testing"
+)
+
+func newSpanTestStorage(t *testing.T) *Storage {
+	if aelog.DefaultLogger == nil {
+		aelog.InitDefault(aelog.LOG_WARN)
+	}
+	s := new(Storage)
+	s.Init(&config.Config{
+		ContainerSize: 1024 * 1024,
+		DataPath:      t.TempDir() + "/",
+		FileHeaders:   true,
+		Journal:       true,
+	})
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSpanningFile(t *testing.T) {
+	s := newSpanTestStorage(t)
+
+	data := make([]byte, 3*1024*1024+12345)
+	rand.Read(data)
+	if _, err := s.Add("small", randReader(1000), 1000); err != nil {
+		t.Fatal(err)
+	}
+	f, err := s.Add("big", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.span) != 4 || len(s.Containers) < 4 {
+		t.Fatalf("Unexpected extents: %d in %d containers", len(f.span), len(s.Containers))
+	}
+	if m := md5.Sum(data); !bytes.Equal(f.Md5, m[:]) {
+		t.Errorf("Unexpected md5: %x", f.Md5)
+	}
+
+	check := func(s *Storage) {
+		f, ok := s.Get("big")
+		if !ok {
+			t.Fatal("Spanning file not found")
+		}
+		if f.FSize != int64(len(data)) {
+			t.Errorf("Unexpected size: %d", f.FSize)
+		}
+		b, _ := io.ReadAll(f.GetReader())
+		if !bytes.Equal(b, data) {
+			t.Error("Content mismatched")
+		}
+		// range across extents boundary
+		r := f.GetReader()
+		buf := make([]byte, 1000)
+		off := int64(1024*1024 - 500)
+		if _, err := r.Seek(off, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(r, buf); err != nil || !bytes.Equal(buf, data[off:off+1000]) {
+			t.Errorf("Range mismatched: %v", err)
+		}
+		if err := f.CheckMd5(); err != nil {
+			t.Error(err)
+		}
+		if err := s.Check(); err != nil {
+			t.Error(err)
+		}
+	}
+	check(s)
+
+	// restore from journal
+	s2 := reopenStorage(t, s)
+	check(s2)
+	s2.Close()
+	// restore from index
+	s3 := reopenStorage(t, s2)
+	check(s3)
+
+	var files int64
+	for _, c := range s3.Containers {
+		files += c.FileCount
+	}
+	if !s3.Delete("big") {
+		t.Fatal("Can't delete spanning file")
+	}
+	var left int64
+	for _, c := range s3.Containers {
+		left += c.FileCount
+	}
+	if files != 6 || left != 1 {
+		t.Errorf("Extents were not released: %d -> %d files", files, left)
+	}
+	s3.Close()
+}
+
+func TestSpanOrphans(t *testing.T) {
+	s := newSpanTestStorage(t)
+
+	size := int64(2*1024*1024 + 1)
+	f, err := s.Add("big", randReader(size), size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lose head, extents must be released on open
+	f.c.Delete(f)
+	s.Close()
+	s2 := reopenStorage(t, s)
+	defer s2.Close()
+	for _, c := range s2.Containers {
+		if c.FileCount != 0 {
+			t.Errorf("Container %d has %d files", c.Id, c.FileCount)
+		}
+	}
+}
@@ -19,7 +19,6 @@ package storage
 import (
 	"encoding/binary"
 	"encoding/gob"
-	"errors"
 	"fmt"
 	"github.com/cheggaaa/Anteater/aelog"
 	"github.com/cheggaaa/Anteater/config"
@@ -28,7 +27,10 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -43,8 +45,53 @@ type Storage struct {
 	LastContainerId int64
 	Stats           *stats.Stats
 	Containers      map[int64]*Container
+	// data paths (see disk.go)
+	Disks []*Disk
 
 	m sync.RWMutex
+	// held for read by every allocation and index mutation, write lock freezes storage (see Snapshot)
+	fm sync.RWMutex
+	// 1 while compaction in progress
+	compacting int32
+	// last journal record sequence
+	jseq int64
+	// content of files by md5 for deduplication (see dedup.go)
+	dm         sync.Mutex
+	dedup      map[string]*File
+	dedupLinks int64
+	dedupSize  int64
+	// encryption keys (see crypt.go)
+	krOnce sync.Once
+	kr     *Keyring
+	krErr  error
+	// files with expiry time (see expire.go)
+	em     sync.Mutex
+	expiry expiryQueue
+	// reads restored from other parts of group (see group.go)
+	reconstructed int64
+	// state of scrubber, 1 while pass in progress (see scrub.go)
+	scm       sync.Mutex
+	scrub     ScrubStatus
+	scrubbing int32
+	// 1 after Close
+	closed int32
+}
+
+// Attributes of new file
+type FileAttrs struct {
+	// modification time, now by default
+	Time time.Time
+	// expiry time, zero - never
+	Expires time.Time
+	// user metadata
+	Meta map[string]string
+	// content type and disposition, detected on read if empty
+	ContentType string
+	Disposition string
+	// replace existing file with the same name, readers of old file get old content until Close
+	Replace bool
+	// precondition on existing file, checked atomically with adding to index
+	Cond Condition
 }
 
 func (s *Storage) Init(c *config.Config) {
@@ -52,36 +99,66 @@ func (s *Storage) Init(c *config.Config) {
 	s.Index = new(Index)
 	s.Index.Init()
 	s.Containers = make(map[int64]*Container)
+	s.Disks = newDisks(c)
 	s.Stats = stats.New()
 }
 
 func (s *Storage) Open() (err error) {
-	aelog.Debugf("Try open %s..", s.Conf.DataPath)
-	dir, err := os.Open(s.Conf.DataPath)
-	if err != nil {
-		return
+	wg := &sync.WaitGroup{}
+	dirs := make(map[*Disk][]os.FileInfo)
+	// copies of index by name, parts of group have own copies
+	indexes := make(map[string][]indexCopy)
+	// ids up to saved last id are never reused (see retire.go)
+	s.loadLastContainerId()
+	for _, d := range s.Disks {
+		aelog.Debugf("Try open %s..", d.Path)
+		files, e := d.readDir()
+		if e != nil {
+			// storage works without failed disk
+			d.fail(e)
+			err = e
+			continue
+		}
+		// data file without index can't be opened, new index will overwrite existing files
+		// part of group that is not rebuilt yet has no index
+		// removal of retired container could be interrupted, its id is not reused
+		for _, file := range files {
+			if filepath.Ext(file.Name()) == ".data" {
+				base := strings.TrimSuffix(file.Name(), ".data")
+				if _, e := os.Stat(d.Path + base + ".index"); e != nil {
+					if _, ge := os.Stat(d.Path + base + ".group"); ge == nil {
+						continue
+					}
+					if id, ie := strconv.ParseInt(strings.TrimPrefix(base, "c"), 10, 64); ie == nil && id <= s.LastContainerId {
+						aelog.Warnf("Index %s not found, data file is skipped. Use aerepair to rebuild it or remove data file", d.Path+base+".index")
+						continue
+					}
+					return fmt.Errorf("Index %s not found: %v. Use aerepair to rebuild it from data file", d.Path+base+".index", e)
+				}
+			}
+		}
+		for _, file := range files {
+			if filepath.Ext(file.Name()) == ".index" {
+				indexes[file.Name()] = append(indexes[file.Name()], indexCopy{d, file})
+			}
+		}
+		dirs[d] = files
 	}
-	info, err := dir.Stat()
-	if err != nil {
+	if len(dirs) == 0 {
 		return
 	}
-	if !info.IsDir() {
-		return errors.New("Data path must be dir")
-	}
-
-	wg := &sync.WaitGroup{}
-	files, err := dir.Readdir(-1)
-	for _, file := range files {
-		if filepath.Ext(file.Name()) == ".index" {
+	err = nil
+	for name, copies := range indexes {
+		for _, ic := range groupIndex(name, copies) {
 			wg.Add(1)
-			go func(name string) {
-				name = s.Conf.DataPath + name
-				e := s.restoreContainer(name)
+			go func(d *Disk, name string) {
+				name = d.Path + name
+				e := s.restoreContainer(d, name)
 				if e != nil {
-					err = e
+					err = fmt.Errorf("Can't restore container from %s: %v. Use aerepair to rebuild index from data file", name, e)
 				}
 				wg.Done()
-			}(file.Name())
+			}(ic.d, name)
 		}
 	}
 	wg.Wait()
@@ -90,6 +167,22 @@ func (s *Storage) Open() (err error) {
 		return
 	}
 
+	s.jseq = time.Now().UnixNano()
+	if s.Conf.Journal {
+		if err = s.replayJournals(); err != nil {
+			return
+		}
+	}
+	s.linkSpans()
+	s.linkDedup()
+	s.loadExpiry()
+	if s.Conf.Journal {
+		s.Dump()
+		if s.Conf.JournalSync > 0 {
+			go s.journalSyncLoop()
+		}
+	}
+
 	if len(s.Containers) == 0 {
 		aelog.Info("Create first container")
 		if _, err = s.createContainer(); err != nil {
@@ -97,11 +190,28 @@ func (s *Storage) Open() (err error) {
 		}
 	}
 
+	go s.reapLoop()
+
+	if len(s.Conf.VersionPrefixes) > 0 {
+		s.Index.SetVersioning(s.versioned)
+		go s.versionLoop()
+	}
+	if s.Conf.TrashDelay > 0 {
+		s.Index.SetTrash(true)
+		go s.trashLoop()
+	}
+	s.loadScrub()
+	if s.Conf.ScrubInterval > 0 {
+		go s.scrubLoop()
+	}
+
 	go func() {
 		if s.Conf.DumpTime > 0 {
 			for {
 				time.Sleep(s.Conf.DumpTime)
 				s.Dump()
+				s.compactIfNeeded()
+				s.retireContainers()
 			}
 		}
 	}()
@@ -110,15 +220,45 @@ func (s *Storage) Open() (err error) {
 }
 
 func (s *Storage) Add(name string, r io.Reader, size int64) (f *File, err error) {
+	return s.AddAt(name, r, size, time.Now())
+}
+
+// Add file with given modification time
+func (s *Storage) AddAt(name string, r io.Reader, size int64, t time.Time) (f *File, err error) {
+	return s.AddWith(name, r, size, FileAttrs{Time: t})
+}
+
+// Add file with given attributes
+func (s *Storage) AddWith(name string, r io.Reader, size int64, a FileAttrs) (f *File, err error) {
+	meta, err := normalizeMeta(a.Meta)
+	if err != nil {
+		return
+	}
+	if err = checkType(a.ContentType, a.Disposition); err != nil {
+		return
+	}
+	if a.Time.IsZero() {
+		a.Time = time.Now()
+	}
 	f = &File{
-		Name:  name,
-		FSize: size,
-		Time:  time.Now(),
+		Name:    name,
+		FSize:   size,
+		Time:    a.Time,
+		Expires: a.Expires,
+		meta:    meta,
 	}
+	f.setType(a.ContentType, a.Disposition)
 	var target int
+	var sum []byte
+	var committed bool
 	defer func() {
 		if err != nil {
-			f.Delete()
+			if f.c != nil {
+				f.c.check(err)
+			}
+			if !committed {
+				f.Delete()
+			}
 		} else {
 			switch target {
 			case ALLOC_REPLACE:
@@ -137,8 +277,26 @@ func (s *Storage) Add(name string, r io.Reader, size int64) (f *File, err error)
 		return
 	}
 
-	// allocate
-	target, err = s.allocate(f)
+	// compress
+	if r, sum, err = s.compress(f, r); err != nil {
+		return
+	}
+	if s.Conf.FileHeaders {
+		if f.Hdr = headerSize(name, s.encrypted()); f.Hdr > 0 {
+			f.Indx = R.Index(f.dataSize() + int64(f.Hdr))
+		}
+	}
+
+	// allocate, storage is not frozen while content is read
+	s.fm.RLock()
+	if s.needSpan(size, f.Hdr) {
+		if err = s.allocateSpan(f); err == nil {
+			target = ALLOC_APPEND
+		}
+	} else {
+		target, err = s.allocate(f)
+	}
+	s.fm.RUnlock()
 	if err != nil {
 		return
 	}
@@ -150,13 +308,87 @@ func (s *Storage) Add(name string, r io.Reader, size int64) (f *File, err error)
 	}
 
 	// check
+	if f.codec != CODEC_NONE {
+		size = f.csize
+	}
 	if w != size {
 		err = fmt.Errorf("Requested %d bytes, but writed only %d", size, w)
 		return
 	}
+	if sum != nil {
+		f.Md5 = sum
+	}
+
+	// commit
+	s.fm.RLock()
+	defer s.fm.RUnlock()
+
+	// same content already stored - keep link instead of copy
+	if s.Conf.Dedup {
+		if l := s.dedupLink(f); l != nil {
+			f.Delete()
+			f = l
+		}
+	}
 
-	// add to index
-	err = s.Index.Add(f)
+	// header is a commit marker for scanner, so write it after content
+	if err = f.writeHeader(); err != nil {
+		return
+	}
+
+	// expired file is not visible, so it can be replaced
+	if old, ok := s.Index.Get(name); ok && old.Expired() {
+		s.deleteExpired(old)
+	}
+
+	// add to index, file is journaled ahead
+	var wal journalBatch
+	var retired *File
+	old, err := s.Index.Put(f, func(old *File) error {
+		if old != nil && old.Expired() {
+			old = nil
+		}
+		if a.Cond != nil {
+			if err := a.Cond(old); err != nil {
+				return err
+			}
+		}
+		if old != nil && !a.Replace {
+			return ErrFileExists
+		}
+		// noncurrent version must be journaled before the file that replaces it
+		if old != nil && s.Index.isVersioned(name) {
+			if err := s.journalRemoval(&wal, old); err != nil {
+				return err
+			}
+			retired = old
+		}
+		if err := f.journalSpan(&wal); err != nil {
+			return err
+		}
+		return wal.append(f.c, &journalRecord{op: JOURNAL_ADD, f: f})
+	})
+	if err != nil {
+		// rollback journaled changes
+		if retired != nil {
+			retired.c.journalWrite(&journalRecord{op: JOURNAL_ADD, f: retired})
+		}
+		if len(wal) != 0 {
+			f.journalDrop()
+		}
+		return
+	}
+	if old != nil {
+		s.retire(old)
+	}
+	if s.Conf.Dedup {
+		s.dedupAdd(f)
+	}
+	s.expireAdd(f)
+	if err = wal.sync(); err != nil {
+		// file is in index already
+		committed = true
+	}
 	return
 }
 
@@ -164,6 +396,9 @@ func (s *Storage) allocate(f *File) (target int, err error) {
 	s.m.RLock()
 	for _, target = range Targets {
 		for _, c := range s.Containers {
+			if !c.writable() {
+				continue
+			}
 			if ok := c.Allocate(f, target); ok {
 				s.m.RUnlock()
 				return
@@ -183,18 +418,152 @@ func (s *Storage) allocate(f *File) (target int, err error) {
 	return
 }
 
+// Return file by name, expired files are not returned
 func (s *Storage) Get(name string) (f *File, ok bool) {
-	return s.Index.Get(name)
+	if f, ok = s.Index.Get(name); ok && f.Expired() {
+		return nil, false
+	}
+	return
 }
 
 func (s *Storage) Delete(name string) (ok bool) {
-	f, ok := s.Index.Delete(name)
-	if ok {
+	_, err := s.DeleteIf(name, nil)
+	return err == nil
+}
+
+// Delete file if cond returns nil for it, check and delete are atomic
+func (s *Storage) DeleteIf(name string, cond Condition) (f *File, err error) {
+	s.fm.RLock()
+	defer s.fm.RUnlock()
+	// expired file can be deleted unconditionally, follower gets deletes of expired files from primary
+	if cond != nil {
+		cond = visibleCond(cond)
+	}
+	var wal journalBatch
+	if f, err = s.Index.DeleteIf(name, func(f *File) error {
+		if cond != nil {
+			if err := cond(f); err != nil {
+				return err
+			}
+		}
+		if f == nil {
+			return nil
+		}
+		return s.journalRemoval(&wal, f)
+	}); err == nil {
+		s.retire(f)
+		err = wal.sync()
+	}
+	return
+}
+
+// Journal removal of file from index ahead of it, index must be locked
+// Shared content is journaled as blob by release
+func (s *Storage) journalRemoval(b *journalBatch, f *File) error {
+	switch {
+	case s.Index.isVersioned(f.Name):
+		if f.version == 0 {
+			f.version = newVersion()
+		}
+		f.noncurrent = time.Now()
+		defer func() { f.noncurrent = time.Time{} }()
+		return b.append(f.c, &journalRecord{op: JOURNAL_VERSION, f: f})
+	case s.Index.trashing:
+		f.trashed = time.Now()
+		defer func() { f.trashed = time.Time{} }()
+		return b.append(f.c, &journalRecord{op: JOURNAL_TRASH, f: f})
+	case atomic.LoadInt32(&f.refs) > 0:
+		return nil
+	}
+	return b.append(f.c, &journalRecord{op: JOURNAL_DELETE, off: f.Off, name: f.Name})
+}
+
+// Release space of file removed from index. Space is released when file is closed by readers
+func (s *Storage) release(f *File) {
+	if !s.keepShared(f) {
+		f.c.journalWrite(&journalRecord{op: JOURNAL_DELETE, off: f.Off, name: f.Name})
 		f.Delete()
 	}
+}
+
+func (s *Storage) Rename(name, newName string) (f *File, err error) {
+	return s.RenameIf(name, newName, nil, false)
+}
+
+// Rename file if cond returns nil for it, check and rename are atomic
+// Existing file with new name is deleted if replace is true, ErrConflict is returned otherwise
+func (s *Storage) RenameIf(name, newName string, cond Condition, replace bool) (f *File, err error) {
+	s.fm.RLock()
+	defer s.fm.RUnlock()
+	if old, ok := s.Index.Get(newName); ok && old.Expired() {
+		s.deleteExpired(old)
+	}
+	var wal journalBatch
+	var journaled, replaced *File
+	cond = visibleCond(cond)
+	if f, err = s.Index.renameIf(name, newName, func(f *File) error {
+		if err := cond(f); err != nil {
+			return err
+		}
+		if f == nil {
+			return nil
+		}
+		old, ok := s.Index.get(newName)
+		if ok && (!replace || old == f) {
+			return ErrConflict
+		}
+		// header with old name would be recovered by scanner
+		if !f.headerFits(newName) {
+			return ErrNameTooLong
+		}
+		if ok {
+			if err := s.journalRemoval(&wal, old); err != nil {
+				return err
+			}
+			replaced = old
+		}
+		journaled = f
+		return wal.append(f.c, &journalRecord{op: JOURNAL_RENAME, off: f.Off, name: newName})
+	}, replace); err != nil {
+		// removal and rename are journaled, but not applied
+		if replaced != nil {
+			replaced.c.journalWrite(&journalRecord{op: JOURNAL_ADD, f: replaced})
+		}
+		if journaled != nil {
+			journaled.c.journalWrite(&journalRecord{op: JOURNAL_ADD, f: journaled})
+		}
+		return
+	}
+	if replaced != nil {
+		s.retire(replaced)
+	}
+	if e := f.writeHeader(); e != nil {
+		// scanner will recover file with old name
+		aelog.Warnf("Can't rewrite header of %s: %v", newName, e)
+	}
+	err = wal.sync()
 	return
 }
 
+// Return condition that sees expired file as missing and fails for it
+func visibleCond(cond Condition) Condition {
+	return func(f *File) error {
+		expired := f != nil && f.Expired()
+		if expired {
+			f = nil
+		}
+		if cond != nil {
+			if err := cond(f); err != nil {
+				return err
+			}
+		}
+		if expired {
+			return ErrFileNotFound
+		}
+		return nil
+	}
+}
+
 func (s *Storage) DeleteChilds(name string) (ok bool) {
 	names, err := s.Index.List(name, 0)
 	if err != nil {
@@ -216,6 +585,7 @@ func (s *Storage) Dump() {
 		err := c.Dump()
 		if err != nil {
 			aelog.Warnf("Can't dump container %d: %v", c.Id, err)
+			c.check(err)
 		}
 	}
 }
@@ -228,10 +598,25 @@ func (s *Storage) GetStats() *stats.Stats {
 	s.Stats.Storage.IndexVersion = s.Index.Version()
 	s.Stats.Storage.FilesSize = 0
 	s.Stats.Storage.TotalSize = 0
+	s.Stats.Storage.PhysicalSize = 0
 	s.Stats.Storage.HoleCount = 0
 	s.Stats.Storage.HoleSize = 0
 	s.Stats.Storage.FilesRealSize = 0
+	s.Stats.Storage.DedupFiles = atomic.LoadInt64(&s.dedupLinks)
+	s.Stats.Storage.DedupSize = atomic.LoadInt64(&s.dedupSize)
+	s.Stats.Storage.Disks = s.diskStats()
+	s.Stats.Storage.Redundancy = s.Conf.Redundancy
+	if k, m := s.groupParts(); m > 0 {
+		s.Stats.Storage.Redundancy = fmt.Sprintf("%s (%d+%d)", s.Conf.Redundancy, k, m)
+	}
+	s.Stats.Storage.Reconstructed = atomic.LoadInt64(&s.reconstructed)
+	*s.Stats.Scrub = s.scrubStats()
+	s.Stats.Storage.DegradedContainers = 0
 	for _, c := range s.Containers {
+		if c.g != nil && c.g.healthy() < len(c.g.members) {
+			s.Stats.Storage.DegradedContainers++
+		}
+		s.Stats.Storage.PhysicalSize += c.physicalSize()
 		c.m.Lock()
 		s.Stats.Storage.TotalSize += c.Size
 		hc, hs := c.holeIndex.Count, c.holeIndex.Size
@@ -256,6 +641,7 @@ func (s *Storage) Check() (err error) {
 }
 
 func (s *Storage) Close() {
+	atomic.StoreInt32(&s.closed, 1)
 	s.Dump()
 	s.m.RLock()
 	defer s.m.RUnlock()
@@ -267,12 +653,11 @@ func (s *Storage) Close() {
 func (s *Storage) Drop() {
 	s.Close()
 	for _, c := range s.Containers {
-		os.Remove(c.fileName())
-		os.Remove(c.indexName())
+		c.removeFiles()
 	}
 }
 
-func (s *Storage) restoreContainer(path string) (err error) {
+func (s *Storage) restoreContainer(d *Disk, path string) (err error) {
 	aelog.Debugf("Restore container from %s..", path)
 	rr, err, _ := dump.LoadData(path)
 	if err != nil {
@@ -317,6 +702,7 @@ func (s *Storage) restoreContainer(path string) (err error) {
 		FileSize:     int64(fs),
 		FileRealSize: int64(frs),
 		Created:      cr == 11,
+		disk:         d,
 	}
 
 	if container.Created {
@@ -327,6 +713,11 @@ func (s *Storage) restoreContainer(path string) (err error) {
 		if container.Id > s.LastContainerId {
 			s.LastContainerId = container.Id
 		}
+		if ex, ok := s.Containers[container.Id]; ok {
+			s.m.Unlock()
+			container.Close()
+			return fmt.Errorf("Container %d is also in %s", container.Id, ex.disk.Path)
+		}
 		s.Containers[container.Id] = container
 		s.m.Unlock()
 		aelog.Debugf("Container %d restored. %d (%d) files (holes) found", container.Id, container.FileCount, container.holeIndex.Count)
@@ -341,13 +732,42 @@ func (s *Storage) restoreContainer(path string) (err error) {
 func (s *Storage) createContainer() (c *Container, err error) {
 	s.m.Lock()
 	defer s.m.Unlock()
-	s.LastContainerId++
-	c = &Container{
-		Id: s.LastContainerId,
-	}
-	err = c.Init(s, nil)
-	if err == nil {
-		s.Containers[s.LastContainerId] = c
+	k, m := s.groupParts()
+	size := s.Conf.ContainerSize
+	if m > 0 {
+		size = partSize(size, k)
+	}
+	for {
+		disks, e := s.placeContainer(k+m, size)
+		if e != nil {
+			return nil, e
+		}
+		s.LastContainerId++
+		c = &Container{
+			Id:   s.LastContainerId,
+			s:    s,
+			disk: disks[0],
+		}
+		if m > 0 {
+			paths := make([]string, len(disks))
+			for n, d := range disks {
+				paths[n] = d.Path
+			}
+			c.g = newGroup(c, k, m, paths)
+		}
+		if err = c.Init(s, nil); err == nil {
+			s.Containers[s.LastContainerId] = c
+			return
+		}
+		// try other disks if one of them has failed
+		failed := false
+		for _, d := range disks {
+			if d.check(err) {
+				failed = true
+			}
+		}
+		if !failed {
+			return nil, err
+		}
 	}
-	return
 }
@@ -19,6 +19,7 @@ package storage
 import (
 	"crypto/md5"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"github.com/cheggaaa/Anteater/aelog"
 	"github.com/cheggaaa/Anteater/config"
@@ -254,6 +255,96 @@ func TestDrop(t *testing.T) {
 	S.Drop()
 }
 
+func TestReplace(t *testing.T) {
+	s := newTestStorage(t, t.TempDir())
+	s.Close()
+	s.Conf.Journal = true
+	s = reopenStorage(t, s)
+
+	if _, err := s.Add("f", randReader(1000), 1000); err != nil {
+		t.Fatal(err)
+	}
+	old, _ := s.Get("f")
+	old.Open()
+	oldMd5 := old.Md5S()
+	if _, err := s.AddWith("f", randReader(2000), 2000, FileAttrs{}); err != ErrFileExists {
+		t.Errorf("Expected ErrFileExists, got %v", err)
+	}
+	failed := errors.New("failed")
+	if _, err := s.AddWith("f", randReader(2000), 2000, FileAttrs{Replace: true, Cond: func(f *File) error { return failed }}); err != failed {
+		t.Errorf("Expected condition error, got %v", err)
+	}
+	if f, _ := s.Get("f"); f != old {
+		t.Fatal("File was replaced despite failed condition")
+	}
+	f, err := s.AddWith("f", randReader(2000), 2000, FileAttrs{Replace: true, Cond: func(f *File) error {
+		if f != old {
+			return failed
+		}
+		return nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, _ := s.Get("f"); g != f || s.Index.Count() != 1 {
+		t.Error("File was not replaced")
+	}
+	// opened file keeps content until close
+	if !old.deleted || old.released != 0 {
+		t.Error("Old file must be deleted, but not released")
+	}
+	h := md5.New()
+	io.Copy(h, old.GetReader())
+	if fmt.Sprintf("%x", h.Sum(nil)) != oldMd5 {
+		t.Error("Content of opened file was changed")
+	}
+	if old.Open() == nil {
+		t.Error("Replaced file was opened")
+	}
+	old.Close()
+	if old.released != 1 {
+		t.Error("Old file was not released after close")
+	}
+	if err := s.Check(); err != nil {
+		t.Error(err)
+	}
+
+	// open without dump
+	s2 := reopenStorage(t, s)
+	defer s2.Close()
+	if g, ok := s2.Get("f"); !ok || g.Md5S() != f.Md5S() || s2.Index.Count() != 1 {
+		t.Error("Replaced file was not restored from journal")
+	} else if g.ETag() != f.ETag() {
+		t.Errorf("E-Tag was changed after restart: %s vs %s", g.ETag(), f.ETag())
+	}
+	for _, c := range s2.Containers {
+		if c.FileCount != 1 {
+			t.Errorf("Unexpected container files count: %d", c.FileCount)
+		}
+	}
+}
+
+func TestAddOverflow(t *testing.T) {
+	s := newTestStorage(t, t.TempDir())
+	defer s.Close()
+	if _, err := s.Add("f", randReader(1500), 1000); err != ErrOverflow {
+		t.Errorf("Expected ErrOverflow, got %v", err)
+	}
+	// spanning file
+	size := s.Conf.ContainerSize + 1000
+	if _, err := s.Add("big", randReader(size+1), size); err != ErrOverflow {
+		t.Errorf("Expected ErrOverflow for spanning file, got %v", err)
+	}
+	if s.Index.Count() != 0 {
+		t.Error("File was added")
+	}
+	for _, c := range s.Containers {
+		if c.FileCount != 0 {
+			t.Errorf("Allocated space was not released: %d files in container %d", c.FileCount, c.Id)
+		}
+	}
+}
+
 func addAndAssert(t *testing.T, name string, sizeS string) {
 	size, _ := utils.BytesFromString(sizeS)
 	rnd := randReader(size)
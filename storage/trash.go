@@ -0,0 +1,169 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"github.com/cheggaaa/Anteater/aelog"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Trash
+// Deleted files are removed from the tree, but keep own space for data.trash_delay and can be restored
+// Files under versioned prefixes are kept as noncurrent versions instead (see version.go)
+
+const TRASH_PURGE_INTERVAL = time.Minute
+
+// Return true if file must be added to the index as deleted file
+func (f *File) inTrash() bool {
+	return f.extent == 0 && !f.blob && !f.trashed.IsZero()
+}
+
+// Bring back the last deleted file with the name. Return ErrFileExists if name is taken
+func (s *Storage) Restore(name string) (f *File, err error) {
+	s.fm.RLock()
+	defer s.fm.RUnlock()
+	if old, ok := s.Index.Get(name); ok && old.Expired() {
+		s.deleteExpired(old)
+	}
+	if f, err = s.Index.Restore(name); err == nil {
+		s.expireAdd(f)
+		err = f.c.journalWrite(&journalRecord{op: JOURNAL_ADD, f: f})
+	}
+	return
+}
+
+// Release space of files deleted more than data.trash_delay ago, return count of purged
+func (s *Storage) PurgeTrash() (n int) {
+	s.fm.RLock()
+	defer s.fm.RUnlock()
+	for _, f := range s.Index.pruneTrash(time.Now().Add(-s.Conf.TrashDelay)) {
+		s.release(f)
+		n++
+	}
+	return
+}
+
+// Deletes are replicated, so followers have own trash and purge it too
+func (s *Storage) trashLoop() {
+	for {
+		time.Sleep(TRASH_PURGE_INTERVAL)
+		if atomic.LoadInt32(&s.closed) != 0 {
+			return
+		}
+		if n := s.PurgeTrash(); n > 0 {
+			aelog.Debugf("Trash: %d files purged", n)
+		}
+	}
+}
+
+// Enable moving of deleted files to trash
+func (i *Index) SetTrash(on bool) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	i.trashing = on
+}
+
+// Move the last deleted file with the name back to the tree
+func (i *Index) Restore(name string) (f *File, err error) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	list := i.trash[name]
+	if len(list) == 0 {
+		return nil, ErrFileNotFound
+	}
+	if _, ok := i.get(name); ok {
+		return nil, ErrFileExists
+	}
+	f = list[len(list)-1]
+	trashed := f.trashed
+	f.trashed = time.Time{}
+	if err = i.add(f); err != nil {
+		f.trashed = trashed
+		return nil, err
+	}
+	i.removeTrash(f)
+	i.notify(EVENT_ADD, f, name)
+	return
+}
+
+// Move file removed from the tree to trash. Index must be locked
+func (i *Index) toTrash(f *File) {
+	f.trashed = time.Now()
+	i.addTrash(f)
+}
+
+// Add deleted file, files are ordered by deletion time. Index must be locked
+func (i *Index) addTrash(f *File) {
+	list := i.trash[f.Name]
+	for _, t := range list {
+		if t == f {
+			return
+		}
+	}
+	list = append(list, f)
+	sort.SliceStable(list, func(a, b int) bool {
+		return list[a].trashed.Before(list[b].trashed)
+	})
+	i.trash[f.Name] = list
+}
+
+// Remove deleted file, return false if file is not in trash. Index must be locked
+func (i *Index) removeTrash(f *File) bool {
+	list := i.trash[f.Name]
+	for n, t := range list {
+		if t == f {
+			list = append(list[:n:n], list[n+1:]...)
+			if len(list) == 0 {
+				delete(i.trash, f.Name)
+			} else {
+				i.trash[f.Name] = list
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Replace deleted file moved by compaction. Index must be locked
+func (i *Index) replaceTrashed(old, f *File) bool {
+	if !i.removeTrash(old) {
+		return false
+	}
+	f.Name, f.trashed = old.Name, old.trashed
+	f.copyAttrs(old)
+	i.addTrash(f)
+	return true
+}
+
+// Remove files deleted before the time from trash
+func (i *Index) pruneTrash(before time.Time) (pruned []*File) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	for _, list := range i.trash {
+		for _, f := range list {
+			if f.trashed.Before(before) {
+				pruned = append(pruned, f)
+			}
+		}
+	}
+	for _, f := range pruned {
+		i.removeTrash(f)
+	}
+	return
+}
@@ -0,0 +1,96 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	s := newTestStorage(t, t.TempDir())
+	s.Close()
+	s.Conf.Journal = true
+	s.Conf.TrashDelay = time.Hour
+	s = reopenStorage(t, s)
+
+	md5s := make(map[string]string)
+	for _, name := range []string{"a", "dir/b", "dir/c", "d"} {
+		f, err := s.Add(name, randReader(1000), 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		md5s[name] = f.Md5S()
+	}
+	s.Dump()
+	if !s.Delete("a") || !s.DeleteChilds("dir") {
+		t.Fatal("Can't delete files")
+	}
+	for _, name := range []string{"a", "dir/b", "dir/c"} {
+		if _, ok := s.Get(name); ok {
+			t.Errorf("Deleted file %s is visible", name)
+		}
+	}
+	if len(s.Index.trash) != 3 {
+		t.Errorf("Unexpected trash size: %d", len(s.Index.trash))
+	}
+
+	// name is taken by new file
+	s.Add("dir/c", randReader(100), 100)
+	if _, err := s.Restore("dir/c"); err != ErrFileExists {
+		t.Errorf("Expected ErrFileExists, got %v", err)
+	}
+	if _, err := s.Restore("none"); err != ErrFileNotFound {
+		t.Errorf("Expected ErrFileNotFound, got %v", err)
+	}
+	if f, err := s.Restore("a"); err != nil || f.Md5S() != md5s["a"] {
+		t.Errorf("Can't restore file: %v", err)
+	}
+
+	check := func(s *Storage) {
+		if f, ok := s.Get("a"); !ok || f.Md5S() != md5s["a"] {
+			t.Error("Restored file is lost")
+		}
+		if len(s.Index.trash) != 2 {
+			t.Errorf("Unexpected trash size: %d", len(s.Index.trash))
+		}
+	}
+	check(s)
+	s.Close()
+
+	// open without dump
+	s2 := reopenStorage(t, s)
+	check(s2)
+	s2.Close()
+	s2 = reopenStorage(t, s)
+	check(s2)
+
+	s2.Conf.TrashDelay = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if n := s2.PurgeTrash(); n != 2 {
+		t.Errorf("Unexpected count of purged files: %d", n)
+	}
+	if _, err := s2.Restore("dir/b"); err != ErrFileNotFound {
+		t.Errorf("Purged file was restored: %v", err)
+	}
+	s2.Close()
+	s2 = reopenStorage(t, s)
+	defer s2.Close()
+	if len(s2.Index.trash) != 0 {
+		t.Error("Purged files were restored")
+	}
+}
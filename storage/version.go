@@ -0,0 +1,314 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"github.com/cheggaaa/Anteater/aelog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Object versioning
+// Files under versioned prefixes are not released when replaced or deleted, they stay in the index
+// as noncurrent versions and keep own space until pruned (see config [versioning])
+// Version id is assigned when file is added under versioned prefix and stored in the index
+
+const VERSION_PRUNE_INTERVAL = time.Minute
+
+var lastVersion int64
+
+// Return new version id, ids are increasing
+func newVersion() int64 {
+	for {
+		last := atomic.LoadInt64(&lastVersion)
+		v := time.Now().UnixNano()
+		if v <= last {
+			v = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastVersion, last, v) {
+			return v
+		}
+	}
+}
+
+// Return version id of file, empty if file has no version
+func (f *File) VersionId() string {
+	if f.version == 0 {
+		return ""
+	}
+	return strconv.FormatInt(f.version, 36)
+}
+
+// Return time when file became noncurrent version, zero for current file
+func (f *File) Noncurrent() time.Time {
+	return f.noncurrent
+}
+
+// Return true if file must be added to the index as noncurrent version
+func (f *File) isVersion() bool {
+	return f.extent == 0 && !f.blob && !f.noncurrent.IsZero() && f.trashed.IsZero()
+}
+
+// Return true if versioning is enabled for the name
+func (s *Storage) versioned(name string) bool {
+	for _, p := range s.Conf.VersionPrefixes {
+		if p == "*" || name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Return current file or noncurrent version by version id
+func (s *Storage) GetVersion(name, id string) (f *File, ok bool) {
+	if f, ok = s.Index.GetVersion(name, id); ok && f.noncurrent.IsZero() && f.Expired() {
+		return nil, false
+	}
+	return
+}
+
+// Return noncurrent versions of file, newest first
+func (s *Storage) Versions(name string) []*File {
+	return s.Index.Versions(name)
+}
+
+// Delete version of file permanently. Current version is deleted without keeping it as noncurrent
+func (s *Storage) DeleteVersion(name, id string) (f *File, err error) {
+	s.fm.RLock()
+	defer s.fm.RUnlock()
+	if f, err = s.Index.DeleteVersion(name, id); err == nil {
+		s.release(f)
+	}
+	return
+}
+
+// Journal file removed from index as noncurrent version or moved to trash, otherwise release it
+func (s *Storage) retire(f *File) {
+	if !f.trashed.IsZero() {
+		f.c.journalWrite(&journalRecord{op: JOURNAL_TRASH, f: f})
+		return
+	}
+	if f.noncurrent.IsZero() {
+		s.release(f)
+		return
+	}
+	f.c.journalWrite(&journalRecord{op: JOURNAL_VERSION, f: f})
+	for _, v := range s.Index.pruneVersions(f.Name, s.Conf.VersionsMax, time.Time{}) {
+		s.release(v)
+	}
+}
+
+// Delete noncurrent versions older than max age, return count of deleted
+func (s *Storage) PruneVersions() (n int) {
+	if s.Conf.VersionsMaxAge <= 0 {
+		return
+	}
+	s.fm.RLock()
+	defer s.fm.RUnlock()
+	before := time.Now().Add(-s.Conf.VersionsMaxAge)
+	for _, name := range s.Index.versionNames() {
+		for _, v := range s.Index.pruneVersions(name, 0, before) {
+			s.release(v)
+			n++
+		}
+	}
+	return
+}
+
+// Versions are not replicated, so followers prune them too
+func (s *Storage) versionLoop() {
+	for {
+		time.Sleep(VERSION_PRUNE_INTERVAL)
+		if atomic.LoadInt32(&s.closed) != 0 {
+			return
+		}
+		if n := s.PruneVersions(); n > 0 {
+			aelog.Debugf("Versioning: %d noncurrent versions pruned", n)
+		}
+	}
+}
+
+// Set function that returns true for names with versioning enabled
+func (i *Index) SetVersioning(fn func(name string) bool) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	i.versioned = fn
+}
+
+// Return file with version id: current one or noncurrent version
+func (i *Index) GetVersion(name, id string) (f *File, ok bool) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	if f, ok = i.get(name); ok && f.VersionId() == id {
+		return
+	}
+	for _, v := range i.versions[name] {
+		if v.VersionId() == id {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// Return noncurrent versions of file, newest first
+func (i *Index) Versions(name string) (list []*File) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	versions := i.versions[name]
+	list = make([]*File, len(versions))
+	for n, v := range versions {
+		list[len(versions)-1-n] = v
+	}
+	return
+}
+
+// Remove version of file from index
+func (i *Index) DeleteVersion(name, id string) (f *File, err error) {
+	if f, err = i.deleteIf(name, func(f *File) error {
+		if f == nil || f.VersionId() != id {
+			return ErrFileNotFound
+		}
+		return nil
+	}, false); err == nil {
+		return
+	}
+	i.m.Lock()
+	defer i.m.Unlock()
+	for _, v := range i.versions[name] {
+		if v.VersionId() == id {
+			i.removeVersion(v)
+			return v, nil
+		}
+	}
+	return nil, ErrFileNotFound
+}
+
+// Keep file removed from the tree as noncurrent version. Index must be locked
+func (i *Index) retire(f *File) {
+	if f.version == 0 {
+		f.version = newVersion()
+	}
+	f.noncurrent = time.Now()
+	i.addVersion(f)
+}
+
+func (i *Index) isVersioned(name string) bool {
+	return i.versioned != nil && i.versioned(name)
+}
+
+// Add file restored from dump or journal to the tree, noncurrent versions or trash
+func (i *Index) restore(f *File) {
+	if f.listed() {
+		i.Add(f)
+		return
+	}
+	i.m.Lock()
+	defer i.m.Unlock()
+	if f.isVersion() {
+		i.addVersion(f)
+	} else if f.inTrash() {
+		i.addTrash(f)
+	}
+}
+
+// Add noncurrent version, versions are ordered by time. Index must be locked
+func (i *Index) addVersion(f *File) {
+	versions := i.versions[f.Name]
+	for _, v := range versions {
+		if v == f {
+			return
+		}
+	}
+	versions = append(versions, f)
+	sort.SliceStable(versions, func(a, b int) bool {
+		if !versions[a].noncurrent.Equal(versions[b].noncurrent) {
+			return versions[a].noncurrent.Before(versions[b].noncurrent)
+		}
+		return versions[a].version < versions[b].version
+	})
+	i.versions[f.Name] = versions
+}
+
+// Remove noncurrent version, return false if file is not a version. Index must be locked
+func (i *Index) removeVersion(f *File) bool {
+	versions := i.versions[f.Name]
+	for n, v := range versions {
+		if v == f {
+			versions = append(versions[:n:n], versions[n+1:]...)
+			if len(versions) == 0 {
+				delete(i.versions, f.Name)
+			} else {
+				i.versions[f.Name] = versions
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Remove file from noncurrent versions or trash
+func (i *Index) dropKept(f *File) bool {
+	i.m.Lock()
+	defer i.m.Unlock()
+	return i.removeVersion(f) || i.removeTrash(f)
+}
+
+// Replace noncurrent version moved by compaction. Index must be locked
+func (i *Index) replaceVersion(old, f *File) bool {
+	for _, v := range i.versions[old.Name] {
+		if v == old {
+			f.Name, f.noncurrent = old.Name, old.noncurrent
+			f.copyAttrs(old)
+			i.removeVersion(old)
+			i.addVersion(f)
+			return true
+		}
+	}
+	return false
+}
+
+// Remove oldest versions of file over max count (0 - unlimited) and versions noncurrent before the time
+func (i *Index) pruneVersions(name string, max int, before time.Time) (pruned []*File) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	versions := i.versions[name]
+	n := 0
+	for n < len(versions) && ((max > 0 && len(versions)-n > max) || versions[n].noncurrent.Before(before)) {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	pruned = append(pruned, versions[:n]...)
+	for _, v := range pruned {
+		i.removeVersion(v)
+	}
+	return
+}
+
+func (i *Index) versionNames() (names []string) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	names = make([]string, 0, len(i.versions))
+	for name := range i.versions {
+		names = append(names, name)
+	}
+	return
+}
@@ -0,0 +1,131 @@
+/*
+  Copyright 2012 Sergey Cherepanov (https://github.com/cheggaaa)
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVersions(t *testing.T) {
+	s := newTestStorage(t, t.TempDir())
+	s.Close()
+	s.Conf.Journal = true
+	s.Conf.VersionPrefixes = []string{"docs"}
+	s.Conf.VersionsMax = 2
+	s = reopenStorage(t, s)
+
+	put := func(name string) *File {
+		f, err := s.AddWith(name, randReader(1000), 1000, FileAttrs{Replace: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	var md5s []string
+	for i := 0; i < 4; i++ {
+		md5s = append(md5s, put("docs/a").Md5S())
+	}
+	put("other")
+	put("other")
+	if v := s.Versions("other"); len(v) != 0 {
+		t.Errorf("Unexpected versions of unversioned file: %d", len(v))
+	}
+	// oldest version was pruned
+	versions := s.Versions("docs/a")
+	if len(versions) != 2 || versions[0].Md5S() != md5s[2] || versions[1].Md5S() != md5s[1] {
+		t.Fatalf("Unexpected versions: %v", versions)
+	}
+	if f, ok := s.GetVersion("docs/a", versions[1].VersionId()); !ok || f.Md5S() != md5s[1] {
+		t.Error("Can't get version")
+	}
+	if _, ok := s.GetVersion("docs/a", "none"); ok {
+		t.Error("Unexpected version")
+	}
+
+	// deleted file becomes noncurrent version
+	s.Dump()
+	cur, _ := s.Get("docs/a")
+	if !s.Delete("docs/a") {
+		t.Fatal("Can't delete file")
+	}
+	if _, ok := s.Get("docs/a"); ok {
+		t.Error("Deleted file is visible")
+	}
+	if f, ok := s.GetVersion("docs/a", cur.VersionId()); !ok || f != cur {
+		t.Error("Deleted file is not kept as version")
+	}
+	id := s.Versions("docs/a")[1].VersionId()
+	if _, err := s.DeleteVersion("docs/a", id); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.DeleteVersion("docs/a", id); err != ErrFileNotFound {
+		t.Errorf("Expected ErrFileNotFound, got %v", err)
+	}
+
+	// current version can be deleted permanently
+	put("docs/b")
+	b := put("docs/b")
+	if _, err := s.DeleteVersion("docs/b", b.VersionId()); err != nil {
+		t.Error(err)
+	}
+	if _, ok := s.Get("docs/b"); ok || len(s.Versions("docs/b")) != 1 {
+		t.Error("Current version was not deleted permanently")
+	}
+
+	check := func(s *Storage) {
+		versions := s.Versions("docs/a")
+		if len(versions) != 1 || versions[0].Md5S() != md5s[3] {
+			t.Errorf("Unexpected versions after reopen: %d", len(versions))
+		}
+		if _, ok := s.Get("docs/a"); ok {
+			t.Error("Deleted file is visible after reopen")
+		}
+		if f, ok := s.GetVersion("docs/a", cur.VersionId()); !ok || f.Md5S() != md5s[3] {
+			t.Error("Can't get version after reopen")
+		}
+	}
+	check(s)
+
+	// compaction moves versions
+	var c *Container
+	for _, c = range s.Containers {
+	}
+	s.compactContainer(c)
+	check(s)
+	s.Close()
+
+	// open without dump
+	s2 := reopenStorage(t, s)
+	check(s2)
+	s2.Close()
+	s2 = reopenStorage(t, s)
+	check(s2)
+
+	// prune by age
+	s2.Conf.VersionsMaxAge = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if n := s2.PruneVersions(); n != 2 {
+		t.Errorf("Unexpected count of pruned versions: %d", n)
+	}
+	s2.Close()
+	s2 = reopenStorage(t, s)
+	defer s2.Close()
+	if len(s2.Versions("docs/a")) != 0 {
+		t.Error("Pruned versions were restored")
+	}
+}